@@ -0,0 +1,103 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/gorilla/mux"
+)
+
+// AccessLogEntry is written to the access log, as a line of JSON, for
+// every request served.
+type AccessLogEntry struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Status  int       `json:"status"`
+	Latency float64   `json:"latency_ms"`
+}
+
+// accessLog writes an AccessLogEntry for every request to w.
+type accessLog struct {
+	sync.Mutex
+	enc    *json.Encoder
+	logger clogger.CiaoLog
+}
+
+func newAccessLog(w io.Writer, logger clogger.CiaoLog) *accessLog {
+	if w == nil {
+		return nil
+	}
+
+	return &accessLog{enc: json.NewEncoder(w), logger: logger}
+}
+
+func (l *accessLog) record(w *statusRecorder, r *http.Request, start time.Time) {
+	entry := AccessLogEntry{
+		Time:    start.UTC(),
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Tenant:  mux.Vars(r)["tenant"],
+		Status:  w.status,
+		Latency: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	err := l.enc.Encode(entry)
+	if err != nil {
+		l.logger.Warningf("Unable to write access log: %v", err)
+	}
+}
+
+// statusRecorder records the status of the response written to the
+// underlying ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Flush allows the event streams to be flushed through the recorder.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
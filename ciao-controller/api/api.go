@@ -15,25 +15,43 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/service"
 	"github.com/ciao-project/ciao/uuid"
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
 )
 
 // Port is the default port number for the ciao API.
 const Port = 8889
 
+// ImageChecksumHeader is the header carrying the hex encoded SHA-256
+// checksum an uploaded image is verified against.
+const ImageChecksumHeader = "X-Image-Checksum"
+
+// MaxMapIPBatch is the maximum number of external IPs which may be mapped by
+// a single batch request.
+const MaxMapIPBatch = 64
+
 const (
 	// PoolsV1 is the content-type string for v1 of our pools resource
 	PoolsV1 = "x.ciao.pools.v1"
@@ -47,9 +65,16 @@ const (
 	// TenantsV1 is the content-type string for v1 of our tenants resource
 	TenantsV1 = "x.ciao.tenants.v1"
 
+	// TenantsV2 is the content-type string for v2 of our tenants resource.
+	// It differs from v1 only in the representation of quotas.
+	TenantsV2 = "x.ciao.tenants.v2"
+
 	// NodeV1 is the content-type string for v1 of our node resource
 	NodeV1 = "x.ciao.node.v1"
 
+	// CNCIsV1 is the content-type string for v1 of our cncis resource
+	CNCIsV1 = "x.ciao.cncis.v1"
+
 	// ImagesV1 is the content-type string for v1 of our images resource
 	ImagesV1 = "x.ciao.images.v1"
 
@@ -60,6 +85,146 @@ const (
 	InstancesV1 = "x.ciao.instances.v1"
 )
 
+// mediaTypes lists the versions of the media types supported for each
+// resource, oldest first. The last version is the current one, which is
+// used for requests for application/json.
+var mediaTypes = map[string][]string{
+	"pools":        {PoolsV1},
+	"external-ips": {ExternalIPsV1},
+	"workloads":    {WorkloadsV1},
+	"tenants":      {TenantsV1, TenantsV2},
+	"node":         {NodeV1},
+	"cncis":        {CNCIsV1},
+	"images":       {ImagesV1},
+	"volumes":      {VolumesV1},
+	"instances":    {InstancesV1},
+}
+
+var ciaoMediaType = regexp.MustCompile(`^application/x\.ciao\.([a-z-]+)\.v[0-9]+$`)
+
+func currentVersion(resource string) string {
+	versions := mediaTypes[resource]
+	return versions[len(versions)-1]
+}
+
+func minimumVersion(resource string) string {
+	return mediaTypes[resource][0]
+}
+
+// requestedMediaTypes returns the media types requested by r, which are its
+// Content-Type or, if it has none, the media types it accepts.
+func requestedMediaTypes(r *http.Request) []string {
+	var requested []string
+
+	header := r.Header.Get("Content-Type")
+	if header == "" {
+		header = r.Header.Get("Accept")
+	}
+
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(strings.SplitN(t, ";", 2)[0])
+		if t != "" {
+			requested = append(requested, t)
+		}
+	}
+
+	return requested
+}
+
+// negotiate returns the version of the media type of resource to be used
+// for r. Requests for application/json are served the current version.
+func negotiate(r *http.Request, resource string) (string, bool) {
+	versions := mediaTypes[resource]
+
+	for _, t := range requestedMediaTypes(r) {
+		if t == "application/json" {
+			return currentVersion(resource), true
+		}
+
+		for _, v := range versions {
+			if t == "application/"+v {
+				return v, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// matchMediaType returns a route matcher for requests which can be served
+// one of the versions of the media type of resource.
+func matchMediaType(resource string) mux.MatcherFunc {
+	return func(r *http.Request, rm *mux.RouteMatch) bool {
+		_, ok := negotiate(r, resource)
+		return ok
+	}
+}
+
+// UnsupportedVersionError is returned when a request asks for a version of
+// the media type of a resource which is not supported.
+type UnsupportedVersionError struct {
+	Resource string
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("Unsupported version of the %s resource", e.Resource)
+}
+
+// Details returns the supported versions of the resource.
+func (e *UnsupportedVersionError) Details() []string {
+	return mediaTypes[e.Resource]
+}
+
+// versionHandlers maps the versions of the media type of a resource to the
+// functions handling requests for them.
+type versionHandlers map[string]func(*Context, http.ResponseWriter, *http.Request) (Response, error)
+
+// versioned returns a handler function which serves each request with the
+// handler of the negotiated version of the media type of resource. A version
+// without a handler of its own is served by the handler of the closest older
+// version, so handlers only need registering for the versions which change
+// the representation of the resource.
+func versioned(resource string, handlers versionHandlers) func(*Context, http.ResponseWriter, *http.Request) (Response, error) {
+	return func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		version, ok := negotiate(r, resource)
+		if !ok {
+			return Response{http.StatusNotAcceptable, nil}, &UnsupportedVersionError{resource}
+		}
+
+		versions := mediaTypes[resource]
+		i := len(versions) - 1
+		for i >= 0 && versions[i] != version {
+			i--
+		}
+
+		for ; i >= 0; i-- {
+			if h, ok := handlers[versions[i]]; ok {
+				return h(c, w, r)
+			}
+		}
+
+		return Response{http.StatusNotAcceptable, nil}, &UnsupportedVersionError{resource}
+	}
+}
+
+// notAcceptable handles requests which did not match any route. Requests for
+// an unsupported version of a known resource are answered with 406 and the
+// list of supported versions.
+func notAcceptable(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	for _, t := range requestedMediaTypes(r) {
+		m := ciaoMediaType.FindStringSubmatch(t)
+		if m == nil {
+			continue
+		}
+
+		if _, ok := mediaTypes[m[1]]; ok {
+			return Response{http.StatusNotAcceptable, nil}, &UnsupportedVersionError{m[1]}
+		}
+	}
+
+	return Response{http.StatusNotFound, nil}, errors.New(http.StatusText(http.StatusNotFound))
+}
+
 // ErrorImage defines all possible image handling errors
 type ErrorImage error
 
@@ -70,6 +235,9 @@ var (
 	// ErrImageSaving is returned when an image is being uploaded.
 	ErrImageSaving = errors.New("Image being uploaded")
 
+	// ErrNoImageUpload is returned when an image upload is not found.
+	ErrNoImageUpload = errors.New("Image upload not found")
+
 	// ErrBadUUID is returned when an invalid UUID is specified
 	ErrBadUUID = errors.New("Bad UUID")
 
@@ -79,6 +247,18 @@ var (
 
 	// ErrQuota is returned when the tenant exceeds its quota
 	ErrQuota = errors.New("Tenant over quota")
+
+	// ErrImageNotPermitted is returned when the visibility of an image
+	// is changed by a tenant which does not own it.
+	ErrImageNotPermitted = errors.New("Image update not permitted")
+
+	// ErrImageNotActive is returned when a volume is created from an
+	// image which is not active.
+	ErrImageNotActive = errors.New("Image not active")
+
+	// ErrImageChecksum is returned when the checksum of uploaded image
+	// data does not match the checksum supplied by the client.
+	ErrImageChecksum = errors.New("Image checksum mismatch")
 )
 
 // CreateImageRequest contains information for a create image request.
@@ -88,6 +268,18 @@ type CreateImageRequest struct {
 	Visibility types.Visibility `json:"visibility,omitempty"`
 }
 
+// UploadImageResponse is returned when an asynchronous image upload
+// has been started. The image data is sent to the upload, with
+// PUT /images/{image_id}/uploads/{upload_id}, in a second request.
+type UploadImageResponse struct {
+	UploadID string `json:"upload_id"`
+}
+
+// UpdateImageRequest contains information for an update image request.
+type UpdateImageRequest struct {
+	Visibility types.Visibility `json:"visibility"`
+}
+
 // RequestedVolume contains information about a volume to be created.
 type RequestedVolume struct {
 	Size        int    `json:"size"`
@@ -98,19 +290,95 @@ type RequestedVolume struct {
 	Internal    bool   `json:"-"`
 }
 
+// VolumeDetach identifies the attachment of a volume to detach. The fields
+// are optional, a volume with a single attachment may be detached without
+// identifying it.
+type VolumeDetach struct {
+	AttachmentID string `json:"attachment-id,omitempty"`
+	InstanceID   string `json:"instance_uuid,omitempty"`
+	Mountpoint   string `json:"mountpoint,omitempty"`
+}
+
+// CreateWorkloadAction requests the creation of a workload from a stopped
+// instance, the boot volume of which is captured into an image.
+type CreateWorkloadAction struct {
+	Name string `json:"name"`
+}
+
+// NodeActionRequest requests the evacuation or the restoration of a node.
+// Exactly one of the actions must be present.
+type NodeActionRequest struct {
+	Evacuate *struct{} `json:"evacuate,omitempty"`
+	Restore  *struct{} `json:"restore,omitempty"`
+}
+
+// TenantActionRequest requests an action on a tenant. Restore cancels the
+// deletion of a soft deleted tenant.
+type TenantActionRequest struct {
+	Restore *struct{} `json:"restore,omitempty"`
+}
+
+// ImageActionRequest requests an action on an image. Cancel aborts the
+// upload of the image.
+type ImageActionRequest struct {
+	Cancel *struct{} `json:"cancel,omitempty"`
+}
+
+// BlockDeviceMapping references an existing volume to be attached to an
+// instance when it is created.
+type BlockDeviceMapping struct {
+	VolumeID   string `json:"volume_id"`
+	MountPoint string `json:"mountpoint,omitempty"`
+}
+
 // CreateServerRequest contains the details needed to start new instance(s)
 type CreateServerRequest struct {
 	Server struct {
-		ID           string            `json:"id"`
-		Name         string            `json:"name"`
-		Image        string            `json:"imageRef"`
-		WorkloadID   string            `json:"workload_id"`
-		MaxInstances int               `json:"max_count"`
-		MinInstances int               `json:"min_count"`
-		Metadata     map[string]string `json:"metadata,omitempty"`
+		ID                 string               `json:"id"`
+		Name               string               `json:"name"`
+		Image              string               `json:"imageRef"`
+		WorkloadID         string               `json:"workload_id"`
+		MaxInstances       int                  `json:"max_count"`
+		MinInstances       int                  `json:"min_count"`
+		Metadata           map[string]string    `json:"metadata,omitempty"`
+		BlockDeviceMapping []BlockDeviceMapping `json:"block_device_mapping,omitempty"`
+		SchedulerHints     *SchedulerHints      `json:"scheduler_hints,omitempty"`
+		Networks           []ServerNetwork      `json:"networks,omitempty"`
 	} `json:"server"`
 }
 
+// ServerNetwork configures the network interface of the instance created
+// by a CreateServerRequest. Instances have a single network interface.
+type ServerNetwork struct {
+	// MacAddr is the MAC address of the interface. It must be a locally
+	// administered unicast address which is not used by another instance
+	// of the tenant. A MAC address is generated if it is omitted.
+	MacAddr string `json:"mac_addr,omitempty"`
+}
+
+// SchedulerHints constrain the placement of the instances created by a
+// CreateServerRequest.
+type SchedulerHints struct {
+	// DifferentHost lists instances which must not share a node with
+	// the new instances.
+	DifferentHost []string `json:"different_host,omitempty"`
+
+	// SameHost lists instances whose node the new instances must be
+	// placed on.
+	SameHost []string `json:"same_host,omitempty"`
+
+	// TargetNode is the ID of the node the new instances must be
+	// placed on.
+	TargetNode string `json:"target_node,omitempty"`
+}
+
+// CreateServerCheckResponse reports whether a CreateServerRequest would be
+// admitted, and the reasons for which it would be rejected.
+type CreateServerCheckResponse struct {
+	Admitted bool     `json:"admitted"`
+	Reasons  []string `json:"reasons,omitempty"`
+}
+
 // PrivateAddresses contains information about a single instance network
 // interface.
 type PrivateAddresses struct {
@@ -131,6 +399,17 @@ type ServerDetails struct {
 	TenantID         string             `json:"tenant_id"`
 	SSHIP            string             `json:"ssh_ip"`
 	SSHPort          int                `json:"ssh_port"`
+
+	// Index is the position of the instance within the create request
+	// that launched it. It is only set in create responses.
+	Index *int `json:"index,omitempty"`
+}
+
+// SSHAccess contains the address and port at which an instance may be
+// reached by ssh.
+type SSHAccess struct {
+	SSHIP   string `json:"ssh_ip"`
+	SSHPort int    `json:"ssh_port"`
 }
 
 // Servers holds multiple servers including a count
@@ -142,12 +421,23 @@ type Servers struct {
 // Server holds a single server's worth of details.
 type Server struct {
 	Server ServerDetails `json:"server"`
+
+	// TimedOut is set when waiting for the instance to reach a status
+	// timed out. Server then holds the last known state of the instance.
+	TimedOut bool `json:"timed_out,omitempty"`
 }
 
+// MaxInstanceWait is the longest a request may wait for an instance to
+// reach a status.
+const MaxInstanceWait = 5 * time.Minute
+
 var (
 	//ErrInstanceNotFound is used if instance not found
 	ErrInstanceNotFound = errors.New("Instance not found")
 
+	// ErrNoExternalIP is returned when an instance has no external IP
+	ErrNoExternalIP = errors.New("Instance has no external IP")
+
 	// ErrVolumeNotAvailable returned if volume not available
 	ErrVolumeNotAvailable = errors.New("Volume not available")
 
@@ -156,22 +446,120 @@ var (
 
 	// ErrVolumeNotAttached returned if volume not attached
 	ErrVolumeNotAttached = errors.New("Volume not attached")
+
+	// ErrVolumeNotFound returned if a volume cannot be found
+	ErrVolumeNotFound = errors.New("Volume not found")
+
+	// ErrVolumeAttached returned if a volume is already attached
+	ErrVolumeAttached = errors.New("Volume already attached")
+
+	// ErrVolumeAttachmentAmbiguous returned if the attachment of a volume
+	// to detach cannot be told apart from its other attachments
+	ErrVolumeAttachmentAmbiguous = errors.New("Volume has several matching attachments")
+
+	// ErrVolumeTooSmall returned if a volume is smaller than the image
+	// or volume it is created from
+	ErrVolumeTooSmall = errors.New("Volume smaller than its source")
+
+	// ErrInstanceNotStopped returned if an operation requires the
+	// instance to be stopped
+	ErrInstanceNotStopped = errors.New("Instance not stopped")
+
+	// ErrNoBootVolume returned if an instance has no boot volume
+	ErrNoBootVolume = errors.New("Instance has no boot volume")
+
+	// ErrBadMountpoint returned if a mountpoint is not a valid device path
+	ErrBadMountpoint = errors.New("Invalid mountpoint")
+
+	// ErrMountpointInUse returned if the mountpoint of a volume is
+	// already used by another volume attached to the instance
+	ErrMountpointInUse = errors.New("Mountpoint already in use")
+
+	// ErrBadMACAddress returned if a requested MAC address is not a
+	// locally administered unicast address
+	ErrBadMACAddress = errors.New("Invalid MAC address")
+
+	// ErrMACAddressInUse returned if a requested MAC address is already
+	// used by another instance of the tenant
+	ErrMACAddressInUse = errors.New("MAC address already in use")
+
+	// ErrNotPrivileged returned if an operation requires privileges
+	ErrNotPrivileged = errors.New("Operation restricted to privileged users")
 )
 
-// HTTPErrorData represents the HTTP response body for
-// a compute API request error.
-type HTTPErrorData struct {
-	Code    int    `json:"code"`
-	Name    string `json:"name"`
-	Message string `json:"message"`
+// errorDetails is implemented by errors which carry a list of individual
+// failures to be returned in the details of the error response.
+type errorDetails interface {
+	Details() []string
+}
+
+// QuotaConflictError is returned when a quota update would set quotas
+// below their current usage.
+type QuotaConflictError struct {
+	Conflicts []string
+}
+
+func (e *QuotaConflictError) Error() string {
+	return fmt.Sprintf("%d quota(s) below current usage", len(e.Conflicts))
+}
+
+// Details returns one error message per conflicting quota.
+func (e *QuotaConflictError) Details() []string {
+	return e.Conflicts
+}
+
+// SchedulerHintsError is returned when the scheduler hints of a
+// CreateServerRequest cannot be satisfied.
+type SchedulerHintsError struct {
+	Reasons []string
+}
+
+func (e *SchedulerHintsError) Error() string {
+	return "Scheduler hints cannot be satisfied"
+}
+
+// Details returns the reasons for which the hints cannot be satisfied.
+func (e *SchedulerHintsError) Details() []string {
+	return e.Reasons
+}
+
+// SubnetConflictError is returned when a subnet added to a pool overlaps
+// a subnet or an address which already belongs to a pool.
+type SubnetConflictError struct {
+	Subnet   string
+	Conflict string
+	PoolID   string
+	PoolName string
+}
+
+func (e *SubnetConflictError) Error() string {
+	return fmt.Sprintf("Subnet %s overlaps %s in pool %s (%s)",
+		e.Subnet, e.Conflict, e.PoolName, e.PoolID)
 }
 
-// HTTPReturnErrorCode represents the unmarshalled version for Return codes
-// when a API call is made and you need to return explicit data of
-// the call as OpenStack format
-// http://developer.openstack.org/api-guide/compute/faults.html
-type HTTPReturnErrorCode struct {
-	Error HTTPErrorData `json:"error"`
+// WriteError writes err to w as a JSON types.APIErrorResponse with the
+// given status code.
+func WriteError(w http.ResponseWriter, status int, err error) {
+	data := types.APIError{
+		Code:    status,
+		Name:    http.StatusText(status),
+		Message: err.Error(),
+	}
+
+	if d, ok := err.(errorDetails); ok {
+		data.Details = d.Details()
+	}
+
+	b, err := json.Marshal(types.APIErrorResponse{Error: data})
+	if err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintln(w, string(b))
 }
 
 // Response contains the http status and any response struct to be marshalled.
@@ -181,15 +569,60 @@ type Response struct {
 }
 
 func errorResponse(err error) Response {
+	switch err.(type) {
+	case *SchedulerHintsError,
+		*SubnetConflictError,
+		*types.TenantSubnetConflictError:
+		return Response{http.StatusConflict, nil}
+	case *types.SubnetBitsError,
+		*types.InvalidQuotasError:
+		return Response{http.StatusBadRequest, nil}
+	}
+
 	switch err {
 	case types.ErrPoolNotFound,
 		types.ErrTenantNotFound,
+		types.ErrNoCNCI,
+		types.ErrNodeNotFound,
 		types.ErrAddressNotFound,
 		types.ErrInstanceNotFound,
-		types.ErrWorkloadNotFound:
+		types.ErrWorkloadNotFound,
+		ErrNoImage,
+		ErrNoImageUpload,
+		ErrNoExternalIP,
+		ErrVolumeNotFound:
 		return Response{http.StatusNotFound, nil}
 
+	case ErrVolumeTooSmall,
+		ErrBadMountpoint,
+		ErrBadMACAddress,
+		ErrNoBootVolume,
+		ErrImageChecksum,
+		types.ErrBadName,
+		types.ErrBadSubnet,
+		types.ErrSubnetAndBits,
+		types.ErrNoWorkloadResources:
+		return Response{http.StatusBadRequest, nil}
+
+	case ErrVolumeAttached,
+		ErrVolumeAttachmentAmbiguous,
+		ErrVolumeNotAvailable,
+		ErrImageNotActive,
+		ErrInstanceNotStopped,
+		ErrMountpointInUse,
+		ErrMACAddressInUse,
+		types.ErrAddressInUse,
+		types.ErrNodeNotEvacuated,
+		types.ErrWorkloadImmutable,
+		types.ErrVolumeImmutable,
+		types.ErrImageImmutable,
+		types.ErrNotCancellable,
+		types.ErrTenantNotDeleting,
+		types.ErrTenantDeleting:
+		return Response{http.StatusConflict, nil}
+
 	case types.ErrQuota,
+		ErrQuota,
 		types.ErrInstanceNotAssigned,
 		types.ErrDuplicateSubnet,
 		types.ErrDuplicateIP,
@@ -199,9 +632,18 @@ func errorResponse(err error) Response {
 		types.ErrBadRequest,
 		types.ErrPoolEmpty,
 		types.ErrDuplicatePoolName,
-		types.ErrWorkloadInUse:
+		types.ErrWorkloadInUse,
+		types.ErrPrivilegedNotPermitted,
+		ErrImageNotPermitted,
+		ErrVolumeOwner:
 		return Response{http.StatusForbidden, nil}
 
+	case types.ErrTooManyStreams:
+		return Response{http.StatusTooManyRequests, nil}
+
+	case ErrRequestTooLarge:
+		return Response{http.StatusRequestEntityTooLarge, nil}
+
 	default:
 		return Response{http.StatusInternalServerError, nil}
 	}
@@ -216,55 +658,203 @@ type Handler struct {
 	Privileged bool
 }
 
+// allowRequest applies the per tenant rate limit to r. If the tenant has
+// exceeded its rate, a 429 response is sent and false is returned.
+func (h Handler) allowRequest(w http.ResponseWriter, r *http.Request) bool {
+	if h.Context == nil || h.limiter == nil {
+		return true
+	}
+
+	if h.unlimitedPrivileged && service.GetPrivilege(r.Context()) {
+		return true
+	}
+
+	tenant := mux.Vars(r)["tenant"]
+	if tenant == "" {
+		tenant, _ = service.GetTenantID(r.Context())
+	}
+
+	if tenant == "" {
+		return true
+	}
+
+	ok, wait := h.limiter.allow(tenant, time.Now())
+	if ok {
+		return true
+	}
+
+	retry := int64(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+
+	h.log().Warningf("Rate limiting request from tenant %s: %s", tenant, r.URL.String())
+	WriteError(w, http.StatusTooManyRequests, ErrTooManyRequests)
+	return false
+}
+
 func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Context != nil && h.accessLog != nil {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer h.accessLog.record(rec, r, time.Now())
+		w = rec
+	}
+
+	if h.Context != nil && h.cors != nil {
+		h.cors.setHeaders(w, r)
+	}
+
 	// check whether we should send permission denied for this route.
 	if h.Privileged {
 		privileged := service.GetPrivilege(r.Context())
 		if !privileged {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			WriteError(w, http.StatusUnauthorized, ErrNotPrivileged)
 			return
 		}
 	}
 
-	// set the content type to whatever was requested.
-	contentType := r.Header.Get("Content-Type")
+	if !h.allowRequest(w, r) {
+		return
+	}
 
-	resp, err := h.Handler(h.Context, w, r)
-	if err != nil {
-		data := HTTPErrorData{
-			Code:    resp.status,
-			Name:    http.StatusText(resp.status),
-			Message: err.Error(),
-		}
+	var body *limitedBody
+	if h.Context != nil {
+		body = limitBody(w, r, h.maxBodySize)
+	}
 
-		code := HTTPReturnErrorCode{
-			Error: data,
+	if h.Context != nil && h.timeouts != nil {
+		if timeout := h.timeouts.lookup(r); timeout > 0 {
+			serveWithTimeout(w, r, timeout, h.log(), func(w http.ResponseWriter, r *http.Request) {
+				h.serve(w, r, body)
+			})
+			return
 		}
+	}
 
-		glog.Warningf("Returning error response to request: %s: %v", r.URL.String(), err)
+	h.serve(w, r, body)
+}
 
-		b, err := json.Marshal(code)
-		if err != nil {
-			http.Error(w, http.StatusText(resp.status), resp.status)
-			return
+// serve calls the handler and sends its response.
+func (h Handler) serve(w http.ResponseWriter, r *http.Request, body *limitedBody) {
+	// set the content type to whatever was requested.
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	resp, err := h.Handler(h.Context, w, r)
+	if err == nil && resp.status == 0 {
+		// the handler has written the response itself
+		return
+	}
+
+	if err != nil {
+		if body != nil && body.exceeded {
+			resp.status = http.StatusRequestEntityTooLarge
+			err = ErrRequestTooLarge
+		} else if err == context.DeadlineExceeded {
+			resp.status = http.StatusServiceUnavailable
+			err = ErrRequestTimeout
 		}
 
-		http.Error(w, string(b), resp.status)
+		h.log().Warningf("Returning error response to request: %s: %v", r.URL.String(), err)
+		WriteError(w, resp.status, err)
 		return
 	}
 
 	b, err := json.Marshal(resp.response)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError),
-			http.StatusInternalServerError)
+		WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if len(b) >= gzipMinSize && acceptsGzip(r) {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err = gz.Write(b)
+		if err == nil {
+			err = gz.Close()
+		}
+
+		if err == nil {
+			w.Header().Set("Content-Encoding", "gzip")
+			b = buf.Bytes()
+		} else {
+			h.log().Warningf("Unable to compress response: %v", err)
+		}
+	}
+
 	w.WriteHeader(resp.status)
 	_, _ = w.Write(b)
 }
 
+// gzipMinSize is the size below which responses are not worth compressing.
+const gzipMinSize = 1024
+
+// acceptsGzip returns true if the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, e := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(e, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+
+		// gzip may be explicitly refused with a zero quality value.
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				q, err := strconv.ParseFloat(p[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// notModified sets the Last-Modified header of the response to modified and
+// returns true if the copy the client holds, as dated by its If-Modified-Since
+// header, is still current. A zero modified time is never reported.
+func notModified(w http.ResponseWriter, r *http.Request, modified time.Time) bool {
+	if modified.IsZero() {
+		return false
+	}
+
+	// HTTP dates have a resolution of a second.
+	modified = modified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !modified.After(since)
+}
+
+func listVersions(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	var resp types.APIVersions
+
+	resources := make([]string, 0, len(mediaTypes))
+	for resource := range mediaTypes {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	for _, resource := range resources {
+		resp.Versions = append(resp.Versions, types.APIVersion{
+			Resource:   resource,
+			Versions:   mediaTypes[resource],
+			Version:    currentVersion(resource),
+			MinVersion: minimumVersion(resource),
+		})
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
 func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	var links []types.APILink
 	vars := mux.Vars(r)
@@ -273,8 +863,8 @@ func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response
 	// we support the "pools" resource.
 	link := types.APILink{
 		Rel:        "pools",
-		Version:    PoolsV1,
-		MinVersion: PoolsV1,
+		Version:    currentVersion("pools"),
+		MinVersion: minimumVersion("pools"),
 	}
 
 	if !ok {
@@ -288,8 +878,8 @@ func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response
 	// we support the "external-ips" resource
 	link = types.APILink{
 		Rel:        "external-ips",
-		Version:    ExternalIPsV1,
-		MinVersion: ExternalIPsV1,
+		Version:    currentVersion("external-ips"),
+		MinVersion: minimumVersion("external-ips"),
 	}
 
 	if !ok {
@@ -303,8 +893,8 @@ func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response
 	// we support the "workloads" resource
 	link = types.APILink{
 		Rel:        "workloads",
-		Version:    WorkloadsV1,
-		MinVersion: WorkloadsV1,
+		Version:    currentVersion("workloads"),
+		MinVersion: minimumVersion("workloads"),
 	}
 
 	if !ok {
@@ -318,8 +908,8 @@ func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response
 	// for the "tenants" resource
 	link = types.APILink{
 		Rel:        "tenants",
-		Version:    TenantsV1,
-		MinVersion: TenantsV1,
+		Version:    currentVersion("tenants"),
+		MinVersion: minimumVersion("tenants"),
 	}
 
 	if !ok {
@@ -334,19 +924,31 @@ func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response
 	if !ok {
 		link = types.APILink{
 			Rel:        "node",
-			Version:    NodeV1,
-			MinVersion: NodeV1,
+			Version:    currentVersion("node"),
+			MinVersion: minimumVersion("node"),
 		}
 
 		link.Href = fmt.Sprintf("%s/node", c.URL)
 		links = append(links, link)
 	}
 
+	// for the "cncis" resource
+	if !ok {
+		link = types.APILink{
+			Rel:        "cncis",
+			Version:    currentVersion("cncis"),
+			MinVersion: minimumVersion("cncis"),
+		}
+
+		link.Href = fmt.Sprintf("%s/cncis", c.URL)
+		links = append(links, link)
+	}
+
 	// for the "images" resource
 	link = types.APILink{
 		Rel:        "images",
-		Version:    ImagesV1,
-		MinVersion: ImagesV1,
+		Version:    currentVersion("images"),
+		MinVersion: minimumVersion("images"),
 	}
 
 	if !ok {
@@ -361,8 +963,8 @@ func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response
 	if ok {
 		link = types.APILink{
 			Rel:        "volumes",
-			Version:    VolumesV1,
-			MinVersion: VolumesV1,
+			Version:    currentVersion("volumes"),
+			MinVersion: minimumVersion("volumes"),
 		}
 
 		link.Href = fmt.Sprintf("%s/%s/volumes", c.URL, tenantID)
@@ -373,8 +975,8 @@ func listResources(c *Context, w http.ResponseWriter, r *http.Request) (Response
 	if ok {
 		link = types.APILink{
 			Rel:        "instances",
-			Version:    InstancesV1,
-			MinVersion: InstancesV1,
+			Version:    currentVersion("instances"),
+			MinVersion: minimumVersion("instances"),
 		}
 
 		link.Href = fmt.Sprintf("%s/%s/instances", c.URL, tenantID)
@@ -396,22 +998,73 @@ func showPool(c *Context, w http.ResponseWriter, r *http.Request) (Response, err
 	return Response{http.StatusOK, pool}, nil
 }
 
+// parsePage returns the limit and offset query parameters of a paged
+// listing. A limit of 0 means the listing is not limited.
+func parsePage(queries url.Values) (int, int, error) {
+	var limit, offset int
+	var err error
+
+	if l := queries.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			return 0, 0, fmt.Errorf("Invalid limit %q", l)
+		}
+	}
+
+	if o := queries.Get("offset"); o != "" {
+		offset, err = strconv.Atoi(o)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Invalid offset %q", o)
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// pageBounds returns the bounds of the page of a listing of n items and
+// whether more items follow the page.
+func pageBounds(n, limit, offset int) (int, int, bool) {
+	if offset > n {
+		offset = n
+	}
+
+	end := n
+	if limit > 0 && offset+limit < n {
+		end = offset + limit
+	}
+
+	return offset, end, end < n
+}
+
 func listPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	var resp types.ListPoolsResponse
 	vars := mux.Vars(r)
 	_, ok := vars["tenant"]
 
+	queries := r.URL.Query()
+
+	limit, offset, err := parsePage(queries)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
 	pools, err := c.ListPools()
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	queries := r.URL.Query()
-
 	names, returnNamedPool := queries["name"]
 
-	var match bool
+	// only return the pools which have addresses available for mapping
+	availableOnly := queries.Get("available") == "true"
+
+	var found bool
 	for i, p := range pools {
+		if availableOnly && p.Free <= 0 {
+			continue
+		}
+
+		var match bool
 		if returnNamedPool == true {
 			for _, name := range names {
 				if name == p.Name {
@@ -423,6 +1076,7 @@ func listPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, er
 		}
 
 		if match {
+			found = true
 			summary := types.PoolSummary{
 				ID:   p.ID,
 				Name: p.Name,
@@ -438,10 +1092,16 @@ func listPools(c *Context, w http.ResponseWriter, r *http.Request) (Response, er
 		}
 	}
 
-	if returnNamedPool && !match {
+	if returnNamedPool && !found {
 		return Response{http.StatusNotFound, nil}, types.ErrPoolNotFound
 	}
 
+	// the pools are filtered before paging so that pages are stable
+	// for a given filter.
+	start, end, more := pageBounds(len(resp.Pools), limit, offset)
+	resp.Pools = append([]types.PoolSummary{}, resp.Pools[start:end]...)
+	resp.More = more
+
 	return Response{http.StatusOK, resp}, err
 }
 
@@ -582,33 +1242,83 @@ func mapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response
 
 	tenantID := vars["tenant"]
 
-	err = c.MapAddress(tenantID, req.PoolName, req.InstanceID)
+	m, err := c.MapAddress(tenantID, req.PoolName, req.InstanceID, req.ExternalIP)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusNoContent, nil}, nil
+	return Response{http.StatusOK, m}, nil
 }
 
-func unmapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// mapExternalIPBatch maps an external IP to each of the instances of the
+// request in turn. A failure only affects its own mapping, unless the pool
+// is exhausted in which case the remaining mappings are not attempted.
+func mapExternalIPBatch(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	tenantID, ok := vars["tenant"]
-	mappingID := vars["mapping_id"]
+	var req []types.MapIPRequest
 
-	var IPs []types.MappedIP
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
 
-	if !ok {
-		IPs = c.ListMappedAddresses(nil)
-	} else {
-		IPs = c.ListMappedAddresses(&tenantID)
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
 	}
 
-	for _, m := range IPs {
-		if m.ID == mappingID {
-			err := c.UnMapAddress(m.ExternalIP)
-			if err != nil {
-				return errorResponse(err), err
-			}
+	if len(req) == 0 || len(req) > MaxMapIPBatch {
+		return Response{http.StatusBadRequest, nil},
+			fmt.Errorf("Batch must contain between 1 and %d mappings", MaxMapIPBatch)
+	}
+
+	tenantID := vars["tenant"]
+	results := make([]types.MapIPBatchResult, len(req))
+	stopped := false
+
+	for i, m := range req {
+		results[i] = types.MapIPBatchResult{
+			InstanceID: m.InstanceID,
+			PoolName:   m.PoolName,
+		}
+
+		if stopped {
+			results[i].Error = types.ErrMappingSkipped.Error()
+			continue
+		}
+
+		mapped, err := c.MapAddress(tenantID, m.PoolName, m.InstanceID, m.ExternalIP)
+		if err != nil {
+			results[i].Error = err.Error()
+			stopped = err == types.ErrPoolEmpty
+			continue
+		}
+
+		results[i].MappedIP = &mapped
+	}
+
+	return Response{http.StatusOK, results}, nil
+}
+
+func unmapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+	mappingID := vars["mapping_id"]
+
+	var IPs []types.MappedIP
+
+	if !ok {
+		IPs = c.ListMappedAddresses(nil)
+	} else {
+		IPs = c.ListMappedAddresses(&tenantID)
+	}
+
+	for _, m := range IPs {
+		if m.ID == mappingID {
+			err := c.UnMapAddress(m.ExternalIP)
+			if err != nil {
+				return errorResponse(err), err
+			}
 
 			return Response{http.StatusAccepted, nil}, nil
 		}
@@ -617,6 +1327,46 @@ func unmapExternalIP(c *Context, w http.ResponseWriter, r *http.Request) (Respon
 	return errorResponse(types.ErrAddressNotFound), types.ErrAddressNotFound
 }
 
+// validateWorkload checks that the workload config is a well formed
+// cloud-init document and that the vm_type, fw_type and image_name
+// fields of the workload are coherent.
+func validateWorkload(req types.Workload) error {
+	switch req.VMType {
+	case payloads.QEMU:
+		if req.FWType != string(payloads.EFI) && req.FWType != payloads.Legacy {
+			return fmt.Errorf("fw_type must be %s or %s for %s workloads",
+				payloads.EFI, payloads.Legacy, payloads.QEMU)
+		}
+
+		if req.ImageName != "" {
+			return fmt.Errorf("image_name must not be set for %s workloads, use storage instead",
+				payloads.QEMU)
+		}
+	case payloads.Docker:
+		if req.FWType != "" {
+			return fmt.Errorf("fw_type must not be set for %s workloads", payloads.Docker)
+		}
+
+		if req.ImageName == "" {
+			return fmt.Errorf("image_name is required for %s workloads", payloads.Docker)
+		}
+	default:
+		return fmt.Errorf("vm_type must be %s or %s", payloads.QEMU, payloads.Docker)
+	}
+
+	if strings.TrimSpace(req.Config) == "" {
+		return errors.New("config must not be empty")
+	}
+
+	var config map[string]interface{}
+	err := yaml.Unmarshal([]byte(req.Config), &config)
+	if err != nil {
+		return fmt.Errorf("config is not a valid cloud-init document: %v", err)
+	}
+
+	return nil
+}
+
 func addWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	var req types.Workload
 
@@ -630,6 +1380,14 @@ func addWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response,
 		return errorResponse(err), err
 	}
 
+	// validation may be skipped by advanced users who know better.
+	if r.URL.Query().Get("validate") != "false" {
+		err = validateWorkload(req)
+		if err != nil {
+			return Response{http.StatusBadRequest, nil}, err
+		}
+	}
+
 	// we allow admin to create public workloads for any tenant. However,
 	// users scoped to a particular tenant may only create workloads
 	// for their own tenant.
@@ -685,6 +1443,28 @@ func deleteWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Respons
 	return Response{http.StatusNoContent, nil}, nil
 }
 
+func updateWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["workload_id"]
+
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = c.PatchWorkload(tenantID, ID, body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
 func showWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 	ID := vars["workload_id"]
@@ -705,7 +1485,10 @@ func showWorkload(c *Context, w http.ResponseWriter, r *http.Request) (Response,
 func listWorkloads(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 
-	tenant := vars["tenant"]
+	tenant, ok := vars["tenant"]
+	if !ok {
+		tenant = "admin"
+	}
 
 	wls, err := c.ListWorkloads(tenant)
 	if err != nil {
@@ -728,6 +1511,47 @@ func listQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, e
 	return Response{http.StatusOK, resp}, nil
 }
 
+func listQuotasV2(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+
+	if !ok {
+		tenantID = vars["for_tenant"]
+	}
+
+	quotas := c.ListQuotas(tenantID)
+
+	return Response{http.StatusOK, types.NewQuotaListResponseV2(quotas)}, nil
+}
+
+// checkQuotaUsage verifies that none of the updated quotas is less than the
+// current usage of its resource. Unlimited quotas and limits are always
+// accepted.
+func checkQuotaUsage(current []types.QuotaDetails, updated []types.QuotaDetails) error {
+	usage := make(map[string]int)
+	for _, qd := range current {
+		usage[qd.Name] = qd.Usage
+	}
+
+	var conflicts []string
+	for _, qd := range updated {
+		if qd.Value < 0 || strings.Contains(qd.Name, "limit") {
+			continue
+		}
+
+		if qd.Value < usage[qd.Name] {
+			conflicts = append(conflicts, fmt.Sprintf("%s: %d is less than current usage %d",
+				qd.Name, qd.Value, usage[qd.Name]))
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return &QuotaConflictError{Conflicts: conflicts}
+	}
+
+	return nil
+}
+
 func updateQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 	tenantID := vars["for_tenant"]
@@ -743,6 +1567,11 @@ func updateQuotas(c *Context, w http.ResponseWriter, r *http.Request) (Response,
 		return errorResponse(err), err
 	}
 
+	err = checkQuotaUsage(c.ListQuotas(tenantID), req.Quotas)
+	if err != nil {
+		return Response{http.StatusConflict, nil}, err
+	}
+
 	err = c.UpdateQuotas(tenantID, req.Quotas)
 	if err != nil {
 		return errorResponse(err), err
@@ -785,13 +1614,68 @@ func changeNodeStatus(c *Context, w http.ResponseWriter, r *http.Request) (Respo
 	return Response{http.StatusNoContent, nil}, nil
 }
 
+func nodeAction(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["node_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req NodeActionRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	if (req.Evacuate == nil) == (req.Restore == nil) {
+		return Response{http.StatusBadRequest, nil},
+			errors.New("Exactly one of evacuate or restore must be requested")
+	}
+
+	if req.Restore != nil {
+		err = c.RestoreNode(ID)
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		return Response{http.StatusAccepted, nil}, nil
+	}
+
+	err = c.EvacuateNode(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp, err := c.NodeEvacuation(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusAccepted, resp}, nil
+}
+
+func showNodeEvacuation(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["node_id"]
+
+	resp, err := c.NodeEvacuation(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
 func listTenants(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	var resp types.TenantsListResponse
 
 	queries := r.URL.Query()
 	IDs, returnSingleTenant := queries["id"]
+	includeDeleted := queries.Get("include_deleted") == "true"
 
-	tenants, err := c.ListTenants()
+	tenants, err := c.ListTenants(includeDeleted)
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -828,12 +1712,370 @@ func updateTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response,
 	vars := mux.Vars(r)
 	ID := vars["tenant"]
 
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = c.PatchTenant(ID, body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func createTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var req types.TenantRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp, err := c.CreateTenant(req.ID, req.Config, req.Quotas)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+func deleteTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["tenant"]
+
+	err := c.DeleteTenant(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func tenantAction(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req TenantActionRequest
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	if req.Restore == nil {
+		return Response{http.StatusBadRequest, nil}, errors.New("No tenant action requested")
+	}
+
+	err = c.RestoreTenant(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
+func probeTenantNetwork(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["tenant"]
+
+	resp, err := c.ProbeTenantNetwork(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func showTenantCNCI(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["tenant"]
+
+	resp, err := c.ShowTenantCNCI(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+// listCNCIs lists the CNCIs of the cluster, or only those of the tenant
+// given by the tenant_id query parameter.
+func listCNCIs(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	tenantID := r.URL.Query().Get("tenant_id")
+
+	cncis, err := c.ListCNCIs(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, types.CNCIListResponse{CNCIs: cncis}}, nil
+}
+
+// showTenantSummary aggregates the resources used by a tenant from the
+// listings of its instances, volumes, images and external IPs.
+func showTenantSummary(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = vars["for_tenant"]
+	}
+
+	_, err := c.ShowTenant(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	summary := types.TenantResourceSummary{TenantID: tenantID}
+
+	servers, err := c.ListServersDetail(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	workloads := make(map[string]types.Workload)
+	for _, s := range servers {
+		summary.Instances++
+		if s.Status != payloads.ComputeStatusRunning {
+			continue
+		}
+		summary.RunningInstances++
+
+		wl, ok := workloads[s.WorkloadID]
+		if !ok {
+			wl, err = c.ShowWorkload(tenantID, s.WorkloadID)
+			if err != nil {
+				return errorResponse(err), err
+			}
+			workloads[s.WorkloadID] = wl
+		}
+
+		summary.VCPUs += wl.Requirements.VCPUs
+		summary.MemMB += wl.Requirements.MemMB
+	}
+
+	volumes, err := c.ListVolumesDetail(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	for _, v := range volumes {
+		summary.Volumes++
+		summary.VolumeGB += v.Size
+	}
+
+	images, err := c.ListImages(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	for _, i := range images {
+		if i.TenantID != tenantID {
+			continue
+		}
+		summary.Images++
+		summary.ImageBytes += i.Size
+	}
+
+	summary.MappedIPs = len(c.ListMappedAddresses(&tenantID))
+
+	return Response{http.StatusOK, summary}, nil
+}
+
+// streamKeepAlive is the interval at which a comment is sent on idle event
+// streams so that proxies do not close them.
+var streamKeepAlive = 30 * time.Second
+
+// streamTenantEvents sends the resource events of a tenant as server-sent
+// events until the client disconnects.
+func streamTenantEvents(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	ID := vars["tenant"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		err := errors.New("Streaming not supported")
+		return errorResponse(err), err
+	}
+
+	events, cancel, err := c.SubscribeTenantEvents(ID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return Response{}, nil
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return Response{}, nil
+			}
+
+			var b []byte
+			b, err = json.Marshal(e)
+			if err != nil {
+				c.log().Warningf("Unable to marshal %s event %s: %v", e.Type, e.ID, err)
+				continue
+			}
+
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+		}
+
+		if err != nil {
+			c.log().Warningf("Closing event stream of tenant %s: %v", ID, err)
+			return Response{}, nil
+		}
+		flusher.Flush()
+	}
+}
+
+func validPrivilege(visibility types.Visibility, privileged bool) bool {
+	return visibility == types.Private || (visibility == types.Public || visibility == types.Internal) && privileged
+}
+
+// createImage creates information about an image, but doesn't contain
+// any actual image.
+func createImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID := vars["tenant"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req CreateImageRequest
+
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return Response{http.StatusInternalServerError, nil}, err
+	}
+
+	privileged := service.GetPrivilege(r.Context())
+
+	if !validPrivilege(req.Visibility, privileged) {
+		return Response{http.StatusForbidden, nil}, nil
+	}
+
+	resp, err := context.CreateImage(tenantID, req)
+
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
+// listImages returns a list of all created images.
+//
+// TBD: support query & sort parameters
+func listImages(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
+
+	images, err := context.ListImages(tenantID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	var modified time.Time
+	for _, image := range images {
+		if image.CreateTime.After(modified) {
+			modified = image.CreateTime
+		}
+	}
+
+	if notModified(w, r, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return Response{}, nil
+	}
+
+	return Response{http.StatusOK, images}, nil
+}
+
+// getImage get information about an image by image_id field
+func getImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	imageID := vars["image_id"]
+
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
+
+	image, err := context.GetImage(tenantID, imageID)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	if notModified(w, r, image.CreateTime) {
+		w.WriteHeader(http.StatusNotModified)
+		return Response{}, nil
+	}
+
+	return Response{http.StatusOK, image}, nil
+}
+
+// updateImage changes the visibility of an image. Images may be made
+// internal only by a privileged caller.
+func updateImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	imageID := vars["image_id"]
+
+	privileged := service.GetPrivilege(r.Context())
+
+	tenantID, ok := vars["tenant"]
+	if !ok || privileged {
+		tenantID = "admin"
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Response{http.StatusBadRequest, nil}, err
+	}
+
+	var req UpdateImageRequest
+
+	err = json.Unmarshal(body, &req)
 	if err != nil {
-		return errorResponse(err), err
+		return Response{http.StatusBadRequest, nil}, err
 	}
 
-	err = c.PatchTenant(ID, body)
+	switch req.Visibility {
+	case types.Public, types.Private:
+	case types.Internal:
+		if !privileged {
+			return Response{http.StatusForbidden, nil}, nil
+		}
+	default:
+		return Response{http.StatusBadRequest, nil}, types.ErrBadRequest
+	}
+
+	err = context.UpdateImage(tenantID, imageID, req.Visibility)
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -841,113 +2083,122 @@ func updateTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response,
 	return Response{http.StatusNoContent, nil}, nil
 }
 
-func createTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return errorResponse(err), err
+// patchImage applies a json merge patch renaming an image.
+func patchImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	imageID := vars["image_id"]
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
 	}
 
-	var req types.TenantRequest
-	err = json.Unmarshal(body, &req)
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	resp, err := c.CreateTenant(req.ID, req.Config)
+	err = context.PatchImage(tenantID, imageID, body)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusCreated, resp}, nil
+	return Response{http.StatusNoContent, nil}, nil
 }
 
-func deleteTenant(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+func uploadImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	ID := vars["tenant"]
+	imageID := vars["image_id"]
 
-	err := c.DeleteTenant(ID)
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
+
+	err := context.UploadImage(r.Context(), tenantID, imageID, r.Body, r.Header.Get(ImageChecksumHeader))
 	if err != nil {
 		return errorResponse(err), err
 	}
-
 	return Response{http.StatusNoContent, nil}, nil
 }
 
-func validPrivilege(visibility types.Visibility, privileged bool) bool {
-	return visibility == types.Private || (visibility == types.Public || visibility == types.Internal) && privileged
-}
-
-// createImage creates information about an image, but doesn't contain
-// any actual image.
-func createImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+func imageAction(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
-	tenantID := vars["tenant"]
+	imageID := vars["image_id"]
+
+	tenantID, ok := vars["tenant"]
+	if !ok {
+		tenantID = "admin"
+	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return Response{http.StatusBadRequest, nil}, err
 	}
 
-	var req CreateImageRequest
-
+	var req ImageActionRequest
 	err = json.Unmarshal(body, &req)
 	if err != nil {
-		return Response{http.StatusInternalServerError, nil}, err
+		return Response{http.StatusBadRequest, nil}, err
 	}
 
-	privileged := service.GetPrivilege(r.Context())
-
-	if !validPrivilege(req.Visibility, privileged) {
-		return Response{http.StatusForbidden, nil}, nil
+	if req.Cancel == nil {
+		return Response{http.StatusBadRequest, nil}, errors.New("No image action requested")
 	}
 
-	resp, err := context.CreateImage(tenantID, req)
-
+	err = context.CancelImage(tenantID, imageID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusCreated, resp}, nil
+	return Response{http.StatusAccepted, nil}, nil
 }
 
-// listImages returns a list of all created images.
-//
-// TBD: support query & sort parameters
-func listImages(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// startImageUpload starts an asynchronous image upload and returns its ID
+// straight away, without reading any data. net/http does not let a handler
+// keep reading the request body once the response has been sent, so the
+// data is sent in a second request, to uploadImageData, while the progress
+// is followed by polling the image.
+func startImageUpload(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
+	imageID := vars["image_id"]
+
 	tenantID, ok := vars["tenant"]
 	if !ok {
 		tenantID = "admin"
 	}
 
-	images, err := context.ListImages(tenantID)
+	uploadID, err := context.StartImageUpload(tenantID, imageID)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusOK, images}, nil
+	return Response{http.StatusAccepted, UploadImageResponse{UploadID: uploadID}}, nil
 }
 
-// getImage get information about an image by image_id field
-//
-func getImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// uploadImageData receives the data of an asynchronous image upload and
+// returns once it has been received. The image is made active in the
+// background.
+func uploadImageData(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 	imageID := vars["image_id"]
+	uploadID := vars["upload_id"]
 
 	tenantID, ok := vars["tenant"]
 	if !ok {
 		tenantID = "admin"
 	}
 
-	image, err := context.GetImage(tenantID, imageID)
+	err := context.UploadImageData(r.Context(), tenantID, imageID, uploadID, r.Body, r.Header.Get(ImageChecksumHeader))
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusOK, image}, nil
+	return Response{http.StatusAccepted, nil}, nil
 }
 
-func uploadImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+// downloadImage streams the contents of an image. Range requests are
+// supported so that interrupted downloads may be resumed.
+func downloadImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 	imageID := vars["image_id"]
 
@@ -956,11 +2207,23 @@ func uploadImage(context *Context, w http.ResponseWriter, r *http.Request) (Resp
 		tenantID = "admin"
 	}
 
-	err := context.UploadImage(tenantID, imageID, r.Body)
+	content, size, err := context.DownloadImage(tenantID, imageID)
 	if err != nil {
 		return errorResponse(err), err
 	}
-	return Response{http.StatusNoContent, nil}, nil
+
+	if c, ok := content.(io.Closer); ok {
+		defer func() { _ = c.Close() }()
+	}
+
+	if context.log().V(2) {
+		context.log().Infof("Sending image %s of %d bytes", imageID, size)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, content)
+
+	return Response{}, nil
 }
 
 func deleteImage(context *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
@@ -995,7 +2258,7 @@ func createVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response
 		return Response{http.StatusInternalServerError, nil}, err
 	}
 
-	vol, err := bc.CreateVolume(tenant, req)
+	vol, err := bc.CreateVolume(r.Context(), tenant, req)
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -1028,13 +2291,46 @@ func showVolumeDetails(bc *Context, w http.ResponseWriter, r *http.Request) (Res
 	return Response{http.StatusOK, vol}, nil
 }
 
+// patchVolume applies a json merge patch changing the name or description
+// of a volume.
+func patchVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	volume := vars["volume_id"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	err = bc.PatchVolume(tenant, volume, body)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusNoContent, nil}, nil
+}
+
 func deleteVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
 	vars := mux.Vars(r)
 	tenant := vars["tenant"]
 	volume := vars["volume_id"]
 
-	// TBD - satisfy preconditions here, or in interface?
-	err := bc.DeleteVolume(tenant, volume)
+	var err error
+
+	// forcing the deletion bypasses the state of the volume and is
+	// restricted to privileged users.
+	if r.URL.Query().Get("force") == "true" {
+		if !service.GetPrivilege(r.Context()) {
+			return Response{http.StatusUnauthorized, nil}, ErrNotPrivileged
+		}
+
+		err = bc.ForceDeleteVolume(tenant, volume)
+	} else {
+		// TBD - satisfy preconditions here, or in interface?
+		err = bc.DeleteVolume(tenant, volume)
+	}
+
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -1045,43 +2341,87 @@ func deleteVolume(bc *Context, w http.ResponseWriter, r *http.Request) (Response
 func volumeActionAttach(bc *Context, m map[string]interface{}, tenant string, volume string) (Response, error) {
 	val := m["attach"]
 
-	m = val.(map[string]interface{})
-
-	val, ok := m["instance_uuid"]
+	m, ok := val.(map[string]interface{})
 	if !ok {
-		// we have to have the instance uuid
 		return Response{http.StatusBadRequest, nil}, nil
 	}
-	instance := val.(string)
 
-	val, ok = m["mountpoint"]
+	// we have to have the instance uuid
+	instance, ok := m["instance_uuid"].(string)
 	if !ok {
-		// we have to have the mountpoint ?
 		return Response{http.StatusBadRequest, nil}, nil
 	}
-	mountPoint := val.(string)
 
-	err := bc.AttachVolume(tenant, volume, instance, mountPoint)
+	// the next free device is used if the mountpoint is omitted
+	var mountPoint string
+	if val = m["mountpoint"]; val != nil {
+		mountPoint, ok = val.(string)
+		if !ok {
+			return Response{http.StatusBadRequest, nil}, nil
+		}
+	}
+
+	// volumes are attached read-write unless read_only is set
+	var readOnly bool
+	if val = m["read_only"]; val != nil {
+		readOnly, ok = val.(bool)
+		if !ok {
+			return Response{http.StatusBadRequest, nil}, nil
+		}
+	}
+
+	mountPoint, err := bc.AttachVolume(tenant, volume, instance, mountPoint, readOnly)
 	if err != nil {
 		return errorResponse(err), err
 	}
 
-	return Response{http.StatusAccepted, nil}, nil
+	resp := types.VolumeAttachment{
+		InstanceID: instance,
+		Mountpoint: mountPoint,
+		ReadOnly:   readOnly,
+	}
+
+	return Response{http.StatusAccepted, resp}, nil
 }
 
 func volumeActionDetach(bc *Context, m map[string]interface{}, tenant string, volume string) (Response, error) {
 	val := m["detach"]
 
-	m = val.(map[string]interface{})
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return Response{http.StatusBadRequest, nil}, nil
+	}
+
+	// the attachment is identified by any of the optional
+	// attachment-id, instance_uuid and mountpoint.
+	var detach VolumeDetach
+	for key, field := range map[string]*string{
+		"attachment-id": &detach.AttachmentID,
+		"instance_uuid": &detach.InstanceID,
+		"mountpoint":    &detach.Mountpoint,
+	} {
+		val = m[key]
+		if val == nil {
+			continue
+		}
+
+		s, ok := val.(string)
+		if !ok {
+			return Response{http.StatusBadRequest, nil}, nil
+		}
+		*field = s
+	}
 
-	// attachment-id is optional
-	var attachment string
-	val = m["attachment-id"]
-	if val != nil {
-		attachment = val.(string)
+	err := bc.DetachVolume(tenant, volume, detach)
+	if err != nil {
+		return errorResponse(err), err
 	}
 
-	err := bc.DetachVolume(tenant, volume, attachment)
+	return Response{http.StatusAccepted, nil}, nil
+}
+
+func volumeActionCancel(bc *Context, tenant string, volume string) (Response, error) {
+	err := bc.CancelVolume(tenant, volume)
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -1108,8 +2448,6 @@ func volumeAction(bc *Context, w http.ResponseWriter, r *http.Request) (Response
 
 	m := req.(map[string]interface{})
 
-	// for now, we will support only attach and detach
-
 	if m["attach"] != nil {
 		return volumeActionAttach(bc, m, tenant, volume)
 	}
@@ -1118,6 +2456,10 @@ func volumeAction(bc *Context, w http.ResponseWriter, r *http.Request) (Response
 		return volumeActionDetach(bc, m, tenant, volume)
 	}
 
+	if m["cancel"] != nil {
+		return volumeActionCancel(bc, tenant, volume)
+	}
+
 	return Response{http.StatusBadRequest, nil}, err
 }
 
@@ -1137,6 +2479,16 @@ func createInstance(c *Context, w http.ResponseWriter, r *http.Request) (Respons
 		return Response{http.StatusBadRequest, nil}, err
 	}
 
+	// a dry run only reports whether the request would be admitted.
+	if r.URL.Query().Get("dry_run") == "true" {
+		check, err := c.CheckServer(tenant, req)
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		return Response{http.StatusOK, check}, nil
+	}
+
 	resp, err := c.CreateServer(tenant, req)
 	if err != nil {
 		return errorResponse(err), err
@@ -1154,14 +2506,17 @@ func listInstanceDetails(c *Context, w http.ResponseWriter, r *http.Request) (Re
 
 	// if this function is called via an admin context, we might
 	// have {workload} on the URL. If it's called from a user context,
-	// we might have workload as a query value.
+	// we might have workload_id, or workload, as a query value.
 	workload, ok := vars["workload"]
 	if !ok {
-		if len(values["workload"]) > 0 {
-			workload = values["workload"][0]
+		workload = values.Get("workload_id")
+		if workload == "" {
+			workload = values.Get("workload")
 		}
 	}
 
+	status := values.Get("status")
+
 	servers, err := c.ListServersDetail(tenant)
 	if err != nil {
 		return errorResponse(err), err
@@ -1169,11 +2524,16 @@ func listInstanceDetails(c *Context, w http.ResponseWriter, r *http.Request) (Re
 
 	resp := Servers{}
 
-	if workload != "" {
+	if workload != "" || status != "" {
+		resp.Servers = []ServerDetails{}
 		for _, s := range servers {
-			if s.WorkloadID == workload {
-				resp.Servers = append(resp.Servers, s)
+			if workload != "" && s.WorkloadID != workload {
+				continue
+			}
+			if status != "" && s.Status != status {
+				continue
 			}
+			resp.Servers = append(resp.Servers, s)
 		}
 	} else {
 		resp.Servers = servers
@@ -1189,7 +2549,41 @@ func showInstanceDetails(c *Context, w http.ResponseWriter, r *http.Request) (Re
 	tenant := vars["tenant"]
 	server := vars["instance_id"]
 
-	resp, err := c.ShowServerDetails(tenant, server)
+	values := r.URL.Query()
+	wait := values.Get("wait")
+	status := values.Get("status")
+
+	if wait == "" && status == "" {
+		resp, err := c.ShowServerDetails(tenant, server)
+		if err != nil {
+			return errorResponse(err), err
+		}
+
+		return Response{http.StatusOK, resp}, nil
+	}
+
+	// the request is held until the instance reaches status, the wait
+	// elapses or the client goes away.
+	timeout, err := time.ParseDuration(wait)
+	if err != nil || timeout <= 0 || timeout > MaxInstanceWait || status == "" {
+		return Response{http.StatusBadRequest, nil},
+			fmt.Errorf("wait must be a duration of at most %v and status must be set", MaxInstanceWait)
+	}
+
+	resp, err := c.WaitServerStatus(r.Context(), tenant, server, status, timeout)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	return Response{http.StatusOK, resp}, nil
+}
+
+func showInstanceSSH(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+	vars := mux.Vars(r)
+	tenant := vars["tenant"]
+	server := vars["instance_id"]
+
+	resp, err := c.ShowServerSSH(tenant, server)
 	if err != nil {
 		return errorResponse(err), err
 	}
@@ -1220,6 +2614,13 @@ func instanceAction(c *Context, w http.ResponseWriter, r *http.Request) (Respons
 		return Response{http.StatusBadRequest, nil}, err
 	}
 
+	var req struct {
+		CreateWorkload *CreateWorkloadAction `json:"create_workload"`
+	}
+	if json.Unmarshal(body, &req) == nil && req.CreateWorkload != nil {
+		return instanceActionCreateWorkload(c, tenant, server, *req.CreateWorkload)
+	}
+
 	bodyString := string(body)
 
 	if strings.Contains(bodyString, "os-start") {
@@ -1238,6 +2639,27 @@ func instanceAction(c *Context, w http.ResponseWriter, r *http.Request) (Respons
 	return Response{http.StatusAccepted, nil}, nil
 }
 
+func instanceActionCreateWorkload(c *Context, tenant string, server string, action CreateWorkloadAction) (Response, error) {
+	if action.Name == "" {
+		return Response{http.StatusBadRequest, nil}, types.ErrBadName
+	}
+
+	wl, err := c.CreateWorkloadFromInstance(tenant, server, action.Name)
+	if err != nil {
+		return errorResponse(err), err
+	}
+
+	resp := types.WorkloadResponse{
+		Workload: wl,
+		Link: types.Link{
+			Rel:  "self",
+			Href: fmt.Sprintf("%s/%s/workloads/%s", c.URL, tenant, wl.ID),
+		},
+	}
+
+	return Response{http.StatusCreated, resp}, nil
+}
+
 // Service is an interface which must be implemented by the ciao API context.
 type Service interface {
 	AddPool(name string, subnet *string, ips []string) (types.Pool, error)
@@ -1247,35 +2669,55 @@ type Service interface {
 	AddAddress(poolID string, subnet *string, IPs []string) error
 	RemoveAddress(poolID string, subnetID *string, IPID *string) error
 	ListMappedAddresses(tenantID *string) []types.MappedIP
-	MapAddress(tenantID string, poolName *string, instanceID string) error
+	MapAddress(tenantID string, poolName *string, instanceID string, externalIP *string) (types.MappedIP, error)
 	UnMapAddress(ID string) error
 	CreateWorkload(req types.Workload) (types.Workload, error)
+	CreateWorkloadFromInstance(tenant string, instance string, name string) (types.Workload, error)
 	DeleteWorkload(tenantID string, workloadID string) error
 	ShowWorkload(tenantID string, workloadID string) (types.Workload, error)
+	PatchWorkload(tenantID string, workloadID string, patch []byte) error
 	ListWorkloads(tenantID string) ([]types.Workload, error)
 	ListQuotas(tenantID string) []types.QuotaDetails
 	UpdateQuotas(tenantID string, qds []types.QuotaDetails) error
 	EvacuateNode(nodeID string) error
 	RestoreNode(nodeID string) error
-	ListTenants() ([]types.TenantSummary, error)
+	NodeEvacuation(nodeID string) (types.NodeAction, error)
+	ListTenants(includeDeleted bool) ([]types.TenantSummary, error)
 	ShowTenant(ID string) (types.TenantConfig, error)
 	PatchTenant(ID string, patch []byte) error
-	CreateTenant(ID string, config types.TenantConfig) (types.TenantSummary, error)
+	CreateTenant(ID string, config types.TenantConfig, quotas []types.QuotaDetails) (types.TenantSummary, error)
 	DeleteTenant(ID string) error
+	RestoreTenant(ID string) error
+	ProbeTenantNetwork(ID string) (types.CNCIProbeResponse, error)
+	ShowTenantCNCI(ID string) (types.TenantCNCIResponse, error)
+	ListCNCIs(tenantID string) ([]types.CNCISummary, error)
+	SubscribeTenantEvents(ID string) (<-chan types.ResourceEvent, func(), error)
 	CreateImage(string, CreateImageRequest) (types.Image, error)
-	UploadImage(string, string, io.Reader) error
+	UploadImage(context.Context, string, string, io.Reader, string) error
+	StartImageUpload(string, string) (string, error)
+	UploadImageData(context.Context, string, string, string, io.Reader, string) error
+	DownloadImage(string, string) (io.ReadSeeker, int64, error)
 	ListImages(string) ([]types.Image, error)
 	GetImage(string, string) (types.Image, error)
+	UpdateImage(tenantID, id string, visibility types.Visibility) error
+	PatchImage(tenantID, imageID string, patch []byte) error
 	DeleteImage(string, string) error
-	CreateVolume(tenant string, req RequestedVolume) (types.Volume, error)
+	CancelImage(tenantID, imageID string) error
+	CreateVolume(ctx context.Context, tenant string, req RequestedVolume) (types.Volume, error)
 	DeleteVolume(tenant string, volume string) error
-	AttachVolume(tenant string, volume string, instance string, mountpoint string) error
-	DetachVolume(tenant string, volume string, attachment string) error
+	ForceDeleteVolume(tenant string, volume string) error
+	AttachVolume(tenant string, volume string, instance string, mountpoint string, readOnly bool) (string, error)
+	DetachVolume(tenant string, volume string, detach VolumeDetach) error
 	ListVolumesDetail(tenant string) ([]types.Volume, error)
 	ShowVolumeDetails(tenant string, volume string) (types.Volume, error)
+	PatchVolume(tenant string, volume string, patch []byte) error
+	CancelVolume(tenant string, volume string) error
 	CreateServer(string, CreateServerRequest) (interface{}, error)
+	CheckServer(string, CreateServerRequest) (CreateServerCheckResponse, error)
 	ListServersDetail(tenant string) ([]ServerDetails, error)
 	ShowServerDetails(tenant string, server string) (Server, error)
+	WaitServerStatus(ctx context.Context, tenant string, server string, status string, timeout time.Duration) (Server, error)
+	ShowServerSSH(tenant string, server string) (SSHAccess, error)
 	DeleteServer(tenant string, server string) error
 	StartServer(tenant string, server string) error
 	StopServer(tenant string, server string) error
@@ -1285,27 +2727,113 @@ type Service interface {
 type Context struct {
 	URL string
 	Service
+
+	limiter             *rateLimiter
+	unlimitedPrivileged bool
+	cors                *corsPolicy
+	idempotency         *idempotencyCache
+	maxBodySize         int64
+	maxImageSize        int64
+	timeouts            *routeTimeouts
+	accessLog           *accessLog
+	logger              clogger.CiaoLog
+}
+
+// log returns the logger of the context, which discards the messages when
+// no logger has been configured.
+func (c *Context) log() clogger.CiaoLog {
+	if c == nil || c.logger == nil {
+		return clogger.CiaoNullLogger{}
+	}
+	return c.logger
 }
 
 // Config is used to setup the Context for the ciao API.
 type Config struct {
 	URL         string
 	CiaoService Service
+
+	// RateLimit is the number of requests per second allowed for each
+	// tenant. Zero or a negative value disables rate limiting.
+	RateLimit float64
+
+	// RateBurst is the number of requests a tenant may make in a burst.
+	// Zero selects DefaultRateBurst.
+	RateBurst int
+
+	// UnlimitedPrivileged exempts privileged callers from rate limiting.
+	UnlimitedPrivileged bool
+
+	// CORSOrigins lists the origins allowed to make cross-origin requests,
+	// "*" allowing any origin. No cross-origin requests are allowed if empty.
+	CORSOrigins []string
+
+	// CORSAllowCredentials allows cross-origin requests to include
+	// credentials.
+	CORSAllowCredentials bool
+
+	// IdempotencyTTL is how long the responses to the create requests
+	// carrying an Idempotency-Key header are kept. Zero selects
+	// DefaultIdempotencyTTL and a negative value disables idempotency keys.
+	IdempotencyTTL time.Duration
+
+	// MaxBodySize is the largest request body accepted, in bytes. Zero
+	// selects DefaultMaxBodySize and a negative value removes the limit.
+	MaxBodySize int64
+
+	// MaxImageSize is the largest image accepted by an upload, in bytes.
+	// Zero or a negative value removes the limit.
+	MaxImageSize int64
+	// RequestTimeout is how long a request may take before a 503 response
+	// is returned and the context of the request is cancelled. Zero selects
+	// DefaultRequestTimeout and a negative value disables the timeout.
+	// Event streams and image downloads have no timeout.
+	RequestTimeout time.Duration
+
+	// ImageUploadTimeout is how long an image upload may take. Zero or a
+	// negative value disables the timeout.
+	ImageUploadTimeout time.Duration
+	// AccessLog receives an AccessLogEntry, as a line of JSON, for every
+	// request. Nil disables the access log.
+	AccessLog io.Writer
+	// Logger receives the messages logged while serving requests. Nil
+	// discards them.
+	Logger clogger.CiaoLog
 }
 
 // Routes returns the supported ciao API endpoints.
-// A plain application/json request will return v1 of the resource
-// since we only have one version of this api so far, that means
-// most routes will match both json as well as our custom
-// content type.
+// Routes match both application/json and every supported version of the
+// custom content type of their resource. A plain application/json request
+// is served the current version of the resource. Handlers serving several
+// versions of a resource on the same path are registered with versioned.
 func Routes(config Config, r *mux.Router) *mux.Router {
 	// make new Context
-	context := &Context{config.URL, config.CiaoService}
+	context := &Context{
+		URL:                 config.URL,
+		Service:             config.CiaoService,
+		limiter:             newRateLimiter(config.RateLimit, config.RateBurst),
+		unlimitedPrivileged: config.UnlimitedPrivileged,
+		cors:                newCORSPolicy(config.CORSOrigins, config.CORSAllowCredentials),
+		idempotency:         newIdempotencyCache(config.IdempotencyTTL),
+		maxBodySize:         config.MaxBodySize,
+		maxImageSize:        config.MaxImageSize,
+		logger:              config.Logger,
+	}
+
+	context.accessLog = newAccessLog(config.AccessLog, context.log())
+
+	if config.RequestTimeout >= 0 {
+		context.timeouts = newRouteTimeouts(config.RequestTimeout)
+	}
 
 	if r == nil {
 		r = mux.NewRouter()
 	}
 
+	if r.NotFoundHandler == nil {
+		r.NotFoundHandler = Handler{context, notAcceptable, false}
+	}
+
 	// external IP pools
 	route := r.Handle("/", Handler{context, listResources, true})
 	route.Methods("GET")
@@ -1313,237 +2841,374 @@ func Routes(config Config, r *mux.Router) *mux.Router {
 	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}", Handler{context, listResources, false})
 	route.Methods("GET")
 
-	matchContent := fmt.Sprintf("application/(%s|json)", PoolsV1)
+	route = r.Handle("/versions", Handler{context, listVersions, false})
+	route.Methods("GET")
+
+	matchContent := matchMediaType("pools")
 
 	route = r.Handle("/pools", Handler{context, listPools, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/pools", Handler{context, listPools, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/pools", Handler{context, addPool, true})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, showPool, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, deletePool, true})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}", Handler{context, addToPool, true})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}/subnets/{subnet:"+uuid.UUIDRegex+"}", Handler{context, deleteSubnet, true})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/pools/{pool:"+uuid.UUIDRegex+"}/external-ips/{ip_id:"+uuid.UUIDRegex+"}", Handler{context, deleteExternalIP, true})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	// mapped external IPs
-	matchContent = fmt.Sprintf("application/(%s|json)", ExternalIPsV1)
+	matchContent = matchMediaType("external-ips")
 
 	route = r.Handle("/external-ips", Handler{context, listMappedIPs, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips", Handler{context, listMappedIPs, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/external-ips", Handler{context, mapExternalIP, true})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips", Handler{context, mapExternalIP, false})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/external-ips/batch", Handler{context, mapExternalIPBatch, true})
+	route.Methods("POST")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips/batch", Handler{context, mapExternalIPBatch, false})
+	route.Methods("POST")
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/external-ips/{mapping_id:"+uuid.UUIDRegex+"}", Handler{context, unmapExternalIP, true})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/external-ips/{mapping_id:"+uuid.UUIDRegex+"}", Handler{context, unmapExternalIP, false})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	// workloads
-	matchContent = fmt.Sprintf("application/(%s|json)", WorkloadsV1)
+	matchContent = matchMediaType("workloads")
 
-	route = r.Handle("/workloads", Handler{context, addWorkload, true})
+	route = r.Handle("/workloads", Handler{context, idempotent(addWorkload), true})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/workloads", Handler{context, listWorkloads, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, deleteWorkload, true})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, showWorkload, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads", Handler{context, addWorkload, false})
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads", Handler{context, idempotent(addWorkload), false})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads", Handler{context, listWorkloads, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, deleteWorkload, false})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, updateWorkload, true})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
 
 	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, showWorkload, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/workloads/{workload_id:"+uuid.UUIDRegex+"}", Handler{context, updateWorkload, false})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
 
 	// tenants
-	matchContent = fmt.Sprintf("application/(%s|json)", TenantsV1)
+	matchContent = matchMediaType("tenants")
 
 	route = r.Handle("/tenants", Handler{context, listTenants, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/tenants", Handler{context, createTenant, true})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}", Handler{context, showTenant, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}", Handler{context, deleteTenant, true})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants", Handler{context, showTenant, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}", Handler{context, updateTenant, true})
 	route.Methods("PATCH")
 	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
 
+	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}/action", Handler{context, tenantAction, true})
+	route.Methods("POST")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}/network/probe", Handler{context, probeTenantNetwork, true})
+	route.Methods("POST")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}/cnci", Handler{context, showTenantCNCI, true})
+	route.Methods("GET")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/summary", Handler{context, showTenantSummary, true})
+	route.Methods("GET")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants/summary", Handler{context, showTenantSummary, false})
+	route.Methods("GET")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/tenants/{tenant:"+uuid.UUIDRegex+"}/stream", Handler{context, streamTenantEvents, true})
+	route.Methods("GET")
+	route.HeadersRegexp("Accept", "text/event-stream")
+	context.timeouts.set(route, -1)
+
 	// tenant quotas
-	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants/quotas", Handler{context, listQuotas, false})
+	quotas := versioned("tenants", versionHandlers{
+		TenantsV1: listQuotas,
+		TenantsV2: listQuotasV2,
+	})
+
+	route = r.Handle("/{tenant:"+uuid.UUIDRegex+"}/tenants/quotas", Handler{context, quotas, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
-	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas", Handler{context, listQuotas, true})
+	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas", Handler{context, quotas, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/tenants/{for_tenant:"+uuid.UUIDRegex+"}/quotas", Handler{context, updateQuotas, true})
 	route.Methods("PUT")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	// evacuation and restore
-	matchContent = fmt.Sprintf("application/(%s|json)", NodeV1)
+	matchContent = matchMediaType("node")
 
 	route = r.Handle("/node/{node_id:"+uuid.UUIDRegex+"}", Handler{context, changeNodeStatus, true})
 	route.Methods("PUT")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/node/{node_id:"+uuid.UUIDRegex+"}/action", Handler{context, nodeAction, true})
+	route.Methods("POST")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/node/{node_id:"+uuid.UUIDRegex+"}/evacuation", Handler{context, showNodeEvacuation, true})
+	route.Methods("GET")
+	route.MatcherFunc(matchContent)
+
+	// cncis
+	matchContent = matchMediaType("cncis")
+
+	route = r.Handle("/cncis", Handler{context, listCNCIs, true})
+	route.Methods("GET")
+	route.MatcherFunc(matchContent)
 
 	// images
-	matchContent = fmt.Sprintf("application/(%s|json)", ImagesV1)
+	matchContent = matchMediaType("images")
 
 	route = r.Handle("/{tenant}/images", Handler{context, createImage, false})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}/file", Handler{context, largeBody(uploadImage), false})
+	route.Methods("PUT")
+	route.MatcherFunc(matchContent)
+	context.timeouts.set(route, config.ImageUploadTimeout)
+
+	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}/file", Handler{context, startImageUpload, false})
+	route.Methods("POST")
+	route.MatcherFunc(matchContent)
 
-	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}/file", Handler{context, uploadImage, false})
+	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}/uploads/{upload_id:"+uuid.UUIDRegex+"}", Handler{context, largeBody(uploadImageData), false})
 	route.Methods("PUT")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+	context.timeouts.set(route, config.ImageUploadTimeout)
+
+	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}/file", Handler{context, downloadImage, false})
+	route.Methods("GET")
+	context.timeouts.set(route, -1)
 
 	route = r.Handle("/{tenant}/images", Handler{context, listImages, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}", Handler{context, getImage, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}", Handler{context, deleteImage, false})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}/action", Handler{context, imageAction, false})
+	route.Methods("POST")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}", Handler{context, updateImage, false})
+	route.Methods("PATCH")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/{tenant}/images/{image_id:"+uuid.UUIDRegex+"}", Handler{context, patchImage, false})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
 
 	route = r.Handle("/images", Handler{context, createImage, true})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}/file", Handler{context, largeBody(uploadImage), true})
+	route.Methods("PUT")
+	route.MatcherFunc(matchContent)
+	context.timeouts.set(route, config.ImageUploadTimeout)
+
+	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}/file", Handler{context, startImageUpload, true})
+	route.Methods("POST")
+	route.MatcherFunc(matchContent)
 
-	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}/file", Handler{context, uploadImage, true})
+	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}/uploads/{upload_id:"+uuid.UUIDRegex+"}", Handler{context, largeBody(uploadImageData), true})
 	route.Methods("PUT")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+	context.timeouts.set(route, config.ImageUploadTimeout)
+
+	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}/file", Handler{context, downloadImage, true})
+	route.Methods("GET")
+	context.timeouts.set(route, -1)
 
 	route = r.Handle("/images", Handler{context, listImages, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}", Handler{context, getImage, true})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}", Handler{context, deleteImage, true})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}/action", Handler{context, imageAction, true})
+	route.Methods("POST")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}", Handler{context, updateImage, true})
+	route.Methods("PATCH")
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/images/{image_id:"+uuid.UUIDRegex+"}", Handler{context, patchImage, true})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
 
 	// Volumes
-	matchContent = fmt.Sprintf("application/(%s|json)", VolumesV1)
+	matchContent = matchMediaType("volumes")
 	route = r.Handle("/{tenant}/volumes", Handler{context, createVolume, false})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant}/volumes", Handler{context, listVolumesDetail, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant}/volumes/{volume_id}", Handler{context, showVolumeDetails, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant}/volumes/{volume_id}", Handler{context, deleteVolume, false})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/{tenant}/volumes/{volume_id}", Handler{context, patchVolume, false})
+	route.Methods("PATCH")
+	route.HeadersRegexp("Content-Type", `application/merge-patch\+json`)
 
 	// Volume actions
 	route = r.Handle("/{tenant}/volumes/{volume_id}/action", Handler{context, volumeAction, false})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	// Instances
-	matchContent = fmt.Sprintf("application/(%s|json)", InstancesV1)
+	matchContent = matchMediaType("instances")
 
-	route = r.Handle("/{tenant}/instances", Handler{context, createInstance, false})
+	route = r.Handle("/{tenant}/instances", Handler{context, idempotent(createInstance), false})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant}/instances/detail", Handler{context, listInstanceDetails, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	// waiting for an instance status is bounded by the wait of the
+	// request rather than by the request timeout.
+	route = r.Handle("/{tenant}/instances/{instance_id}", Handler{context, showInstanceDetails, false})
+	route.Methods("GET")
+	route.Queries("wait", "{wait}")
+	route.MatcherFunc(matchContent)
+	context.timeouts.set(route, -1)
 
 	route = r.Handle("/{tenant}/instances/{instance_id}", Handler{context, showInstanceDetails, false})
 	route.Methods("GET")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	route = r.Handle("/{tenant}/instances/{instance_id}/ssh", Handler{context, showInstanceSSH, false})
+	route.Methods("GET")
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant}/instances/{instance_id}", Handler{context, deleteInstance, false})
 	route.Methods("DELETE")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
 
 	route = r.Handle("/{tenant}/instances/{instance_id}/action", Handler{context, instanceAction, false})
 	route.Methods("POST")
-	route.HeadersRegexp("Content-Type", matchContent)
+	route.MatcherFunc(matchContent)
+
+	// CORS preflight
+	if context.cors != nil {
+		r.MatcherFunc(isPreflight).Handler(context.cors.preflight(r)).Name(PreflightRoute)
+	}
 
 	return r
 }
@@ -16,15 +16,28 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	storage "github.com/ciao-project/ciao/ciao-storage"
+	"github.com/ciao-project/ciao/clogger"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/service"
 )
@@ -45,7 +58,15 @@ var tests = []test{
 		"",
 		"application/text",
 		http.StatusOK,
-		`[{"rel":"pools","href":"/pools","version":"x.ciao.pools.v1","minimum_version":"x.ciao.pools.v1"},{"rel":"external-ips","href":"/external-ips","version":"x.ciao.external-ips.v1","minimum_version":"x.ciao.external-ips.v1"},{"rel":"workloads","href":"/workloads","version":"x.ciao.workloads.v1","minimum_version":"x.ciao.workloads.v1"},{"rel":"tenants","href":"/tenants","version":"x.ciao.tenants.v1","minimum_version":"x.ciao.tenants.v1"},{"rel":"node","href":"/node","version":"x.ciao.node.v1","minimum_version":"x.ciao.node.v1"},{"rel":"images","href":"/images","version":"x.ciao.images.v1","minimum_version":"x.ciao.images.v1"}]`,
+		`[{"rel":"pools","href":"/pools","version":"x.ciao.pools.v1","minimum_version":"x.ciao.pools.v1"},{"rel":"external-ips","href":"/external-ips","version":"x.ciao.external-ips.v1","minimum_version":"x.ciao.external-ips.v1"},{"rel":"workloads","href":"/workloads","version":"x.ciao.workloads.v1","minimum_version":"x.ciao.workloads.v1"},{"rel":"tenants","href":"/tenants","version":"x.ciao.tenants.v2","minimum_version":"x.ciao.tenants.v1"},{"rel":"node","href":"/node","version":"x.ciao.node.v1","minimum_version":"x.ciao.node.v1"},{"rel":"cncis","href":"/cncis","version":"x.ciao.cncis.v1","minimum_version":"x.ciao.cncis.v1"},{"rel":"images","href":"/images","version":"x.ciao.images.v1","minimum_version":"x.ciao.images.v1"}]`,
+	},
+	{
+		"GET",
+		"/versions",
+		"",
+		"application/json",
+		http.StatusOK,
+		`{"versions":[{"resource":"cncis","versions":["x.ciao.cncis.v1"],"version":"x.ciao.cncis.v1","minimum_version":"x.ciao.cncis.v1"},{"resource":"external-ips","versions":["x.ciao.external-ips.v1"],"version":"x.ciao.external-ips.v1","minimum_version":"x.ciao.external-ips.v1"},{"resource":"images","versions":["x.ciao.images.v1"],"version":"x.ciao.images.v1","minimum_version":"x.ciao.images.v1"},{"resource":"instances","versions":["x.ciao.instances.v1"],"version":"x.ciao.instances.v1","minimum_version":"x.ciao.instances.v1"},{"resource":"node","versions":["x.ciao.node.v1"],"version":"x.ciao.node.v1","minimum_version":"x.ciao.node.v1"},{"resource":"pools","versions":["x.ciao.pools.v1"],"version":"x.ciao.pools.v1","minimum_version":"x.ciao.pools.v1"},{"resource":"tenants","versions":["x.ciao.tenants.v1","x.ciao.tenants.v2"],"version":"x.ciao.tenants.v2","minimum_version":"x.ciao.tenants.v1"},{"resource":"volumes","versions":["x.ciao.volumes.v1"],"version":"x.ciao.volumes.v1","minimum_version":"x.ciao.volumes.v1"},{"resource":"workloads","versions":["x.ciao.workloads.v1"],"version":"x.ciao.workloads.v1","minimum_version":"x.ciao.workloads.v1"}]}`,
 	},
 	{
 		"GET",
@@ -53,7 +74,23 @@ var tests = []test{
 		"",
 		fmt.Sprintf("application/%s", PoolsV1),
 		http.StatusOK,
-		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]},{"id":"a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10","name":"availablepool","free":5,"total_ips":6,"links":[{"rel":"self","href":"/pools/a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?available=true",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10","name":"availablepool","free":5,"total_ips":6,"links":[{"rel":"self","href":"/pools/a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?name=testpool&available=true",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusNotFound,
+		"{\"error\":{\"code\":404,\"name\":\"Not Found\",\"message\":\"Pool not found\"}}\n",
 	},
 	{
 		"GET",
@@ -63,6 +100,70 @@ var tests = []test{
 		http.StatusOK,
 		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}]}`,
 	},
+	{
+		"GET",
+		"/pools?limit=1",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"ba58f471-0735-4773-9550-188e2d012941","name":"testpool","free":0,"total_ips":0,"links":[{"rel":"self","href":"/pools/ba58f471-0735-4773-9550-188e2d012941"}]}],"more":true}`,
+	},
+	{
+		"GET",
+		"/pools?limit=1&offset=1",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10","name":"availablepool","free":5,"total_ips":6,"links":[{"rel":"self","href":"/pools/a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?offset=2",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[]}`,
+	},
+	{
+		"GET",
+		"/pools?name=testpool&name=availablepool&limit=1&offset=1",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10","name":"availablepool","free":5,"total_ips":6,"links":[{"rel":"self","href":"/pools/a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?name=availablepool&limit=1",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[{"id":"a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10","name":"availablepool","free":5,"total_ips":6,"links":[{"rel":"self","href":"/pools/a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10"}]}]}`,
+	},
+	{
+		"GET",
+		"/pools?name=availablepool&offset=1",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusOK,
+		`{"pools":[]}`,
+	},
+	{
+		"GET",
+		"/pools?limit=-1",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Invalid limit \\\"-1\\\"\"}}\n",
+	},
+	{
+		"GET",
+		"/pools?offset=x",
+		"",
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Invalid offset \\\"x\\\"\"}}\n",
+	},
 	{
 		"POST",
 		"/pools",
@@ -95,6 +196,14 @@ var tests = []test{
 		http.StatusNoContent,
 		"null",
 	},
+	{
+		"POST",
+		"/pools/ba58f471-0735-4773-9550-188e2d012941",
+		`{"subnet":"192.168.0.0/16"}`,
+		fmt.Sprintf("application/%s", PoolsV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Subnet 192.168.0.0/16 overlaps 192.168.0.0/24 in pool availablepool (a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10)\"}}\n",
+	},
 	{
 		"DELETE",
 		"/pools/ba58f471-0735-4773-9550-188e2d012941/subnets/ba58f471-0735-4773-9550-188e2d012941",
@@ -124,17 +233,89 @@ var tests = []test{
 		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
 		`{"pool_name":"apool","instance_id":"validinstanceID"}`,
 		fmt.Sprintf("application/%s", ExternalIPsV1),
-		http.StatusNoContent,
-		"null",
+		http.StatusOK,
+		`{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.2","internal_ip":"172.16.0.1","instance_id":"validinstanceID","tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"apool","links":null}`,
 	},
 	{
 		"POST",
-		"/workloads",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool","instance_id":"validinstanceID","external_ip":"192.168.0.42"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.42","internal_ip":"172.16.0.1","instance_id":"validinstanceID","tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"apool","links":null}`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool","instance_id":"validinstanceID","external_ip":"192.168.0.1"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Address already mapped\"}}\n",
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips",
+		`{"pool_name":"apool","instance_id":"validinstanceID","external_ip":"10.0.0.1"}`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusNotFound,
+		"{\"error\":{\"code\":404,\"name\":\"Not Found\",\"message\":\"Address Not Found\"}}\n",
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips/batch",
+		`[{"pool_name":"apool","instance_id":"validinstanceID"},{"pool_name":"apool","instance_id":"validinstanceID","external_ip":"192.168.0.1"},{"pool_name":"emptypool","instance_id":"validinstanceID"},{"pool_name":"apool","instance_id":"validinstanceID"}]`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusOK,
+		`[{"instance_id":"validinstanceID","pool_name":"apool","mapped_ip":{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"192.168.0.2","internal_ip":"172.16.0.1","instance_id":"validinstanceID","tenant_id":"19df9b86-eda3-489d-b75f-d38710e210cb","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"apool","links":null}},{"instance_id":"validinstanceID","pool_name":"apool","error":"Address already mapped"},{"instance_id":"validinstanceID","pool_name":"emptypool","error":"Pool has no Free IPs"},{"instance_id":"validinstanceID","pool_name":"apool","error":"Mapping not attempted"}]`,
+	},
+	{
+		"POST",
+		"/19df9b86-eda3-489d-b75f-d38710e210cb/external-ips/batch",
+		`[]`,
+		fmt.Sprintf("application/%s", ExternalIPsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Batch must contain between 1 and 64 mappings\"}}\n",
+	},
+	{
+		"POST",
+		"/workloads?validate=false",
 		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!"}`,
 		fmt.Sprintf("application/%s", WorkloadsV1),
 		http.StatusCreated,
 		`{"workload":{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","storage":null,"visibility":"public","workload_requirements":{"MemMB":0,"VCPUs":0,"NodeID":"","Hostname":"","NetworkNode":false,"Privileged":false}},"link":{"rel":"self","href":"/workloads/ba58f471-0735-4773-9550-188e2d012941"}}`,
 	},
+	{
+		"POST",
+		"/workloads",
+		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"---\n#cloud-config\nruncmd:\n  - [ touch, /etc/bootdone ]\n...\n"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusCreated,
+		`{"workload":{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"---\n#cloud-config\nruncmd:\n  - [ touch, /etc/bootdone ]\n...\n","storage":null,"visibility":"public","workload_requirements":{"MemMB":0,"VCPUs":0,"NodeID":"","Hostname":"","NetworkNode":false,"Privileged":false}},"link":{"rel":"self","href":"/workloads/ba58f471-0735-4773-9550-188e2d012941"}}`,
+	},
+	{
+		"POST",
+		"/workloads",
+		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"config is not a valid cloud-init document: yaml: unmarshal errors:\\n  line 1: cannot unmarshal !!str `this wi...` into map[string]interface {}\"}}\n",
+	},
+	{
+		"POST",
+		"/workloads",
+		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"docker","image_name":"ubuntu","config":"---\n#cloud-config\n...\n"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"fw_type must not be set for docker workloads\"}}\n",
+	},
+	{
+		"POST",
+		"/workloads",
+		`{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"ubuntu","config":"---\n#cloud-config\n...\n"}`,
+		fmt.Sprintf("application/%s", WorkloadsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"image_name must not be set for qemu workloads, use storage instead\"}}\n",
+	},
 	{
 		"DELETE",
 		"/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ed",
@@ -151,6 +332,22 @@ var tests = []test{
 		http.StatusOK,
 		`{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","storage":null,"visibility":"private","workload_requirements":{"MemMB":0,"VCPUs":0,"NodeID":"","Hostname":"","NetworkNode":false,"Privileged":false}}`,
 	},
+	{
+		"PATCH",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941",
+		`{"description":"Updated testWorkload","workload_requirements":{"VCPUs":4}}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"PATCH",
+		"/workloads/ba58f471-0735-4773-9550-188e2d012941",
+		`{"vm_type":"docker"}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Only description, visibility and workload_requirements of a workload may be changed\"}}\n",
+	},
 	{
 		"GET",
 		"/workloads",
@@ -169,592 +366,2666 @@ var tests = []test{
 	},
 	{
 		"GET",
-		"/tenants",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
 		"",
-		fmt.Sprintf("application/%s", TenantsV1),
+		fmt.Sprintf("application/%s", TenantsV2),
 		http.StatusOK,
-		`{"tenants":[{"id":"bc70dcd6-7298-4933-98a9-cded2d232d02","name":"Test Tenant","links":[{"rel":"self","href":"/tenants/bc70dcd6-7298-4933-98a9-cded2d232d02"}]}]}`,
+		`{"quotas":[{"name":"test-quota-1","value":10,"usage":3},{"name":"test-quota-2","value":-1,"usage":10,"unlimited":true},{"name":"test-limit","value":123}]}`,
 	},
 	{
 		"GET",
-		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
 		"",
-		fmt.Sprintf("application/%s", TenantsV1),
+		"application/json",
 		http.StatusOK,
-		`{"name":"Test Tenant","subnet_bits":24,"permissions":{"privileged_containers":false}}`,
+		`{"quotas":[{"name":"test-quota-1","value":10,"usage":3},{"name":"test-quota-2","value":-1,"usage":10,"unlimited":true},{"name":"test-limit","value":123}]}`,
 	},
 	{
-		"PATCH",
-		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
-		`{"name":"Updated Test Tenant","subnet_bits":4}`,
-		fmt.Sprintf("application/%s", "merge-patch+json"),
-		http.StatusNoContent,
-		"null",
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
+		"",
+		"application/x.ciao.tenants.v3",
+		http.StatusNotAcceptable,
+		"{\"error\":{\"code\":406,\"name\":\"Not Acceptable\",\"message\":\"Unsupported version of the tenants resource\",\"details\":[\"x.ciao.tenants.v1\",\"x.ciao.tenants.v2\"]}}\n",
 	},
 	{
-		"POST",
-		"/tenants",
-		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","config":{"name":"New Tenant","subnet_bits":4}}`,
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
+		`{"quotas":[{"name":"test-quota-1","value":"3"},{"name":"test-quota-2","value":"unlimited"},{"name":"test-limit","value":"1"}]}`,
 		fmt.Sprintf("application/%s", TenantsV1),
 		http.StatusCreated,
-		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","name":"New Tenant","links":[{"rel":"self","href":"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22"}]}`,
+		`{"quotas":[{"name":"test-quota-1","value":"10","usage":"3"},{"name":"test-quota-2","value":"unlimited","usage":"10"},{"name":"test-limit","value":"123"}]}`,
 	},
 	{
-		"DELETE",
-		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
-		"",
+		"PUT",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/quotas",
+		`{"quotas":[{"name":"test-quota-1","value":"2"},{"name":"test-quota-2","value":"5"}]}`,
 		fmt.Sprintf("application/%s", TenantsV1),
-		http.StatusNoContent,
-		"null",
-	}, {
-		"POST",
-		"/images",
-		`{"container_format":"bare","disk_format":"raw","name":"Ubuntu","id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","visibility":"private"}`,
-		fmt.Sprintf("application/%s", ImagesV1),
-		http.StatusCreated,
-		`{"id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","state":"created","tenant_id":"","name":"Ubuntu","create_time":"2015-11-29T22:21:42Z","size":0,"visibility":"private"}`,
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"2 quota(s) below current usage\",\"details\":[\"test-quota-1: 2 is less than current usage 3\",\"test-quota-2: 5 is less than current usage 10\"]}}\n",
 	},
 	{
-		"GET",
-		"/images",
-		"",
-		fmt.Sprintf("application/%s", ImagesV1),
-		http.StatusOK,
-		`[{"id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","state":"created","tenant_id":"","name":"Ubuntu","create_time":"2015-11-29T22:21:42Z","size":0,"visibility":"public"}]`,
+		"POST",
+		"/node/4bd9b3a4-1b59-4d0c-8d56-5c8e1c1d3e7a/action",
+		`{"evacuate":{}}`,
+		fmt.Sprintf("application/%s", NodeV1),
+		http.StatusAccepted,
+		`{"node_id":"4bd9b3a4-1b59-4d0c-8d56-5c8e1c1d3e7a","action":"evacuate","total_instances":3,"migrated_instances":1,"remaining_instances":2}`,
 	},
 	{
-		"GET",
-		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
-		"",
-		fmt.Sprintf("application/%s", ImagesV1),
-		http.StatusOK,
-		`{"id":"1bea47ed-f6a9-463b-b423-14b9cca9ad27","state":"active","tenant_id":"","name":"cirros-0.3.2-x86_64-disk","create_time":"2014-05-05T17:15:10Z","size":13167616,"visibility":"public"}`,
+		"POST",
+		"/node/0c0d9f3e-5c22-4f4b-9d55-2b8f3c2f5e01/action",
+		`{"evacuate":{}}`,
+		fmt.Sprintf("application/%s", NodeV1),
+		http.StatusNotFound,
+		"{\"error\":{\"code\":404,\"name\":\"Not Found\",\"message\":\"Node not found\"}}\n",
 	},
 	{
-		"DELETE",
-		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
-		"",
-		fmt.Sprintf("application/%s", ImagesV1),
-		http.StatusNoContent,
-		`null`,
+		"POST",
+		"/node/4bd9b3a4-1b59-4d0c-8d56-5c8e1c1d3e7a/action",
+		`{"restore":{}}`,
+		fmt.Sprintf("application/%s", NodeV1),
+		http.StatusAccepted,
+		"null",
 	},
 	{
 		"POST",
-		"/validtenantid/volumes",
-		`{"size": 10,"source_volid": null,"description":null,"name":null,"imageRef":null}`,
-		fmt.Sprintf("application/%s", VolumesV1),
-		http.StatusAccepted,
-		`{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"new volume","description":"newly created volume","internal":false}`,
+		"/node/7a2e4c1d-9b3f-4e6a-8c5d-1f2e3d4c5b6a/action",
+		`{"restore":{}}`,
+		fmt.Sprintf("application/%s", NodeV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Node has not been evacuated\"}}\n",
 	},
 	{
 		"GET",
-		"/validtenantid/volumes",
+		"/node/4bd9b3a4-1b59-4d0c-8d56-5c8e1c1d3e7a/evacuation",
 		"",
-		fmt.Sprintf("application/%s", VolumesV1),
+		fmt.Sprintf("application/%s", NodeV1),
 		http.StatusOK,
-		`[{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"my volume","description":"my volume for stuff","internal":false},{"id":"new-test-id2","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"volume 2","description":"my other volume","internal":false}]`,
+		`{"node_id":"4bd9b3a4-1b59-4d0c-8d56-5c8e1c1d3e7a","action":"evacuate","total_instances":3,"migrated_instances":1,"remaining_instances":2}`,
 	},
 	{
 		"GET",
-		"/validtenantid/volumes/validvolumeid",
+		"/tenants",
 		"",
-		fmt.Sprintf("application/%s", VolumesV1),
+		fmt.Sprintf("application/%s", TenantsV1),
 		http.StatusOK,
-		`{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"my volume","description":"my volume for stuff","internal":false}`,
+		`{"tenants":[{"id":"bc70dcd6-7298-4933-98a9-cded2d232d02","name":"Test Tenant","links":[{"rel":"self","href":"/tenants/bc70dcd6-7298-4933-98a9-cded2d232d02"}]}]}`,
 	},
 	{
-		"DELETE",
-		"/validtenantid/volumes/validvolumeid",
+		"GET",
+		"/tenants?include_deleted=true",
 		"",
-		fmt.Sprintf("application/%s", VolumesV1),
-		http.StatusAccepted,
-		"null",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"tenants":[{"id":"bc70dcd6-7298-4933-98a9-cded2d232d02","name":"Test Tenant","links":[{"rel":"self","href":"/tenants/bc70dcd6-7298-4933-98a9-cded2d232d02"}]},{"id":"5bbf4a5e-0b4c-4d47-8f40-6a5e2ef1b0a4","name":"Deleted Tenant","state":"deleting"}]}`,
 	},
 	{
 		"POST",
-		"/validtenantid/volumes/validvolumeid/action",
-		`{"attach":{"instance_uuid":"validinstanceid","mountpoint":"/dev/vdc"}}`,
-		fmt.Sprintf("application/%s", VolumesV1),
-		http.StatusAccepted,
+		"/tenants/5bbf4a5e-0b4c-4d47-8f40-6a5e2ef1b0a4/action",
+		`{"restore":{}}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNoContent,
 		"null",
 	},
 	{
 		"POST",
-		"/validtenantid/volumes/validvolumeid/action",
-		`{"detach":{}}`,
-		fmt.Sprintf("application/%s", VolumesV1),
-		http.StatusAccepted,
-		"null",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/action",
+		`{"restore":{}}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Tenant is not being deleted\"}}\n",
 	},
 	{
 		"POST",
-		"/validtenantid/instances",
-		`{"server":{"name":"new-server-test","imageRef": "http://glance.openstack.example.com/images/70a599e0-31e7-49b7-b260-868f441e862b","workload_id":"http://openstack.example.com/flavors/1","metadata":{"My Server Name":"Apache1"}}}`,
-		fmt.Sprintf("application/%s", InstancesV1),
-		http.StatusAccepted,
-		`{"server":{"id":"validServerID","name":"new-server-test","imageRef":"http://glance.openstack.example.com/images/70a599e0-31e7-49b7-b260-868f441e862b","workload_id":"http://openstack.example.com/flavors/1","max_count":0,"min_count":0,"metadata":{"My Server Name":"Apache1"}}}`,
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/action",
+		`{}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"No tenant action requested\"}}\n",
 	},
 	{
 		"GET",
-		"/validtenantid/instances/detail",
-		"",
-		fmt.Sprintf("application/%s", InstancesV1),
-		http.StatusOK,
-		`{"total_servers":1,"servers":[{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"testUUID","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0}]}`},
-	{
-		"GET",
-		"/validtenantid/instances/instanceid",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
 		"",
-		fmt.Sprintf("application/%s", InstancesV1),
+		fmt.Sprintf("application/%s", TenantsV1),
 		http.StatusOK,
-		`{"server":{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"instanceid","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0}}`,
+		`{"name":"Test Tenant","subnet_bits":24,"permissions":{"privileged_containers":false}}`,
 	},
 	{
-		"DELETE",
-		"/validtenantid/instances/instanceid",
-		"",
-		fmt.Sprintf("application/%s", InstancesV1),
+		"PATCH",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
+		`{"name":"Updated Test Tenant","subnet_bits":24}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
 		http.StatusNoContent,
 		"null",
 	},
 	{
-		"POST",
-		"/validtenantid/instances/instanceid/action",
-		`{"os-start":null}`,
-		fmt.Sprintf("application/%s", InstancesV1),
-		http.StatusAccepted,
-		"null",
-	},
-	{
-		"POST",
-		"/validtenantid/instances/instanceid/action",
-		`{"os-stop":null}`,
-		fmt.Sprintf("application/%s", InstancesV1),
+		"PATCH",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
+		`{"name":"Updated Test Tenant","subnet_bits":4}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Subnet bits 4 invalid, must be between 12 and 30\"}}\n",
+	},
+	{
+		"PATCH",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
+		`{"subnet_bits":0}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Subnet bits 0 invalid, must be between 12 and 30\"}}\n",
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","config":{"name":"New Tenant","subnet_bits":24}}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusCreated,
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","name":"New Tenant","links":[{"rel":"self","href":"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22"}]}`,
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","config":{"name":"New Tenant","subnet_bits":31}}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Subnet bits 31 invalid, must be between 12 and 30\"}}\n",
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","config":{"name":"New Tenant","subnet":"10.1.0.0/16"}}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusCreated,
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","name":"New Tenant","links":[{"rel":"self","href":"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22"}]}`,
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","config":{"name":"New Tenant","subnet":"10.1.0.0/16","subnet_bits":16}}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Only one of subnet and subnet_bits may be set\"}}\n",
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","config":{"name":"New Tenant","subnet":"10.0.0.0/12"}}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Subnet 10.0.0.0/12 overlaps subnet 10.2.0.0/16 of tenant bc70dcd6-7298-4933-98a9-cded2d232d02\"}}\n",
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","config":{"name":"New Tenant","subnet_bits":24},"quotas":[{"name":"tenant-instances-quota","value":10}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusCreated,
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","name":"New Tenant","links":[{"rel":"self","href":"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22"}]}`,
+	},
+	{
+		"POST",
+		"/tenants",
+		`{"id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","config":{"name":"New Tenant","subnet_bits":24},"quotas":[{"name":"tenant-instances-quota","value":-2}]}`,
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"1 invalid quota(s)\",\"details\":[\"tenant-instances-quota: invalid value -2\"]}}\n",
+	},
+	{
+		"DELETE",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"POST",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/network/probe",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"healthy":false,"matrix":{"0ce88c06-3e35-4c31-b9d7-de2d1e6a4d8a":{"e1f6e1b1-03ab-4a39-a9b5-bd8e3bdb4f0e":true},"e1f6e1b1-03ab-4a39-a9b5-bd8e3bdb4f0e":{"0ce88c06-3e35-4c31-b9d7-de2d1e6a4d8a":false}},"failures":[{"from":"e1f6e1b1-03ab-4a39-a9b5-bd8e3bdb4f0e","to":"0ce88c06-3e35-4c31-b9d7-de2d1e6a4d8a","error":"timeout"}]}`,
+	},
+	{
+		"GET",
+		"/tenants/093ae09b-f653-464e-9ae6-5ae28bd03a22/cnci",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusOK,
+		`{"cncis":[{"tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","ip_address":"192.168.0.110","mac_address":"02:00:c0:a8:00:6e","instance_id":"0ce88c06-3e35-4c31-b9d7-de2d1e6a4d8a","subnets":["172.16.0.0/24"],"mapped_ips":[{"mapping_id":"ba58f471-0735-4773-9550-188e2d012941","external_ip":"10.19.200.1","internal_ip":"172.16.0.2","instance_id":"","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","pool_id":"f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e","pool_name":"mypool","links":null}]}]}`,
+	},
+	{
+		"GET",
+		"/tenants/4a5a8a8e-1a43-4b8f-ac5b-f2e6f6d3cdc4/cnci",
+		"",
+		fmt.Sprintf("application/%s", TenantsV1),
+		http.StatusNotFound,
+		"{\"error\":{\"code\":404,\"name\":\"Not Found\",\"message\":\"Tenant has no CNCI\"}}\n",
+	},
+	{
+		"GET",
+		"/cncis",
+		"",
+		fmt.Sprintf("application/%s", CNCIsV1),
+		http.StatusOK,
+		`{"cncis":[{"id":"0ce88c06-3e35-4c31-b9d7-de2d1e6a4d8a","tenant_id":"093ae09b-f653-464e-9ae6-5ae28bd03a22","ip_address":"192.168.0.110","subnets":2,"tenants":1,"public_ips":1},{"id":"5b6f3d40-7c1e-4a2f-9f0b-2d8e6c1a7b3e","tenant_id":"4a5a8a8e-1a43-4b8f-ac5b-f2e6f6d3cdc4","ip_address":"192.168.0.111","subnets":1,"tenants":1,"public_ips":0}]}`,
+	},
+	{
+		"GET",
+		"/cncis?tenant_id=4a5a8a8e-1a43-4b8f-ac5b-f2e6f6d3cdc4",
+		"",
+		fmt.Sprintf("application/%s", CNCIsV1),
+		http.StatusOK,
+		`{"cncis":[{"id":"5b6f3d40-7c1e-4a2f-9f0b-2d8e6c1a7b3e","tenant_id":"4a5a8a8e-1a43-4b8f-ac5b-f2e6f6d3cdc4","ip_address":"192.168.0.111","subnets":1,"tenants":1,"public_ips":0}]}`,
+	},
+	{
+		"GET",
+		"/cncis?tenant_id=invalidtenant",
+		"",
+		fmt.Sprintf("application/%s", CNCIsV1),
+		http.StatusNotFound,
+		"{\"error\":{\"code\":404,\"name\":\"Not Found\",\"message\":\"Tenant not found\"}}\n",
+	}, {
+		"POST",
+		"/images",
+		`{"container_format":"bare","disk_format":"raw","name":"Ubuntu","id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","visibility":"private"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusCreated,
+		`{"id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","state":"created","tenant_id":"","name":"Ubuntu","create_time":"2015-11-29T22:21:42Z","size":0,"visibility":"private"}`,
+	},
+	{
+		"GET",
+		"/images",
+		"",
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusOK,
+		`[{"id":"b2173dd3-7ad6-4362-baa6-a68bce3565cb","state":"created","tenant_id":"","name":"Ubuntu","create_time":"2015-11-29T22:21:42Z","size":0,"visibility":"public"}]`,
+	},
+	{
+		"GET",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+		"",
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusOK,
+		`{"id":"1bea47ed-f6a9-463b-b423-14b9cca9ad27","state":"active","tenant_id":"","name":"cirros-0.3.2-x86_64-disk","create_time":"2014-05-05T17:15:10Z","size":13167616,"visibility":"public"}`,
+	},
+	{
+		"DELETE",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+		"",
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusNoContent,
+		`null`,
+	},
+	{
+		"POST",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/file",
+		"",
+		fmt.Sprintf("application/%s", ImagesV1),
 		http.StatusAccepted,
+		`{"upload_id":"5f4e2b7a-0c1d-4e9b-8a6f-3d2c1b0a9e8f"}`,
+	},
+	{
+		"PUT",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/uploads/5f4e2b7a-0c1d-4e9b-8a6f-3d2c1b0a9e8f",
+		"image data",
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"PUT",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/uploads/9d6f2b1e-5c3a-4e8f-a1b7-2c4d6e8f0a12",
+		"image data",
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusNotFound,
+		"{\"error\":{\"code\":404,\"name\":\"Not Found\",\"message\":\"Image upload not found\"}}\n",
+	},
+	{
+		"PATCH",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+		`{"visibility":"public"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusNoContent,
+		`null`,
+	},
+	{
+		"PATCH",
+		"/images/b2173dd3-7ad6-4362-baa6-a68bce3565cb",
+		`{"visibility":"public"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusForbidden,
+		"{\"error\":{\"code\":403,\"name\":\"Forbidden\",\"message\":\"Image update not permitted\"}}\n",
+	},
+	{
+		"POST",
+		"/images/9d6f2b1e-5c3a-4e8f-a1b7-2c4d6e8f0a12/action",
+		`{"cancel":{}}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/action",
+		`{"cancel":{}}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"No operation in progress to cancel\"}}\n",
+	},
+	{
+		"POST",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/action",
+		`{}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"No image action requested\"}}\n",
+	},
+	{
+		"PATCH",
+		"/images/9d6f2b1e-5c3a-4e8f-a1b7-2c4d6e8f0a12",
+		`{"visibility":"public"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusNotFound,
+		"{\"error\":{\"code\":404,\"name\":\"Not Found\",\"message\":\"Image not found\"}}\n",
+	},
+	{
+		"PATCH",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+		`{"visibility":"shared"}`,
+		fmt.Sprintf("application/%s", ImagesV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Invalid Request\"}}\n",
+	},
+	{
+		"PATCH",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+		`{"name":"cirros-renamed"}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
+		http.StatusNoContent,
+		`null`,
+	},
+	{
+		"PATCH",
+		"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+		`{"size":1}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Only name of an image may be changed\"}}\n",
+	},
+	{
+		"PATCH",
+		"/images/9d6f2b1e-5c3a-4e8f-a1b7-2c4d6e8f0a12",
+		`{"name":"cirros-renamed"}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
+		http.StatusNotFound,
+		"{\"error\":{\"code\":404,\"name\":\"Not Found\",\"message\":\"Image not found\"}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes",
+		`{"size": 10,"source_volid": null,"description":null,"name":null,"imageRef":null}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		`{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"new volume","description":"newly created volume","internal":false,"attachments":[]}`,
+	},
+	{
+		"POST",
+		"/validtenantid/volumes",
+		`{"size": 1001,"source_volid": null,"description":null,"name":null,"imageRef":null}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusForbidden,
+		"{\"error\":{\"code\":403,\"name\":\"Forbidden\",\"message\":\"Tenant over quota\"}}\n",
+	},
+	{
+		"GET",
+		"/validtenantid/volumes",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusOK,
+		`[{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"in-use","created":"0001-01-01T00:00:00Z","name":"my volume","description":"my volume for stuff","internal":false,"attachments":[{"instance_id":"validServerID","mountpoint":"/dev/vdc"}]},{"id":"new-test-id2","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"available","created":"0001-01-01T00:00:00Z","name":"volume 2","description":"my other volume","internal":false,"attachments":[]}]`,
+	},
+	{
+		"GET",
+		"/validtenantid/volumes/validvolumeid",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusOK,
+		`{"id":"new-test-id","bootable":false,"boot_index":0,"ephemeral":false,"local":false,"swap":false,"size":123456,"tenant_id":"test-tenant-id","state":"in-use","created":"0001-01-01T00:00:00Z","name":"my volume","description":"my volume for stuff","internal":false,"attachments":[{"instance_id":"validServerID","mountpoint":"/dev/vdc"}]}`,
+	},
+	{
+		"DELETE",
+		"/validtenantid/volumes/validvolumeid",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"DELETE",
+		"/validtenantid/volumes/validvolumeid?force=true",
+		"",
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"PATCH",
+		"/validtenantid/volumes/validvolumeid",
+		`{"name":"renamed volume","description":"my renamed volume"}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
+		http.StatusNoContent,
 		"null",
 	},
+	{
+		"PATCH",
+		"/validtenantid/volumes/validvolumeid",
+		`{"state":"available","size":2}`,
+		fmt.Sprintf("application/%s", "merge-patch+json"),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Only name and description of a volume may be changed\"}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"instance_uuid":"validinstanceid","mountpoint":"/dev/vdc"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		`{"instance_id":"validinstanceid","mountpoint":"/dev/vdc"}`,
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"instance_uuid":"validinstanceid"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		`{"instance_id":"validinstanceid","mountpoint":"/dev/vdb"}`,
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"instance_uuid":"validinstanceid","read_only":true}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		`{"instance_id":"validinstanceid","mountpoint":"/dev/vdb","read_only":true}`,
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"instance_uuid":"validinstanceid","read_only":"yes"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusBadRequest,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"instance_uuid":"validinstanceid","mountpoint":"/dev/vdd"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Mountpoint already in use\"}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"instance_uuid":"validinstanceid","mountpoint":"/etc/passwd"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Invalid mountpoint\"}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"attach":{"mountpoint":"/dev/vdc"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusBadRequest,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"detach":{}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"detach":{"instance_uuid":"validinstanceid","mountpoint":"/dev/vdc"}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"cancel":{}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/availablevolumeid/action",
+		`{"cancel":{}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"No operation in progress to cancel\"}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/validvolumeid/action",
+		`{"detach":{"mountpoint":1}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusBadRequest,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/volumes/multiattachedvolumeid/action",
+		`{"detach":{}}`,
+		fmt.Sprintf("application/%s", VolumesV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Volume has several matching attachments\"}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/instances",
+		`{"server":{"name":"new-server-test","imageRef": "http://glance.openstack.example.com/images/70a599e0-31e7-49b7-b260-868f441e862b","workload_id":"http://openstack.example.com/flavors/1","metadata":{"My Server Name":"Apache1"}}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		`{"server":{"id":"validServerID","name":"new-server-test","imageRef":"http://glance.openstack.example.com/images/70a599e0-31e7-49b7-b260-868f441e862b","workload_id":"http://openstack.example.com/flavors/1","max_count":0,"min_count":0,"metadata":{"My Server Name":"Apache1"}}}`,
+	},
+	{
+		"POST",
+		"/validtenantid/instances",
+		`{"server":{"name":"new-server-test","workload_id":"validworkloadid","block_device_mapping":[{"volume_id":"availablevolumeid","mountpoint":"/dev/vdc"}]}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		`{"server":{"id":"validServerID","name":"new-server-test","imageRef":"","workload_id":"validworkloadid","max_count":0,"min_count":0,"block_device_mapping":[{"volume_id":"availablevolumeid","mountpoint":"/dev/vdc"}]}}`,
+	},
+	{
+		"POST",
+		"/validtenantid/instances",
+		`{"server":{"name":"new-server-test","workload_id":"validworkloadid","block_device_mapping":[{"volume_id":"attachedvolumeid"}]}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Volume already attached\"}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/instances",
+		`{"server":{"name":"new-server-test","workload_id":"validworkloadid","scheduler_hints":{"different_host":["validinstanceid"],"target_node":"validnodeid"}}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Scheduler hints cannot be satisfied\",\"details\":[\"Instance validinstanceid is on node validnodeid\"]}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/instances",
+		`{"server":{"name":"new-server-test","workload_id":"validworkloadid","networks":[{"mac_addr":"02:aa:bb:cc:dd:ee"}]}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"MAC address already in use\"}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/instances?dry_run=true",
+		`{"server":{"name":"new-server-test","workload_id":"validworkloadid"}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"admitted":true}`,
+	},
+	{
+		"POST",
+		"/validtenantid/instances?dry_run=true",
+		`{"server":{"name":"new-server-test","workload_id":"invalidworkloadid"}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"admitted":false,"reasons":["Workload not found"]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/detail",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"total_servers":1,"servers":[{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"testUUID","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0}]}`},
+	{
+		"GET",
+		"/validtenantid/instances/detail?workload_id=testWorkloadUUID",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"total_servers":1,"servers":[{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"testUUID","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0}]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/detail?workload_id=unknownWorkloadUUID",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"total_servers":0,"servers":[]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/detail?workload_id=testWorkloadUUID&status=active",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"total_servers":1,"servers":[{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"testUUID","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0}]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/detail?workload_id=testWorkloadUUID&status=exited",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"total_servers":0,"servers":[]}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"server":{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"instanceid","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0}}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid?wait=30s&status=active",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"server":{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"instanceid","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0}}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid?wait=30s&status=exited",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"server":{"private_addresses":[{"addr":"192.169.0.1","mac_addr":"00:02:00:01:02:03"}],"created":"0001-01-01T00:00:00Z","workload_id":"testWorkloadUUID","node_id":"nodeUUID","id":"instanceid","name":"","volumes":null,"status":"active","tenant_id":"validtenantid","ssh_ip":"","ssh_port":0},"timed_out":true}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid?wait=1h&status=active",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"wait must be a duration of at most 5m0s and status must be set\"}}\n",
+	},
+	{
+		"GET",
+		"/validtenantid/instances/instanceid/ssh",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusOK,
+		`{"ssh_ip":"10.19.200.1","ssh_port":22}`,
+	},
+	{
+		"GET",
+		"/validtenantid/instances/noexternalip/ssh",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusNotFound,
+		"{\"error\":{\"code\":404,\"name\":\"Not Found\",\"message\":\"Instance has no external IP\"}}\n",
+	},
+	{
+		"DELETE",
+		"/validtenantid/instances/instanceid",
+		"",
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusNoContent,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"os-start":null}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"os-stop":null}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusAccepted,
+		"null",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"create_workload":{"name":"golden"}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusCreated,
+		`{"workload":{"id":"ba58f471-0735-4773-9550-188e2d012941","description":"golden","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"this will totally work!","storage":null,"visibility":"private","workload_requirements":{"MemMB":0,"VCPUs":0,"NodeID":"","Hostname":"","NetworkNode":false,"Privileged":false}},"link":{"rel":"self","href":"/validtenantid/workloads/ba58f471-0735-4773-9550-188e2d012941"}}`,
+	},
+	{
+		"POST",
+		"/validtenantid/instances/instanceid/action",
+		`{"create_workload":{}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusBadRequest,
+		"{\"error\":{\"code\":400,\"name\":\"Bad Request\",\"message\":\"Requested name doesn't match requirements\"}}\n",
+	},
+	{
+		"POST",
+		"/validtenantid/instances/pendinginstanceid/action",
+		`{"create_workload":{"name":"golden"}}`,
+		fmt.Sprintf("application/%s", InstancesV1),
+		http.StatusConflict,
+		"{\"error\":{\"code\":409,\"name\":\"Conflict\",\"message\":\"Instance not stopped\"}}\n",
+	},
+}
+
+type testCiaoService struct{}
+
+func (ts testCiaoService) ListPools() ([]types.Pool, error) {
+	self := types.Link{
+		Rel:  "self",
+		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+	}
+
+	resp := types.Pool{
+		ID:       "ba58f471-0735-4773-9550-188e2d012941",
+		Name:     "testpool",
+		Free:     0,
+		TotalIPs: 0,
+		Subnets:  []types.ExternalSubnet{},
+		IPs:      []types.ExternalIP{},
+		Links:    []types.Link{self},
+	}
+
+	available := types.Pool{
+		ID:       "a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10",
+		Name:     "availablepool",
+		Free:     5,
+		TotalIPs: 6,
+		Subnets: []types.ExternalSubnet{
+			{
+				ID:   "6f1a5a0e-2d4b-4a8c-8f77-0b5d2a1c9e33",
+				CIDR: "192.168.0.0/29",
+				Used: 1,
+				Free: 5,
+			},
+		},
+		IPs: []types.ExternalIP{},
+		Links: []types.Link{
+			{
+				Rel:  "self",
+				Href: "/pools/a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10",
+			},
+		},
+	}
+
+	return []types.Pool{resp, available}, nil
+}
+
+func (ts testCiaoService) AddPool(name string, subnet *string, ips []string) (types.Pool, error) {
+	return types.Pool{}, nil
+}
+
+func (ts testCiaoService) ShowPool(id string) (types.Pool, error) {
+	self := types.Link{
+		Rel:  "self",
+		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+	}
+
+	resp := types.Pool{
+		ID:       "ba58f471-0735-4773-9550-188e2d012941",
+		Name:     "testpool",
+		Free:     0,
+		TotalIPs: 0,
+		Subnets:  []types.ExternalSubnet{},
+		IPs:      []types.ExternalIP{},
+		Links:    []types.Link{self},
+	}
+
+	return resp, nil
+}
+
+func (ts testCiaoService) DeletePool(id string) error {
+	return nil
+}
+
+func (ts testCiaoService) AddAddress(poolID string, subnet *string, ips []string) error {
+	if subnet != nil && *subnet == "192.168.0.0/16" {
+		return &SubnetConflictError{
+			Subnet:   *subnet,
+			Conflict: "192.168.0.0/24",
+			PoolID:   "a3d4ef8b-6e4c-4b0e-9b8e-7c3b8c1a2f10",
+			PoolName: "availablepool",
+		}
+	}
+	return nil
+}
+
+func (ts testCiaoService) RemoveAddress(poolID string, subnet *string, extIP *string) error {
+	return nil
+}
+
+func (ts testCiaoService) ListMappedAddresses(tenant *string) []types.MappedIP {
+	var ref string
+
+	m := types.MappedIP{
+		ID:         "ba58f471-0735-4773-9550-188e2d012941",
+		ExternalIP: "192.168.0.1",
+		InternalIP: "172.16.0.1",
+		TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
+		PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+		PoolName:   "mypool",
+	}
+
+	if tenant != nil {
+		ref = fmt.Sprintf("%s/external-ips/%s", *tenant, m.ID)
+	} else {
+		ref = fmt.Sprintf("/external-ips/%s", m.ID)
+	}
+
+	link := types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+
+	m.Links = []types.Link{link}
+
+	if tenant == nil {
+		ref := fmt.Sprintf("/pools/%s", m.PoolID)
+
+		link := types.Link{
+			Rel:  "pool",
+			Href: ref,
+		}
+
+		m.Links = append(m.Links, link)
+	}
+
+	return []types.MappedIP{m}
+}
+
+func (ts testCiaoService) MapAddress(tenantID string, name *string, instanceID string, externalIP *string) (types.MappedIP, error) {
+	m := types.MappedIP{
+		ID:         "ba58f471-0735-4773-9550-188e2d012941",
+		ExternalIP: "192.168.0.2",
+		InternalIP: "172.16.0.1",
+		InstanceID: instanceID,
+		TenantID:   tenantID,
+		PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+		PoolName:   *name,
+	}
+
+	if *name == "emptypool" {
+		return types.MappedIP{}, types.ErrPoolEmpty
+	}
+
+	if externalIP != nil {
+		switch *externalIP {
+		case "192.168.0.1":
+			return types.MappedIP{}, types.ErrAddressInUse
+		case "10.0.0.1":
+			return types.MappedIP{}, types.ErrAddressNotFound
+		}
+		m.ExternalIP = *externalIP
+	}
+
+	return m, nil
+}
+
+func (ts testCiaoService) UnMapAddress(string) error {
+	return nil
+}
+
+func (ts testCiaoService) CreateWorkload(req types.Workload) (types.Workload, error) {
+	req.ID = "ba58f471-0735-4773-9550-188e2d012941"
+	return req, nil
+}
+
+func (ts testCiaoService) CreateWorkloadFromInstance(tenant string, instance string, name string) (types.Workload, error) {
+	if instance == "pendinginstanceid" {
+		return types.Workload{}, ErrInstanceNotStopped
+	}
+
+	return types.Workload{
+		ID:          "ba58f471-0735-4773-9550-188e2d012941",
+		TenantID:    tenant,
+		Description: name,
+		FWType:      payloads.Legacy,
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Visibility:  types.Private,
+	}, nil
+}
+
+func (ts testCiaoService) DeleteWorkload(tenant string, workload string) error {
+	return nil
+}
+
+func (ts testCiaoService) ShowWorkload(tenant string, ID string) (types.Workload, error) {
+	return types.Workload{
+		ID:          "ba58f471-0735-4773-9550-188e2d012941",
+		TenantID:    tenant,
+		Description: "testWorkload",
+		FWType:      payloads.Legacy,
+		VMType:      payloads.QEMU,
+		Config:      "this will totally work!",
+		Visibility:  types.Private,
+	}, nil
+}
+
+func (ts testCiaoService) PatchWorkload(tenant string, ID string, patch []byte) error {
+	var fields map[string]interface{}
+
+	err := json.Unmarshal(patch, &fields)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{"id", "fw_type", "vm_type"} {
+		if _, ok := fields[f]; ok {
+			return types.ErrWorkloadImmutable
+		}
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) ListWorkloads(tenant string) ([]types.Workload, error) {
+	return []types.Workload{
+		{
+			ID:          "ba58f471-0735-4773-9550-188e2d012941",
+			TenantID:    tenant,
+			Description: "testWorkload",
+			FWType:      payloads.Legacy,
+			VMType:      payloads.QEMU,
+			Config:      "this will totally work!",
+			Visibility:  types.Private,
+		},
+	}, nil
+}
+
+func (ts testCiaoService) ListQuotas(tenantID string) []types.QuotaDetails {
+	return []types.QuotaDetails{
+		{Name: "test-quota-1", Value: 10, Usage: 3},
+		{Name: "test-quota-2", Value: -1, Usage: 10},
+		{Name: "test-limit", Value: 123, Usage: 0},
+	}
+}
+
+func (ts testCiaoService) EvacuateNode(nodeID string) error {
+	if nodeID == "0c0d9f3e-5c22-4f4b-9d55-2b8f3c2f5e01" {
+		return types.ErrNodeNotFound
+	}
+	return nil
+}
+
+func (ts testCiaoService) RestoreNode(nodeID string) error {
+	if nodeID != "4bd9b3a4-1b59-4d0c-8d56-5c8e1c1d3e7a" {
+		return types.ErrNodeNotEvacuated
+	}
+	return nil
+}
+
+func (ts testCiaoService) NodeEvacuation(nodeID string) (types.NodeAction, error) {
+	return types.NodeAction{
+		NodeID:             nodeID,
+		Action:             "evacuate",
+		TotalInstances:     3,
+		MigratedInstances:  1,
+		RemainingInstances: 2,
+	}, nil
+}
+
+func (ts testCiaoService) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
+	return nil
+}
+
+const testDeletedTenantID = "5bbf4a5e-0b4c-4d47-8f40-6a5e2ef1b0a4"
+
+func (ts testCiaoService) ListTenants(includeDeleted bool) ([]types.TenantSummary, error) {
+	summary := types.TenantSummary{
+		ID:   "bc70dcd6-7298-4933-98a9-cded2d232d02",
+		Name: "Test Tenant",
+	}
+
+	ref := fmt.Sprintf("/tenants/%s", summary.ID)
+
+	link := types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+
+	summary.Links = append(summary.Links, link)
+
+	if !includeDeleted {
+		return []types.TenantSummary{summary}, nil
+	}
+
+	deleted := types.TenantSummary{
+		ID:    testDeletedTenantID,
+		Name:  "Deleted Tenant",
+		State: types.TenantDeleting,
+	}
+
+	return []types.TenantSummary{summary, deleted}, nil
+}
+
+func (ts testCiaoService) ShowTenant(ID string) (types.TenantConfig, error) {
+	config := types.TenantConfig{
+		Name:       "Test Tenant",
+		SubnetBits: 24,
+	}
+
+	return config, nil
+}
+
+func (ts testCiaoService) PatchTenant(ID string, patch []byte) error {
+	var config types.TenantConfig
+
+	err := json.Unmarshal(patch, &config)
+	if err != nil {
+		return err
+	}
+
+	if strings.Contains(string(patch), "subnet_bits") {
+		return config.ValidateSubnetBits()
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) CreateTenant(ID string, config types.TenantConfig, quotas []types.QuotaDetails) (types.TenantSummary, error) {
+	if config.Subnet != "" {
+		if config.SubnetBits != 0 {
+			return types.TenantSummary{}, types.ErrSubnetAndBits
+		}
+
+		subnet, err := config.ValidateSubnet()
+		if err != nil {
+			return types.TenantSummary{}, err
+		}
+
+		if subnet.Contains(net.ParseIP("10.2.0.0")) {
+			return types.TenantSummary{}, &types.TenantSubnetConflictError{
+				Subnet:   config.Subnet,
+				Conflict: "10.2.0.0/16",
+				TenantID: "bc70dcd6-7298-4933-98a9-cded2d232d02",
+			}
+		}
+	} else if config.SubnetBits != 0 {
+		if err := config.ValidateSubnetBits(); err != nil {
+			return types.TenantSummary{}, err
+		}
+	}
+
+	var reasons []string
+	for _, qd := range quotas {
+		if qd.Value < -1 {
+			reasons = append(reasons, fmt.Sprintf("%s: invalid value %d", qd.Name, qd.Value))
+		}
+	}
+	if len(reasons) > 0 {
+		return types.TenantSummary{}, &types.InvalidQuotasError{Reasons: reasons}
+	}
+
+	summary := types.TenantSummary{
+		ID:   ID,
+		Name: config.Name,
+	}
+
+	ref := fmt.Sprintf("/tenants/%s", summary.ID)
+	link := types.Link{
+		Rel:  "self",
+		Href: ref,
+	}
+	summary.Links = append(summary.Links, link)
+
+	return summary, nil
+}
+
+func (ts testCiaoService) DeleteTenant(string) error {
+	return nil
+}
+
+func (ts testCiaoService) RestoreTenant(ID string) error {
+	if ID != testDeletedTenantID {
+		return types.ErrTenantNotDeleting
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) ProbeTenantNetwork(string) (types.CNCIProbeResponse, error) {
+	cnci1 := "0ce88c06-3e35-4c31-b9d7-de2d1e6a4d8a"
+	cnci2 := "e1f6e1b1-03ab-4a39-a9b5-bd8e3bdb4f0e"
+
+	return types.CNCIProbeResponse{
+		Healthy: false,
+		Matrix: map[string]map[string]bool{
+			cnci1: {cnci2: true},
+			cnci2: {cnci1: false},
+		},
+		Failures: []types.CNCIProbeFailure{
+			{From: cnci2, To: cnci1, Error: "timeout"},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) ListCNCIs(tenantID string) ([]types.CNCISummary, error) {
+	cncis := []types.CNCISummary{
+		{
+			ID:        "0ce88c06-3e35-4c31-b9d7-de2d1e6a4d8a",
+			TenantID:  "093ae09b-f653-464e-9ae6-5ae28bd03a22",
+			IPAddress: "192.168.0.110",
+			Subnets:   2,
+			Tenants:   1,
+			PublicIPs: 1,
+		},
+		{
+			ID:        "5b6f3d40-7c1e-4a2f-9f0b-2d8e6c1a7b3e",
+			TenantID:  "4a5a8a8e-1a43-4b8f-ac5b-f2e6f6d3cdc4",
+			IPAddress: "192.168.0.111",
+			Subnets:   1,
+			Tenants:   1,
+			PublicIPs: 0,
+		},
+	}
+
+	if tenantID == "" {
+		return cncis, nil
+	}
+
+	var filtered []types.CNCISummary
+	for _, cnci := range cncis {
+		if cnci.TenantID == tenantID {
+			filtered = append(filtered, cnci)
+		}
+	}
+
+	if len(filtered) == 0 {
+		return nil, types.ErrTenantNotFound
+	}
+
+	return filtered, nil
+}
+
+func (ts testCiaoService) ShowTenantCNCI(ID string) (types.TenantCNCIResponse, error) {
+	if ID != "093ae09b-f653-464e-9ae6-5ae28bd03a22" {
+		return types.TenantCNCIResponse{}, types.ErrNoCNCI
+	}
+
+	return types.TenantCNCIResponse{
+		CNCIs: []types.TenantCNCI{
+			{
+				TenantID:   ID,
+				IPAddress:  "192.168.0.110",
+				MACAddress: "02:00:c0:a8:00:6e",
+				InstanceID: "0ce88c06-3e35-4c31-b9d7-de2d1e6a4d8a",
+				Subnets:    []string{"172.16.0.0/24"},
+				MappedIPs: []types.MappedIP{
+					{
+						ID:         "ba58f471-0735-4773-9550-188e2d012941",
+						ExternalIP: "10.19.200.1",
+						InternalIP: "172.16.0.2",
+						TenantID:   ID,
+						PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
+						PoolName:   "mypool",
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) CreateImage(tenantID string, req CreateImageRequest) (types.Image, error) {
+	name := "Ubuntu"
+	createdAt, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+
+	return types.Image{
+		State:      types.Created,
+		CreateTime: createdAt,
+		Visibility: types.Private,
+		ID:         "b2173dd3-7ad6-4362-baa6-a68bce3565cb",
+		Name:       name,
+	}, nil
+}
+
+func (ts testCiaoService) ListImages(tenantID string) ([]types.Image, error) {
+	name := "Ubuntu"
+	createdAt, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+
+	image := types.Image{
+		State:      types.Created,
+		CreateTime: createdAt,
+		ID:         "b2173dd3-7ad6-4362-baa6-a68bce3565cb",
+		Name:       name,
+		Visibility: types.Public,
+	}
+
+	var images []types.Image
+	images = append(images, image)
+
+	return images, nil
+}
+
+func (ts testCiaoService) GetImage(tenantID, ID string) (types.Image, error) {
+	imageID := "1bea47ed-f6a9-463b-b423-14b9cca9ad27"
+	name := "cirros-0.3.2-x86_64-disk"
+	createdAt, _ := time.Parse(time.RFC3339, "2014-05-05T17:15:10Z")
+	var size uint64 = 13167616
+
+	return types.Image{
+		State:      types.Active,
+		CreateTime: createdAt,
+		Visibility: types.Public,
+		ID:         imageID,
+		Name:       name,
+		Size:       size,
+	}, nil
+}
+
+func testVerifyChecksum(body io.Reader, checksum string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return err
+	}
+
+	if checksum != "" && checksum != hex.EncodeToString(h.Sum(nil)) {
+		return ErrImageChecksum
+	}
+
+	return nil
+}
+
+func (ts testCiaoService) UploadImage(ctx context.Context, tenantID, ID string, body io.Reader, checksum string) error {
+	return testVerifyChecksum(body, checksum)
+}
+
+const testImageUploadID = "5f4e2b7a-0c1d-4e9b-8a6f-3d2c1b0a9e8f"
+
+func (ts testCiaoService) StartImageUpload(tenantID, ID string) (string, error) {
+	return testImageUploadID, nil
+}
+
+func (ts testCiaoService) UploadImageData(ctx context.Context, tenantID, ID, uploadID string, body io.Reader, checksum string) error {
+	if uploadID != testImageUploadID {
+		return ErrNoImageUpload
+	}
+	return testVerifyChecksum(body, checksum)
+}
+
+const testImageContent = "0123456789"
+
+func (ts testCiaoService) DownloadImage(tenantID, ID string) (io.ReadSeeker, int64, error) {
+	switch ID {
+	case "1bea47ed-f6a9-463b-b423-14b9cca9ad27":
+		return strings.NewReader(testImageContent), int64(len(testImageContent)), nil
+	case "b2173dd3-7ad6-4362-baa6-a68bce3565cb":
+		return nil, 0, ErrImageNotActive
+	}
+	return nil, 0, ErrNoImage
+}
+
+func (ts testCiaoService) DeleteImage(string, string) error {
+	return nil
+}
+
+func (ts testCiaoService) CancelImage(tenantID, ID string) error {
+	if ID == "1bea47ed-f6a9-463b-b423-14b9cca9ad27" {
+		return types.ErrNotCancellable
+	}
+	return nil
+}
+
+func (ts testCiaoService) UpdateImage(tenantID, ID string, visibility types.Visibility) error {
+	switch ID {
+	case "1bea47ed-f6a9-463b-b423-14b9cca9ad27":
+		return nil
+	case "b2173dd3-7ad6-4362-baa6-a68bce3565cb":
+		return ErrImageNotPermitted
+	}
+	return ErrNoImage
+}
+
+func (ts testCiaoService) PatchImage(tenantID, ID string, patch []byte) error {
+	var fields map[string]interface{}
+
+	err := json.Unmarshal(patch, &fields)
+	if err != nil {
+		return err
+	}
+
+	for f := range fields {
+		if f != "name" {
+			return types.ErrImageImmutable
+		}
+	}
+
+	switch ID {
+	case "1bea47ed-f6a9-463b-b423-14b9cca9ad27":
+		return nil
+	case "b2173dd3-7ad6-4362-baa6-a68bce3565cb":
+		return ErrImageNotPermitted
+	}
+	return ErrNoImage
+}
+
+func (ts testCiaoService) PatchVolume(tenant string, volume string, patch []byte) error {
+	var fields map[string]interface{}
+
+	err := json.Unmarshal(patch, &fields)
+	if err != nil {
+		return err
+	}
+
+	for f := range fields {
+		if f != "name" && f != "description" {
+			return types.ErrVolumeImmutable
+		}
+	}
+	return nil
+}
+
+func (ts testCiaoService) CancelVolume(tenant string, volume string) error {
+	if volume == "availablevolumeid" {
+		return types.ErrNotCancellable
+	}
+	return nil
+}
+
+func (ts testCiaoService) ShowVolumeDetails(tenant string, volume string) (types.Volume, error) {
+	return types.Volume{
+		BlockDevice: storage.BlockDevice{
+			ID:   "new-test-id",
+			Size: 123456,
+		},
+		State:       types.InUse,
+		Name:        "my volume",
+		Description: "my volume for stuff",
+		TenantID:    "test-tenant-id",
+		Attachments: []types.VolumeAttachment{
+			{InstanceID: "validServerID", Mountpoint: "/dev/vdc"},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) CreateVolume(ctx context.Context, tenant string, req RequestedVolume) (types.Volume, error) {
+	if req.Size > 1000 {
+		return types.Volume{}, ErrQuota
+	}
+
+	return types.Volume{
+		BlockDevice: storage.BlockDevice{
+			ID:   "new-test-id",
+			Size: 123456,
+		},
+		State:       types.Available,
+		Name:        "new volume",
+		Description: "newly created volume",
+		TenantID:    "test-tenant-id",
+		Attachments: []types.VolumeAttachment{},
+	}, nil
+}
+
+func (ts testCiaoService) DeleteVolume(tenant string, volume string) error {
+	return nil
+}
+
+func (ts testCiaoService) ForceDeleteVolume(tenant string, volume string) error {
+	return nil
+}
+
+func (ts testCiaoService) AttachVolume(tenant string, volume string, instance string, mountpoint string, readOnly bool) (string, error) {
+	switch mountpoint {
+	case "":
+		return "/dev/vdb", nil
+	case "/dev/vdc", "vdc":
+		return "/dev/vdc", nil
+	case "/dev/vdd":
+		return "", ErrMountpointInUse
+	}
+	return "", ErrBadMountpoint
+}
+
+func (ts testCiaoService) DetachVolume(tenant string, volume string, detach VolumeDetach) error {
+	if volume == "multiattachedvolumeid" && detach == (VolumeDetach{}) {
+		return ErrVolumeAttachmentAmbiguous
+	}
+	return nil
+}
+
+func (ts testCiaoService) ListVolumesDetail(tenant string) ([]types.Volume, error) {
+	return []types.Volume{
+		{
+			BlockDevice: storage.BlockDevice{
+				ID:   "new-test-id",
+				Size: 123456,
+			},
+			State:       types.InUse,
+			Name:        "my volume",
+			Description: "my volume for stuff",
+			TenantID:    "test-tenant-id",
+			Attachments: []types.VolumeAttachment{
+				{InstanceID: "validServerID", Mountpoint: "/dev/vdc"},
+			},
+		},
+		{
+			BlockDevice: storage.BlockDevice{
+				ID:   "new-test-id2",
+				Size: 123456,
+			},
+			State:       types.Available,
+			Name:        "volume 2",
+			Description: "my other volume",
+			TenantID:    "test-tenant-id",
+			Attachments: []types.VolumeAttachment{},
+		},
+	}, nil
+}
+
+func (ts testCiaoService) CreateServer(tenant string, req CreateServerRequest) (interface{}, error) {
+	for _, m := range req.Server.BlockDeviceMapping {
+		if m.VolumeID == "attachedvolumeid" {
+			return nil, ErrVolumeAttached
+		}
+	}
+
+	for _, n := range req.Server.Networks {
+		if n.MacAddr == "02:aa:bb:cc:dd:ee" {
+			return nil, ErrMACAddressInUse
+		}
+	}
+
+	if hints := req.Server.SchedulerHints; hints != nil {
+		for _, id := range hints.DifferentHost {
+			if hints.TargetNode != "" {
+				return nil, &SchedulerHintsError{
+					Reasons: []string{fmt.Sprintf("Instance %s is on node %s", id, hints.TargetNode)},
+				}
+			}
+		}
+	}
+
+	req.Server.ID = "validServerID"
+	return req, nil
+}
+
+func (ts testCiaoService) CheckServer(tenant string, req CreateServerRequest) (CreateServerCheckResponse, error) {
+	if req.Server.WorkloadID != "validworkloadid" {
+		return CreateServerCheckResponse{Reasons: []string{types.ErrWorkloadNotFound.Error()}}, nil
+	}
+	return CreateServerCheckResponse{Admitted: true}, nil
+}
+
+func (ts testCiaoService) ListServersDetail(tenant string) ([]ServerDetails, error) {
+	var servers []ServerDetails
+
+	server := ServerDetails{
+		NodeID:     "nodeUUID",
+		ID:         "testUUID",
+		TenantID:   tenant,
+		WorkloadID: "testWorkloadUUID",
+		Status:     "active",
+		PrivateAddresses: []PrivateAddresses{
+			{
+				Addr:    "192.169.0.1",
+				MacAddr: "00:02:00:01:02:03",
+			},
+		},
+	}
+
+	servers = append(servers, server)
+
+	return servers, nil
+}
+
+func (ts testCiaoService) ShowServerDetails(tenant string, server string) (Server, error) {
+	s := ServerDetails{
+		NodeID:     "nodeUUID",
+		ID:         server,
+		TenantID:   tenant,
+		WorkloadID: "testWorkloadUUID",
+		Status:     "active",
+		PrivateAddresses: []PrivateAddresses{
+			{
+				Addr:    "192.169.0.1",
+				MacAddr: "00:02:00:01:02:03",
+			},
+		},
+	}
+
+	return Server{Server: s}, nil
+}
+
+func (ts testCiaoService) SubscribeTenantEvents(ID string) (<-chan types.ResourceEvent, func(), error) {
+	switch ID {
+	case "093ae09b-f653-464e-9ae6-5ae28bd03a22":
+	case "d2fe2b41-ba3a-4b4d-b5a4-f4cbd8c3f0b4":
+		return nil, nil, types.ErrTooManyStreams
+	default:
+		return nil, nil, types.ErrTenantNotFound
+	}
+
+	events := make(chan types.ResourceEvent, 2)
+	events <- types.ResourceEvent{Type: types.InstanceEvent, ID: "validServerID", State: "active"}
+	events <- types.ResourceEvent{Type: types.VolumeEvent, ID: "validVolumeID", State: types.DeletedState}
+	close(events)
+
+	return events, func() {}, nil
+}
+
+func (ts testCiaoService) WaitServerStatus(ctx context.Context, tenant string, server string, status string, timeout time.Duration) (Server, error) {
+	s, err := ts.ShowServerDetails(tenant, server)
+	if err != nil {
+		return s, err
+	}
+
+	s.TimedOut = s.Server.Status != status
+
+	return s, nil
+}
+
+func (ts testCiaoService) ShowServerSSH(tenant string, server string) (SSHAccess, error) {
+	if server == "noexternalip" {
+		return SSHAccess{}, ErrNoExternalIP
+	}
+
+	return SSHAccess{SSHIP: "10.19.200.1", SSHPort: 22}, nil
+}
+
+func (ts testCiaoService) DeleteServer(tenant string, server string) error {
+	return nil
+}
+
+func (ts testCiaoService) StartServer(tenant string, server string) error {
+	return nil
+}
+
+func (ts testCiaoService) StopServer(tenant string, server string) error {
+	return nil
+}
+
+func TestResponse(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	for i, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.request, bytes.NewBuffer([]byte(tt.requestBody)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+
+		rr := httptest.NewRecorder()
+		req.Header.Set("Content-Type", tt.media)
+
+		mux.ServeHTTP(rr, req)
+
+		status := rr.Code
+		if status != tt.expectedStatus {
+			t.Errorf("test %d: got %v, expected %v", i, status, tt.expectedStatus)
+		}
+
+		if rr.Body.String() != tt.expectedResponse {
+			t.Errorf("test %d: %s: failed\ngot: %v\nexp: %v", i, tt.request, rr.Body.String(), tt.expectedResponse)
+		}
+	}
+}
+
+// testLogger counts the messages logged by the API.
+type testLogger struct {
+	clogger.CiaoNullLogger
+	warnings int
+}
+
+func (l *testLogger) Warningf(format string, v ...interface{}) {
+	l.warnings++
+}
+
+func TestQuietResponse(t *testing.T) {
+	var ts testCiaoService
+	var logger testLogger
+
+	mux := Routes(Config{URL: "", CiaoService: ts, Logger: &logger}, nil)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		output <- string(b)
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.request, strings.NewReader(tt.requestBody))
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", tt.media)
+
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	os.Stdout = stdout
+	_ = w.Close()
+
+	if out := <-output; out != "" {
+		t.Errorf("Unexpected output: %q", out)
+	}
+
+	if logger.warnings == 0 {
+		t.Error("Errors not logged to the configured logger")
+	}
+}
+
+func TestForceDeleteVolumeUnprivileged(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	req, err := http.NewRequest("DELETE", "/validtenantid/volumes/validvolumeid?force=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(service.SetPrivilege(req.Context(), false))
+
+	rr := httptest.NewRecorder()
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", VolumesV1))
+
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestImagesConditionalGet(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	for _, tt := range []struct {
+		url            string
+		lastModified   string
+		since          string
+		expectedStatus int
+	}{
+		{"/images", "Sun, 29 Nov 2015 22:21:42 GMT", "", http.StatusOK},
+		{"/images", "Sun, 29 Nov 2015 22:21:42 GMT", "Sun, 29 Nov 2015 22:21:42 GMT", http.StatusNotModified},
+		{"/images", "Sun, 29 Nov 2015 22:21:42 GMT", "Mon, 30 Nov 2015 00:00:00 GMT", http.StatusNotModified},
+		{"/images", "Sun, 29 Nov 2015 22:21:42 GMT", "Sat, 28 Nov 2015 00:00:00 GMT", http.StatusOK},
+		{"/images", "Sun, 29 Nov 2015 22:21:42 GMT", "not a date", http.StatusOK},
+		{"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27", "Mon, 05 May 2014 17:15:10 GMT", "Mon, 05 May 2014 17:15:10 GMT", http.StatusNotModified},
+		{"/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27", "Mon, 05 May 2014 17:15:10 GMT", "Mon, 05 May 2014 17:15:09 GMT", http.StatusOK},
+	} {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ImagesV1))
+		if tt.since != "" {
+			req.Header.Set("If-Modified-Since", tt.since)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s since %q: got %v, expected %v", tt.url, tt.since, rr.Code, tt.expectedStatus)
+		}
+
+		if lm := rr.Header().Get("Last-Modified"); lm != tt.lastModified {
+			t.Errorf("%s: got Last-Modified %q, expected %q", tt.url, lm, tt.lastModified)
+		}
+
+		if tt.expectedStatus == http.StatusNotModified && rr.Body.Len() != 0 {
+			t.Errorf("%s: unexpected body %q", tt.url, rr.Body.String())
+		}
+	}
+}
+
+func TestMapExternalIPBatchTooLarge(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	pool := "apool"
+	batch := make([]types.MapIPRequest, MaxMapIPBatch+1)
+	for i := range batch {
+		batch[i] = types.MapIPRequest{
+			PoolName:   &pool,
+			InstanceID: "validinstanceID",
+		}
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/external-ips/batch", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req = req.WithContext(service.SetPrivilege(req.Context(), true))
+
+	rr := httptest.NewRecorder()
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ExternalIPsV1))
+
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUploadImageChecksum(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	data := "image data"
+	sum := sha256.Sum256([]byte(data))
+	valid := hex.EncodeToString(sum[:])
+	invalid := strings.Repeat("0", len(valid))
+
+	file := "/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/file"
+	upload := "/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/uploads/" + testImageUploadID
+
+	for _, tt := range []struct {
+		url            string
+		checksum       string
+		expectedStatus int
+	}{
+		{file, "", http.StatusNoContent},
+		{file, valid, http.StatusNoContent},
+		{file, invalid, http.StatusBadRequest},
+		{upload, valid, http.StatusAccepted},
+		{upload, invalid, http.StatusBadRequest},
+	} {
+		req, err := http.NewRequest("PUT", tt.url, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", ImagesV1))
+		if tt.checksum != "" {
+			req.Header.Set(ImageChecksumHeader, tt.checksum)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s %q: got %v, expected %v", tt.url, tt.checksum, rr.Code, tt.expectedStatus)
+		}
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	var ts testCiaoService
+
+	config := `---\n#cloud-config\nruncmd:\n  - [ touch, /etc/bootdone ]\n...\n`
+	workload := func(padding int) string {
+		return `{"id":"","description":"testWorkload","fw_type":"legacy","vm_type":"qemu","image_name":"","config":"` +
+			config + strings.Repeat("#", padding) + `"}`
+	}
+	image := strings.Repeat("x", 2048)
+
+	for _, tt := range []struct {
+		maxImageSize   int64
+		method         string
+		url            string
+		body           string
+		media          string
+		expectedStatus int
+	}{
+		{0, "POST", "/workloads", workload(0), WorkloadsV1, http.StatusCreated},
+		{0, "POST", "/workloads", workload(2048), WorkloadsV1, http.StatusRequestEntityTooLarge},
+		{0, "PUT", "/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/file", image, ImagesV1, http.StatusNoContent},
+		{4096, "PUT", "/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/file", image, ImagesV1, http.StatusNoContent},
+		{1024, "PUT", "/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/file", image, ImagesV1, http.StatusRequestEntityTooLarge},
+		{1024, "PUT", "/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27/uploads/" + testImageUploadID, image, ImagesV1, http.StatusRequestEntityTooLarge},
+	} {
+		mux := Routes(Config{URL: "", CiaoService: ts, MaxBodySize: 1024, MaxImageSize: tt.maxImageSize}, nil)
+
+		req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", tt.media))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Fatalf("%s %s (%d bytes): got %v, expected %v", tt.method, tt.url, len(tt.body), rr.Code, tt.expectedStatus)
+		}
+
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			continue
+		}
+
+		expected := "{\"error\":{\"code\":413,\"name\":\"Request Entity Too Large\",\"message\":\"Request body too large\"}}\n"
+		if rr.Body.String() != expected {
+			t.Errorf("%s %s: got %q, expected %q", tt.method, tt.url, rr.Body.String(), expected)
+		}
+	}
 }
 
-type testCiaoService struct{}
+func TestDownloadImage(t *testing.T) {
+	var ts testCiaoService
 
-func (ts testCiaoService) ListPools() ([]types.Pool, error) {
-	self := types.Link{
-		Rel:  "self",
-		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
-	}
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	for _, tt := range []struct {
+		image           string
+		rng             string
+		expectedStatus  int
+		expectedContent string
+	}{
+		{"1bea47ed-f6a9-463b-b423-14b9cca9ad27", "", http.StatusOK, testImageContent},
+		{"1bea47ed-f6a9-463b-b423-14b9cca9ad27", "bytes=2-5", http.StatusPartialContent, "2345"},
+		{"1bea47ed-f6a9-463b-b423-14b9cca9ad27", "bytes=7-", http.StatusPartialContent, "789"},
+		{"b2173dd3-7ad6-4362-baa6-a68bce3565cb", "", http.StatusConflict, ""},
+		{"5f4e2b7a-0c1d-4e9b-8a6f-3d2c1b0a9e8f", "", http.StatusNotFound, ""},
+	} {
+		req, err := http.NewRequest("GET", "/images/"+tt.image+"/file", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	resp := types.Pool{
-		ID:       "ba58f471-0735-4773-9550-188e2d012941",
-		Name:     "testpool",
-		Free:     0,
-		TotalIPs: 0,
-		Subnets:  []types.ExternalSubnet{},
-		IPs:      []types.ExternalIP{},
-		Links:    []types.Link{self},
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Accept", "application/octet-stream")
+		if tt.rng != "" {
+			req.Header.Set("Range", tt.rng)
+		}
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s %s: got %v, expected %v", tt.image, tt.rng, rr.Code, tt.expectedStatus)
+			continue
+		}
+
+		if tt.expectedContent == "" {
+			continue
+		}
+
+		if rr.Body.String() != tt.expectedContent {
+			t.Errorf("%s %s: got %q, expected %q", tt.image, tt.rng, rr.Body.String(), tt.expectedContent)
+		}
+
+		length := strconv.Itoa(len(tt.expectedContent))
+		if rr.Header().Get("Content-Length") != length {
+			t.Errorf("%s %s: got Content-Length %s, expected %s", tt.image, tt.rng,
+				rr.Header().Get("Content-Length"), length)
+		}
 	}
+}
 
-	return []types.Pool{resp}, nil
+// summaryTestService extends the mock service with instances and images of
+// several kinds so that their aggregation can be checked.
+type summaryTestService struct {
+	testCiaoService
 }
 
-func (ts testCiaoService) AddPool(name string, subnet *string, ips []string) (types.Pool, error) {
-	return types.Pool{}, nil
+func (ts summaryTestService) ListServersDetail(tenant string) ([]ServerDetails, error) {
+	return []ServerDetails{
+		{ID: "server1", TenantID: tenant, WorkloadID: "small", Status: payloads.ComputeStatusRunning},
+		{ID: "server2", TenantID: tenant, WorkloadID: "large", Status: payloads.ComputeStatusRunning},
+		{ID: "server3", TenantID: tenant, WorkloadID: "small", Status: payloads.ComputeStatusStopped},
+	}, nil
 }
 
-func (ts testCiaoService) ShowPool(id string) (types.Pool, error) {
-	fmt.Println("ShowPool")
-	self := types.Link{
-		Rel:  "self",
-		Href: "/pools/ba58f471-0735-4773-9550-188e2d012941",
+func (ts summaryTestService) ShowWorkload(tenant string, ID string) (types.Workload, error) {
+	wl := types.Workload{ID: ID, TenantID: tenant}
+
+	switch ID {
+	case "small":
+		wl.Requirements = payloads.WorkloadRequirements{VCPUs: 2, MemMB: 512}
+	case "large":
+		wl.Requirements = payloads.WorkloadRequirements{VCPUs: 4, MemMB: 1024}
+	default:
+		return types.Workload{}, types.ErrWorkloadNotFound
 	}
 
-	resp := types.Pool{
-		ID:       "ba58f471-0735-4773-9550-188e2d012941",
-		Name:     "testpool",
-		Free:     0,
-		TotalIPs: 0,
-		Subnets:  []types.ExternalSubnet{},
-		IPs:      []types.ExternalIP{},
-		Links:    []types.Link{self},
+	return wl, nil
+}
+
+func (ts summaryTestService) ListImages(tenant string) ([]types.Image, error) {
+	return []types.Image{
+		{ID: "owned", TenantID: tenant, Size: 100, Visibility: types.Private},
+		{ID: "public", TenantID: "admin", Size: 1000, Visibility: types.Public},
+	}, nil
+}
+
+func TestTenantSummary(t *testing.T) {
+	var ts summaryTestService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	tenantID := "093ae09b-f653-464e-9ae6-5ae28bd03a22"
+	expected := types.TenantResourceSummary{
+		TenantID:         tenantID,
+		Instances:        3,
+		RunningInstances: 2,
+		VCPUs:            6,
+		MemMB:            1536,
+		Volumes:          2,
+		VolumeGB:         2 * 123456,
+		Images:           1,
+		ImageBytes:       100,
+		MappedIPs:        1,
 	}
 
-	return resp, nil
+	for _, url := range []string{
+		"/tenants/" + tenantID + "/summary",
+		"/" + tenantID + "/tenants/summary",
+	} {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", TenantsV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: got %v, expected %v", url, rr.Code, http.StatusOK)
+		}
+
+		var summary types.TenantResourceSummary
+		err = json.Unmarshal(rr.Body.Bytes(), &summary)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if summary != expected {
+			t.Errorf("%s: got %+v, expected %+v", url, summary, expected)
+		}
+	}
 }
 
-func (ts testCiaoService) DeletePool(id string) error {
-	return nil
+// notFoundTestService extends the mock service with lookups which fail so
+// that the error responses can be checked.
+type notFoundTestService struct {
+	testCiaoService
 }
 
-func (ts testCiaoService) AddAddress(poolID string, subnet *string, ips []string) error {
-	return nil
+func (ts notFoundTestService) GetImage(tenantID, ID string) (types.Image, error) {
+	return types.Image{}, ErrNoImage
 }
 
-func (ts testCiaoService) RemoveAddress(poolID string, subnet *string, extIP *string) error {
-	return nil
+func (ts notFoundTestService) ShowVolumeDetails(tenant string, volume string) (types.Volume, error) {
+	return types.Volume{}, ErrVolumeNotFound
 }
 
-func (ts testCiaoService) ListMappedAddresses(tenant *string) []types.MappedIP {
-	var ref string
+func TestErrorResponse(t *testing.T) {
+	var ts notFoundTestService
 
-	m := types.MappedIP{
-		ID:         "ba58f471-0735-4773-9550-188e2d012941",
-		ExternalIP: "192.168.0.1",
-		InternalIP: "172.16.0.1",
-		TenantID:   "8a497c68-a88a-4c1c-be56-12a4883208d3",
-		PoolID:     "f384ffd8-e7bd-40c2-8552-2efbe7e3ad6e",
-		PoolName:   "mypool",
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	for _, tt := range []struct {
+		url      string
+		media    string
+		expected types.APIErrorResponse
+	}{
+		{
+			"/test-tenant-id/images/1bea47ed-f6a9-463b-b423-14b9cca9ad27",
+			ImagesV1,
+			types.APIErrorResponse{
+				Error: types.APIError{Code: 404, Name: "Not Found", Message: "Image not found"},
+			},
+		},
+		{
+			"/test-tenant-id/volumes/missing-volume-id",
+			VolumesV1,
+			types.APIErrorResponse{
+				Error: types.APIError{Code: 404, Name: "Not Found", Message: "Volume not found"},
+			},
+		},
+	} {
+		req, err := http.NewRequest("GET", tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", tt.media))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("%s: got %v, expected %v", tt.url, rr.Code, http.StatusNotFound)
+		}
+
+		if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got Content-Type %q, expected application/json", tt.url, ct)
+		}
+
+		var body types.APIErrorResponse
+		err = json.Unmarshal(rr.Body.Bytes(), &body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.url, err)
+		}
+
+		if !reflect.DeepEqual(body, tt.expected) {
+			t.Errorf("%s: got %+v, expected %+v", tt.url, body, tt.expected)
+		}
 	}
+}
 
-	if tenant != nil {
-		ref = fmt.Sprintf("%s/external-ips/%s", *tenant, m.ID)
-	} else {
-		ref = fmt.Sprintf("/external-ips/%s", m.ID)
+func TestNegotiateAccept(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	for _, tt := range []struct {
+		accept         string
+		expectedStatus int
+	}{
+		{"application/json", http.StatusOK},
+		{"text/html, application/x.ciao.pools.v1;q=0.9", http.StatusOK},
+		{"application/x.ciao.pools.v2", http.StatusNotAcceptable},
+		{"text/html", http.StatusNotFound},
+	} {
+		req, err := http.NewRequest("GET", "/pools", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Accept", tt.accept)
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatus {
+			t.Errorf("%s: got %v, expected %v", tt.accept, rr.Code, tt.expectedStatus)
+		}
 	}
+}
 
-	link := types.Link{
-		Rel:  "self",
-		Href: ref,
+// Tests that each version of a resource is served by the handler
+// registered for it or, failing that, for the closest older version.
+func TestVersioned(t *testing.T) {
+	saved := mediaTypes["tenants"]
+	defer func() {
+		mediaTypes["tenants"] = saved
+	}()
+	mediaTypes["tenants"] = []string{TenantsV1, TenantsV2, "x.ciao.tenants.v3"}
+
+	handler := func(version string) func(*Context, http.ResponseWriter, *http.Request) (Response, error) {
+		return func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+			return Response{http.StatusOK, version}, nil
+		}
 	}
 
-	m.Links = []types.Link{link}
+	h := versioned("tenants", versionHandlers{
+		TenantsV1:           handler(TenantsV1),
+		"x.ciao.tenants.v3": handler("x.ciao.tenants.v3"),
+	})
+
+	for _, tt := range []struct {
+		media    string
+		expected string
+	}{
+		{"application/json", "x.ciao.tenants.v3"},
+		{"application/" + TenantsV1, TenantsV1},
+		{"application/" + TenantsV2, TenantsV1},
+		{"application/x.ciao.tenants.v3", "x.ciao.tenants.v3"},
+	} {
+		req, err := http.NewRequest("GET", "/tenants", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", tt.media)
 
-	if tenant == nil {
-		ref := fmt.Sprintf("/pools/%s", m.PoolID)
+		resp, err := h(nil, httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.media, err)
+			continue
+		}
 
-		link := types.Link{
-			Rel:  "pool",
-			Href: ref,
+		if resp.response != tt.expected {
+			t.Errorf("%s: served by %v, expected %s", tt.media, resp.response, tt.expected)
 		}
+	}
 
-		m.Links = append(m.Links, link)
+	req, err := http.NewRequest("GET", "/tenants", nil)
+	if err != nil {
+		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", "application/x.ciao.tenants.v4")
 
-	return []types.MappedIP{m}
+	resp, err := h(nil, httptest.NewRecorder(), req)
+	if err == nil || resp.status != http.StatusNotAcceptable {
+		t.Errorf("expected unsupported version to be rejected, got %v %v", resp.status, err)
+	}
 }
 
-func (ts testCiaoService) MapAddress(tenantID string, name *string, instanceID string) error {
-	return nil
-}
+func TestGzipResponse(t *testing.T) {
+	for _, tt := range []struct {
+		size           int
+		acceptEncoding string
+		compressed     bool
+	}{
+		{gzipMinSize, "gzip, deflate", true},
+		{gzipMinSize, "", false},
+		{gzipMinSize, "gzip;q=0", false},
+		{10, "gzip", false},
+	} {
+		body := strings.Repeat("a", tt.size)
+		h := Handler{&Context{}, func(*Context, http.ResponseWriter, *http.Request) (Response, error) {
+			return Response{http.StatusOK, body}, nil
+		}, false}
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-func (ts testCiaoService) UnMapAddress(string) error {
-	return nil
-}
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
 
-func (ts testCiaoService) CreateWorkload(req types.Workload) (types.Workload, error) {
-	req.ID = "ba58f471-0735-4773-9550-188e2d012941"
-	return req, nil
-}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		var r io.Reader = rr.Body
+		encoding := rr.Header().Get("Content-Encoding")
+		if tt.compressed {
+			if encoding != "gzip" {
+				t.Fatalf("%d %q: expected gzip encoding, got %q", tt.size, tt.acceptEncoding, encoding)
+			}
+
+			r, err = gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		} else if encoding != "" {
+			t.Fatalf("%d %q: unexpected encoding %q", tt.size, tt.acceptEncoding, encoding)
+		}
 
-func (ts testCiaoService) DeleteWorkload(tenant string, workload string) error {
-	return nil
-}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-func (ts testCiaoService) ShowWorkload(tenant string, ID string) (types.Workload, error) {
-	return types.Workload{
-		ID:          "ba58f471-0735-4773-9550-188e2d012941",
-		TenantID:    tenant,
-		Description: "testWorkload",
-		FWType:      payloads.Legacy,
-		VMType:      payloads.QEMU,
-		Config:      "this will totally work!",
-		Visibility:  types.Private,
-	}, nil
+		if string(b) != `"`+body+`"` {
+			t.Fatalf("%d %q: unexpected body", tt.size, tt.acceptEncoding)
+		}
+	}
 }
 
-func (ts testCiaoService) ListWorkloads(tenant string) ([]types.Workload, error) {
-	return []types.Workload{
-		{
-			ID:          "ba58f471-0735-4773-9550-188e2d012941",
-			TenantID:    tenant,
-			Description: "testWorkload",
-			FWType:      payloads.Legacy,
-			VMType:      payloads.QEMU,
-			Config:      "this will totally work!",
-			Visibility:  types.Private,
-		},
-	}, nil
-}
+func TestRateLimit(t *testing.T) {
+	var ts testCiaoService
 
-func (ts testCiaoService) ListQuotas(tenantID string) []types.QuotaDetails {
-	return []types.QuotaDetails{
-		{Name: "test-quota-1", Value: 10, Usage: 3},
-		{Name: "test-quota-2", Value: -1, Usage: 10},
-		{Name: "test-limit", Value: 123, Usage: 0},
+	mux := Routes(Config{URL: "", CiaoService: ts, RateLimit: 1, RateBurst: 3, UnlimitedPrivileged: true}, nil)
+
+	send := func(tenant string, privileged bool) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/"+tenant+"/volumes", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), privileged))
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", VolumesV1))
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
 	}
-}
 
-func (ts testCiaoService) EvacuateNode(nodeID string) error {
-	return nil
-}
+	for i := 0; i < 3; i++ {
+		rr := send("burstytenant", false)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got %v, expected %v", i, rr.Code, http.StatusOK)
+		}
+	}
 
-func (ts testCiaoService) RestoreNode(nodeID string) error {
-	return nil
+	rr := send("burstytenant", false)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusTooManyRequests)
+	}
+
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Unexpected Retry-After: %q", rr.Header().Get("Retry-After"))
+	}
+
+	// other tenants are not affected
+	rr = send("quiettenant", false)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	// privileged callers are not limited
+	for i := 0; i < 5; i++ {
+		rr := send("burstytenant", true)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("privileged request %d: got %v, expected %v", i, rr.Code, http.StatusOK)
+		}
+	}
 }
 
-func (ts testCiaoService) UpdateQuotas(tenantID string, qds []types.QuotaDetails) error {
-	return nil
+func TestRateLimitEviction(t *testing.T) {
+	l := newRateLimiter(10, 5)
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow(fmt.Sprintf("tenant%d", i), now); !ok {
+			t.Fatalf("tenant%d: request not allowed", i)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.allow("busytenant", now); !ok {
+			t.Fatalf("request %d not allowed", i)
+		}
+	}
+
+	// the buckets are kept until they have refilled
+	now = now.Add(100 * time.Millisecond)
+	if ok, _ := l.allow("busytenant", now); !ok {
+		t.Fatal("request not allowed after a token was added")
+	}
+	if len(l.buckets) != 101 {
+		t.Fatalf("expected 101 buckets, got %d", len(l.buckets))
+	}
+
+	// the idle tenants are forgotten once their buckets are full
+	now = now.Add(time.Second)
+	if ok, _ := l.allow("busytenant", now); !ok {
+		t.Fatal("request not allowed after the bucket refilled")
+	}
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected 1 bucket, got %d", len(l.buckets))
+	}
 }
 
-func (ts testCiaoService) ListTenants() ([]types.TenantSummary, error) {
-	summary := types.TenantSummary{
-		ID:   "bc70dcd6-7298-4933-98a9-cded2d232d02",
-		Name: "Test Tenant",
+func TestIdempotencyKey(t *testing.T) {
+	var ts testCiaoService
+
+	calls := 0
+	create := func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		calls++
+		if r.URL.Query().Get("fail") == "true" {
+			return Response{http.StatusInternalServerError, nil}, errors.New("Create failed")
+		}
+		return Response{http.StatusAccepted, calls}, nil
 	}
 
-	ref := fmt.Sprintf("/tenants/%s", summary.ID)
+	context := &Context{
+		Service:     ts,
+		idempotency: newIdempotencyCache(0),
+	}
+	h := Handler{context, idempotent(create), false}
 
-	link := types.Link{
-		Rel:  "self",
-		Href: ref,
+	send := func(path string, key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, bytes.NewBuffer([]byte("{}")))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
 	}
 
-	summary.Links = append(summary.Links, link)
+	for _, tt := range []struct {
+		path     string
+		key      string
+		status   int
+		response string
+		calls    int
+	}{
+		{"/tenant1/instances", "key1", http.StatusAccepted, "1", 1},
+		{"/tenant1/instances", "key1", http.StatusAccepted, "1", 1},
+		{"/tenant1/instances", "key2", http.StatusAccepted, "2", 2},
+		{"/tenant2/instances", "key1", http.StatusAccepted, "3", 3},
+		{"/tenant1/instances", "", http.StatusAccepted, "4", 4},
+		{"/tenant1/instances", "", http.StatusAccepted, "5", 5},
+		{"/tenant1/instances?fail=true", "key3", http.StatusInternalServerError, "", 6},
+		{"/tenant1/instances?fail=true", "key3", http.StatusInternalServerError, "", 7},
+	} {
+		rr := send(tt.path, tt.key)
+		if rr.Code != tt.status {
+			t.Errorf("%s %q: got %v, expected %v", tt.path, tt.key, rr.Code, tt.status)
+		}
+
+		if tt.response != "" && rr.Body.String() != tt.response {
+			t.Errorf("%s %q: got response %s, expected %s", tt.path, tt.key, rr.Body.String(), tt.response)
+		}
 
-	return []types.TenantSummary{summary}, nil
+		if calls != tt.calls {
+			t.Errorf("%s %q: handler called %d times, expected %d", tt.path, tt.key, calls, tt.calls)
+		}
+	}
 }
 
-func (ts testCiaoService) ShowTenant(ID string) (types.TenantConfig, error) {
-	config := types.TenantConfig{
-		Name:       "Test Tenant",
-		SubnetBits: 24,
+func TestIdempotencyExpiry(t *testing.T) {
+	cache := newIdempotencyCache(time.Minute)
+
+	calls := 0
+	create := func() (Response, error) {
+		calls++
+		return Response{http.StatusAccepted, calls}, nil
 	}
 
-	return config, nil
-}
+	now := time.Now()
 
-func (ts testCiaoService) PatchTenant(string, []byte) error {
-	return nil
-}
+	resp, _ := cache.do("key", now, create)
+	if resp.response != 1 {
+		t.Fatalf("got response %v, expected 1", resp.response)
+	}
 
-func (ts testCiaoService) CreateTenant(ID string, config types.TenantConfig) (types.TenantSummary, error) {
-	summary := types.TenantSummary{
-		ID:   ID,
-		Name: config.Name,
+	resp, _ = cache.do("key", now.Add(30*time.Second), create)
+	if resp.response != 1 {
+		t.Fatalf("got response %v before expiry, expected 1", resp.response)
 	}
 
-	ref := fmt.Sprintf("/tenants/%s", summary.ID)
-	link := types.Link{
-		Rel:  "self",
-		Href: ref,
+	resp, _ = cache.do("key", now.Add(2*time.Minute), create)
+	if resp.response != 2 {
+		t.Fatalf("got response %v after expiry, expected 2", resp.response)
 	}
-	summary.Links = append(summary.Links, link)
 
-	return summary, nil
+	if newIdempotencyCache(-1) != nil {
+		t.Fatal("Negative TTL should disable idempotency keys")
+	}
 }
 
-func (ts testCiaoService) DeleteTenant(string) error {
-	return nil
+func TestStreamTenantEvents(t *testing.T) {
+	var ts testCiaoService
+
+	mux := Routes(Config{URL: "", CiaoService: ts}, nil)
+
+	for _, tt := range []struct {
+		tenant   string
+		status   int
+		response string
+	}{
+		{
+			"093ae09b-f653-464e-9ae6-5ae28bd03a22",
+			http.StatusOK,
+			"event: instance\ndata: {\"type\":\"instance\",\"id\":\"validServerID\",\"state\":\"active\"}\n\n" +
+				"event: volume\ndata: {\"type\":\"volume\",\"id\":\"validVolumeID\",\"state\":\"deleted\"}\n\n",
+		},
+		{
+			"d2fe2b41-ba3a-4b4d-b5a4-f4cbd8c3f0b4",
+			http.StatusTooManyRequests,
+			"{\"error\":{\"code\":429,\"name\":\"Too Many Requests\",\"message\":\"Too many event streams\"}}\n",
+		},
+	} {
+		req, err := http.NewRequest("GET", "/tenants/"+tt.tenant+"/stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+		req.Header.Set("Accept", "text/event-stream")
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("%s: got %v, expected %v", tt.tenant, rr.Code, tt.status)
+		}
+
+		if rr.Body.String() != tt.response {
+			t.Errorf("%s: got %q, expected %q", tt.tenant, rr.Body.String(), tt.response)
+		}
+
+		if tt.status == http.StatusOK && rr.Header().Get("Content-Type") != "text/event-stream" {
+			t.Errorf("%s: unexpected content type %s", tt.tenant, rr.Header().Get("Content-Type"))
+		}
+	}
 }
 
-func (ts testCiaoService) CreateImage(tenantID string, req CreateImageRequest) (types.Image, error) {
-	name := "Ubuntu"
-	createdAt, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+func TestRoutes(t *testing.T) {
+	var ts testCiaoService
+	config := Config{URL: "", CiaoService: ts}
 
-	return types.Image{
-		State:      types.Created,
-		CreateTime: createdAt,
-		Visibility: types.Private,
-		ID:         "b2173dd3-7ad6-4362-baa6-a68bce3565cb",
-		Name:       name,
-	}, nil
+	r := Routes(config, nil)
+	if r == nil {
+		t.Fatalf("No routes returned")
+	}
 }
 
-func (ts testCiaoService) ListImages(tenantID string) ([]types.Image, error) {
-	name := "Ubuntu"
-	createdAt, _ := time.Parse(time.RFC3339, "2015-11-29T22:21:42Z")
+func TestCORSPreflight(t *testing.T) {
+	var ts testCiaoService
 
-	image := types.Image{
-		State:      types.Created,
-		CreateTime: createdAt,
-		ID:         "b2173dd3-7ad6-4362-baa6-a68bce3565cb",
-		Name:       name,
-		Visibility: types.Public,
+	mux := Routes(Config{URL: "", CiaoService: ts, CORSOrigins: []string{"https://ui.example.com"}}, nil)
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("OPTIONS", "/workloads/76f4fa99-e533-4cbd-ab36-f6c0f51292ba", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "DELETE")
+		req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
 	}
 
-	var images []types.Image
-	images = append(images, image)
+	rr := preflight("https://ui.example.com")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusNoContent)
+	}
 
-	return images, nil
-}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://ui.example.com",
+		"Access-Control-Allow-Methods":     "GET, PATCH, DELETE",
+		"Access-Control-Allow-Headers":     "Content-Type",
+		"Access-Control-Allow-Credentials": "",
+	}
+	for k, v := range expected {
+		if rr.Header().Get(k) != v {
+			t.Errorf("%s: got %q, expected %q", k, rr.Header().Get(k), v)
+		}
+	}
 
-func (ts testCiaoService) GetImage(tenantID, ID string) (types.Image, error) {
-	imageID := "1bea47ed-f6a9-463b-b423-14b9cca9ad27"
-	name := "cirros-0.3.2-x86_64-disk"
-	createdAt, _ := time.Parse(time.RFC3339, "2014-05-05T17:15:10Z")
-	var size uint64 = 13167616
+	rr = preflight("https://evil.example.com")
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusForbidden)
+	}
 
-	return types.Image{
-		State:      types.Active,
-		CreateTime: createdAt,
-		Visibility: types.Public,
-		ID:         imageID,
-		Name:       name,
-		Size:       size,
-	}, nil
+	if rr.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Unexpected Access-Control-Allow-Origin: %q", rr.Header().Get("Access-Control-Allow-Origin"))
+	}
 }
 
-func (ts testCiaoService) UploadImage(string, string, io.Reader) error {
-	return nil
-}
+func TestCORSCredentials(t *testing.T) {
+	var ts testCiaoService
 
-func (ts testCiaoService) DeleteImage(string, string) error {
-	return nil
-}
+	mux := Routes(Config{URL: "", CiaoService: ts, CORSOrigins: []string{"*"}, CORSAllowCredentials: true}, nil)
 
-func (ts testCiaoService) ShowVolumeDetails(tenant string, volume string) (types.Volume, error) {
-	return types.Volume{
-		BlockDevice: storage.BlockDevice{
-			ID:   "new-test-id",
-			Size: 123456,
-		},
-		State:       types.Available,
-		Name:        "my volume",
-		Description: "my volume for stuff",
-		TenantID:    "test-tenant-id",
-	}, nil
-}
+	req, err := http.NewRequest("GET", "/workloads", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func (ts testCiaoService) CreateVolume(tenant string, req RequestedVolume) (types.Volume, error) {
-	return types.Volume{
-		BlockDevice: storage.BlockDevice{
-			ID:   "new-test-id",
-			Size: 123456,
-		},
-		State:       types.Available,
-		Name:        "new volume",
-		Description: "newly created volume",
-		TenantID:    "test-tenant-id",
-	}, nil
-}
+	req = req.WithContext(service.SetPrivilege(req.Context(), true))
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", WorkloadsV1))
+	req.Header.Set("Origin", "https://ui.example.com")
 
-func (ts testCiaoService) DeleteVolume(tenant string, volume string) error {
-	return nil
-}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
 
-func (ts testCiaoService) AttachVolume(tenant string, volume string, instance string, mountpoint string) error {
-	return nil
-}
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusOK)
+	}
 
-func (ts testCiaoService) DetachVolume(tenant string, volume string, attachment string) error {
-	return nil
+	if rr.Header().Get("Access-Control-Allow-Origin") != "https://ui.example.com" {
+		t.Fatalf("Unexpected Access-Control-Allow-Origin: %q", rr.Header().Get("Access-Control-Allow-Origin"))
+	}
+
+	if rr.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Fatalf("Unexpected Access-Control-Allow-Credentials: %q", rr.Header().Get("Access-Control-Allow-Credentials"))
+	}
 }
 
-func (ts testCiaoService) ListVolumesDetail(tenant string) ([]types.Volume, error) {
-	return []types.Volume{
-		{
-			BlockDevice: storage.BlockDevice{
-				ID:   "new-test-id",
-				Size: 123456,
-			},
-			State:       types.Available,
-			Name:        "my volume",
-			Description: "my volume for stuff",
-			TenantID:    "test-tenant-id",
-		},
-		{
-			BlockDevice: storage.BlockDevice{
-				ID:   "new-test-id2",
-				Size: 123456,
-			},
-			State:       types.Available,
-			Name:        "volume 2",
-			Description: "my other volume",
-			TenantID:    "test-tenant-id",
-		},
-	}, nil
+// slowTestService extends the mock service with a volume creation which
+// only completes once its context is cancelled.
+type slowTestService struct {
+	testCiaoService
+	cancelled chan error
 }
 
-func (ts testCiaoService) CreateServer(tenant string, req CreateServerRequest) (interface{}, error) {
-	req.Server.ID = "validServerID"
-	return req, nil
+func (ts slowTestService) CreateVolume(ctx context.Context, tenant string, req RequestedVolume) (types.Volume, error) {
+	<-ctx.Done()
+	ts.cancelled <- ctx.Err()
+	return types.Volume{}, ctx.Err()
 }
 
-func (ts testCiaoService) ListServersDetail(tenant string) ([]ServerDetails, error) {
-	var servers []ServerDetails
+func TestRequestTimeout(t *testing.T) {
+	ts := slowTestService{cancelled: make(chan error, 1)}
 
-	server := ServerDetails{
-		NodeID:     "nodeUUID",
-		ID:         "testUUID",
-		TenantID:   tenant,
-		WorkloadID: "testWorkloadUUID",
-		Status:     "active",
-		PrivateAddresses: []PrivateAddresses{
-			{
-				Addr:    "192.169.0.1",
-				MacAddr: "00:02:00:01:02:03",
-			},
-		},
+	mux := Routes(Config{URL: "", CiaoService: ts, RequestTimeout: 50 * time.Millisecond}, nil)
+
+	body := `{"size": 10,"source_volid": null,"description":null,"name":null,"imageRef":null}`
+	req, err := http.NewRequest("POST", "/validtenantid/volumes", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	servers = append(servers, server)
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", VolumesV1))
 
-	return servers, nil
-}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
 
-func (ts testCiaoService) ShowServerDetails(tenant string, server string) (Server, error) {
-	s := ServerDetails{
-		NodeID:     "nodeUUID",
-		ID:         server,
-		TenantID:   tenant,
-		WorkloadID: "testWorkloadUUID",
-		Status:     "active",
-		PrivateAddresses: []PrivateAddresses{
-			{
-				Addr:    "192.169.0.1",
-				MacAddr: "00:02:00:01:02:03",
-			},
-		},
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusServiceUnavailable)
 	}
 
-	return Server{Server: s}, nil
-}
+	expected := "{\"error\":{\"code\":503,\"name\":\"Service Unavailable\",\"message\":\"Request timed out\"}}\n"
+	if rr.Body.String() != expected {
+		t.Errorf("got %q, expected %q", rr.Body.String(), expected)
+	}
 
-func (ts testCiaoService) DeleteServer(tenant string, server string) error {
-	return nil
+	select {
+	case err := <-ts.cancelled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Unexpected service error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Service call not cancelled")
+	}
 }
 
-func (ts testCiaoService) StartServer(tenant string, server string) error {
-	return nil
-}
+func (ts slowTestService) WaitServerStatus(ctx context.Context, tenant string, server string, status string, timeout time.Duration) (Server, error) {
+	select {
+	case <-ctx.Done():
+		ts.cancelled <- ctx.Err()
+		return Server{}, ctx.Err()
+	case <-time.After(timeout):
+	}
 
-func (ts testCiaoService) StopServer(tenant string, server string) error {
-	return nil
+	s, err := ts.ShowServerDetails(tenant, server)
+	s.TimedOut = true
+	return s, err
 }
 
-func TestResponse(t *testing.T) {
-	var ts testCiaoService
+func TestRequestTimeoutInstanceWait(t *testing.T) {
+	ts := slowTestService{cancelled: make(chan error, 1)}
 
-	mux := Routes(Config{"", ts}, nil)
+	mux := Routes(Config{URL: "", CiaoService: ts, RequestTimeout: 50 * time.Millisecond}, nil)
 
-	for i, tt := range tests {
-		req, err := http.NewRequest(tt.method, tt.request, bytes.NewBuffer([]byte(tt.requestBody)))
-		if err != nil {
-			t.Fatal(err)
-		}
+	req, err := http.NewRequest("GET", "/validtenantid/instances/instanceid?wait=200ms&status=exited", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		req = req.WithContext(service.SetPrivilege(req.Context(), true))
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", InstancesV1))
 
-		rr := httptest.NewRecorder()
-		req.Header.Set("Content-Type", tt.media)
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
 
-		mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+	}
 
-		status := rr.Code
-		if status != tt.expectedStatus {
-			t.Errorf("test %d: got %v, expected %v", i, status, tt.expectedStatus)
-		}
+	var s Server
+	err = json.Unmarshal(rr.Body.Bytes(), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		if rr.Body.String() != tt.expectedResponse {
-			t.Errorf("test %d: %s: failed\ngot: %v\nexp: %v", i, tt.request, rr.Body.String(), tt.expectedResponse)
-		}
+	if !s.TimedOut {
+		t.Errorf("expected the wait to time out: %s", rr.Body.String())
+	}
+
+	select {
+	case err := <-ts.cancelled:
+		t.Errorf("Unexpected service cancellation: %v", err)
+	default:
 	}
 }
 
-func TestRoutes(t *testing.T) {
+func TestAccessLog(t *testing.T) {
 	var ts testCiaoService
-	config := Config{"", ts}
+	var log bytes.Buffer
 
-	r := Routes(config, nil)
-	if r == nil {
-		t.Fatalf("No routes returned")
+	mux := Routes(Config{URL: "", CiaoService: ts, AccessLog: &log}, nil)
+
+	req, err := http.NewRequest("GET", "/validtenantid/volumes", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", fmt.Sprintf("application/%s", VolumesV1))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 access log line, got %q", log.String())
+	}
+
+	var entry AccessLogEntry
+	err = json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.Method != "GET" || entry.Path != "/validtenantid/volumes" ||
+		entry.Tenant != "validtenantid" || entry.Status != http.StatusOK ||
+		entry.Latency < 0 || entry.Time.IsZero() {
+		t.Errorf("incorrect access log entry %+v", entry)
 	}
 }
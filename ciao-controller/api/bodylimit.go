@@ -0,0 +1,97 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxBodySize is the largest request body, in bytes, accepted when
+// no limit is configured.
+const DefaultMaxBodySize = 1 << 20
+
+// ErrRequestTooLarge is returned when a request body exceeds its limit.
+var ErrRequestTooLarge = errors.New("Request body too large")
+
+// limitedBody caps the size of a request body with http.MaxBytesReader.
+// The limit is only applied on the first read so that the handlers which
+// legitimately accept larger bodies may raise it beforehand.
+type limitedBody struct {
+	io.ReadCloser
+	w        http.ResponseWriter
+	limit    int64
+	reader   io.Reader
+	read     int64
+	exceeded bool
+}
+
+func newLimitedBody(w http.ResponseWriter, body io.ReadCloser, limit int64) *limitedBody {
+	if limit == 0 {
+		limit = DefaultMaxBodySize
+	}
+
+	return &limitedBody{
+		ReadCloser: body,
+		w:          w,
+		limit:      limit,
+	}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.reader == nil {
+		b.reader = b.ReadCloser
+		if b.limit > 0 {
+			b.reader = http.MaxBytesReader(b.w, b.ReadCloser, b.limit)
+		}
+	}
+
+	n, err := b.reader.Read(p)
+	b.read += int64(n)
+
+	// http.MaxBytesReader fails once limit bytes have been returned and
+	// more remain.
+	if err != nil && err != io.EOF && b.limit > 0 && b.read >= b.limit {
+		b.exceeded = true
+		err = ErrRequestTooLarge
+	}
+
+	return n, err
+}
+
+// limitBody wraps the body of r so that its size is capped at limit bytes,
+// zero selecting DefaultMaxBodySize and a negative value removing the limit.
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64) *limitedBody {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+
+	body := newLimitedBody(w, r.Body, limit)
+	r.Body = body
+	return body
+}
+
+// largeBody raises the body size limit of the requests served by h to the
+// limit configured for image uploads.
+func largeBody(h func(*Context, http.ResponseWriter, *http.Request) (Response, error)) func(*Context, http.ResponseWriter, *http.Request) (Response, error) {
+	return func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		if b, ok := r.Body.(*limitedBody); ok && b.reader == nil {
+			b.limit = c.maxImageSize
+		}
+
+		return h(c, w, r)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// PreflightRoute is the name of the route answering CORS preflight requests.
+// Browsers send preflight requests without credentials.
+const PreflightRoute = "cors-preflight"
+
+// corsMethods are the methods which may be allowed by a preflight request.
+var corsMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// corsProbeTypes are the content types used to find the routes matching a
+// preflight request, as the preflight does not carry the content type.
+var corsProbeTypes = []string{"application/json", "application/merge-patch+json"}
+
+// corsMaxAge is the number of seconds the result of a preflight request may
+// be cached by the browser.
+const corsMaxAge = "600"
+
+// corsPolicy holds the cross-origin resource sharing configuration.
+type corsPolicy struct {
+	origins          map[string]bool
+	allowCredentials bool
+}
+
+func newCORSPolicy(origins []string, allowCredentials bool) *corsPolicy {
+	if len(origins) == 0 {
+		return nil
+	}
+
+	p := &corsPolicy{
+		origins:          make(map[string]bool),
+		allowCredentials: allowCredentials,
+	}
+
+	for _, o := range origins {
+		p.origins[o] = true
+	}
+
+	return p
+}
+
+// allowedOrigin returns the value of the Access-Control-Allow-Origin header
+// for origin, if origin is allowed. The wildcard may not be used when
+// credentials are allowed, hence the origin is returned instead.
+func (p *corsPolicy) allowedOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+
+	if p.origins[origin] {
+		return origin, true
+	}
+
+	if p.origins["*"] {
+		if p.allowCredentials {
+			return origin, true
+		}
+		return "*", true
+	}
+
+	return "", false
+}
+
+// setHeaders adds the CORS headers for a request from an allowed origin.
+func (p *corsPolicy) setHeaders(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+
+	allowed, ok := p.allowedOrigin(r.Header.Get("Origin"))
+	if !ok {
+		return false
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	if p.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	return true
+}
+
+// allowedMethods returns the methods supported by the routes of router for
+// the path of r.
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	var methods []string
+
+	for _, m := range corsMethods {
+		for _, t := range corsProbeTypes {
+			probe := *r
+			probe.Method = m
+			probe.Header = http.Header{"Content-Type": {t}}
+
+			var match mux.RouteMatch
+			if router.Match(&probe, &match) && match.Route != nil {
+				methods = append(methods, m)
+				break
+			}
+		}
+	}
+
+	return methods
+}
+
+// preflight returns the handler answering preflight requests for the routes
+// of router.
+func (p *corsPolicy) preflight(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.setHeaders(w, r) {
+			WriteError(w, http.StatusForbidden, errors.New("Origin not allowed"))
+			return
+		}
+
+		methods := allowedMethods(router, r)
+		if len(methods) == 0 {
+			WriteError(w, http.StatusNotFound, errors.New("Resource not found"))
+			return
+		}
+
+		headers := r.Header.Get("Access-Control-Request-Headers")
+		if headers == "" {
+			headers = "Accept, Content-Type"
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// isPreflight matches CORS preflight requests.
+func isPreflight(r *http.Request, rm *mux.RouteMatch) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header carrying the key which
+	// identifies retries of the same create request.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// DefaultIdempotencyTTL is how long the response to a request carrying
+	// an idempotency key is kept when no TTL is configured.
+	DefaultIdempotencyTTL = 24 * time.Hour
+)
+
+type idempotentResponse struct {
+	resp    Response
+	err     error
+	expires time.Time
+	done    chan struct{}
+}
+
+// idempotencyCache holds the responses to the requests carrying an
+// idempotency key until they expire.
+type idempotencyCache struct {
+	sync.Mutex
+	ttl       time.Duration
+	responses map[string]*idempotentResponse
+}
+
+func newIdempotencyCache(ttl time.Duration) *idempotencyCache {
+	if ttl < 0 {
+		return nil
+	}
+
+	if ttl == 0 {
+		ttl = DefaultIdempotencyTTL
+	}
+
+	return &idempotencyCache{
+		ttl:       ttl,
+		responses: make(map[string]*idempotentResponse),
+	}
+}
+
+// do calls fn unless it has already been called for key, in which case the
+// response of the first call is returned. Concurrent requests with the same
+// key wait for the first one to complete. Failures are not kept so that the
+// request may be retried.
+func (c *idempotencyCache) do(key string, now time.Time, fn func() (Response, error)) (Response, error) {
+	c.Lock()
+	for k, ir := range c.responses {
+		if !ir.expires.IsZero() && now.After(ir.expires) {
+			delete(c.responses, k)
+		}
+	}
+
+	ir, ok := c.responses[key]
+	if ok {
+		c.Unlock()
+		<-ir.done
+		if ir.err == nil {
+			return ir.resp, nil
+		}
+		return c.do(key, now, fn)
+	}
+
+	ir = &idempotentResponse{done: make(chan struct{})}
+	c.responses[key] = ir
+	c.Unlock()
+
+	ir.resp, ir.err = fn()
+
+	c.Lock()
+	if ir.err != nil {
+		delete(c.responses, key)
+	} else {
+		ir.expires = now.Add(c.ttl)
+	}
+	c.Unlock()
+	close(ir.done)
+
+	return ir.resp, ir.err
+}
+
+// idempotent wraps a create handler so that the retries of a request
+// carrying an idempotency key return the response of the first request.
+// Keys are scoped to the path and query of the request, and hence to the
+// tenant.
+func idempotent(h func(*Context, http.ResponseWriter, *http.Request) (Response, error)) func(*Context, http.ResponseWriter, *http.Request) (Response, error) {
+	return func(c *Context, w http.ResponseWriter, r *http.Request) (Response, error) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" || c.idempotency == nil {
+			return h(c, w, r)
+		}
+
+		return c.idempotency.do(r.URL.RequestURI()+" "+key, time.Now(), func() (Response, error) {
+			return h(c, w, r)
+		})
+	}
+}
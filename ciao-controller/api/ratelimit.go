@@ -0,0 +1,114 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultRateBurst is the number of requests a tenant may make in a burst
+// when no burst size is configured.
+const DefaultRateBurst = 40
+
+// ErrTooManyRequests is returned when a tenant exceeds its request rate.
+var ErrTooManyRequests = errors.New("Too many requests")
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter maintains a token bucket per tenant. Each request consumes a
+// token and tokens are added back at rate per second, up to burst.
+type rateLimiter struct {
+	sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = DefaultRateBurst
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// refill returns the number of tokens in b at now.
+func (l *rateLimiter) refill(b *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return b.tokens
+	}
+	return math.Min(l.burst, b.tokens+elapsed*l.rate)
+}
+
+// sweep removes the full buckets, a missing bucket being created full. It
+// runs at most once in the time taken to fill an empty bucket so that the
+// buckets of the tenants which stopped making requests are not kept.
+func (l *rateLimiter) sweep(now time.Time) {
+	period := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.swept) < period {
+		return
+	}
+	l.swept = now
+
+	for tenant, b := range l.buckets {
+		if l.refill(b, now) >= l.burst {
+			delete(l.buckets, tenant)
+		}
+	}
+}
+
+// allow consumes a token from the bucket of tenant. If the bucket is empty
+// it returns false and the time after which a token will be available.
+func (l *rateLimiter) allow(tenant string, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[tenant]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[tenant] = b
+	}
+
+	if now.After(b.last) {
+		b.tokens = l.refill(b, now)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := (1 - b.tokens) / l.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ciao-project/ciao/clogger"
+	"github.com/gorilla/mux"
+)
+
+// DefaultRequestTimeout is how long a request may take when no timeout is
+// configured.
+const DefaultRequestTimeout = 60 * time.Second
+
+// ErrRequestTimeout is returned when a request does not complete before its
+// timeout.
+var ErrRequestTimeout = errors.New("Request timed out")
+
+// routeTimeouts holds the timeouts of the routes which do not use the
+// default request timeout. A negative timeout disables the timeout.
+type routeTimeouts struct {
+	timeout time.Duration
+	routes  map[*mux.Route]time.Duration
+}
+
+func newRouteTimeouts(timeout time.Duration) *routeTimeouts {
+	if timeout == 0 {
+		timeout = DefaultRequestTimeout
+	}
+
+	return &routeTimeouts{
+		timeout: timeout,
+		routes:  make(map[*mux.Route]time.Duration),
+	}
+}
+
+// set overrides the timeout of route, zero or a negative timeout disabling
+// it. It must only be called while the routes are being set up.
+func (t *routeTimeouts) set(route *mux.Route, timeout time.Duration) {
+	if t == nil {
+		return
+	}
+
+	if timeout == 0 {
+		timeout = -1
+	}
+	t.routes[route] = timeout
+}
+
+// lookup returns the timeout of the route serving r.
+func (t *routeTimeouts) lookup(r *http.Request) time.Duration {
+	if route := mux.CurrentRoute(r); route != nil {
+		if timeout, ok := t.routes[route]; ok {
+			return timeout
+		}
+	}
+	return t.timeout
+}
+
+// bufferedResponse records the response of a handler so that it is only
+// sent if the handler completes before its timeout.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// serveWithTimeout runs serve with the context of r cancelled after
+// timeout. The response is buffered and sent once serve returns. If the
+// timeout expires first, a 503 response is sent instead and the response
+// of serve is discarded when it eventually returns.
+func serveWithTimeout(w http.ResponseWriter, r *http.Request, timeout time.Duration,
+	logger clogger.CiaoLog, serve func(http.ResponseWriter, *http.Request)) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	resp := &bufferedResponse{header: make(http.Header)}
+	done := make(chan struct{})
+
+	go func() {
+		serve(resp, r.WithContext(ctx))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		for k, v := range resp.header {
+			w.Header()[k] = v
+		}
+		if resp.status == 0 {
+			resp.status = http.StatusOK
+		}
+		w.WriteHeader(resp.status)
+		_, _ = w.Write(resp.body.Bytes())
+	case <-ctx.Done():
+		if ctx.Err() != context.DeadlineExceeded {
+			// the client has gone away
+			return
+		}
+
+		logger.Warningf("Request timed out after %v: %s", timeout, r.URL.String())
+		WriteError(w, http.StatusServiceUnavailable, ErrRequestTimeout)
+	}
+}
@@ -43,9 +43,10 @@ type controllerClient interface {
 	Disconnect()
 	mapExternalIP(t types.Tenant, m types.MappedIP) error
 	unMapExternalIP(t types.Tenant, m types.MappedIP) error
-	attachVolume(volID string, instanceID string, nodeID string) error
+	attachVolume(volID string, instanceID string, nodeID string, readOnly bool) error
 	ssntpClient() *ssntp.Client
 	CNCIRefresh(cnciID string, cnciList []payloads.CNCINet) error
+	CNCIProbe(cnciID string, probeID string, targets []payloads.CNCIProbeTarget) error
 }
 
 type ssntpClient struct {
@@ -234,6 +235,32 @@ func (client *ssntpClient) concentratorInstanceAdded(payload []byte) {
 	}
 }
 
+func (client *ssntpClient) concentratorInstanceReady(payload []byte) {
+	var event payloads.EventConcentratorInstanceReady
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		glog.Warningf("Error unmarshalling EventConcentratorInstanceReady: %v", err)
+		return
+	}
+	ready := event.CNCIReady
+
+	if !ready.Degraded {
+		glog.Infof("CNCI %s network ready", ready.InstanceUUID)
+		return
+	}
+
+	// the CNCI is up but could not restore all of its tenant's
+	// networking, so let the tenant know what is not reachable.
+	msg := fmt.Sprintf("CNCI %s network degraded: failed subnets %v, failed public IPs %v",
+		ready.InstanceUUID, ready.FailedSubnets, ready.FailedPublicIPs)
+	glog.Warning(msg)
+
+	err = client.ctl.ds.LogError(ready.TenantUUID, msg)
+	if err != nil {
+		glog.Warningf("Error logging error: %v", err)
+	}
+}
+
 func (client *ssntpClient) traceReport(payload []byte) {
 	var trace payloads.Trace
 	err := yaml.Unmarshal(payload, &trace)
@@ -282,9 +309,10 @@ func (client *ssntpClient) unassignEvent(payload []byte) {
 		return
 	}
 
-	i, err := client.ctl.ds.GetInstance(event.UnassignedIP.InstanceUUID)
+	// the instance may already have been deleted
+	m, err := client.ctl.ds.GetMappedIP(event.UnassignedIP.PublicIP)
 	if err != nil {
-		glog.Warningf("Error getting instance from datastore: %v", err)
+		glog.Warningf("Error getting external IP mapping from datastore: %v", err)
 		return
 	}
 
@@ -294,10 +322,10 @@ func (client *ssntpClient) unassignEvent(payload []byte) {
 		return
 	}
 
-	client.ctl.qs.Release(i.TenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
+	client.ctl.qs.Release(m.TenantID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
 
 	msg := fmt.Sprintf("Unmapped %s from %s", event.UnassignedIP.PublicIP, event.UnassignedIP.PrivateIP)
-	err = client.ctl.ds.LogEvent(i.TenantID, msg)
+	err = client.ctl.ds.LogEvent(m.TenantID, msg)
 	if err != nil {
 		glog.Warningf("Error logging event: %v", err)
 	}
@@ -324,6 +352,32 @@ func (client *ssntpClient) assignEvent(payload []byte) {
 	}
 }
 
+func (client *ssntpClient) cnciProbeResult(payload []byte) {
+	var event payloads.EventCNCIProbeResult
+	err := yaml.Unmarshal(payload, &event)
+	if err != nil {
+		glog.Warningf("Error unmarshalling EventCNCIProbeResult: %v", err)
+		return
+	}
+
+	i, err := client.ctl.ds.GetInstance(event.Result.CNCIUUID)
+	if err != nil {
+		glog.Warningf("Error getting instance: %v", err)
+		return
+	}
+
+	tenant, err := client.ctl.ds.GetTenant(i.TenantID)
+	if err != nil || tenant == nil {
+		glog.Warningf("Error getting tenant: %v", err)
+		return
+	}
+
+	err = tenant.CNCIctrl.ProbeResult(event.Result)
+	if err != nil {
+		glog.Warningf("Error handling CNCI probe result: %v", err)
+	}
+}
+
 func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 	payload := frame.Payload
 
@@ -341,6 +395,9 @@ func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 	case ssntp.ConcentratorInstanceAdded:
 		client.concentratorInstanceAdded(payload)
 
+	case ssntp.ConcentratorInstanceReady:
+		client.concentratorInstanceReady(payload)
+
 	case ssntp.TraceReport:
 		client.traceReport(payload)
 
@@ -356,6 +413,9 @@ func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 	case ssntp.PublicIPUnassigned:
 		client.unassignEvent(payload)
 
+	case ssntp.CNCIProbeResult:
+		client.cnciProbeResult(payload)
+
 	}
 }
 
@@ -415,6 +475,15 @@ func (client *ssntpClient) attachVolumeFailure(payload []byte) {
 	}
 }
 
+// publicIPFailureReason describes a public IP failure, including the cause
+// reported by the CNCI if any.
+func publicIPFailureReason(failure *payloads.ErrorPublicIPFailure) string {
+	if failure.Detail == "" {
+		return failure.Reason.String()
+	}
+	return fmt.Sprintf("%s (%s)", failure.Reason.String(), failure.Detail)
+}
+
 func (client *ssntpClient) assignError(payload []byte) {
 	var failure payloads.ErrorPublicIPFailure
 	err := yaml.Unmarshal(payload, &failure)
@@ -430,7 +499,7 @@ func (client *ssntpClient) assignError(payload []byte) {
 
 	client.ctl.qs.Release(failure.TenantUUID, payloads.RequestedResource{Type: payloads.ExternalIP, Value: 1})
 
-	msg := fmt.Sprintf("Failed to map %s to %s: %s", failure.PublicIP, failure.InstanceUUID, failure.Reason.String())
+	msg := fmt.Sprintf("Failed to map %s to %s: %s", failure.PublicIP, failure.InstanceUUID, publicIPFailureReason(&failure))
 	err = client.ctl.ds.LogError(failure.TenantUUID, msg)
 	if err != nil {
 		glog.Warningf("Error logging error: %v", err)
@@ -446,7 +515,7 @@ func (client *ssntpClient) unassignError(payload []byte) {
 	}
 
 	// we can't unmap the IP - all we can do is log.
-	msg := fmt.Sprintf("Failed to unmap %s from %s: %s", failure.PublicIP, failure.InstanceUUID, failure.Reason.String())
+	msg := fmt.Sprintf("Failed to unmap %s from %s: %s", failure.PublicIP, failure.InstanceUUID, publicIPFailureReason(&failure))
 	err = client.ctl.ds.LogError(failure.TenantUUID, msg)
 	if err != nil {
 		glog.Warningf("Error logging error: %v", err)
@@ -612,6 +681,7 @@ func (client *ssntpClient) RestartInstance(i *types.Instance, w *types.Workload,
 		vol.ID = attachments[k].BlockID
 		vol.Bootable = attachments[k].Boot
 		vol.Ephemeral = attachments[k].Ephemeral
+		vol.ReadOnly = attachments[k].ReadOnly
 	}
 
 	payload := payloads.Start{
@@ -689,12 +759,13 @@ func (client *ssntpClient) RestoreNode(nodeID string) error {
 	return err
 }
 
-func (client *ssntpClient) attachVolume(volID string, instanceID string, nodeID string) error {
+func (client *ssntpClient) attachVolume(volID string, instanceID string, nodeID string, readOnly bool) error {
 	payload := payloads.AttachVolume{
 		Attach: payloads.VolumeCmd{
 			InstanceUUID:      instanceID,
 			VolumeUUID:        volID,
 			WorkloadAgentUUID: nodeID,
+			ReadOnly:          readOnly,
 		},
 	}
 
@@ -798,3 +869,24 @@ func (client *ssntpClient) CNCIRefresh(cnciID string, cnciList []payloads.CNCINe
 	_, err = client.ssntp.SendCommand(ssntp.RefreshCNCI, y)
 	return err
 }
+
+func (client *ssntpClient) CNCIProbe(cnciID string, probeID string, targets []payloads.CNCIProbeTarget) error {
+	payload := payloads.CommandCNCIProbe{
+		Probe: payloads.CNCIProbeCommand{
+			ProbeID:  probeID,
+			CNCIUUID: cnciID,
+			Targets:  targets,
+		},
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Probe CNCI %s: %v\n", cnciID, targets)
+	glog.V(1).Info(string(y))
+
+	_, err = client.ssntp.SendCommand(ssntp.ProbeCNCI, y)
+	return err
+}
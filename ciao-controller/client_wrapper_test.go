@@ -112,8 +112,8 @@ func (client *ssntpClientWrapper) unMapExternalIP(t types.Tenant, m types.Mapped
 	return client.realClient.unMapExternalIP(t, m)
 }
 
-func (client *ssntpClientWrapper) attachVolume(volID string, instanceID string, nodeID string) error {
-	return client.realClient.attachVolume(volID, instanceID, nodeID)
+func (client *ssntpClientWrapper) attachVolume(volID string, instanceID string, nodeID string, readOnly bool) error {
+	return client.realClient.attachVolume(volID, instanceID, nodeID, readOnly)
 }
 
 func (client *ssntpClientWrapper) ssntpClient() *ssntp.Client {
@@ -277,3 +277,7 @@ func (client *ssntpClientWrapper) RemoveInstance(ID string) {
 func (client *ssntpClientWrapper) CNCIRefresh(cnciID string, cnciList []payloads.CNCINet) error {
 	return client.realClient.CNCIRefresh(cnciID, cnciList)
 }
+
+func (client *ssntpClientWrapper) CNCIProbe(cnciID string, probeID string, targets []payloads.CNCIProbeTarget) error {
+	return client.realClient.CNCIProbe(cnciID, probeID, targets)
+}
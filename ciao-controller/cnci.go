@@ -21,11 +21,13 @@ import (
 	"fmt"
 	"hash/crc32"
 	"net"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/uuid"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
@@ -49,6 +51,8 @@ var (
 
 var cnciEventTimeout = (2 * time.Minute)
 
+var cnciProbeTimeout = (30 * time.Second)
+
 // CNCI represents a cnci instance that manages a single subnet.
 type CNCI struct {
 	instance *types.Instance
@@ -72,6 +76,12 @@ type CNCIManager struct {
 
 	// this is a map of subnet strings to CNCI structs
 	subnets map[string]*CNCI
+
+	probeLock sync.Mutex
+
+	// this is a map of in progress probe IDs to the channel
+	// the probe results are delivered on
+	probes map[string]chan payloads.CNCIProbeResultEvent
 }
 
 func (c *CNCI) stop() error {
@@ -479,6 +489,177 @@ func (c *CNCIManager) refresh() error {
 	return nil
 }
 
+// Probe asks each active CNCI to ping the tunnel IPs of all the other
+// active CNCIs of the tenant and returns the resulting reachability matrix.
+// A CNCI which does not reply before the probe times out is reported
+// as unable to reach any of its peers.
+func (c *CNCIManager) Probe() (types.CNCIProbeResponse, error) {
+	var targets []payloads.CNCIProbeTarget
+
+	c.cnciLock.RLock()
+	for _, cnci := range c.cncis {
+		if !instanceActive(cnci.instance) {
+			continue
+		}
+
+		tunnelIP := getTunnelIP(cnci.instance.Subnet)
+		if tunnelIP == nil {
+			c.cnciLock.RUnlock()
+			return types.CNCIProbeResponse{}, errors.New("Unable to derive CNCI tunnel IP")
+		}
+
+		targets = append(targets, payloads.CNCIProbeTarget{
+			CNCIUUID: cnci.instance.ID,
+			TunnelIP: tunnelIP.String(),
+		})
+	}
+	c.cnciLock.RUnlock()
+
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].CNCIUUID < targets[j].CNCIUUID
+	})
+
+	probeID := uuid.Generate().String()
+	ch := make(chan payloads.CNCIProbeResultEvent, len(targets))
+
+	c.probeLock.Lock()
+	c.probes[probeID] = ch
+	c.probeLock.Unlock()
+
+	defer func() {
+		c.probeLock.Lock()
+		delete(c.probes, probeID)
+		c.probeLock.Unlock()
+	}()
+
+	resp := types.CNCIProbeResponse{
+		Matrix: make(map[string]map[string]bool),
+	}
+
+	pending := make(map[string]bool)
+
+	for _, from := range targets {
+		var peers []payloads.CNCIProbeTarget
+
+		resp.Matrix[from.CNCIUUID] = make(map[string]bool)
+		for _, to := range targets {
+			if to.CNCIUUID == from.CNCIUUID {
+				continue
+			}
+			resp.Matrix[from.CNCIUUID][to.CNCIUUID] = false
+			peers = append(peers, to)
+		}
+
+		if len(peers) == 0 {
+			continue
+		}
+
+		err := c.ctrl.client.CNCIProbe(from.CNCIUUID, probeID, peers)
+		if err != nil {
+			resp.Failures = append(resp.Failures, types.CNCIProbeFailure{
+				From:  from.CNCIUUID,
+				Error: err.Error(),
+			})
+			continue
+		}
+
+		pending[from.CNCIUUID] = true
+	}
+
+	timeout := time.After(cnciProbeTimeout)
+
+	for len(pending) > 0 {
+		select {
+		case result := <-ch:
+			if !pending[result.CNCIUUID] {
+				continue
+			}
+			delete(pending, result.CNCIUUID)
+
+			row := resp.Matrix[result.CNCIUUID]
+			for _, r := range result.Results {
+				if _, ok := row[r.CNCIUUID]; !ok {
+					continue
+				}
+
+				row[r.CNCIUUID] = r.Reachable
+				if !r.Reachable {
+					resp.Failures = append(resp.Failures, types.CNCIProbeFailure{
+						From:  result.CNCIUUID,
+						To:    r.CNCIUUID,
+						Error: r.Error,
+					})
+				}
+			}
+		case <-timeout:
+			for ID := range pending {
+				resp.Failures = append(resp.Failures, types.CNCIProbeFailure{
+					From:  ID,
+					Error: "timeout waiting for probe result",
+				})
+				delete(pending, ID)
+			}
+		}
+	}
+
+	resp.Healthy = len(resp.Failures) == 0
+
+	return resp, nil
+}
+
+// ProbeResult delivers the result of a tunnel probe performed by
+// a CNCI to the probe waiting for it.
+func (c *CNCIManager) ProbeResult(result payloads.CNCIProbeResultEvent) error {
+	c.probeLock.Lock()
+	defer c.probeLock.Unlock()
+
+	ch, ok := c.probes[result.ProbeID]
+	if !ok {
+		return errors.New("No probe in progress")
+	}
+
+	select {
+	case ch <- result:
+		return nil
+	default:
+		return errors.New("Unexpected probe result")
+	}
+}
+
+// List returns the CNCIs of the tenant along with the subnets they serve,
+// sorted by instance ID.
+func (c *CNCIManager) List() []types.TenantCNCI {
+	c.cnciLock.RLock()
+	defer c.cnciLock.RUnlock()
+
+	served := make(map[string][]string)
+	for subnet, cnci := range c.subnets {
+		served[cnci.instance.ID] = append(served[cnci.instance.ID], subnet)
+	}
+
+	cncis := []types.TenantCNCI{}
+	for ID, cnci := range c.cncis {
+		subnets := served[ID]
+		if subnets == nil {
+			subnets = []string{}
+		}
+		sort.Strings(subnets)
+
+		cncis = append(cncis, types.TenantCNCI{
+			TenantID:   c.tenant,
+			IPAddress:  cnci.instance.IPAddress,
+			MACAddress: cnci.instance.MACAddress,
+			InstanceID: ID,
+			Subnets:    subnets,
+			MappedIPs:  []types.MappedIP{},
+		})
+	}
+
+	sort.Slice(cncis, func(i, j int) bool { return cncis[i].InstanceID < cncis[j].InstanceID })
+
+	return cncis
+}
+
 // GetInstanceCNCI will return the CNCI Instance for a specific tenant Instance
 func (c *CNCIManager) GetInstanceCNCI(ID string) (*types.Instance, error) {
 	// figure out what subnet we are looking for.
@@ -552,6 +733,7 @@ func newCNCIManager(ctrl *controller, tenant string) (*CNCIManager, error) {
 
 		cncis:   make(map[string]*CNCI),
 		subnets: make(map[string]*CNCI),
+		probes:  make(map[string]chan payloads.CNCIProbeResultEvent),
 	}
 
 	instances, err := ctrl.ds.GetTenantCNCIs(tenant)
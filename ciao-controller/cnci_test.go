@@ -15,9 +15,14 @@
 package main
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/uuid"
 )
 
 func TestCNCIInitializeCtrls(t *testing.T) {
@@ -165,3 +170,199 @@ func TestCNCIRemoved(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCNCIProbe(t *testing.T) {
+	mgr, err := newCNCIManager(ctl, uuid.Generate().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subnets := []string{"172.16.0.0/24", "172.16.1.0/24", "172.16.2.0/24"}
+	var IDs []string
+	for _, subnet := range subnets {
+		cnci := &CNCI{
+			ctrl: ctl,
+			instance: &types.Instance{
+				ID:     uuid.Generate().String(),
+				State:  payloads.Running,
+				Subnet: subnet,
+				CNCI:   true,
+			},
+			subnet: subnet,
+		}
+		mgr.cncis[cnci.instance.ID] = cnci
+		mgr.subnets[subnet] = cnci
+		IDs = append(IDs, cnci.instance.ID)
+	}
+
+	savedTimeout := cnciProbeTimeout
+	cnciProbeTimeout = 2 * time.Second
+	defer func() { cnciProbeTimeout = savedTimeout }()
+
+	// the first two CNCIs reply, the first one cannot reach the second
+	// one and the last CNCI never replies.
+	go func() {
+		var probeID string
+		for probeID == "" {
+			time.Sleep(10 * time.Millisecond)
+			mgr.probeLock.Lock()
+			for ID := range mgr.probes {
+				probeID = ID
+			}
+			mgr.probeLock.Unlock()
+		}
+
+		for i, from := range IDs[:2] {
+			result := payloads.CNCIProbeResultEvent{
+				ProbeID:  probeID,
+				CNCIUUID: from,
+			}
+			for j, to := range IDs {
+				if i == j {
+					continue
+				}
+				r := payloads.CNCIProbeTargetResult{
+					CNCIUUID:  to,
+					Reachable: !(i == 0 && j == 1),
+				}
+				result.Results = append(result.Results, r)
+			}
+
+			err := mgr.ProbeResult(result)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	resp, err := mgr.Probe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Healthy {
+		t.Fatal("Probe reported healthy network")
+	}
+
+	if len(resp.Matrix) != len(IDs) {
+		t.Fatalf("Expected %d matrix rows got %d", len(IDs), len(resp.Matrix))
+	}
+
+	if resp.Matrix[IDs[0]][IDs[1]] || !resp.Matrix[IDs[0]][IDs[2]] {
+		t.Fatalf("Unexpected results for %s: %v", IDs[0], resp.Matrix[IDs[0]])
+	}
+
+	if !resp.Matrix[IDs[1]][IDs[0]] || !resp.Matrix[IDs[1]][IDs[2]] {
+		t.Fatalf("Unexpected results for %s: %v", IDs[1], resp.Matrix[IDs[1]])
+	}
+
+	if resp.Matrix[IDs[2]][IDs[0]] || resp.Matrix[IDs[2]][IDs[1]] {
+		t.Fatalf("Unexpected results for %s: %v", IDs[2], resp.Matrix[IDs[2]])
+	}
+
+	if len(resp.Failures) != 2 {
+		t.Fatalf("Expected 2 failures got %v", resp.Failures)
+	}
+
+	mgr.probeLock.Lock()
+	defer mgr.probeLock.Unlock()
+	if len(mgr.probes) != 0 {
+		t.Fatal("Probe not removed after completion")
+	}
+}
+
+func TestCNCIList(t *testing.T) {
+	tenantID := uuid.Generate().String()
+	mgr, err := newCNCIManager(ctl, tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cncis := mgr.List(); len(cncis) != 0 {
+		t.Fatalf("Unexpected CNCIs %v", cncis)
+	}
+
+	subnets := []string{"172.16.1.0/24", "172.16.0.0/24"}
+	for i, subnet := range subnets {
+		cnci := &CNCI{
+			ctrl: ctl,
+			instance: &types.Instance{
+				ID:        fmt.Sprintf("%d-%s", i, uuid.Generate().String()),
+				State:     payloads.Running,
+				Subnet:    subnet,
+				IPAddress: fmt.Sprintf("192.168.0.%d", 100+i),
+				CNCI:      true,
+			},
+			subnet: subnet,
+		}
+		mgr.cncis[cnci.instance.ID] = cnci
+		mgr.subnets[subnet] = cnci
+	}
+
+	cncis := mgr.List()
+	if len(cncis) != len(subnets) {
+		t.Fatalf("Expected %d CNCIs got %d", len(subnets), len(cncis))
+	}
+
+	for i, cnci := range cncis {
+		if cnci.TenantID != tenantID {
+			t.Errorf("Wrong tenant %s", cnci.TenantID)
+		}
+
+		if cnci.IPAddress != fmt.Sprintf("192.168.0.%d", 100+i) {
+			t.Errorf("Wrong CNCI IP %s", cnci.IPAddress)
+		}
+
+		if len(cnci.Subnets) != 1 || cnci.Subnets[0] != subnets[i] {
+			t.Errorf("Wrong subnets %v", cnci.Subnets)
+		}
+	}
+
+	_, err = ctl.ShowTenantCNCI(uuid.Generate().String())
+	if err == nil {
+		t.Error("Expected error for unknown tenant")
+	}
+}
+
+func TestListCNCISummaries(t *testing.T) {
+	tenants, err := ctl.ds.GetAllTenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := 0
+	for _, tenant := range tenants {
+		expected += len(tenant.CNCIctrl.List())
+	}
+
+	cncis, err := ctl.ListCNCIs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cncis) != expected {
+		t.Fatalf("Expected %d CNCIs got %d", expected, len(cncis))
+	}
+
+	for _, cnci := range cncis {
+		if cnci.Tenants != 1 {
+			t.Errorf("Unexpected CNCI summary %+v", cnci)
+		}
+
+		filtered, err := ctl.ListCNCIs(cnci.TenantID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, f := range filtered {
+			if f.TenantID != cnci.TenantID {
+				t.Errorf("CNCI %s of tenant %s listed for tenant %s", f.ID, f.TenantID, cnci.TenantID)
+			}
+		}
+	}
+
+	_, err = ctl.ListCNCIs(uuid.Generate().String())
+	if err != types.ErrTenantNotFound {
+		t.Errorf("Expected %v got %v", types.ErrTenantNotFound, err)
+	}
+}
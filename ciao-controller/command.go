@@ -22,6 +22,7 @@ import (
 	"runtime"
 	"time"
 
+	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/golang/glog"
@@ -150,11 +151,17 @@ func (c *controller) deleteInstance(instanceID string) error {
 		return types.ErrInstanceNotAssigned
 	}
 
-	// check for any external IPs
+	// release any external IPs so that the CNCI tears down their NAT
+	// rules. The mappings are removed once the CNCI confirms.
 	IPs := c.ds.GetMappedIPs(&i.TenantID)
 	for _, m := range IPs {
-		if m.InstanceID == instanceID {
-			return types.ErrInstanceMapped
+		if m.InstanceID != instanceID {
+			continue
+		}
+
+		err = c.UnMapAddress(m.ExternalIP)
+		if err != nil {
+			return errors.Wrapf(err, "error releasing external IP %s", m.ExternalIP)
 		}
 	}
 
@@ -235,7 +242,27 @@ func (c *controller) confirmTenant(tenantID string) error {
 func (c *controller) createInstance(w types.WorkloadRequest, wl types.Workload, name string, newIP net.IP) (*types.Instance, error) {
 	startTime := time.Now()
 
-	instance, err := newInstance(c, w.TenantID, &wl, name, w.Subnet, newIP)
+	// existing volumes requested at boot are attached like the
+	// pre-existing volumes of the workload.
+	if len(w.Volumes) > 0 {
+		storage := make([]types.StorageResource, 0, len(wl.Storage)+len(w.Volumes))
+		storage = append(storage, wl.Storage...)
+		for _, ID := range w.Volumes {
+			storage = append(storage, types.StorageResource{ID: ID})
+		}
+		wl.Storage = storage
+	}
+
+	// placement constraints from the scheduler hints of the request
+	// apply to this instance only.
+	if w.NodeID != "" {
+		wl.Requirements.NodeID = w.NodeID
+	}
+	if len(w.Exclude) > 0 {
+		wl.Requirements.ExcludeNodes = w.Exclude
+	}
+
+	instance, err := newInstance(c, w.TenantID, &wl, name, w.Subnet, newIP, w.MACAddress)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error creating instance")
 	}
@@ -252,10 +279,10 @@ func (c *controller) createInstance(w types.WorkloadRequest, wl types.Workload,
 		return nil, errors.New("Over quota")
 	}
 
-	err = instance.Add()
+	err = c.addInstance(instance, w.MACAddress)
 	if err != nil {
 		_ = instance.Clean()
-		return nil, errors.Wrap(err, "Error adding instance")
+		return nil, err
 	}
 
 	if w.TraceLabel == "" {
@@ -272,7 +299,50 @@ func (c *controller) createInstance(w types.WorkloadRequest, wl types.Workload,
 	return instance.Instance, nil
 }
 
+// addInstance adds instance to the datastore. A requested MAC address is
+// checked again while holding macAddressLock so that concurrent requests
+// cannot claim the same address.
+func (c *controller) addInstance(instance *instance, mac string) error {
+	if mac != "" {
+		c.macAddressLock.Lock()
+		defer c.macAddressLock.Unlock()
+
+		inUse, err := c.macAddressInUse(instance.TenantID, mac)
+		if err != nil {
+			return err
+		}
+
+		if inUse {
+			return api.ErrMACAddressInUse
+		}
+	}
+
+	err := instance.Add()
+	if err != nil {
+		return errors.Wrap(err, "Error adding instance")
+	}
+
+	return nil
+}
+
 func (c *controller) startWorkload(w types.WorkloadRequest) ([]*types.Instance, error) {
+	indexed, err := c.startIndexedWorkload(w)
+
+	var newInstances []*types.Instance
+	for _, instance := range indexed {
+		if instance != nil {
+			newInstances = append(newInstances, instance)
+		}
+	}
+
+	return newInstances, err
+}
+
+// startIndexedWorkload starts the instances requested by w. The returned
+// slice has one entry per requested instance, ordered by the index of the
+// instance within the request. Entries for instances that failed to start
+// are nil.
+func (c *controller) startIndexedWorkload(w types.WorkloadRequest) ([]*types.Instance, error) {
 	var e error
 	var sem = make(chan int, runtime.NumCPU())
 
@@ -292,7 +362,7 @@ func (c *controller) startWorkload(w types.WorkloadRequest) ([]*types.Instance,
 		}
 
 		if !tenant.Permissions.PrivilegedContainers {
-			return nil, errors.New("Permission denied: you do not have permission to create privileged workloads")
+			return nil, types.ErrPrivilegedNotPermitted
 		}
 	}
 
@@ -306,8 +376,9 @@ func (c *controller) startWorkload(w types.WorkloadRequest) ([]*types.Instance,
 		}
 	}
 
-	var newInstances []*types.Instance
+	newInstances := make([]*types.Instance, w.Instances)
 	type result struct {
+		index    int
 		instance *types.Instance
 		err      error
 	}
@@ -328,22 +399,23 @@ func (c *controller) startWorkload(w types.WorkloadRequest) ([]*types.Instance,
 			}
 		}
 
-		go func(newIP net.IP, name string) {
+		go func(index int, newIP net.IP, name string) {
 			sem <- 1
 			instance, err := c.createInstance(w, wl, name, newIP)
 			ret := result{
+				index:    index,
 				err:      err,
 				instance: instance,
 			}
 			<-sem
 			errChan <- ret
-		}(newIP, name)
+		}(i, newIP, name)
 	}
 
 	for i := 0; i < w.Instances; i++ {
 		retVal := <-errChan
 		if retVal.err == nil {
-			newInstances = append(newInstances, retVal.instance)
+			newInstances[retVal.index] = retVal.instance
 		} else if e == nil {
 			// return the first error
 			e = retVal.err
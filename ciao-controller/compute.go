@@ -15,12 +15,16 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"regexp"
 	"sort"
+	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/ciao-project/ciao/payloads"
 	"github.com/gorilla/mux"
 )
 
@@ -46,32 +50,97 @@ func instanceToServer(ctl *controller, instance *types.Instance) (api.ServerDeta
 			},
 		},
 		Volumes: volumes,
-		SSHIP:   instance.SSHIP,
-		SSHPort: instance.SSHPort,
 		Created: instance.CreateTime,
 		Name:    instance.Name,
 	}
 
+	if ssh, err := ctl.instanceSSH(instance.ID); err == nil {
+		server.SSHIP = ssh.SSHIP
+		server.SSHPort = ssh.SSHPort
+	}
+
 	return server, nil
 }
 
-func (c *controller) CreateServer(tenant string, server api.CreateServerRequest) (resp interface{}, err error) {
-	nInstances := 1
+// instanceSSH returns the external IP mapped to an instance and the port at
+// which ssh is reached through it.
+func (c *controller) instanceSSH(instanceID string) (api.SSHAccess, error) {
+	for _, m := range c.ds.GetMappedIPs(nil) {
+		if m.InstanceID == instanceID {
+			return api.SSHAccess{
+				SSHIP:   m.ExternalIP,
+				SSHPort: *instanceSSHPort,
+			}, nil
+		}
+	}
 
+	return api.SSHAccess{}, api.ErrNoExternalIP
+}
+
+// serverInstances returns the number of instances requested by server.
+func serverInstances(server api.CreateServerRequest) int {
 	if server.Server.MaxInstances > 0 {
-		nInstances = server.Server.MaxInstances
+		return server.Server.MaxInstances
 	} else if server.Server.MinInstances > 0 {
-		nInstances = server.Server.MinInstances
+		return server.Server.MinInstances
+	}
+
+	return 1
+}
+
+// Between 1 and 64 (HOST_NAME_MAX) alphanum (+ "-")
+var serverNameRegexp = regexp.MustCompile("^[a-z0-9-]{1,64}$")
+
+func (c *controller) CreateServer(tenant string, server api.CreateServerRequest) (resp interface{}, err error) {
+	nInstances := serverInstances(server)
+
+	err = c.checkTenantActive(tenant)
+	if err != nil {
+		return server, err
 	}
 
 	if server.Server.Name != "" {
-		// Between 1 and 64 (HOST_NAME_MAX) alphanum (+ "-")
-		r := regexp.MustCompile("^[a-z0-9-]{1,64}$")
-		if !r.MatchString(server.Server.Name) {
+		if !serverNameRegexp.MatchString(server.Server.Name) {
 			return server, types.ErrBadName
 		}
 	}
 
+	wl, err := c.ds.GetWorkload(server.Server.WorkloadID)
+	if err != nil {
+		return server, err
+	}
+
+	err = c.checkWorkloadRequirements(tenant, wl)
+	if err != nil {
+		return server, err
+	}
+
+	volumes, err := c.checkBootVolumes(tenant, server.Server.BlockDeviceMapping, nInstances)
+	if err != nil {
+		return server, err
+	}
+
+	nodeID, exclude, err := c.checkSchedulerHints(tenant, server)
+	if err != nil {
+		return server, err
+	}
+
+	mac, err := checkServerNetworks(server, nInstances)
+	if err != nil {
+		return server, err
+	}
+
+	if mac != "" {
+		inUse, err := c.macAddressInUse(tenant, mac)
+		if err != nil {
+			return server, err
+		}
+
+		if inUse {
+			return server, api.ErrMACAddressInUse
+		}
+	}
+
 	label := server.Server.Metadata["label"]
 
 	w := types.WorkloadRequest{
@@ -80,20 +149,32 @@ func (c *controller) CreateServer(tenant string, server api.CreateServerRequest)
 		Instances:  nInstances,
 		TraceLabel: label,
 		Name:       server.Server.Name,
+		Volumes:    volumes,
+		NodeID:     nodeID,
+		Exclude:    exclude,
+		MACAddress: mac,
 	}
 	var e error
-	instances, err := c.startWorkload(w)
+	instances, err := c.startIndexedWorkload(w)
 	if err != nil {
 		e = err
 	}
 
 	var servers api.Servers
 
-	for _, instance := range instances {
+	// servers are returned in the order in which they were requested,
+	// each tagged with its index within the request.
+	for i, instance := range instances {
+		if instance == nil {
+			continue
+		}
+
 		server, err := instanceToServer(c, instance)
 		if err != nil && e == nil {
 			e = err
 		}
+		index := i
+		server.Index = &index
 		servers.Servers = append(servers.Servers, server)
 	}
 
@@ -106,10 +187,10 @@ func (c *controller) CreateServer(tenant string, server api.CreateServerRequest)
 		return server, e
 	}
 
-	servers.TotalServers = len(instances)
+	servers.TotalServers = len(servers.Servers)
 
 	// set machine ID for OpenStack compatibility
-	server.Server.ID = instances[0].ID
+	server.Server.ID = servers.Servers[0].ID
 
 	// builtServers is define to meet OpenStack compatibility on result
 	// format and keep CIAOs legacy behavior.
@@ -129,6 +210,298 @@ func (c *controller) CreateServer(tenant string, server api.CreateServerRequest)
 	return builtServers, nil
 }
 
+// CheckServer runs the admission checks of CreateServer without creating
+// any instance or consuming any quota. The reasons for which the request
+// would be rejected are returned in the response.
+func (c *controller) CheckServer(tenant string, server api.CreateServerRequest) (api.CreateServerCheckResponse, error) {
+	var reasons []string
+
+	nInstances := serverInstances(server)
+
+	err := c.checkTenantActive(tenant)
+	if err == types.ErrTenantDeleting {
+		reasons = append(reasons, err.Error())
+	} else if err != nil {
+		return api.CreateServerCheckResponse{}, err
+	}
+
+	if server.Server.Name != "" {
+		if !serverNameRegexp.MatchString(server.Server.Name) {
+			reasons = append(reasons, types.ErrBadName.Error())
+		} else {
+			for i := 0; i < nInstances; i++ {
+				name := server.Server.Name
+				if nInstances > 1 {
+					name = fmt.Sprintf("%s-%d", name, i)
+				}
+
+				id, err := c.ds.ResolveInstance(tenant, name)
+				if err != nil {
+					return api.CreateServerCheckResponse{}, err
+				}
+
+				if id != "" {
+					reasons = append(reasons, fmt.Sprintf("Instance name already in use: %s", name))
+				}
+			}
+		}
+	}
+
+	_, err = c.checkBootVolumes(tenant, server.Server.BlockDeviceMapping, nInstances)
+	if err != nil {
+		reasons = append(reasons, err.Error())
+	}
+
+	_, _, err = c.checkSchedulerHints(tenant, server)
+	if hintsErr, ok := err.(*api.SchedulerHintsError); ok {
+		reasons = append(reasons, hintsErr.Reasons...)
+	} else if err != nil {
+		reasons = append(reasons, err.Error())
+	}
+
+	mac, err := checkServerNetworks(server, nInstances)
+	if err != nil {
+		reasons = append(reasons, err.Error())
+	} else if mac != "" {
+		inUse, err := c.macAddressInUse(tenant, mac)
+		if err != nil {
+			return api.CreateServerCheckResponse{}, err
+		}
+
+		if inUse {
+			reasons = append(reasons, api.ErrMACAddressInUse.Error())
+		}
+	}
+
+	wl, err := c.ds.GetWorkload(server.Server.WorkloadID)
+	if err != nil {
+		reasons = append(reasons, types.ErrWorkloadNotFound.Error())
+		return api.CreateServerCheckResponse{Reasons: reasons}, nil
+	}
+
+	err = c.checkWorkloadRequirements(tenant, wl)
+	if err == types.ErrPrivilegedNotPermitted || err == types.ErrNoWorkloadResources {
+		reasons = append(reasons, err.Error())
+	} else if err != nil {
+		return api.CreateServerCheckResponse{}, err
+	}
+
+	if !isCNCIWorkload(&wl) {
+		resources := []payloads.RequestedResource{
+			{Type: payloads.Instance, Value: 1},
+			{Type: payloads.MemMB, Value: wl.Requirements.MemMB},
+			{Type: payloads.VCPUs, Value: wl.Requirements.VCPUs}}
+		res := <-c.qs.Check(tenant, nInstances, resources...)
+		if !res.Allowed() {
+			reasons = append(reasons, res.Reason())
+		}
+	}
+
+	if reason := c.checkCapacity(wl, nInstances); reason != "" {
+		reasons = append(reasons, reason)
+	}
+
+	return api.CreateServerCheckResponse{
+		Admitted: len(reasons) == 0,
+		Reasons:  reasons,
+	}, nil
+}
+
+// checkWorkloadRequirements verifies that the tenant may launch instances
+// of wl. Privileged workloads require the tenant to be permitted privileged
+// containers and VM workloads must require some memory and VCPUs.
+func (c *controller) checkWorkloadRequirements(tenant string, wl types.Workload) error {
+	if wl.Requirements.Privileged {
+		t, err := c.ds.GetTenant(tenant)
+		if err != nil {
+			return err
+		}
+
+		if t == nil || !t.Permissions.PrivilegedContainers {
+			return types.ErrPrivilegedNotPermitted
+		}
+	}
+
+	if wl.VMType == payloads.QEMU && (wl.Requirements.MemMB <= 0 || wl.Requirements.VCPUs <= 0) {
+		return types.ErrNoWorkloadResources
+	}
+
+	return nil
+}
+
+// checkCapacity uses the last statistics reported by the ready nodes to
+// check whether there is enough memory available to run n instances of wl.
+// An empty string is returned if the instances would fit.
+func (c *controller) checkCapacity(wl types.Workload, n int) string {
+	var fit int
+	var ready bool
+
+	for _, node := range c.ds.GetNodeLastStats().Nodes {
+		if node.Status != string(types.NodeStatusReady) {
+			continue
+		}
+
+		ready = true
+		if wl.Requirements.MemMB <= 0 {
+			return ""
+		}
+		fit += node.MemAvailable / wl.Requirements.MemMB
+	}
+
+	if !ready {
+		return "No compute nodes are ready"
+	}
+
+	if fit < n {
+		return fmt.Sprintf("Insufficient capacity: only %d of %d instances would fit", fit, n)
+	}
+
+	return ""
+}
+
+// checkSchedulerHints validates the scheduler hints of server and resolves
+// them into the node the instances must be placed on and the nodes they
+// must not be placed on. An *api.SchedulerHintsError is returned if the
+// hints cannot be satisfied.
+func (c *controller) checkSchedulerHints(tenant string, server api.CreateServerRequest) (string, []string, error) {
+	hints := server.Server.SchedulerHints
+	if hints == nil {
+		return "", nil, nil
+	}
+
+	var reasons []string
+	nodeID := hints.TargetNode
+
+	if nodeID != "" {
+		if _, err := c.ds.GetNode(nodeID); err != nil {
+			return "", nil, types.ErrNodeNotFound
+		}
+	}
+
+	for _, id := range hints.SameHost {
+		instance, err := c.ds.GetTenantInstance(tenant, id)
+		if err != nil {
+			return "", nil, types.ErrInstanceNotFound
+		}
+
+		if instance.NodeID == "" {
+			reasons = append(reasons, fmt.Sprintf("Instance %s has not been placed on a node", id))
+		} else if nodeID == "" {
+			nodeID = instance.NodeID
+		} else if nodeID != instance.NodeID {
+			reasons = append(reasons, fmt.Sprintf("Instance %s is not on node %s", id, nodeID))
+		}
+	}
+
+	var exclude []string
+	for _, id := range hints.DifferentHost {
+		instance, err := c.ds.GetTenantInstance(tenant, id)
+		if err != nil {
+			return "", nil, types.ErrInstanceNotFound
+		}
+
+		if instance.NodeID == "" {
+			reasons = append(reasons, fmt.Sprintf("Instance %s has not been placed on a node", id))
+			continue
+		}
+
+		if instance.NodeID == nodeID {
+			reasons = append(reasons, fmt.Sprintf("Instance %s is on node %s", id, nodeID))
+		}
+		exclude = append(exclude, instance.NodeID)
+	}
+
+	if wl, err := c.ds.GetWorkload(server.Server.WorkloadID); err == nil {
+		if nodeID != "" && wl.Requirements.NodeID != "" && wl.Requirements.NodeID != nodeID {
+			reasons = append(reasons, fmt.Sprintf("Workload must be placed on node %s", wl.Requirements.NodeID))
+		}
+	}
+
+	if len(reasons) == 0 && nodeID == "" && len(exclude) > 0 {
+		available := false
+		for _, node := range c.ds.GetNodeLastStats().Nodes {
+			if node.Status != string(types.NodeStatusReady) {
+				continue
+			}
+
+			excluded := false
+			for _, e := range exclude {
+				if node.ID == e {
+					excluded = true
+					break
+				}
+			}
+
+			if !excluded {
+				available = true
+				break
+			}
+		}
+
+		if !available {
+			reasons = append(reasons, "No other ready node is available")
+		}
+	}
+
+	if len(reasons) > 0 {
+		return "", nil, &api.SchedulerHintsError{Reasons: reasons}
+	}
+
+	return nodeID, exclude, nil
+}
+
+// checkServerNetworks validates the network configuration of server and
+// returns the MAC address requested for its instance, if any. A MAC address
+// may only be requested for a single instance and must be a locally
+// administered unicast address outside of the 02:00 prefix from which the
+// addresses of instances are generated.
+func checkServerNetworks(server api.CreateServerRequest, nInstances int) (string, error) {
+	networks := server.Server.Networks
+	if len(networks) == 0 {
+		return "", nil
+	}
+
+	if len(networks) > 1 {
+		return "", types.ErrBadRequest
+	}
+
+	if networks[0].MacAddr == "" {
+		return "", nil
+	}
+
+	if nInstances > 1 {
+		return "", types.ErrBadRequest
+	}
+
+	mac, err := net.ParseMAC(networks[0].MacAddr)
+	if err != nil || len(mac) != 6 {
+		return "", api.ErrBadMACAddress
+	}
+
+	if mac[0]&0x02 == 0 || mac[0]&0x01 != 0 || (mac[0] == 0x02 && mac[1] == 0x00) {
+		return "", api.ErrBadMACAddress
+	}
+
+	return mac.String(), nil
+}
+
+// macAddressInUse returns true if mac is the MAC address of one of the
+// instances of tenant.
+func (c *controller) macAddressInUse(tenant string, mac string) (bool, error) {
+	instances, err := c.ds.GetAllInstancesFromTenant(tenant)
+	if err != nil {
+		return false, err
+	}
+
+	for _, i := range instances {
+		if i.MACAddress == mac {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func (c *controller) ListServersDetail(tenant string) ([]api.ServerDetails, error) {
 	var servers []api.ServerDetails
 	var err error
@@ -174,6 +547,48 @@ func (c *controller) ShowServerDetails(tenant string, server string) (api.Server
 	return s, nil
 }
 
+// instanceWaitInterval is how often the status of an instance is checked
+// while waiting for it to reach a given status.
+const instanceWaitInterval = 250 * time.Millisecond
+
+// WaitServerStatus waits for an instance to reach status. The details of the
+// instance are returned as soon as it does or, flagged as timed out, once
+// timeout elapses. Waiting stops early if ctx is done.
+func (c *controller) WaitServerStatus(ctx context.Context, tenant string, server string, status string, timeout time.Duration) (api.Server, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	ticker := time.NewTicker(instanceWaitInterval)
+	defer ticker.Stop()
+
+	for {
+		s, err := c.ShowServerDetails(tenant, server)
+		if err != nil || s.Server.Status == status {
+			return s, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return s, ctx.Err()
+		case <-timer.C:
+			s.TimedOut = true
+			return s, nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ShowServerSSH returns the ssh connection information of an instance
+// with an external IP.
+func (c *controller) ShowServerSSH(tenant string, server string) (api.SSHAccess, error) {
+	instance, err := c.ds.GetTenantInstance(tenant, server)
+	if err != nil {
+		return api.SSHAccess{}, err
+	}
+
+	return c.instanceSSH(instance.ID)
+}
+
 func (c *controller) DeleteServer(tenant string, server string) error {
 	/* First check that the instance belongs to this tenant */
 	_, err := c.ds.GetTenantInstance(tenant, server)
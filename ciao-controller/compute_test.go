@@ -34,6 +34,7 @@ import (
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/ssntp"
 	"github.com/ciao-project/ciao/testutil"
+	"github.com/ciao-project/ciao/uuid"
 	"github.com/pkg/errors"
 )
 
@@ -144,6 +145,346 @@ func testCreateServer(t *testing.T, n int) api.Servers {
 	return servers
 }
 
+func TestCreateServerDryRun(t *testing.T) {
+	tenant, err := ctl.ds.GetTenant(testutil.ComputeUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatalf("No valid workloads for tenant: %s\n", tenant.ID)
+	}
+
+	before, err := ctl.ds.GetAllInstancesFromTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := testutil.ComputeURL + "/" + tenant.ID + "/instances?dry_run=true"
+
+	var server api.CreateServerRequest
+	server.Server.MaxInstances = 3
+	server.Server.WorkloadID = wls[0].ID
+
+	b, err := json.Marshal(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := testHTTPRequest(t, "POST", url, http.StatusOK, b, true)
+
+	var check api.CreateServerCheckResponse
+	err = json.Unmarshal(body, &check)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !check.Admitted && len(check.Reasons) == 0 {
+		t.Fatal("Rejected dry run should have reasons")
+	}
+
+	after, err := ctl.ds.GetAllInstancesFromTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(after) != len(before) {
+		t.Fatalf("Dry run created instances: %d before, %d after", len(before), len(after))
+	}
+
+	server.Server.WorkloadID = "not-a-workload"
+	b, err = json.Marshal(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body = testHTTPRequest(t, "POST", url, http.StatusOK, b, true)
+
+	check = api.CreateServerCheckResponse{}
+	err = json.Unmarshal(body, &check)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if check.Admitted || len(check.Reasons) != 1 || check.Reasons[0] != types.ErrWorkloadNotFound.Error() {
+		t.Fatalf("Unexpected dry run result for invalid workload: %+v", check)
+	}
+}
+
+func TestCreateServerBlockDeviceMapping(t *testing.T) {
+	tenant, err := ctl.ds.GetTenant(testutil.ComputeUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatalf("No valid workloads for tenant: %s\n", tenant.ID)
+	}
+
+	volID := createTestVolume(tenant.ID, 20, t)
+
+	var server api.CreateServerRequest
+	server.Server.WorkloadID = wls[0].ID
+	server.Server.BlockDeviceMapping = []api.BlockDeviceMapping{
+		{VolumeID: volID, MountPoint: "/dev/vdc"},
+	}
+
+	_, err = ctl.CreateServer(tenant.ID, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attachments, err := ctl.ds.GetVolumeAttachments(volID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(attachments) != 1 {
+		t.Fatalf("Expected 1 attachment, got %d", len(attachments))
+	}
+
+	bd, err := ctl.ds.GetBlockDevice(volID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bd.State != types.InUse {
+		t.Fatalf("Expected volume to be in use, got %s", bd.State)
+	}
+
+	// the volume is now attached
+	_, err = ctl.CreateServer(tenant.ID, server)
+	if err != api.ErrVolumeAttached {
+		t.Fatalf("Expected %v, got %v", api.ErrVolumeAttached, err)
+	}
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Server.BlockDeviceMapping[0].VolumeID = createTestVolume(other.ID, 20, t)
+	_, err = ctl.CreateServer(tenant.ID, server)
+	if err != api.ErrVolumeOwner {
+		t.Fatalf("Expected %v, got %v", api.ErrVolumeOwner, err)
+	}
+
+	server.Server.BlockDeviceMapping[0].VolumeID = createTestVolume(tenant.ID, 20, t)
+	server.Server.MaxInstances = 2
+	_, err = ctl.CreateServer(tenant.ID, server)
+	if err != types.ErrBadRequest {
+		t.Fatalf("Expected %v, got %v", types.ErrBadRequest, err)
+	}
+}
+
+func TestCreateServerWorkloadRequirements(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatalf("No valid workloads for tenant: %s\n", tenant.ID)
+	}
+
+	privileged := wls[0]
+	privileged.ID = uuid.Generate().String()
+	privileged.Requirements.Privileged = true
+
+	noResources := wls[0]
+	noResources.ID = uuid.Generate().String()
+	noResources.Requirements.MemMB = 0
+
+	for _, wl := range []types.Workload{privileged, noResources} {
+		err = ctl.ds.AddWorkload(wl)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		workloadID string
+		err        error
+	}{
+		{privileged.ID, types.ErrPrivilegedNotPermitted},
+		{noResources.ID, types.ErrNoWorkloadResources},
+	} {
+		var server api.CreateServerRequest
+		server.Server.WorkloadID = tt.workloadID
+
+		_, err = ctl.CreateServer(tenant.ID, server)
+		if err != tt.err {
+			t.Fatalf("Expected %v, got %v", tt.err, err)
+		}
+
+		check, err := ctl.CheckServer(tenant.ID, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if check.Admitted || len(check.Reasons) == 0 || check.Reasons[0] != tt.err.Error() {
+			t.Fatalf("Unexpected dry run result: %+v", check)
+		}
+	}
+
+	instances, err := ctl.ds.GetAllInstancesFromTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(instances) != 0 {
+		t.Fatalf("Expected no instances, got %d", len(instances))
+	}
+}
+
+func TestCreateServerSchedulerHints(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	instance := instances[0]
+
+	var server api.CreateServerRequest
+	server.Server.WorkloadID = instance.WorkloadID
+	server.Server.SchedulerHints = &api.SchedulerHints{
+		SameHost: []string{instance.ID},
+	}
+
+	nodeID, _, err := ctl.checkSchedulerHints(instance.TenantID, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if nodeID != testutil.AgentUUID {
+		t.Fatalf("Expected node %s, got %s", testutil.AgentUUID, nodeID)
+	}
+
+	server.Server.SchedulerHints = &api.SchedulerHints{
+		DifferentHost: []string{instance.ID},
+		TargetNode:    testutil.AgentUUID,
+	}
+
+	_, err = ctl.CreateServer(instance.TenantID, server)
+	if _, ok := err.(*api.SchedulerHintsError); !ok {
+		t.Fatalf("Expected scheduler hints error, got %v", err)
+	}
+
+	server.Server.SchedulerHints = &api.SchedulerHints{
+		TargetNode: "unknownnode",
+	}
+
+	_, err = ctl.CreateServer(instance.TenantID, server)
+	if err != types.ErrNodeNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrNodeNotFound, err)
+	}
+
+	server.Server.SchedulerHints = &api.SchedulerHints{
+		DifferentHost: []string{"unknowninstance"},
+	}
+
+	_, err = ctl.CreateServer(instance.TenantID, server)
+	if err != types.ErrInstanceNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrInstanceNotFound, err)
+	}
+}
+
+func TestCreateServerMACAddress(t *testing.T) {
+	tenant, err := ctl.ds.GetTenant(testutil.ComputeUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(wls) == 0 {
+		t.Fatalf("No valid workloads for tenant: %s\n", tenant.ID)
+	}
+
+	var server api.CreateServerRequest
+	server.Server.WorkloadID = wls[0].ID
+	server.Server.Networks = []api.ServerNetwork{
+		{MacAddr: "06:12:34:56:78:9A"},
+	}
+
+	_, err = ctl.CreateServer(tenant.ID, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instances, err := ctl.ds.GetAllInstancesFromTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, i := range instances {
+		if i.MACAddress == "06:12:34:56:78:9a" {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		t.Fatal("No instance created with the requested MAC address")
+	}
+
+	// the MAC address is now in use
+	_, err = ctl.CreateServer(tenant.ID, server)
+	if err != api.ErrMACAddressInUse {
+		t.Fatalf("Expected %v, got %v", api.ErrMACAddressInUse, err)
+	}
+
+	check, err := ctl.CheckServer(tenant.ID, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if check.Admitted || len(check.Reasons) == 0 || check.Reasons[0] != api.ErrMACAddressInUse.Error() {
+		t.Fatalf("Unexpected dry run result: %+v", check)
+	}
+
+	for _, tt := range []struct {
+		mac       string
+		instances int
+		err       error
+	}{
+		{"not-a-mac", 1, api.ErrBadMACAddress},
+		{"00:12:34:56:78:9a", 1, api.ErrBadMACAddress},
+		{"07:12:34:56:78:9a", 1, api.ErrBadMACAddress},
+		{"02:00:ac:10:00:02", 1, api.ErrBadMACAddress},
+		{"06:12:34:56:78:9b", 2, types.ErrBadRequest},
+	} {
+		server.Server.Networks[0].MacAddr = tt.mac
+		server.Server.MaxInstances = tt.instances
+
+		_, err = ctl.CreateServer(tenant.ID, server)
+		if err != tt.err {
+			t.Fatalf("%s: expected %v, got %v", tt.mac, tt.err, err)
+		}
+	}
+}
+
 func testListServerDetailsTenant(t *testing.T, tenantID string) api.Servers {
 	url := testutil.ComputeURL + "/" + tenantID + "/instances/detail"
 
@@ -162,6 +503,20 @@ func TestCreateSingleServer(t *testing.T) {
 	_ = testCreateServer(t, 1)
 }
 
+func TestCreateServersIndexed(t *testing.T) {
+	servers := testCreateServer(t, 5)
+
+	for i, s := range servers.Servers {
+		if s.Index == nil {
+			t.Fatalf("Server %s has no index", s.ID)
+		}
+
+		if *s.Index != i {
+			t.Fatalf("Expected server %s to have index %d, got %d", s.ID, i, *s.Index)
+		}
+	}
+}
+
 func TestListServerDetailsTenant(t *testing.T) {
 	tenant, err := ctl.ds.GetTenant(testutil.ComputeUser)
 	if err != nil {
@@ -17,14 +17,20 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -252,7 +258,7 @@ func BenchmarkNewConfig(b *testing.B) {
 
 	b.ResetTimer()
 	for n := 0; n < b.N; n++ {
-		_, err := newConfig(ctl, &wls[0], id.String(), tenant.ID, fmt.Sprintf("test-%d", n), ip)
+		_, err := newConfig(ctl, &wls[0], id.String(), tenant.ID, fmt.Sprintf("test-%d", n), ip, "")
 		if err != nil {
 			b.Error(err)
 		}
@@ -425,6 +431,60 @@ func TestDeleteInstance(t *testing.T) {
 	}
 }
 
+func TestDeleteInstanceReleasesExternalIP(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	poolName := "testdeletemapped"
+	pool, err := ctl.AddPool(poolName, nil, []string{"10.15.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseCh := server.AddCmdChan(ssntp.ReleasePublicIP)
+	deleteCh := server.AddCmdChan(ssntp.DELETE)
+
+	err = ctl.DeleteServer(instances[0].TenantID, instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := server.GetCmdChanResult(releaseCh, ssntp.ReleasePublicIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != instances[0].ID || result.TenantUUID != instances[0].TenantID {
+		t.Fatalf("Unexpected release of public IP %+v", result)
+	}
+
+	result, err = server.GetCmdChanResult(deleteCh, ssntp.DELETE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InstanceUUID != instances[0].ID {
+		t.Fatal("Did not get correct Instance ID")
+	}
+
+	err = ctl.ds.UnMapExternalIP(m.ExternalIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DeletePool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestStopInstance(t *testing.T) {
 	var reason payloads.StartFailureReason
 
@@ -530,6 +590,19 @@ func TestRestoreNode(t *testing.T) {
 	}
 	defer client.Shutdown()
 
+	// only evacuated nodes may be restored
+	evacuateCh := server.AddCmdChan(ssntp.EVACUATE)
+
+	err = ctl.EvacuateNode(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.GetCmdChanResult(evacuateCh, ssntp.EVACUATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	serverCh := server.AddCmdChan(ssntp.Restore)
 
 	err = ctl.RestoreNode(client.UUID)
@@ -546,6 +619,147 @@ func TestRestoreNode(t *testing.T) {
 	}
 }
 
+func TestNodeEvacuation(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 2, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	_, err := ctl.NodeEvacuation(client.UUID)
+	if err != types.ErrNodeNotEvacuated {
+		t.Fatalf("Expected %v, got %v", types.ErrNodeNotEvacuated, err)
+	}
+
+	serverCh := server.AddCmdChan(ssntp.EVACUATE)
+
+	err = ctl.EvacuateNode(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.GetCmdChanResult(serverCh, ssntp.EVACUATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	action, err := ctl.NodeEvacuation(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action.TotalInstances < len(instances) ||
+		action.MigratedInstances+action.RemainingInstances != action.TotalInstances {
+		t.Fatalf("Unexpected evacuation progress: %+v", action)
+	}
+
+	// deleted instances have left the node
+	before := action.MigratedInstances
+	err = ctl.ds.DeleteInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	action, err = ctl.NodeEvacuation(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action.MigratedInstances != before+1 {
+		t.Fatalf("Expected %d migrated instances, got %d", before+1, action.MigratedInstances)
+	}
+
+	serverCh = server.AddCmdChan(ssntp.Restore)
+
+	err = ctl.RestoreNode(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.GetCmdChanResult(serverCh, ssntp.Restore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.RestoreNode(client.UUID)
+	if err != types.ErrNodeNotEvacuated {
+		t.Fatalf("Expected %v, got %v", types.ErrNodeNotEvacuated, err)
+	}
+
+	err = ctl.EvacuateNode("unknownnode")
+	if err != types.ErrNodeNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrNodeNotFound, err)
+	}
+}
+
+func TestNodeEvacuationRestart(t *testing.T) {
+	client, err := testutil.NewSsntpTestClientConnection("EvacuationRestart", ssntp.AGENT, testutil.AgentUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	serverCh := server.AddCmdChan(ssntp.EVACUATE)
+
+	err = ctl.EvacuateNode(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.GetCmdChanResult(serverCh, ssntp.EVACUATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted controller only knows the status reported by the node
+	ctl.evacuationsLock.Lock()
+	ctl.evacuations = nil
+	ctl.evacuationsLock.Unlock()
+
+	_, err = ctl.NodeEvacuation(client.UUID)
+	if err != types.ErrNodeNotEvacuated {
+		t.Fatalf("Expected %v, got %v", types.ErrNodeNotEvacuated, err)
+	}
+
+	err = ctl.ds.HandleStats(payloads.Stat{
+		NodeUUID: client.UUID,
+		Status:   string(types.NodeStatusMaintenance),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restore the stats reported by the test node
+	defer sendStatsCmd(client, t)
+
+	action, err := ctl.NodeEvacuation(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if action.MigratedInstances != 0 || action.RemainingInstances != action.TotalInstances {
+		t.Fatalf("Unexpected evacuation progress: %+v", action)
+	}
+
+	serverCh = server.AddCmdChan(ssntp.Restore)
+
+	err = ctl.RestoreNode(client.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := server.GetCmdChanResult(serverCh, ssntp.Restore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NodeUUID != client.UUID {
+		t.Fatal("Did not get node ID")
+	}
+}
+
 func TestAttachVolume(t *testing.T) {
 	client, err := testutil.NewSsntpTestClientConnection("AttachVolume", ssntp.AGENT, testutil.AgentUUID)
 	if err != nil {
@@ -557,7 +771,7 @@ func TestAttachVolume(t *testing.T) {
 
 	// ok to not send workload first?
 
-	err = ctl.client.attachVolume("volID", "instanceID", client.UUID)
+	err = ctl.client.attachVolume("volID", "instanceID", client.UUID, false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -631,7 +845,7 @@ func doAttachVolumeCommand(t *testing.T, fail bool) (client *testutil.SsntpTestC
 		}()
 	}
 
-	err := ctl.AttachVolume(tenantID, data.ID, instances[0].ID, "")
+	_, err := ctl.AttachVolume(tenantID, data.ID, instances[0].ID, "/dev/vdc", false)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -684,127 +898,380 @@ func doAttachVolumeCommand(t *testing.T, fail bool) (client *testutil.SsntpTestC
 }
 
 func TestAttachVolumeCommand(t *testing.T) {
-	client, _, _, _ := doAttachVolumeCommand(t, false)
-	client.Ssntp.Close()
-}
-
-func TestAttachVolumeFailure(t *testing.T) {
-	client, _, _, _ := doAttachVolumeCommand(t, true)
-	client.Ssntp.Close()
-}
-
-func doDetachVolumeCommand(t *testing.T, fail bool) {
-	// attach volume should succeed for this test
 	client, tenantID, volume, instanceID := doAttachVolumeCommand(t, false)
 	defer client.Ssntp.Close()
 
-	sendStatsCmd(client, t)
-
-	data, err := ctl.ds.GetBlockDevice(volume)
+	vol, err := ctl.ShowVolumeDetails(tenantID, volume)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if data.State != types.InUse {
-		t.Fatalf("expected state %s, got %s\n", types.Detaching, data.State)
+	expected := []types.VolumeAttachment{
+		{InstanceID: instanceID, Mountpoint: "/dev/vdc"},
+	}
+	if !reflect.DeepEqual(vol.Attachments, expected) {
+		t.Fatalf("expected attachments %v got %v", expected, vol.Attachments)
 	}
 
-	if fail {
-		err := ctl.DetachVolume(tenantID, volume, "")
-		if err == nil {
-			t.Fatal("Expected error when detaching volume from active instance")
-
-		}
-
-		data, err := ctl.ds.GetBlockDevice(volume)
-		if err != nil {
-			t.Fatal(err)
-
-		}
-
-		if data.State != types.InUse {
-			t.Fatalf("expected state %s, got %s\n", types.Detaching, data.State)
-		}
-	} else {
-		serverCh := server.AddCmdChan(ssntp.DELETE)
-		clientCh := client.AddCmdChan(ssntp.DELETE)
+	vols, err := ctl.ListVolumesDetail(tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		err := ctl.stopInstance(instanceID)
-		if err != nil {
-			t.Fatal(err)
-		}
+	if len(vols) != 1 || !reflect.DeepEqual(vols[0].Attachments, expected) {
+		t.Fatalf("expected attachments %v in %v", expected, vols)
+	}
+}
 
-		result, err := server.GetCmdChanResult(serverCh, ssntp.DELETE)
-		if err != nil {
-			t.Fatal(err)
-		}
+func TestAttachVolumeMountpoints(t *testing.T) {
+	client, tenantID, _, instanceID := doAttachVolumeCommand(t, false)
+	defer client.Ssntp.Close()
 
-		_, err = client.GetCmdChanResult(clientCh, ssntp.DELETE)
-		if err != nil {
-			t.Fatal(err)
+	for _, tt := range []struct {
+		mountpoint string
+		expected   string
+		err        error
+	}{
+		{"vdc", "", api.ErrMountpointInUse},
+		{"/dev/../etc/passwd", "", api.ErrBadMountpoint},
+		{"", "/dev/vdb", nil},
+		{"", "/dev/vdd", nil},
+		{"/dev//vde/", "/dev/vde", nil},
+		{"/dev/vde", "", api.ErrMountpointInUse},
+	} {
+		data := addTestBlockDevice(t, tenantID)
+
+		var serverCh chan testutil.Result
+		if tt.err == nil {
+			serverCh = server.AddCmdChan(ssntp.AttachVolume)
 		}
 
-		if result.InstanceUUID != instanceID {
-			t.Fatal("Did not get correct Instance ID")
+		mountpoint, err := ctl.AttachVolume(tenantID, data.ID, instanceID, tt.mountpoint, false)
+		if err != tt.err {
+			t.Fatalf("%q: expected %v got %v", tt.mountpoint, tt.err, err)
 		}
 
-		err = sendStopEvent(client, instanceID)
-		if err != nil {
-			t.Fatal(err)
+		if mountpoint != tt.expected {
+			t.Fatalf("%q: expected mountpoint %q got %q", tt.mountpoint, tt.expected, mountpoint)
 		}
 
-		err = ctl.DetachVolume(tenantID, volume, "")
 		if err != nil {
-			t.Fatal(err)
+			continue
 		}
 
-		data, err := ctl.ds.GetBlockDevice(volume)
+		_, err = server.GetCmdChanResult(serverCh, ssntp.AttachVolume)
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		if data.State != types.Available {
-			t.Fatalf("expected state %s, got %s\n", types.Detaching, data.State)
-		}
 	}
 }
 
-func TestDetachVolumeCommand(t *testing.T) {
-	doDetachVolumeCommand(t, false)
-}
-
-func TestDetachVolumeFailure(t *testing.T) {
-	doDetachVolumeCommand(t, true)
-}
-
-func TestDetachVolumeByAttachment(t *testing.T) {
+func TestAvailableVolumeAttachments(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = ctl.DetachVolume(tenant.ID, "invalidVolume", "attachmentID")
-	if err == nil {
-		t.Fatal("Detach by attachment ID not supported yet")
+	vol, err := ctl.ShowVolumeDetails(tenant.ID, createTestVolume(tenant.ID, 1, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vol.Attachments == nil || len(vol.Attachments) != 0 {
+		t.Fatalf("expected no attachments got %v", vol.Attachments)
 	}
 }
 
-func TestInstanceDeletedEvent(t *testing.T) {
+func TestAttachVolumeFailure(t *testing.T) {
+	client, _, _, _ := doAttachVolumeCommand(t, true)
+	client.Ssntp.Close()
+}
+
+func TestAttachVolumeReadOnly(t *testing.T) {
 	var reason payloads.StartFailureReason
 
 	client, instances := testStartWorkload(t, 1, false, reason)
-	defer client.Shutdown()
+	defer client.Ssntp.Close()
+
+	tenantID := instances[0].TenantID
+
+	// the readers are started one at a time as the instances of a
+	// workload start in no particular order.
+	for i := 0; i < 2; i++ {
+		clientCmdCh := client.AddCmdChan(ssntp.START)
+
+		w := types.WorkloadRequest{
+			WorkloadID: instances[0].WorkloadID,
+			TenantID:   tenantID,
+			Instances:  1,
+		}
+		newInstances, err := ctl.startWorkload(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.GetCmdChanResult(clientCmdCh, ssntp.START)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		instances = append(instances, newInstances...)
+	}
 
 	sendStatsCmd(client, t)
 
-	serverCh := server.AddCmdChan(ssntp.DELETE)
+	data := addTestBlockDevice(t, tenantID)
 
-	err := ctl.deleteInstance(instances[0].ID)
+	serverCh := server.AddCmdChan(ssntp.AttachVolume)
+	_, err := ctl.AttachVolume(tenantID, data.ID, instances[0].ID, "", false)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	_, err = server.GetCmdChanResult(serverCh, ssntp.DELETE)
+	result, err := server.GetCmdChanResult(serverCh, ssntp.AttachVolume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.ReadOnly {
+		t.Fatal("Volume attached read-only")
+	}
+
+	// read-only attachments are only made to stopped instances
+	_, err = ctl.AttachVolume(tenantID, data.ID, instances[1].ID, "", true)
+	if err != api.ErrInstanceNotStopped {
+		t.Fatalf("expected %v got %v", api.ErrInstanceNotStopped, err)
+	}
+
+	for _, i := range instances[1:] {
+		err = ctl.ds.InstanceStopped(i.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the volume may only be written by a single instance
+	_, err = ctl.AttachVolume(tenantID, data.ID, instances[1].ID, "", false)
+	if err != api.ErrVolumeNotAvailable {
+		t.Fatalf("expected %v got %v", api.ErrVolumeNotAvailable, err)
+	}
+
+	for _, i := range instances[1:] {
+		serverCh = server.AddCmdChan(ssntp.AttachVolume)
+		_, err = ctl.AttachVolume(tenantID, data.ID, i.ID, "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err = server.GetCmdChanResult(serverCh, ssntp.AttachVolume)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !result.ReadOnly || result.InstanceUUID != i.ID {
+			t.Fatalf("expected read-only attachment to %s got %v", i.ID, result)
+		}
+	}
+
+	_, err = ctl.AttachVolume(tenantID, data.ID, instances[1].ID, "", true)
+	if err != api.ErrVolumeAttached {
+		t.Fatalf("expected %v got %v", api.ErrVolumeAttached, err)
+	}
+
+	vol, err := ctl.ShowVolumeDetails(tenantID, data.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vol.State != types.InUse || len(vol.Attachments) != len(instances) {
+		t.Fatalf("expected %d attachments to volume in use got %v", len(instances), vol)
+	}
+
+	for _, a := range vol.Attachments {
+		if a.ReadOnly != (a.InstanceID != instances[0].ID) {
+			t.Fatalf("unexpected attachment %v", a)
+		}
+	}
+}
+
+func doDetachVolumeCommand(t *testing.T, fail bool) {
+	// attach volume should succeed for this test
+	client, tenantID, volume, instanceID := doAttachVolumeCommand(t, false)
+	defer client.Ssntp.Close()
+
+	sendStatsCmd(client, t)
+
+	data, err := ctl.ds.GetBlockDevice(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data.State != types.InUse {
+		t.Fatalf("expected state %s, got %s\n", types.Detaching, data.State)
+	}
+
+	if fail {
+		err := ctl.DetachVolume(tenantID, volume, api.VolumeDetach{})
+		if err == nil {
+			t.Fatal("Expected error when detaching volume from active instance")
+
+		}
+
+		data, err := ctl.ds.GetBlockDevice(volume)
+		if err != nil {
+			t.Fatal(err)
+
+		}
+
+		if data.State != types.InUse {
+			t.Fatalf("expected state %s, got %s\n", types.Detaching, data.State)
+		}
+	} else {
+		serverCh := server.AddCmdChan(ssntp.DELETE)
+		clientCh := client.AddCmdChan(ssntp.DELETE)
+
+		err := ctl.stopInstance(instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := server.GetCmdChanResult(serverCh, ssntp.DELETE)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.GetCmdChanResult(clientCh, ssntp.DELETE)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result.InstanceUUID != instanceID {
+			t.Fatal("Did not get correct Instance ID")
+		}
+
+		err = sendStopEvent(client, instanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ctl.DetachVolume(tenantID, volume, api.VolumeDetach{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ctl.ShowVolumeDetails(tenantID, volume)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if data.State != types.Available {
+			t.Fatalf("expected state %s, got %s\n", types.Detaching, data.State)
+		}
+
+		if len(data.Attachments) != 0 {
+			t.Fatalf("expected no attachments, got %v", data.Attachments)
+		}
+	}
+}
+
+func TestDetachVolumeCommand(t *testing.T) {
+	doDetachVolumeCommand(t, false)
+}
+
+func TestDetachVolumeFailure(t *testing.T) {
+	doDetachVolumeCommand(t, true)
+}
+
+func TestDetachVolumeMultipleAttachments(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 2, false, reason)
+	defer client.Ssntp.Close()
+
+	tenantID := instances[0].TenantID
+	data := addTestBlockDevice(t, tenantID)
+
+	for i, mountpoint := range []string{"/dev/vdb", "/dev/vdc"} {
+		err := ctl.ds.InstanceStopped(instances[i].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ctl.ds.CreateStorageAttachment(instances[i].ID, payloads.StorageResource{ID: data.ID}, mountpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tt := range []struct {
+		detach   api.VolumeDetach
+		err      error
+		state    types.BlockState
+		attached []string
+	}{
+		{api.VolumeDetach{}, api.ErrVolumeAttachmentAmbiguous, types.InUse, []string{instances[0].ID, instances[1].ID}},
+		{api.VolumeDetach{Mountpoint: "/dev/vdd"}, api.ErrVolumeNotAttached, types.InUse, []string{instances[0].ID, instances[1].ID}},
+		{api.VolumeDetach{InstanceID: instances[0].ID, Mountpoint: "/dev/vdc"}, api.ErrVolumeNotAttached, types.InUse, []string{instances[0].ID, instances[1].ID}},
+		{api.VolumeDetach{Mountpoint: "/dev/vdc"}, nil, types.InUse, []string{instances[0].ID}},
+		{api.VolumeDetach{}, nil, types.Available, []string{}},
+	} {
+		err := ctl.DetachVolume(tenantID, data.ID, tt.detach)
+		if err != tt.err {
+			t.Fatalf("%v: expected %v got %v", tt.detach, tt.err, err)
+		}
+
+		vol, err := ctl.ShowVolumeDetails(tenantID, data.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if vol.State != tt.state {
+			t.Fatalf("%v: expected state %s got %s", tt.detach, tt.state, vol.State)
+		}
+
+		attached := []string{}
+		for _, a := range vol.Attachments {
+			attached = append(attached, a.InstanceID)
+		}
+		sort.Strings(attached)
+
+		expected := append([]string{}, tt.attached...)
+		sort.Strings(expected)
+
+		if !reflect.DeepEqual(attached, expected) {
+			t.Fatalf("%v: expected attachments %v got %v", tt.detach, expected, attached)
+		}
+	}
+}
+
+func TestDetachVolumeByAttachment(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DetachVolume(tenant.ID, "invalidVolume", api.VolumeDetach{AttachmentID: "attachmentID"})
+	if err != api.ErrVolumeNotAttached {
+		t.Fatalf("expected %v got %v", api.ErrVolumeNotAttached, err)
+	}
+}
+
+func TestInstanceDeletedEvent(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	sendStatsCmd(client, t)
+
+	serverCh := server.AddCmdChan(ssntp.DELETE)
+
+	err := ctl.deleteInstance(instances[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = server.GetCmdChanResult(serverCh, ssntp.DELETE)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1334,7 +1801,7 @@ func TestStorageConfig(t *testing.T) {
 
 	ip := net.ParseIP("172.16.0.2")
 
-	_, err = newConfig(ctl, &wls[0], id.String(), tenant.ID, "test", ip)
+	_, err = newConfig(ctl, &wls[0], id.String(), tenant.ID, "test", ip, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1342,12 +1809,112 @@ func TestStorageConfig(t *testing.T) {
 	wls[0].Storage = []types.StorageResource{}
 }
 
+func TestCreateWorkloadStorage(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := ctl.CreateImage(tenant.ID, api.CreateImageRequest{
+		Name:       "workload-storage-image",
+		Visibility: types.Private,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image.State = types.Active
+	image.Size = 3 << 30
+	err = ctl.ds.UpdateImage(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetWorkloads(tenant.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatal(err)
+	}
+
+	boot := types.StorageResource{
+		Bootable:   true,
+		SourceType: types.ImageService,
+		Source:     image.Name,
+	}
+	scratch := types.StorageResource{
+		Ephemeral:  true,
+		SourceType: types.Empty,
+		Size:       4,
+	}
+
+	for _, tt := range []struct {
+		name    string
+		storage []types.StorageResource
+	}{
+		{"no bootable volume", []types.StorageResource{scratch}},
+		{"two bootable volumes", []types.StorageResource{boot, boot}},
+		{"negative size", []types.StorageResource{boot, {SourceType: types.Empty, Size: -1}}},
+		{"unsized empty volume", []types.StorageResource{boot, {SourceType: types.Empty}}},
+	} {
+		wl := wls[0]
+		wl.ID = ""
+		wl.Storage = tt.storage
+
+		_, err = ctl.CreateWorkload(wl)
+		if err != types.ErrBadRequest {
+			t.Errorf("%s: expected %v got %v", tt.name, types.ErrBadRequest, err)
+		}
+	}
+
+	wl := wls[0]
+	wl.ID = ""
+	wl.Storage = []types.StorageResource{boot, scratch}
+
+	wl, err = ctl.CreateWorkload(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wl.Storage[0].Source != image.ID {
+		t.Fatalf("image source not resolved: got %s expected %s", wl.Storage[0].Source, image.ID)
+	}
+
+	instanceID := uuid.Generate().String()
+	cfg, err := newConfig(ctl, &wl, instanceID, tenant.ID, "test", net.ParseIP("172.16.0.2"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := cfg.sc.Start.Storage
+	if len(storage) != 2 {
+		t.Fatalf("expected 2 volumes got %d", len(storage))
+	}
+
+	for i, s := range storage {
+		vol, err := ctl.ds.GetBlockDevice(s.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.Bootable != wl.Storage[i].Bootable || s.Ephemeral != wl.Storage[i].Ephemeral {
+			t.Errorf("incorrect storage %+v for %+v", s, wl.Storage[i])
+		}
+
+		if vol.Bootable != wl.Storage[i].Bootable {
+			t.Errorf("incorrect volume %+v for %+v", vol, wl.Storage[i])
+		}
+	}
+
+	if vol, _ := ctl.ds.GetBlockDevice(storage[1].ID); vol.Size != 4 {
+		t.Errorf("expected empty volume of size 4 got %d", vol.Size)
+	}
+}
+
 func createTestVolume(tenantID string, size int, t *testing.T) string {
 	req := api.RequestedVolume{
 		Size: size,
 	}
 
-	vol, err := ctl.CreateVolume(tenantID, req)
+	vol, err := ctl.CreateVolume(context.Background(), tenantID, req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1380,672 +1947,2233 @@ func TestCreateVolume(t *testing.T) {
 	}
 }
 
-func TestCreateImageVolume(t *testing.T) {
+func TestVolumeStorageQuota(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	imageRef := "test-image-id"
-	req := api.RequestedVolume{
-		ImageRef: imageRef,
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-storage-quota", Value: 30},
+	})
+
+	storageUsage := func() int {
+		qd := findQuota(ctl.qs.DumpQuotas(tenant.ID), "tenant-storage-quota")
+		if qd == nil {
+			t.Fatal("storage quota not found")
+		}
+		return qd.Usage
 	}
 
-	vol, err := ctl.CreateVolume(tenant.ID, req)
-	if err != nil {
-		t.Fatal(err)
+	createTestVolume(tenant.ID, 20, t)
+	volID := createTestVolume(tenant.ID, 10, t)
+
+	_, err = ctl.CreateVolume(context.Background(), tenant.ID, api.RequestedVolume{Size: 1})
+	if err != api.ErrQuota {
+		t.Fatalf("expected %v got %v", api.ErrQuota, err)
 	}
 
-	// confirm that we can retrieve the volume from
-	// the datastore.
-	bd, err := ctl.ds.GetBlockDevice(vol.ID)
+	if usage := storageUsage(); usage != 30 {
+		t.Fatalf("expected storage usage 30 got %d", usage)
+	}
+
+	err = ctl.DeleteVolume(tenant.ID, volID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if bd.State != types.Available || bd.TenantID != tenant.ID || bd.Bootable == false {
-		t.Fatalf("incorrect volume information stored\n")
+	if usage := storageUsage(); usage != 20 {
+		t.Fatalf("expected storage usage 20 got %d", usage)
+	}
+
+	createTestVolume(tenant.ID, 10, t)
+
+	ctl.qs.Update(tenant.ID, []types.QuotaDetails{
+		{Name: "tenant-storage-quota", Value: -1},
+	})
+
+	createTestVolume(tenant.ID, 100, t)
+
+	if usage := storageUsage(); usage != 130 {
+		t.Fatalf("expected storage usage 130 got %d", usage)
 	}
 }
 
-func TestDeleteVolume(t *testing.T) {
+func TestCloneVolume(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	volID := createTestVolume(tenant.ID, 20, t)
+	source, err := ctl.ds.GetBlockDevice(createTestVolume(tenant.ID, 4, t))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	// confirm that we can retrieve the volume from
-	// the datastore.
-	_, err = ctl.ds.GetBlockDevice(volID)
+	source.Bootable = true
+	err = ctl.ds.UpdateBlockDevice(source)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// attempt to delete invalid volume
-	err = ctl.DeleteVolume(tenant.ID, "badID")
-	if err != datastore.ErrNoBlockData {
-		t.Fatal("Incorrect error")
+	for _, tt := range []struct {
+		size     int
+		expected int
+		err      error
+	}{
+		{0, 4, nil},
+		{8, 8, nil},
+		{2, 0, api.ErrVolumeTooSmall},
+	} {
+		req := api.RequestedVolume{
+			Size:        tt.size,
+			SourceVolID: source.ID,
+		}
+
+		vol, err := ctl.CreateVolume(context.Background(), tenant.ID, req)
+		if err != tt.err {
+			t.Fatalf("expected %v got %v", tt.err, err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if vol.Size != tt.expected || !vol.Bootable {
+			t.Fatalf("incorrect clone of %d GiB, bootable %v", vol.Size, vol.Bootable)
+		}
 	}
+}
 
-	// add second tenant to datastore to prevent CNCI launching.
-	tenant2, err := addTestTenant()
+func TestCloneVolumeBadSource(t *testing.T) {
+	tenant, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// attempt to delete with bad tenant ID
-	err = ctl.DeleteVolume(tenant2.ID, volID)
-	if err != api.ErrVolumeOwner {
-		t.Fatal("Incorrect error")
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// this should work
-	err = ctl.DeleteVolume(tenant.ID, volID)
+	source, err := ctl.ds.GetBlockDevice(createTestVolume(tenant.ID, 4, t))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// confirm that we cannot retrieve the volume from
-	// the datastore.
-	_, err = ctl.ds.GetBlockDevice(volID)
-	if err != datastore.ErrNoBlockData {
+	source.State = types.Attaching
+	err = ctl.ds.UpdateBlockDevice(source)
+	if err != nil {
 		t.Fatal(err)
 	}
+
+	for _, tt := range []struct {
+		tenant string
+		source string
+		err    error
+	}{
+		{tenant.ID, source.ID, api.ErrVolumeNotAvailable},
+		{other.ID, source.ID, api.ErrVolumeOwner},
+		{tenant.ID, uuid.Generate().String(), api.ErrVolumeNotFound},
+	} {
+		req := api.RequestedVolume{
+			SourceVolID: tt.source,
+		}
+
+		_, err := ctl.CreateVolume(context.Background(), tt.tenant, req)
+		if err != tt.err {
+			t.Fatalf("expected %v got %v", tt.err, err)
+		}
+	}
 }
 
-func TestShowVolumeDetails(t *testing.T) {
+func TestCreateImageVolume(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	volID := createTestVolume(tenant.ID, 20, t)
-
-	vol, err := ctl.ShowVolumeDetails(tenant.ID, volID)
+	image, err := ctl.CreateImage(tenant.ID, api.CreateImageRequest{
+		Name:       "volume-image",
+		Visibility: types.Private,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if vol.ID != volID {
-		t.Fatal("wrong volume retrieved")
+	req := api.RequestedVolume{
+		ImageRef: image.Name,
 	}
-}
 
-func TestListVolumesDetail(t *testing.T) {
-	tenant, err := addTestTenant()
-	if err != nil {
-		t.Fatal(err)
+	_, err = ctl.CreateVolume(context.Background(), tenant.ID, req)
+	if err != api.ErrImageNotActive {
+		t.Fatalf("expected %v got %v", api.ErrImageNotActive, err)
 	}
 
-	_ = createTestVolume(tenant.ID, 20, t)
-
-	vols, err := ctl.ListVolumesDetail(tenant.ID)
+	image.State = types.Active
+	image.Size = 3 << 30
+	err = ctl.ds.UpdateImage(image)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(vols) != 1 {
-		t.Fatal("Incorrect number of volumes returned")
+	req.Size = 2
+	_, err = ctl.CreateVolume(context.Background(), tenant.ID, req)
+	if err != api.ErrVolumeTooSmall {
+		t.Fatalf("expected %v got %v", api.ErrVolumeTooSmall, err)
 	}
-}
 
-func testAddPool(t *testing.T, name string, subnet *string, ips []string) {
-	pool, err := ctl.AddPool(name, subnet, ips)
+	req.Size = 0
+	vol, err := ctl.CreateVolume(context.Background(), tenant.ID, req)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if pool.ID == "" {
-		t.Fatal("id not set")
+	if vol.Size < 3 {
+		t.Fatalf("volume of %d GiB smaller than image", vol.Size)
 	}
 
-	expected := types.Pool{
-		ID:   pool.ID,
-		Name: name,
+	// confirm that we can retrieve the volume from
+	// the datastore.
+	bd, err := ctl.ds.GetBlockDevice(vol.ID)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if subnet != nil {
-		if pool.Subnets[0].ID == "" {
-			t.Fatal("subnet id not created")
-		}
+	if bd.State != types.Available || bd.TenantID != tenant.ID || bd.Bootable == false {
+		t.Fatalf("incorrect volume information stored\n")
+	}
+}
 
-		sub := types.ExternalSubnet{
-			ID:   pool.Subnets[0].ID,
-			CIDR: *subnet,
-		}
+func TestCreateWorkloadFromInstance(t *testing.T) {
+	var reason payloads.StartFailureReason
 
-		expected.Subnets = []types.ExternalSubnet{sub}
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
 
-		_, ipNet, err := net.ParseCIDR(*subnet)
-		if err != nil {
-			t.Fatal(err)
-		}
+	instance := instances[0]
+	tenantID := instance.TenantID
 
-		ones, bits := ipNet.Mask.Size()
-		expected.TotalIPs = (1 << uint32(bits-ones)) - 2
-		expected.Free = expected.TotalIPs
-	} else if len(ips) > 0 {
-		// not an easy way to check this, so we're going to
-		// do some manual tests
-		if pool.TotalIPs != len(ips) ||
-			pool.Free != len(ips) ||
-			len(pool.IPs) != len(ips) {
-			t.Fatal("External IPs not handled correctly")
-		}
-		return
+	volID := createTestVolume(tenantID, 4, t)
+	_, err := ctl.ds.CreateStorageAttachment(instance.ID, payloads.StorageResource{ID: volID, Bootable: true}, "")
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if reflect.DeepEqual(expected, pool) == false {
-		t.Fatalf("expected %v, got %v\n", expected, pool)
+	_, err = ctl.CreateWorkloadFromInstance(tenantID, instance.ID, "golden")
+	if err != api.ErrInstanceNotStopped {
+		t.Fatalf("expected %v got %v", api.ErrInstanceNotStopped, err)
 	}
-}
 
-func deletePool(name string) error {
-	pools, err := ctl.ListPools()
+	err = ctl.ds.InstanceStopped(instance.ID)
 	if err != nil {
-		return err
+		t.Fatal(err)
 	}
 
-	if len(pools) < 1 {
-		return types.ErrPoolNotFound
+	_, err = ctl.CreateWorkloadFromInstance(tenantID, instance.ID, "Not a valid name")
+	if err != types.ErrBadName {
+		t.Fatalf("expected %v got %v", types.ErrBadName, err)
 	}
 
-	for _, pool := range pools {
-		if pool.Name == name {
-			return ctl.DeletePool(pool.ID)
-		}
+	wl, err := ctl.CreateWorkloadFromInstance(tenantID, instance.ID, "golden")
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	return types.ErrPoolNotFound
-}
-
-func TestAddPoolWithSubnet(t *testing.T) {
-	subnet := "192.168.0.0/16"
-	testAddPool(t, "test1", &subnet, []string{})
-	err := deletePool("test1")
+	source, err := ctl.ds.GetWorkload(instance.WorkloadID)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestAddPoolWithIPs(t *testing.T) {
-	ips := []string{"10.10.0.1", "10.10.0.2"}
-	testAddPool(t, "test2", nil, ips)
-	err := deletePool("test2")
+	stored, err := ctl.ShowWorkload(tenantID, wl.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestAddPool(t *testing.T) {
-	testAddPool(t, "test3", nil, []string{})
-	err := deletePool("test3")
+	if stored.Description != "golden" || stored.Visibility != types.Private ||
+		stored.Config != source.Config || !reflect.DeepEqual(stored.Requirements, source.Requirements) {
+		t.Fatalf("incorrect workload created %+v", stored)
+	}
+
+	if len(stored.Storage) != 1 || !stored.Storage[0].Bootable ||
+		stored.Storage[0].SourceType != types.ImageService || stored.Storage[0].Size != 4 {
+		t.Fatalf("incorrect workload storage %+v", stored.Storage)
+	}
+
+	image, err := ctl.GetImage(tenantID, stored.Storage[0].Source)
 	if err != nil {
 		t.Fatal(err)
 	}
-}
 
-func TestListPools(t *testing.T) {
-	testAddPool(t, "listPoolTest", nil, []string{})
+	if image.Name != "golden" || image.State != types.Active || image.TenantID != tenantID {
+		t.Fatalf("incorrect image captured %+v", image)
+	}
+}
 
-	pools, err := ctl.ListPools()
+func TestCreateVolumeNoImage(t *testing.T) {
+	tenant, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+	req := api.RequestedVolume{
+		ImageRef: "test-image-id",
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "listPoolTest" {
-			err := ctl.DeletePool(pool.ID)
-			if err != nil {
-				t.Fatal(err)
-			}
-			return
-		}
+	_, err = ctl.CreateVolume(context.Background(), tenant.ID, req)
+	if err != api.ErrNoImage {
+		t.Fatalf("expected %v got %v", api.ErrNoImage, err)
 	}
-
-	t.Fatal("Could not list pools")
 }
 
-func TestShowPool(t *testing.T) {
-	testAddPool(t, "showPoolTest", nil, []string{})
-
-	pools, err := ctl.ListPools()
+func TestUpdateImageVisibility(t *testing.T) {
+	owner, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "showPoolTest" {
-			_, err := ctl.ShowPool(pool.ID)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			err = ctl.DeletePool(pool.ID)
-			if err != nil {
-				t.Fatal(err)
-			}
-
-			return
-		}
+	req := api.CreateImageRequest{
+		Name:       "visibility-test",
+		Visibility: types.Private,
 	}
 
-	t.Fatal("Could not show pool")
-}
+	image, err := ctl.CreateImage(owner.ID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func TestDeletePool(t *testing.T) {
-	testAddPool(t, "deletePoolTest", nil, []string{})
+	err = ctl.UpdateImage(other.ID, image.ID, types.Public)
+	if err != api.ErrImageNotPermitted {
+		t.Fatalf("expected %v got %v", api.ErrImageNotPermitted, err)
+	}
 
-	pools, err := ctl.ListPools()
+	err = ctl.UpdateImage(owner.ID, image.ID, types.Public)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+	i, err := ctl.GetImage(other.ID, image.ID)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "deletePoolTest" {
-			err := ctl.DeletePool(pool.ID)
-			if err != nil {
-				t.Fatal(err)
-			}
+	if i.Visibility != types.Public {
+		t.Fatalf("expected public image got %v", i.Visibility)
+	}
 
-			_, err = ctl.ShowPool(pool.ID)
-			if err != types.ErrPoolNotFound {
-				t.Fatal("Pool not deleted")
-			}
-			return
-		}
+	err = ctl.UpdateImage("admin", uuid.Generate().String(), types.Public)
+	if err != api.ErrNoImage {
+		t.Fatalf("expected %v got %v", api.ErrNoImage, err)
 	}
 
-	t.Fatal("Could not delete pool")
+	err = ctl.ds.DeleteImage(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
 }
 
-func TestAddPoolSubnet(t *testing.T) {
-	subnet := "192.168.0.0/24"
-
-	testAddPool(t, "addsubnet", nil, []string{})
+func TestPatchImage(t *testing.T) {
+	owner, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	pools, err := ctl.ListPools()
+	other, err := addTestTenant()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+	req := api.CreateImageRequest{
+		Name:       "rename-test",
+		Visibility: types.Private,
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "addsubnet" {
-			err := ctl.AddAddress(pool.ID, &subnet, []string{})
-			if err != nil {
-				t.Fatal(err)
-			}
+	image, err := ctl.CreateImage(owner.ID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-			p1, err := ctl.ShowPool(pool.ID)
-			if err != nil {
-				t.Fatal(err)
-			}
+	err = ctl.PatchImage(other.ID, image.ID, []byte(`{"name":"renamed"}`))
+	if err != api.ErrImageNotPermitted {
+		t.Fatalf("expected %v got %v", api.ErrImageNotPermitted, err)
+	}
 
-			// we should have a our subnet.
-			if p1.Subnets[0].CIDR != subnet {
-				t.Fatalf("expectd %s subnet got %s", subnet, p1.Subnets[0].CIDR)
-			}
+	err = ctl.PatchImage(owner.ID, image.ID, []byte(`{"name":"Not A Valid Name"}`))
+	if err != types.ErrBadName {
+		t.Fatalf("expected %v got %v", types.ErrBadName, err)
+	}
 
-			err = ctl.DeletePool(pool.ID)
-			if err != nil {
-				t.Fatal(err)
-			}
-			return
+	for _, patch := range []string{
+		`{"size":1024}`,
+		`{"state":"active"}`,
+		`{"id":"1bea47ed-f6a9-463b-b423-14b9cca9ad27"}`,
+	} {
+		err = ctl.PatchImage(owner.ID, image.ID, []byte(patch))
+		if err != types.ErrImageImmutable {
+			t.Errorf("%s: expected %v got %v", patch, types.ErrImageImmutable, err)
 		}
 	}
 
-}
+	err = ctl.PatchImage(owner.ID, image.ID, []byte(`{"name":"renamed"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-func TestAddPoolAddress(t *testing.T) {
-	address := "192.168.1.1"
+	i, err := ctl.GetImage(owner.ID, image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	testAddPool(t, "addaddress", nil, []string{})
+	if i.Name != "renamed" || i.State != image.State || i.Visibility != types.Private {
+		t.Fatalf("incorrect image after rename %+v", i)
+	}
 
-	pools, err := ctl.ListPools()
+	err = ctl.ds.DeleteImage(image.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
+}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+func TestPatchVolume(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volID := createTestVolume(tenant.ID, 20, t)
+
+	patch := []byte(`{"name":"renamed","description":"renamed volume"}`)
+
+	err = ctl.PatchVolume(other.ID, volID, patch)
+	if err != api.ErrVolumeOwner {
+		t.Fatalf("expected %v got %v", api.ErrVolumeOwner, err)
+	}
+
+	for _, p := range []string{
+		`{"size":40}`,
+		`{"state":"in-use"}`,
+		`{"tenant_id":"` + other.ID + `"}`,
+	} {
+		err = ctl.PatchVolume(tenant.ID, volID, []byte(p))
+		if err != types.ErrVolumeImmutable {
+			t.Errorf("%s: expected %v got %v", p, types.ErrVolumeImmutable, err)
+		}
+	}
+
+	err = ctl.PatchVolume(tenant.ID, volID, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vol, err := ctl.ShowVolumeDetails(tenant.ID, volID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vol.Name != "renamed" || vol.Description != "renamed volume" ||
+		vol.Size != 20 || vol.State != types.Available {
+		t.Fatalf("incorrect volume after rename %+v", vol)
+	}
+}
+
+func TestCancelVolume(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volID := createTestVolume(tenant.ID, 20, t)
+
+	err = ctl.CancelVolume(tenant.ID, volID)
+	if err != types.ErrNotCancellable {
+		t.Fatalf("expected %v got %v", types.ErrNotCancellable, err)
+	}
+
+	// a volume being created
+	bd, err := ctl.CreateBlockDevice("", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := types.Volume{
+		BlockDevice: bd,
+		TenantID:    tenant.ID,
+		State:       types.Creating,
+		Attachments: []types.VolumeAttachment{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = ctl.addVolumeCreation(data, cancel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.CancelVolume(other.ID, bd.ID)
+	if err != api.ErrVolumeOwner {
+		t.Fatalf("expected %v got %v", api.ErrVolumeOwner, err)
+	}
+
+	err = ctl.CancelVolume(tenant.ID, bd.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctx.Err() != context.Canceled {
+		t.Fatal("volume creation not cancelled")
+	}
+
+	resources := []payloads.RequestedResource{
+		{Type: payloads.Volume, Value: 1},
+		{Type: payloads.SharedDiskGiB, Value: 10},
+	}
+
+	err = ctl.completeVolume(ctx, &data, 10, resources)
+	if err != context.Canceled {
+		t.Fatalf("expected %v got %v", context.Canceled, err)
+	}
+
+	vol, err := ctl.ds.GetBlockDevice(bd.ID)
+	if err != nil || vol.State != types.Creating {
+		t.Fatalf("cancelled volume completed %+v: %v", vol, err)
+	}
+
+	// a volume left creating without a creation in progress is deleted
+	err = ctl.CancelVolume(tenant.ID, bd.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.ds.GetBlockDevice(bd.ID)
+	if err != datastore.ErrNoBlockData {
+		t.Fatalf("expected %v got %v", datastore.ErrNoBlockData, err)
+	}
+}
+
+func waitForImage(t *testing.T, tenantID, imageID string, check func(types.Image) bool) types.Image {
+	for i := 0; i < 100; i++ {
+		image, err := ctl.GetImage(tenantID, imageID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check(image) {
+			return image
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("image %s did not reach the expected state", imageID)
+	return types.Image{}
+}
+
+func TestUploadImageAsync(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := api.CreateImageRequest{
+		Name:       "async-upload-test",
+		Visibility: types.Private,
+	}
+
+	image, err := ctl.CreateImage(tenant.ID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadID, err := ctl.StartImageUpload(tenant.ID, image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForImage(t, tenant.ID, image.ID, func(i types.Image) bool {
+		return i.State == types.Uploading && i.Size == 0
+	})
+
+	_, err = ctl.StartImageUpload(tenant.ID, image.ID)
+	if err != api.ErrImageSaving {
+		t.Fatalf("expected %v got %v", api.ErrImageSaving, err)
+	}
+
+	err = ctl.UploadImageData(context.Background(), tenant.ID, image.ID, uuid.Generate().String(), strings.NewReader(""), "")
+	if err != api.ErrNoImageUpload {
+		t.Fatalf("expected %v got %v", api.ErrNoImageUpload, err)
+	}
+
+	pr, pw := io.Pipe()
+	errCh := make(chan error)
+	go func() {
+		errCh <- ctl.UploadImageData(context.Background(), tenant.ID, image.ID, uploadID, pr, "")
+	}()
+
+	_, err = pw.Write(make([]byte, 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForImage(t, tenant.ID, image.ID, func(i types.Image) bool {
+		return i.State == types.Uploading && i.Size == 1024
+	})
+
+	err = ctl.UploadImageData(context.Background(), tenant.ID, image.ID, uploadID, strings.NewReader(""), "")
+	if err != api.ErrImageSaving {
+		t.Fatalf("expected %v got %v", api.ErrImageSaving, err)
+	}
+
+	_ = pw.Close()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	waitForImage(t, tenant.ID, image.ID, func(i types.Image) bool {
+		return i.State == types.Active
+	})
+
+	err = ctl.ds.DeleteImage(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadImageAsyncNoData(t *testing.T) {
+	saved := imageUploadDataTimeout
+	imageUploadDataTimeout = 10 * time.Millisecond
+	defer func() { imageUploadDataTimeout = saved }()
+
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := api.CreateImageRequest{
+		Name:       "async-upload-no-data-test",
+		Visibility: types.Private,
+	}
+
+	image, err := ctl.CreateImage(tenant.ID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadID, err := ctl.StartImageUpload(tenant.ID, image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForImage(t, tenant.ID, image.ID, func(i types.Image) bool {
+		return i.State == types.Killed
+	})
+
+	err = ctl.UploadImageData(context.Background(), tenant.ID, image.ID, uploadID, strings.NewReader(""), "")
+	if err != api.ErrNoImageUpload {
+		t.Fatalf("expected %v got %v", api.ErrNoImageUpload, err)
+	}
+
+	err = ctl.ds.DeleteImage(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDownloadImage(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := api.CreateImageRequest{
+		Name:       "download-test",
+		Visibility: types.Private,
+	}
+
+	image, err := ctl.CreateImage(tenant.ID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ctl.DownloadImage(tenant.ID, image.ID)
+	if err != api.ErrImageNotActive {
+		t.Fatalf("expected %v got %v", api.ErrImageNotActive, err)
+	}
+
+	err = ctl.UploadImage(context.Background(), tenant.ID, image.ID, strings.NewReader(""), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, size, err := ctl.DownloadImage(tenant.ID, image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = content.(io.Closer).Close()
+
+	if size != 0 {
+		t.Fatalf("expected empty image got %d bytes", size)
+	}
+
+	_, _, err = ctl.DownloadImage(tenant.ID, uuid.Generate().String())
+	if err != api.ErrNoImage {
+		t.Fatalf("expected %v got %v", api.ErrNoImage, err)
+	}
+
+	err = ctl.ds.DeleteImage(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadImageChecksum(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := api.CreateImageRequest{
+		Name:       "checksum-test",
+		Visibility: types.Private,
+	}
+
+	image, err := ctl.CreateImage(tenant.ID, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := "image data"
+	sum := sha256.Sum256([]byte(data))
+	checksum := hex.EncodeToString(sum[:])
+
+	err = ctl.UploadImage(context.Background(), tenant.ID, image.ID, strings.NewReader(data), strings.Repeat("0", len(checksum)))
+	if err != api.ErrImageChecksum {
+		t.Fatalf("expected %v got %v", api.ErrImageChecksum, err)
+	}
+
+	err = ctl.UploadImage(context.Background(), tenant.ID, image.ID, strings.NewReader(data), strings.ToUpper(checksum))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := ctl.GetImage(tenant.ID, image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.State != types.Active || i.Checksum != checksum {
+		t.Fatalf("expected active image with checksum %s got %s %s", checksum, i.State, i.Checksum)
+	}
+
+	err = ctl.ds.DeleteImage(image.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volID := createTestVolume(tenant.ID, 20, t)
+
+	// confirm that we can retrieve the volume from
+	// the datastore.
+	_, err = ctl.ds.GetBlockDevice(volID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// attempt to delete invalid volume
+	err = ctl.DeleteVolume(tenant.ID, "badID")
+	if err != datastore.ErrNoBlockData {
+		t.Fatal("Incorrect error")
+	}
+
+	// add second tenant to datastore to prevent CNCI launching.
+	tenant2, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// attempt to delete with bad tenant ID
+	err = ctl.DeleteVolume(tenant2.ID, volID)
+	if err != api.ErrVolumeOwner {
+		t.Fatal("Incorrect error")
+	}
+
+	// this should work
+	err = ctl.DeleteVolume(tenant.ID, volID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// confirm that we cannot retrieve the volume from
+	// the datastore.
+	_, err = ctl.ds.GetBlockDevice(volID)
+	if err != datastore.ErrNoBlockData {
+		t.Fatal(err)
+	}
+}
+
+func TestForceDeleteVolume(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volID := createTestVolume(tenant.ID, 20, t)
+
+	bd, err := ctl.ds.GetBlockDevice(volID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a volume stuck detaching cannot be deleted normally
+	bd.State = types.Detaching
+	err = ctl.ds.UpdateBlockDevice(bd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.DeleteVolume(tenant.ID, volID)
+	if err != api.ErrVolumeNotAvailable {
+		t.Fatal("Incorrect error")
+	}
+
+	err = ctl.ForceDeleteVolume(tenant.ID, volID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ctl.ds.GetBlockDevice(volID)
+	if err != datastore.ErrNoBlockData {
+		t.Fatal(err)
+	}
+}
+
+func TestShowVolumeDetails(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volID := createTestVolume(tenant.ID, 20, t)
+
+	vol, err := ctl.ShowVolumeDetails(tenant.ID, volID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if vol.ID != volID {
+		t.Fatal("wrong volume retrieved")
+	}
+}
+
+func TestListVolumesDetail(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = createTestVolume(tenant.ID, 20, t)
+
+	vols, err := ctl.ListVolumesDetail(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(vols) != 1 {
+		t.Fatal("Incorrect number of volumes returned")
+	}
+}
+
+func testAddPool(t *testing.T, name string, subnet *string, ips []string) {
+	pool, err := ctl.AddPool(name, subnet, ips)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pool.ID == "" {
+		t.Fatal("id not set")
+	}
+
+	expected := types.Pool{
+		ID:   pool.ID,
+		Name: name,
+	}
+
+	if subnet != nil {
+		if pool.Subnets[0].ID == "" {
+			t.Fatal("subnet id not created")
+		}
+
+		sub := types.ExternalSubnet{
+			ID:   pool.Subnets[0].ID,
+			CIDR: *subnet,
+		}
+
+		expected.Subnets = []types.ExternalSubnet{sub}
+
+		_, ipNet, err := net.ParseCIDR(*subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ones, bits := ipNet.Mask.Size()
+		expected.TotalIPs = (1 << uint32(bits-ones)) - 2
+		expected.Free = expected.TotalIPs
+	} else if len(ips) > 0 {
+		// not an easy way to check this, so we're going to
+		// do some manual tests
+		if pool.TotalIPs != len(ips) ||
+			pool.Free != len(ips) ||
+			len(pool.IPs) != len(ips) {
+			t.Fatal("External IPs not handled correctly")
+		}
+		return
+	}
+
+	if reflect.DeepEqual(expected, pool) == false {
+		t.Fatalf("expected %v, got %v\n", expected, pool)
+	}
+}
+
+func deletePool(name string) error {
+	pools, err := ctl.ListPools()
+	if err != nil {
+		return err
+	}
+
+	if len(pools) < 1 {
+		return types.ErrPoolNotFound
+	}
+
+	for _, pool := range pools {
+		if pool.Name == name {
+			return ctl.DeletePool(pool.ID)
+		}
+	}
+
+	return types.ErrPoolNotFound
+}
+
+func TestAddPoolWithSubnet(t *testing.T) {
+	subnet := "192.168.0.0/16"
+	testAddPool(t, "test1", &subnet, []string{})
+	err := deletePool("test1")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddPoolWithIPs(t *testing.T) {
+	ips := []string{"10.10.0.1", "10.10.0.2"}
+	testAddPool(t, "test2", nil, ips)
+	err := deletePool("test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddPool(t *testing.T) {
+	testAddPool(t, "test3", nil, []string{})
+	err := deletePool("test3")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListPools(t *testing.T) {
+	testAddPool(t, "listPoolTest", nil, []string{})
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "listPoolTest" {
+			err := ctl.DeletePool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+
+	t.Fatal("Could not list pools")
+}
+
+func TestShowPool(t *testing.T) {
+	testAddPool(t, "showPoolTest", nil, []string{})
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "showPoolTest" {
+			_, err := ctl.ShowPool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ctl.DeletePool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return
+		}
+	}
+
+	t.Fatal("Could not show pool")
+}
+
+func TestShowPoolAddressCount(t *testing.T) {
+	subnet := "192.168.8.0/29"
+	testAddPool(t, "countPoolTest", &subnet, []string{})
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "countPoolTest" {
+			p, err := ctl.ShowPool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if p.TotalIPs != 6 || p.Free != 6 {
+				t.Errorf("expected 6 free of 6 got %d free of %d", p.Free, p.TotalIPs)
+			}
+
+			if pool.TotalIPs != p.TotalIPs || pool.Free != p.Free {
+				t.Errorf("listed and shown counts differ")
+			}
+
+			err = ctl.DeletePool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return
+		}
+	}
+
+	t.Fatal("Could not show pool")
+}
+
+func TestCountPoolSubnetAddresses(t *testing.T) {
+	pool := types.Pool{
+		ID: "pool",
+		Subnets: []types.ExternalSubnet{
+			{CIDR: "192.168.8.0/29"},
+			{CIDR: "192.168.9.0/30"},
+		},
+		IPs: []types.ExternalIP{{Address: "192.168.10.1"}},
+	}
+
+	mapped := []types.MappedIP{
+		{PoolID: "pool", ExternalIP: "192.168.8.1"},
+		{PoolID: "pool", ExternalIP: "192.168.8.2"},
+		{PoolID: "pool", ExternalIP: "192.168.10.1"},
+		{PoolID: "other", ExternalIP: "192.168.9.1"},
+	}
+
+	countPoolAddresses(&pool, mapped)
+
+	if pool.TotalIPs != 9 || pool.Free != 6 {
+		t.Errorf("expected 6 free of 9 got %d free of %d", pool.Free, pool.TotalIPs)
+	}
+
+	expected := []struct{ used, free int }{{2, 4}, {0, 2}}
+	for i, e := range expected {
+		s := pool.Subnets[i]
+		if s.Used != e.used || s.Free != e.free {
+			t.Errorf("%s: expected %d used %d free got %d used %d free",
+				s.CIDR, e.used, e.free, s.Used, s.Free)
+		}
+	}
+}
+
+func TestDeletePool(t *testing.T) {
+	testAddPool(t, "deletePoolTest", nil, []string{})
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "deletePoolTest" {
+			err := ctl.DeletePool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ctl.ShowPool(pool.ID)
+			if err != types.ErrPoolNotFound {
+				t.Fatal("Pool not deleted")
+			}
+			return
+		}
+	}
+
+	t.Fatal("Could not delete pool")
+}
+
+func TestAddPoolSubnet(t *testing.T) {
+	subnet := "192.168.0.0/24"
+
+	testAddPool(t, "addsubnet", nil, []string{})
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "addsubnet" {
+			err := ctl.AddAddress(pool.ID, &subnet, []string{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p1, err := ctl.ShowPool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// we should have a our subnet.
+			if p1.Subnets[0].CIDR != subnet {
+				t.Fatalf("expectd %s subnet got %s", subnet, p1.Subnets[0].CIDR)
+			}
+
+			err = ctl.DeletePool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+
+}
+
+func TestAddPoolSubnetOverlap(t *testing.T) {
+	subnet := "10.64.0.0/24"
+
+	orig, err := ctl.AddPool("overlapsubnet", &subnet, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := ctl.AddPool("overlapother", nil, []string{"10.66.0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		subnet   string
+		conflict string
+	}{
+		{"10.64.0.0/24", "10.64.0.0/24"},   // duplicate
+		{"10.64.0.0/16", "10.64.0.0/24"},   // supernet
+		{"10.64.0.128/25", "10.64.0.0/24"}, // contained
+		{"10.66.0.0/24", "10.66.0.5"},      // contains an address
+		{"10.64.1.0/24", ""},               // adjacent
+	}
+
+	for _, test := range tests {
+		s := test.subnet
+		err := ctl.AddAddress(other.ID, &s, nil)
+
+		if test.conflict == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", s, err)
+			}
+			continue
+		}
+
+		conflict, ok := err.(*api.SubnetConflictError)
+		if !ok {
+			t.Errorf("%s: expected subnet conflict, got %v", s, err)
+			continue
+		}
+
+		if conflict.Conflict != test.conflict {
+			t.Errorf("%s: expected conflict with %s, got %s", s, test.conflict, conflict.Conflict)
+		}
+	}
+
+	// overlapping subnets are also rejected at pool creation
+	_, err = ctl.AddPool("overlapnew", &subnet, []string{})
+	if conflict, ok := err.(*api.SubnetConflictError); !ok || conflict.PoolID != orig.ID {
+		t.Fatalf("expected subnet conflict with pool %s, got %v", orig.ID, err)
+	}
+
+	for _, ID := range []string{orig.ID, other.ID} {
+		err = ctl.DeletePool(ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAddPoolAddress(t *testing.T) {
+	address := "192.168.1.1"
+
+	testAddPool(t, "addaddress", nil, []string{})
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "addaddress" {
+			err := ctl.AddAddress(pool.ID, nil, []string{address})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p1, err := ctl.ShowPool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// we should have a our subnet.
+			if p1.IPs[0].Address != address {
+				t.Fatalf("expected %s address got %s", address, p1.IPs[0].Address)
+			}
+
+			err = ctl.DeletePool(pool.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+
+}
+
+func TestRemovePoolSubnet(t *testing.T) {
+	subnet := "192.168.0.0/24"
+	address := "192.168.1.1"
+
+	testAddPool(t, "addsubnet", &subnet, []string{})
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pool types.Pool
+
+	for _, pool = range pools {
+		if pool.Name == "addsubnet" {
+			// make sure the subnet is there.
+			for _, sub := range pool.Subnets {
+				if sub.CIDR == subnet {
+					err := ctl.RemoveAddress(pool.ID, &sub.ID, nil)
+					if err != nil {
+						t.Fatalf("%s: %v\n", err, pool.Subnets)
+					}
+				}
+			}
+		}
+		break
+	}
+
+	p1, err := ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p1.Subnets) != 0 || p1.TotalIPs != 0 || p1.Free != 0 {
+		fmt.Printf("pool %v\n", p1)
+		t.Fatal("subnet not deleted")
+	}
+
+	err = ctl.AddAddress(pool.ID, nil, []string{address})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p1, err = ctl.ShowPool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.RemoveAddress(pool.ID, nil, &p1.IPs[0].ID)
+	if err != nil {
+		t.Fatalf("%s: %v\n", err, pool.IPs)
+	}
+
+	err = ctl.RemoveAddress(pool.ID, nil, nil)
+	if err != types.ErrBadRequest {
+		t.Fatal("invalid remove address request allowed")
+	}
+}
+
+func TestMapAddress(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	ips := []string{"10.10.0.1"}
+	poolName := "testmap"
+
+	testAddPool(t, poolName, nil, ips)
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "testmap" {
+			if pool.Free != 1 {
+				t.Fatal("Pool Free not correct")
+			}
+		}
+	}
+
+	_, err = ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pools, err = ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
+	}
+
+	for _, pool := range pools {
+		if pool.Name == "testmap" {
+			if pool.Free != 0 {
+				fmt.Printf("%v", pool)
+				t.Fatal("Pool Free not decremented")
+			}
+		}
+	}
+}
+
+func TestWaitServerStatus(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+	instanceID := instances[0].ID
+
+	s, err := ctl.ShowServerDetails(tenantID, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = ctl.WaitServerStatus(context.Background(), tenantID, instanceID, s.Server.Status, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.TimedOut {
+		t.Fatal("Wait for the current status timed out")
+	}
+
+	s, err = ctl.WaitServerStatus(context.Background(), tenantID, instanceID, "unreachable", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.TimedOut || s.Server.ID != instanceID {
+		t.Fatalf("Expected last known state to be returned on timeout, got %+v", s)
+	}
+
+	// a client going away releases the wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = ctl.WaitServerStatus(ctx, tenantID, instanceID, "unreachable", time.Minute)
+	if err != context.Canceled {
+		t.Fatalf("Expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestServerSSH(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	tenantID := instances[0].TenantID
+	instanceID := instances[0].ID
+
+	_, err := ctl.ShowServerSSH(tenantID, instanceID)
+	if err != api.ErrNoExternalIP {
+		t.Fatalf("Expected %v, got %v", api.ErrNoExternalIP, err)
+	}
+
+	s, err := ctl.ShowServerDetails(tenantID, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Server.SSHIP != "" || s.Server.SSHPort != 0 {
+		t.Fatalf("Unexpected ssh access %s:%d", s.Server.SSHIP, s.Server.SSHPort)
+	}
+
+	poolName := "testssh"
+	testAddPool(t, poolName, nil, []string{"10.14.0.1"})
+
+	_, err = ctl.MapAddress(tenantID, &poolName, instanceID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ssh, err := ctl.ShowServerSSH(tenantID, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ssh.SSHIP != "10.14.0.1" || ssh.SSHPort != *instanceSSHPort {
+		t.Fatalf("Unexpected ssh access %s:%d", ssh.SSHIP, ssh.SSHPort)
+	}
+
+	s, err = ctl.ShowServerDetails(tenantID, instanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Server.SSHIP != ssh.SSHIP || s.Server.SSHPort != ssh.SSHPort {
+		t.Fatalf("Unexpected ssh access %s:%d", s.Server.SSHIP, s.Server.SSHPort)
+	}
+}
+
+func TestMapSpecificAddress(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	subnet := "10.12.0.0/29"
+	poolName := "testmapaddress"
+
+	pool, err := ctl.AddPool(poolName, &subnet, []string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.AddAddress(pool.ID, nil, []string{"10.12.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenantID := instances[0].TenantID
+	address := "10.12.0.4"
+
+	m, err := ctl.MapAddress(tenantID, &poolName, instances[0].ID, &address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.ExternalIP != address || m.InstanceID != instances[0].ID {
+		t.Fatalf("Unexpected mapping: %+v", m)
+	}
+
+	_, err = ctl.MapAddress(tenantID, &poolName, instances[0].ID, &address)
+	if err != types.ErrAddressInUse {
+		t.Fatalf("Expected %v, got %v", types.ErrAddressInUse, err)
+	}
+
+	other := "10.13.0.1"
+	_, err = ctl.MapAddress(tenantID, &poolName, instances[0].ID, &other)
+	if err != types.ErrAddressNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrAddressNotFound, err)
+	}
+
+	// without a pool name the pool of the address is found
+	single := "10.12.1.5"
+	m, err = ctl.MapAddress(tenantID, nil, instances[0].ID, &single)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.ExternalIP != single || m.PoolName != poolName {
+		t.Fatalf("Unexpected mapping: %+v", m)
+	}
+
+	for _, IP := range []string{address, single} {
+		err = ctl.ds.UnMapExternalIP(IP)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ctl.DeletePool(pool.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMapAddressNoPool(t *testing.T) {
+	var reason payloads.StartFailureReason
+
+	client, instances := testStartWorkload(t, 1, false, reason)
+	defer client.Shutdown()
+
+	ips := []string{"10.10.0.2"}
+	poolName := "testmapnopool"
+
+	testAddPool(t, poolName, nil, ips)
+
+	_, err := ctl.MapAddress(instances[0].TenantID, nil, instances[0].ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pools, err := ctl.ListPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pools) < 1 {
+		t.Fatal("Unable to retrieve pools")
 	}
 
 	for _, pool := range pools {
-		if pool.Name == "addaddress" {
-			err := ctl.AddAddress(pool.ID, nil, []string{address})
-			if err != nil {
-				t.Fatal(err)
+		if pool.Name == "testmapnopool" {
+			if pool.Free != 0 {
+				fmt.Printf("%v", pool)
+				t.Fatal("Pool Free not decremented")
 			}
+		}
+	}
 
-			p1, err := ctl.ShowPool(pool.ID)
-			if err != nil {
-				t.Fatal(err)
+	mappedIPs := ctl.ListMappedAddresses(&instances[0].TenantID)
+	if len(mappedIPs) != 1 {
+		t.Fatal("mapped IP not in list")
+	}
+}
+
+func TestListTenants(t *testing.T) {
+	tenants, err := ctl.ds.GetAllTenants()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := ctl.ListTenants(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tenant := range tenants {
+		var match bool
+
+		if tenant.ID == "public" {
+			continue
+		}
+
+		for _, s := range summary {
+			if s.ID != tenant.ID {
+				continue
 			}
 
-			// we should have a our subnet.
-			if p1.IPs[0].Address != address {
-				t.Fatalf("expected %s address got %s", address, p1.IPs[0].Address)
+			if s.Name != tenant.Name {
+				t.Fatal("bad name")
 			}
+			match = true
 
-			err = ctl.DeletePool(pool.ID)
-			if err != nil {
-				t.Fatal(err)
+			break
+		}
+
+		if match == false {
+			t.Fatal("did not list all tenants")
+		}
+	}
+}
+
+func TestShowTenant(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ctl.ShowTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Name != tenant.Name ||
+		config.SubnetBits != tenant.SubnetBits {
+		fmt.Printf("expect name %s, got %s\n", tenant.Name, config.Name)
+		fmt.Printf("expect bits %d, got %d\n", tenant.SubnetBits, config.SubnetBits)
+		t.Fatal("incorrect config returned")
+	}
+}
+
+func TestUpdateTenant(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ctl.ShowTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldconfig := config
+
+	config.Name = "test1"
+	config.SubnetBits = 30
+
+	a, err := json.Marshal(oldconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merge, err := jsonpatch.CreateMergePatch(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.PatchTenant(tenant.ID, merge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err = ctl.ShowTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Name != "test1" || config.SubnetBits != 30 {
+		t.Fatal("Tenant Update not successful")
+	}
+}
+
+func TestUpdateWorkload(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetTenantWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl, err := ctl.ShowWorkload(tenant.ID, wls[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldwl := wl
+
+	wl.Description = "test1"
+	wl.Visibility = types.Private
+	wl.Requirements.MemMB = 1024
+
+	a, err := json.Marshal(oldwl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merge, err := jsonpatch.CreateMergePatch(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ctl.PatchWorkload(tenant.ID, wl.ID, merge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl, err = ctl.ShowWorkload(tenant.ID, wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wl.Description != "test1" || wl.Requirements.MemMB != 1024 {
+		t.Fatal("Workload Update not successful")
+	}
+
+	err = ctl.PatchWorkload(tenant.ID, wl.ID, []byte(`{"vm_type":"docker"}`))
+	if err != types.ErrWorkloadImmutable {
+		t.Fatalf("Expected %v, got %v", types.ErrWorkloadImmutable, err)
+	}
+
+	err = ctl.PatchWorkload(tenant.ID, wl.ID, []byte(`{"visibility":"public"}`))
+	if err != types.ErrBadRequest {
+		t.Fatalf("Expected %v, got %v", types.ErrBadRequest, err)
+	}
+}
+
+func TestWorkloadVisibility(t *testing.T) {
+	owner, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ctl.ds.GetTenantWorkloads(owner.ID)
+	if err != nil || len(wls) == 0 {
+		t.Fatalf("no private workload for tenant: %v", err)
+	}
+	private := wls[0].ID
+
+	listed := func(tenantID string) bool {
+		wls, err := ctl.ListWorkloads(tenantID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, wl := range wls {
+			if wl.ID == private {
+				return true
 			}
-			return
 		}
+		return false
+	}
+
+	for _, tt := range []struct {
+		tenantID string
+		visible  bool
+	}{
+		{owner.ID, true},
+		{other.ID, false},
+		{"admin", true},
+	} {
+		_, err = ctl.ShowWorkload(tt.tenantID, private)
+		if tt.visible && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.tenantID, err)
+		} else if !tt.visible && err != types.ErrWorkloadNotFound {
+			t.Errorf("%s: expected %v got %v", tt.tenantID, types.ErrWorkloadNotFound, err)
+		}
+
+		if listed(tt.tenantID) != tt.visible {
+			t.Errorf("%s: expected private workload listed %v", tt.tenantID, tt.visible)
+		}
+	}
+
+	// public workloads are visible to everyone
+	wls, err = ctl.ListWorkloads(other.ID)
+	if err != nil {
+		t.Fatal(err)
 	}
 
+	for _, wl := range wls {
+		if wl.Visibility != types.Public {
+			continue
+		}
+
+		_, err = ctl.ShowWorkload(other.ID, wl.ID)
+		if err != nil {
+			t.Errorf("public workload %s: unexpected error %v", wl.ID, err)
+		}
+	}
 }
 
-func TestRemovePoolSubnet(t *testing.T) {
-	subnet := "192.168.0.0/24"
-	address := "192.168.1.1"
+func TestCreateTenant(t *testing.T) {
+	config := types.TenantConfig{
+		Name:       "createTenant",
+		SubnetBits: 21,
+	}
 
-	testAddPool(t, "addsubnet", &subnet, []string{})
+	ID := uuid.Generate()
 
-	pools, err := ctl.ListPools()
+	summary, err := ctl.CreateTenant(ID.String(), config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var pool types.Pool
+	if summary.Name != "createTenant" || summary.ID != ID.String() {
+		t.Fatal(err)
+	}
+
+	if len(summary.Links) != 1 {
+		t.Fatal("Link not built correctly")
+	}
+}
 
-	for _, pool = range pools {
-		if pool.Name == "addsubnet" {
-			// make sure the subnet is there.
-			for _, sub := range pool.Subnets {
-				if sub.CIDR == subnet {
-					err := ctl.RemoveAddress(pool.ID, &sub.ID, nil)
-					if err != nil {
-						t.Fatalf("%s: %v\n", err, pool.Subnets)
-					}
-				}
+func TestCreateTenantSubnetBits(t *testing.T) {
+	tests := []struct {
+		subnetBits int
+		valid      bool
+	}{
+		{0, true},
+		{-1, false},
+		{4, false},
+		{types.MinSubnetBits - 1, false},
+		{types.MinSubnetBits, true},
+		{types.MaxSubnetBits, true},
+		{types.MaxSubnetBits + 1, false},
+	}
+
+	for _, test := range tests {
+		config := types.TenantConfig{
+			Name:       "subnetBitsTenant",
+			SubnetBits: test.subnetBits,
+		}
+
+		_, err := ctl.CreateTenant(uuid.Generate().String(), config, nil)
+		if test.valid && err != nil {
+			t.Errorf("subnet bits %d rejected: %v", test.subnetBits, err)
+		}
+
+		if !test.valid {
+			if _, ok := err.(*types.SubnetBitsError); !ok {
+				t.Errorf("subnet bits %d: expected SubnetBitsError got %v", test.subnetBits, err)
 			}
 		}
-		break
 	}
+}
 
-	p1, err := ctl.ShowPool(pool.ID)
-	if err != nil {
-		t.Fatal(err)
+func TestCreateTenantSubnet(t *testing.T) {
+	config := types.TenantConfig{
+		Name:   "subnetTenant",
+		Subnet: "10.80.0.0/20",
 	}
 
-	if len(p1.Subnets) != 0 || p1.TotalIPs != 0 || p1.Free != 0 {
-		fmt.Printf("pool %v\n", p1)
-		t.Fatal("subnet not deleted")
-	}
+	ID := uuid.Generate().String()
 
-	err = ctl.AddAddress(pool.ID, nil, []string{address})
+	_, err := ctl.CreateTenant(ID, config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	p1, err = ctl.ShowPool(pool.ID)
+	created, err := ctl.ShowTenant(ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = ctl.RemoveAddress(pool.ID, nil, &p1.IPs[0].ID)
-	if err != nil {
-		t.Fatalf("%s: %v\n", err, pool.IPs)
+	if created.Subnet != config.Subnet || created.SubnetBits != 20 {
+		t.Fatalf("expected subnet %s/20 got %s/%d", config.Subnet, created.Subnet, created.SubnetBits)
 	}
 
-	err = ctl.RemoveAddress(pool.ID, nil, nil)
-	if err != types.ErrBadRequest {
-		t.Fatal("invalid remove address request allowed")
+	tests := []struct {
+		subnet     string
+		subnetBits int
+		err        error
+	}{
+		{"10.80.0.0/16", 0, &types.TenantSubnetConflictError{
+			Subnet:   "10.80.0.0/16",
+			Conflict: config.Subnet,
+			TenantID: ID,
+		}},
+		{"10.80.8.0/24", 0, &types.TenantSubnetConflictError{
+			Subnet:   "10.80.8.0/24",
+			Conflict: config.Subnet,
+			TenantID: ID,
+		}},
+		{"10.81.0.0/24", 24, types.ErrSubnetAndBits},
+		{"10.81.0.1/24", 0, types.ErrBadSubnet},
+		{"10.81.0.0", 0, types.ErrBadSubnet},
+		{"10.81.0.0/31", 0, &types.SubnetBitsError{SubnetBits: 31}},
 	}
-}
-
-func TestMapAddress(t *testing.T) {
-	var reason payloads.StartFailureReason
-
-	client, instances := testStartWorkload(t, 1, false, reason)
-	defer client.Shutdown()
 
-	ips := []string{"10.10.0.1"}
-	poolName := "testmap"
+	for _, test := range tests {
+		config := types.TenantConfig{
+			Name:       "subnetTenant",
+			SubnetBits: test.subnetBits,
+			Subnet:     test.subnet,
+		}
 
-	testAddPool(t, poolName, nil, ips)
+		_, err := ctl.CreateTenant(uuid.Generate().String(), config, nil)
+		if !reflect.DeepEqual(err, test.err) {
+			t.Errorf("%s/%d: expected %v got %v", test.subnet, test.subnetBits, test.err, err)
+		}
+	}
+}
 
-	pools, err := ctl.ListPools()
+func TestUpdateTenantSubnetBits(t *testing.T) {
+	tenant, err := addTestTenantNoCNCI()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+	tests := []struct {
+		patch string
+		valid bool
+	}{
+		{`{"subnet_bits":0}`, false},
+		{`{"subnet_bits":-1}`, false},
+		{`{"subnet_bits":null}`, false},
+		{`{"subnet_bits":4}`, false},
+		{fmt.Sprintf(`{"subnet_bits":%d}`, types.MinSubnetBits-1), false},
+		{fmt.Sprintf(`{"subnet_bits":%d}`, types.MinSubnetBits), true},
+		{fmt.Sprintf(`{"subnet_bits":%d}`, types.MaxSubnetBits), true},
+		{fmt.Sprintf(`{"subnet_bits":%d}`, types.MaxSubnetBits+1), false},
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "testmap" {
-			if pool.Free != 1 {
-				t.Fatal("Pool Free not correct")
+	for _, test := range tests {
+		config, err := ctl.ShowTenant(tenant.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ctl.PatchTenant(tenant.ID, []byte(test.patch))
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s rejected: %v", test.patch, err)
 			}
+			continue
+		}
+
+		if _, ok := err.(*types.SubnetBitsError); !ok {
+			t.Errorf("%s: expected SubnetBitsError got %v", test.patch, err)
+		}
+
+		updated, err := ctl.ShowTenant(tenant.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if updated.SubnetBits != config.SubnetBits {
+			t.Errorf("%s: subnet bits changed to %d", test.patch, updated.SubnetBits)
 		}
 	}
+}
+
+func TestDeleteTenant(t *testing.T) {
+	config := types.TenantConfig{
+		Name:       "deleteTenant",
+		SubnetBits: 24,
+	}
 
-	err = ctl.MapAddress(instances[0].TenantID, &poolName, instances[0].ID)
+	ID := uuid.Generate()
+
+	_, err := ctl.CreateTenant(ID.String(), config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pools, err = ctl.ListPools()
+	err = ctl.DeleteTenant(ID.String())
 	if err != nil {
 		t.Fatal(err)
 	}
+}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+func listedTenant(t *testing.T, ID string, includeDeleted bool) *types.TenantSummary {
+	summary, err := ctl.ListTenants(includeDeleted)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "testmap" {
-			if pool.Free != 0 {
-				fmt.Printf("%v", pool)
-				t.Fatal("Pool Free not decremented")
-			}
+	for i := range summary {
+		if summary[i].ID == ID {
+			return &summary[i]
 		}
 	}
-}
 
-func TestMapAddressNoPool(t *testing.T) {
-	var reason payloads.StartFailureReason
+	return nil
+}
 
-	client, instances := testStartWorkload(t, 1, false, reason)
-	defer client.Shutdown()
+func TestSoftDeleteTenant(t *testing.T) {
+	ctl.tenantRetention = time.Hour
+	defer func() {
+		ctl.tenantRetention = 0
+	}()
 
-	ips := []string{"10.10.0.2"}
-	poolName := "testmapnopool"
+	config := types.TenantConfig{
+		Name:       "softDeleteTenant",
+		SubnetBits: 24,
+	}
 
-	testAddPool(t, poolName, nil, ips)
+	ID := uuid.Generate().String()
 
-	err := ctl.MapAddress(instances[0].TenantID, nil, instances[0].ID)
+	_, err := ctl.CreateTenant(ID, config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	pools, err := ctl.ListPools()
-	if err != nil {
-		t.Fatal(err)
+	err = ctl.RestoreTenant(ID)
+	if err != types.ErrTenantNotDeleting {
+		t.Fatalf("expected %v got %v", types.ErrTenantNotDeleting, err)
 	}
 
-	if len(pools) < 1 {
-		t.Fatal("Unable to retrieve pools")
+	err = ctl.DeleteTenant(ID)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for _, pool := range pools {
-		if pool.Name == "testmapnopool" {
-			if pool.Free != 0 {
-				fmt.Printf("%v", pool)
-				t.Fatal("Pool Free not decremented")
-			}
-		}
+	if listedTenant(t, ID, false) != nil {
+		t.Fatal("Deleted tenant listed")
 	}
 
-	mappedIPs := ctl.ListMappedAddresses(&instances[0].TenantID)
-	if len(mappedIPs) != 1 {
-		t.Fatal("mapped IP not in list")
+	ts := listedTenant(t, ID, true)
+	if ts == nil || ts.State != types.TenantDeleting {
+		t.Fatalf("expected tenant to be listed as deleting, got %v", ts)
 	}
-}
 
-func TestListTenants(t *testing.T) {
-	tenants, err := ctl.ds.GetAllTenants()
+	err = ctl.RestoreTenant(ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	summary, err := ctl.ListTenants()
-	if err != nil {
-		t.Fatal(err)
+	ts = listedTenant(t, ID, false)
+	if ts == nil || ts.State != "" {
+		t.Fatalf("expected tenant to be restored, got %v", ts)
 	}
 
-	for _, tenant := range tenants {
-		var match bool
-
-		if tenant.ID == "public" {
-			continue
+	// deleting a deleted tenant removes it
+	for i := 0; i < 2; i++ {
+		err = ctl.DeleteTenant(ID)
+		if err != nil {
+			t.Fatal(err)
 		}
+	}
 
-		for _, s := range summary {
-			if s.ID != tenant.ID {
-				continue
-			}
-
-			if s.Name != tenant.Name {
-				t.Fatal("bad name")
-			}
-			match = true
+	tenant, err := ctl.ds.GetTenant(ID)
+	if err != nil || tenant != nil {
+		t.Fatalf("expected tenant to be removed, got %v %v", tenant, err)
+	}
+}
 
-			break
-		}
+func TestSoftDeletedTenantCreate(t *testing.T) {
+	ctl.tenantRetention = time.Hour
+	defer func() {
+		ctl.tenantRetention = 0
+	}()
 
-		if match == false {
-			t.Fatal("did not list all tenants")
-		}
+	config := types.TenantConfig{
+		Name:       "softDeletedCreate",
+		SubnetBits: 24,
 	}
-}
 
-func TestShowTenant(t *testing.T) {
-	tenant, err := addTestTenant()
+	ID := uuid.Generate().String()
+
+	_, err := ctl.CreateTenant(ID, config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	config, err := ctl.ShowTenant(tenant.ID)
+	err = ctl.DeleteTenant(ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if config.Name != tenant.Name ||
-		config.SubnetBits != tenant.SubnetBits {
-		fmt.Printf("expect name %s, got %s\n", tenant.Name, config.Name)
-		fmt.Printf("expect bits %d, got %d\n", tenant.SubnetBits, config.SubnetBits)
-		t.Fatal("incorrect config returned")
+	var server api.CreateServerRequest
+	server.Server.WorkloadID = uuid.Generate().String()
+
+	_, err = ctl.CreateServer(ID, server)
+	if err != types.ErrTenantDeleting {
+		t.Errorf("CreateServer: expected %v got %v", types.ErrTenantDeleting, err)
 	}
-}
 
-func TestUpdateTenant(t *testing.T) {
-	tenant, err := addTestTenantNoCNCI()
+	check, err := ctl.CheckServer(ID, server)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	config, err := ctl.ShowTenant(tenant.ID)
-	if err != nil {
-		t.Fatal(err)
+	if check.Admitted || len(check.Reasons) == 0 || check.Reasons[0] != types.ErrTenantDeleting.Error() {
+		t.Errorf("Unexpected dry run result: %+v", check)
 	}
 
-	oldconfig := config
+	_, err = ctl.CreateVolume(context.Background(), ID, api.RequestedVolume{Size: 1})
+	if err != types.ErrTenantDeleting {
+		t.Errorf("CreateVolume: expected %v got %v", types.ErrTenantDeleting, err)
+	}
 
-	config.Name = "test1"
-	config.SubnetBits = 30
+	_, err = ctl.CreateImage(ID, api.CreateImageRequest{Name: "softDeletedImage"})
+	if err != types.ErrTenantDeleting {
+		t.Errorf("CreateImage: expected %v got %v", types.ErrTenantDeleting, err)
+	}
 
-	a, err := json.Marshal(oldconfig)
+	_, err = ctl.CreateWorkload(types.Workload{TenantID: ID})
+	if err != types.ErrTenantDeleting {
+		t.Errorf("CreateWorkload: expected %v got %v", types.ErrTenantDeleting, err)
+	}
+
+	_, err = ctl.CreateWorkloadFromInstance(ID, uuid.Generate().String(), "softDeletedWorkload")
+	if err != types.ErrTenantDeleting {
+		t.Errorf("CreateWorkloadFromInstance: expected %v got %v", types.ErrTenantDeleting, err)
+	}
+
+	err = ctl.RestoreTenant(ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	b, err := json.Marshal(config)
+	check, err = ctl.CheckServer(ID, server)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	merge, err := jsonpatch.CreateMergePatch(a, b)
+	for _, reason := range check.Reasons {
+		if reason == types.ErrTenantDeleting.Error() {
+			t.Errorf("Restored tenant rejected: %+v", check)
+		}
+	}
+
+	ctl.tenantRetention = 0
+	err = ctl.DeleteTenant(ID)
 	if err != nil {
 		t.Fatal(err)
 	}
+}
 
-	err = ctl.PatchTenant(tenant.ID, merge)
+func TestSoftDeleteTenantExpiry(t *testing.T) {
+	ctl.tenantRetention = 10 * time.Millisecond
+	defer func() {
+		ctl.tenantRetention = 0
+	}()
+
+	config := types.TenantConfig{
+		Name:       "expiredTenant",
+		SubnetBits: 24,
+	}
+
+	ID := uuid.Generate().String()
+
+	_, err := ctl.CreateTenant(ID, config, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	config, err = ctl.ShowTenant(tenant.ID)
+	err = ctl.DeleteTenant(ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if config.Name != "test1" || config.SubnetBits != 30 {
-		t.Fatal("Tenant Update not successful")
+	for i := 0; i < 100; i++ {
+		tenant, err := ctl.ds.GetTenant(ID)
+		if err == nil && tenant == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
+
+	t.Fatal("Deleted tenant not removed after retention period")
 }
 
-func TestCreateTenant(t *testing.T) {
+func TestCreateTenantQuotas(t *testing.T) {
 	config := types.TenantConfig{
-		Name:       "createTenant",
-		SubnetBits: 21,
+		Name:       "quotaTenant",
+		SubnetBits: 24,
 	}
 
-	ID := uuid.Generate()
+	qds := []types.QuotaDetails{
+		{Name: "tenant-instances-quota", Value: 10},
+		{Name: "tenant-vcpu-per-instance-limit", Value: 4},
+	}
 
-	summary, err := ctl.CreateTenant(ID.String(), config)
+	ID := uuid.Generate().String()
+
+	_, err := ctl.CreateTenant(ID, config, qds)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer func() {
+		_ = ctl.DeleteTenant(ID)
+	}()
 
-	if summary.Name != "createTenant" || summary.ID != ID.String() {
-		t.Fatal(err)
+	values := make(map[string]int)
+	for _, qd := range ctl.ListQuotas(ID) {
+		values[qd.Name] = qd.Value
 	}
 
-	if len(summary.Links) != 1 {
-		t.Fatal("Link not built correctly")
+	for _, qd := range qds {
+		if values[qd.Name] != qd.Value {
+			t.Errorf("Expected %s to be %d, got %d", qd.Name, qd.Value, values[qd.Name])
+		}
 	}
 }
 
-func TestDeleteTenant(t *testing.T) {
+func TestCreateTenantInvalidQuotas(t *testing.T) {
 	config := types.TenantConfig{
-		Name:       "deleteTenant",
+		Name:       "invalidQuotaTenant",
 		SubnetBits: 24,
 	}
 
-	ID := uuid.Generate()
-
-	_, err := ctl.CreateTenant(ID.String(), config)
-	if err != nil {
-		t.Fatal(err)
+	tests := [][]types.QuotaDetails{
+		{{Name: "tenant-unknown-quota", Value: 1}},
+		{{Name: "tenant-instances-quota", Value: -2}},
+		{
+			{Name: "tenant-instances-quota", Value: 1},
+			{Name: "tenant-instances-quota", Value: 2},
+		},
 	}
 
-	err = ctl.DeleteTenant(ID.String())
-	if err != nil {
-		t.Fatal(err)
+	for _, qds := range tests {
+		ID := uuid.Generate().String()
+
+		_, err := ctl.CreateTenant(ID, config, qds)
+		if _, ok := err.(*types.InvalidQuotasError); !ok {
+			t.Errorf("Expected invalid quotas error for %v, got %v", qds, err)
+		}
+
+		tenant, err := ctl.ds.GetTenant(ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tenant != nil {
+			t.Errorf("Tenant %s created with invalid quotas %v", ID, qds)
+		}
 	}
 }
 
@@ -2130,3 +4258,41 @@ func TestMain(m *testing.M) {
 
 	os.Exit(code)
 }
+
+func TestSubscribeTenantEvents(t *testing.T) {
+	_, _, err := ctl.SubscribeTenantEvents(uuid.Generate().String())
+	if err != types.ErrTenantNotFound {
+		t.Fatalf("Expected %v, got %v", types.ErrTenantNotFound, err)
+	}
+
+	tenant, err := addTestTenantNoCNCI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cancels []func()
+	for i := 0; i < maxTenantStreams; i++ {
+		_, cancel, err := ctl.SubscribeTenantEvents(tenant.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancels = append(cancels, cancel)
+	}
+
+	_, _, err = ctl.SubscribeTenantEvents(tenant.ID)
+	if err != types.ErrTooManyStreams {
+		t.Fatalf("Expected %v, got %v", types.ErrTooManyStreams, err)
+	}
+
+	cancels[0]()
+
+	_, cancel, err := ctl.SubscribeTenantEvents(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancels[0] = cancel
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
@@ -16,10 +16,14 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"sort"
 
+	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/uuid"
+	"github.com/pkg/errors"
 )
 
 func (c *controller) makePoolLinks(pool *types.Pool) {
@@ -100,6 +104,13 @@ func (c *controller) AddPool(name string, subnet *string, ips []string) (types.P
 		}
 	}
 
+	if subnet != nil {
+		err = c.checkSubnetOverlap(*subnet)
+		if err != nil {
+			return types.Pool{}, err
+		}
+	}
+
 	pool := types.Pool{
 		ID:   uuid.Generate().String(),
 		Name: name,
@@ -118,17 +129,70 @@ func (c *controller) AddPool(name string, subnet *string, ips []string) (types.P
 	return c.ds.GetPool(pool.ID)
 }
 
+// countPoolAddresses sets the total number of addresses of the pool from
+// the size of its subnets and its individual addresses. The free count is
+// the total less the addresses of the pool which are mapped. The used and
+// free counts of each subnet are set from the mapped addresses it contains.
+func countPoolAddresses(pool *types.Pool, mapped []types.MappedIP) {
+	var poolMapped []net.IP
+	for _, m := range mapped {
+		if m.PoolID == pool.ID {
+			poolMapped = append(poolMapped, net.ParseIP(m.ExternalIP))
+		}
+	}
+
+	total := len(pool.IPs)
+
+	for i := range pool.Subnets {
+		subnet := &pool.Subnets[i]
+
+		_, ipNet, err := net.ParseCIDR(subnet.CIDR)
+		if err != nil {
+			continue
+		}
+
+		// gateway and broadcast are not allocatable
+		ones, bits := ipNet.Mask.Size()
+		n := (1 << uint32(bits-ones)) - 2
+		if n < 0 {
+			n = 0
+		}
+		total += n
+
+		subnet.Used = 0
+		for _, IP := range poolMapped {
+			if IP != nil && ipNet.Contains(IP) {
+				subnet.Used++
+			}
+		}
+
+		subnet.Free = n - subnet.Used
+		if subnet.Free < 0 {
+			subnet.Free = 0
+		}
+	}
+
+	pool.TotalIPs = total
+	pool.Free = total - len(poolMapped)
+	if pool.Free < 0 {
+		pool.Free = 0
+	}
+}
+
 func (c *controller) ListPools() ([]types.Pool, error) {
 	pools, err := c.ds.GetPools()
 	if err != nil {
 		return pools, err
 	}
 
+	mapped := c.ds.GetMappedIPs(nil)
+
 	// update the links. we do this here because we get the
 	// current hostname:port.
 	for i := range pools {
 		pool := &pools[i]
 		c.makePoolLinks(pool)
+		countPoolAddresses(pool, mapped)
 	}
 
 	return pools, nil
@@ -141,12 +205,72 @@ func (c *controller) ShowPool(ID string) (types.Pool, error) {
 	}
 
 	c.makePoolLinks(&pool)
+	countPoolAddresses(&pool, c.ds.GetMappedIPs(nil))
 
 	return pool, nil
 }
 
+// subnetsOverlap returns true if a and b share any address. CIDR blocks
+// are aligned, so they overlap only if one of them contains the other.
+func subnetsOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// checkSubnetOverlap walks the subnets and addresses of the existing pools
+// and returns an *api.SubnetConflictError for the first pool, by name,
+// which overlaps subnet.
+func (c *controller) checkSubnetOverlap(subnet string) error {
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return errors.Wrapf(err, "unable to parse subnet CIDR (%v)", subnet)
+	}
+
+	pools, err := c.ds.GetPools()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+
+	for _, pool := range pools {
+		for _, s := range pool.Subnets {
+			_, existing, err := net.ParseCIDR(s.CIDR)
+			if err != nil {
+				continue
+			}
+
+			if subnetsOverlap(ipNet, existing) {
+				return &api.SubnetConflictError{
+					Subnet:   subnet,
+					Conflict: s.CIDR,
+					PoolID:   pool.ID,
+					PoolName: pool.Name,
+				}
+			}
+		}
+
+		for _, IP := range pool.IPs {
+			if ipNet.Contains(net.ParseIP(IP.Address)) {
+				return &api.SubnetConflictError{
+					Subnet:   subnet,
+					Conflict: IP.Address,
+					PoolID:   pool.ID,
+					PoolName: pool.Name,
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c *controller) AddAddress(poolID string, subnet *string, ips []string) error {
 	if subnet != nil {
+		err := c.checkSubnetOverlap(*subnet)
+		if err != nil {
+			return err
+		}
+
 		return c.ds.AddExternalSubnet(poolID, *subnet)
 	}
 
@@ -180,8 +304,11 @@ func (c *controller) ListMappedAddresses(tenant *string) []types.MappedIP {
 	return IPs
 }
 
-func (c *controller) MapAddress(tenantID string, poolName *string, instanceID string) (err error) {
-	var m types.MappedIP
+// MapAddress maps an external IP to an instance. If address is not nil that
+// specific address is mapped, from the named pool or from whichever pool
+// it belongs to. Otherwise a free address is picked from the named pool,
+// or from the first pool with free addresses.
+func (c *controller) MapAddress(tenantID string, poolName *string, instanceID string, address *string) (m types.MappedIP, err error) {
 	var i *types.Instance
 
 	if tenantID == "" {
@@ -191,7 +318,12 @@ func (c *controller) MapAddress(tenantID string, poolName *string, instanceID st
 		i, err = c.ds.GetTenantInstance(tenantID, instanceID)
 	}
 	if err != nil {
-		return err
+		return m, err
+	}
+
+	err = c.checkTenantActive(i.TenantID)
+	if err != nil {
+		return m, err
 	}
 
 	// A matching release for this is in the client unAssignEvent
@@ -203,46 +335,67 @@ func (c *controller) MapAddress(tenantID string, poolName *string, instanceID st
 	}()
 
 	if !res.Allowed() {
-		return types.ErrQuota
+		return m, types.ErrQuota
 	}
 
 	pools, err := c.ds.GetPools()
 	if err != nil {
-		return err
+		return m, err
 	}
 
-	err = types.ErrPoolEmpty
+	if address != nil {
+		err = types.ErrAddressNotFound
+		if poolName != nil {
+			err = types.ErrPoolNotFound
+		}
+	} else {
+		err = types.ErrPoolEmpty
+	}
 
 	for _, pool := range pools {
-		if poolName != nil {
-			if pool.Name == *poolName {
-				m, err = c.ds.MapExternalIP(pool.ID, instanceID)
-				break
+		if poolName != nil && pool.Name != *poolName {
+			continue
+		}
+
+		if address != nil {
+			m, err = c.ds.MapExternalIPAddress(pool.ID, instanceID, *address)
+			if err == types.ErrAddressNotFound && poolName == nil {
+				continue
 			}
-		} else if pool.Free > 0 {
+			break
+		}
+
+		if poolName != nil || pool.Free > 0 {
 			m, err = c.ds.MapExternalIP(pool.ID, instanceID)
 			break
 		}
 	}
 
 	if err != nil {
-		return err
+		return m, err
 	}
 
 	// get tenant CNCI info
 	t, err := c.ds.GetTenant(m.TenantID)
 	if err != nil {
 		_ = c.UnMapAddress(m.ExternalIP)
-		return err
+		return m, err
 	}
 
 	err = c.client.mapExternalIP(*t, m)
 	if err != nil {
 		// can never fail at this point.
 		_ = c.UnMapAddress(m.ExternalIP)
+		return m, err
+	}
+
+	if tenantID == "" {
+		c.makeMappedIPLinks(&m, nil)
+	} else {
+		c.makeMappedIPLinks(&m, &tenantID)
 	}
 
-	return err
+	return m, nil
 }
 
 func (c *controller) UnMapAddress(address string) error {
@@ -15,11 +15,17 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"regexp"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
@@ -29,12 +35,18 @@ import (
 	"github.com/golang/glog"
 )
 
+var imageNameRegexp = regexp.MustCompile("^[a-z0-9-.]{1,64}$")
+
 // CreateImage will create an empty image in the image datastore.
 func (c *controller) CreateImage(tenantID string, req api.CreateImageRequest) (types.Image, error) {
 	// create an ImageInfo struct and store it in our image
 	// datastore.
 	glog.Infof("Creating Image: %v", req.ID)
 
+	if err := c.checkTenantActive(tenantID); err != nil {
+		return types.Image{}, err
+	}
+
 	id := req.ID
 	if id == "" {
 		id = uuid.Generate().String()
@@ -45,8 +57,7 @@ func (c *controller) CreateImage(tenantID string, req api.CreateImageRequest) (t
 		}
 	}
 
-	r := regexp.MustCompile("^[a-z0-9-.]{1,64}$")
-	if !r.MatchString(req.Name) {
+	if !imageNameRegexp.MatchString(req.Name) {
 		return types.Image{}, types.ErrBadName
 	}
 
@@ -87,26 +98,50 @@ func (c *controller) ListImages(tenant string) ([]types.Image, error) {
 	return c.ds.GetImages(tenant, false)
 }
 
-func (c *controller) uploadImage(imageID string, body io.Reader) error {
+// spoolImage writes the image data to a temporary file, the name of which
+// is returned along with the hex encoded SHA-256 checksum of the data. The
+// data written is also copied to progress if not nil. If checksum is not
+// empty and does not match the data, the file is removed and
+// api.ErrImageChecksum returned.
+func spoolImage(body io.Reader, progress io.Writer, checksum string) (string, string, error) {
 	f, err := ioutil.TempFile("", "ciao-image")
 	if err != nil {
-		return fmt.Errorf("Error creating temporary image file: %v", err)
+		return "", "", fmt.Errorf("Error creating temporary image file: %v", err)
+	}
+
+	h := sha256.New()
+	w := io.MultiWriter(f, h)
+	if progress != nil {
+		w = io.MultiWriter(f, h, progress)
 	}
-	defer func() { _ = os.Remove(f.Name()) }()
 
 	buf := make([]byte, 1<<16)
-	_, err = io.CopyBuffer(f, body, buf)
+	_, err = io.CopyBuffer(w, body, buf)
 	if err != nil {
 		_ = f.Close()
-		return fmt.Errorf("Error writing to temporary image file: %v", err)
+		_ = os.Remove(f.Name())
+		return "", "", fmt.Errorf("Error writing to temporary image file: %v", err)
 	}
 
 	err = f.Close()
 	if err != nil {
-		return fmt.Errorf("Error closing temporary image file: %v", err)
+		_ = os.Remove(f.Name())
+		return "", "", fmt.Errorf("Error closing temporary image file: %v", err)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if checksum != "" && !strings.EqualFold(checksum, sum) {
+		_ = os.Remove(f.Name())
+		return "", "", api.ErrImageChecksum
 	}
 
-	_, err = c.CreateBlockDevice(imageID, f.Name(), 0)
+	return f.Name(), sum, nil
+}
+
+// importImage creates the block device backing the image from the
+// image data in path.
+func (c *controller) importImage(imageID string, path string) error {
+	_, err := c.CreateBlockDevice(imageID, path, 0)
 	if err != nil {
 		return fmt.Errorf("Error creating block device: %v", err)
 	}
@@ -120,8 +155,80 @@ func (c *controller) uploadImage(imageID string, body io.Reader) error {
 	return nil
 }
 
-// UploadImage will upload a raw image data and update its status.
-func (c *controller) UploadImage(tenantID, imageID string, body io.Reader) error {
+func (c *controller) uploadImage(imageID string, body io.Reader, checksum string) (string, error) {
+	path, sum, err := spoolImage(body, nil, checksum)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = os.Remove(path) }()
+
+	return sum, c.importImage(imageID, path)
+}
+
+// captureImage creates a private image of the tenant from a copy of a
+// volume. The image is active once created.
+func (c *controller) captureImage(tenantID, volumeID, name string) (types.Image, error) {
+	bd, err := c.CopyBlockDevice(volumeID)
+	if err != nil {
+		return types.Image{}, fmt.Errorf("Error copying volume %v: %v", volumeID, err)
+	}
+
+	image, err := c.CreateImage(tenantID, api.CreateImageRequest{
+		ID:         bd.ID,
+		Name:       name,
+		Visibility: types.Private,
+	})
+	if err != nil {
+		_ = c.DeleteBlockDevice(bd.ID)
+		return types.Image{}, err
+	}
+
+	fail := func(err error) (types.Image, error) {
+		glog.Errorf("Error capturing image %v: %v", image.ID, err)
+		image.State = types.Killed
+		_ = c.ds.UpdateImage(image)
+		return types.Image{}, api.ErrImageSaving
+	}
+
+	err = c.CreateBlockDeviceSnapshot(image.ID, "ciao-image")
+	if err != nil {
+		return fail(fmt.Errorf("Unable to create snapshot: %v", err))
+	}
+
+	image.Size, err = c.GetBlockDeviceSize(image.ID)
+	if err != nil {
+		return fail(fmt.Errorf("Error getting block device size: %v", err))
+	}
+
+	image.State = types.Active
+	err = c.ds.UpdateImage(image)
+	if err != nil {
+		return types.Image{}, err
+	}
+
+	glog.Infof("Image %v captured from volume %v", image.ID, volumeID)
+	return image, nil
+}
+
+// contextReader fails reads once its context is done, aborting the upload
+// of an image which the client is no longer waiting for.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// UploadImage will upload a raw image data and update its status. The data
+// is verified against checksum, a hex encoded SHA-256 checksum, if given.
+// The upload is abandoned and the image killed if ctx is cancelled or the
+// upload is cancelled with CancelImage.
+func (c *controller) UploadImage(ctx context.Context, tenantID, imageID string, body io.Reader, checksum string) error {
 	glog.Infof("Uploading image: %v", imageID)
 
 	image, err := c.ds.GetImage(imageID)
@@ -133,33 +240,46 @@ func (c *controller) UploadImage(tenantID, imageID string, body io.Reader) error
 		return api.ErrNoImage
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	upload, err := c.addUpload(imageID, cancel)
+	if err != nil {
+		return err
+	}
+
 	image.State = types.Saving
 	err = c.ds.UpdateImage(image)
 	if err != nil {
+		c.removeUpload(imageID, upload)
 		return err
 	}
 
-	err = c.uploadImage(imageID, body)
+	sum, err := c.uploadImage(imageID, contextReader{ctx, body}, checksum)
 	if err != nil {
-		glog.Errorf("Error uploading image: %v", err)
-		image.State = types.Killed
-		_ = c.ds.UpdateImage(image)
+		c.failUpload(image, upload, err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == api.ErrImageChecksum {
+			return err
+		}
 		return api.ErrImageSaving
 	}
 
 	imageSize, err := c.GetBlockDeviceSize(imageID)
 	if err != nil {
-		glog.Errorf("Error getting block device size: %v", err)
-		image.State = types.Killed
-		_ = c.ds.UpdateImage(image)
+		c.failUpload(image, upload, fmt.Errorf("Error getting block device size: %v", err))
 		return api.ErrImageSaving
 	}
 
 	image.Size = imageSize
+	image.Checksum = sum
 	image.State = types.Active
 
-	err = c.ds.UpdateImage(image)
+	err = c.completeUpload(ctx, image, upload)
 	if err != nil {
+		c.failUpload(image, upload, err)
 		return err
 	}
 
@@ -167,6 +287,384 @@ func (c *controller) UploadImage(tenantID, imageID string, body io.Reader) error
 	return nil
 }
 
+// DownloadImage returns the contents of an active image and their size.
+// The contents are exported to a temporary file which is unlinked before
+// being returned, so the file is removed when the caller closes it.
+func (c *controller) DownloadImage(tenantID, imageID string) (io.ReadSeeker, int64, error) {
+	glog.Infof("Downloading image [%v] from [%v]", imageID, tenantID)
+
+	image, err := c.GetImage(tenantID, imageID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if image.State != types.Active {
+		return nil, 0, api.ErrImageNotActive
+	}
+
+	f, err := ioutil.TempFile("", "ciao-image")
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error creating temporary image file: %v", err)
+	}
+	path := f.Name()
+	_ = f.Close()
+	defer func() { _ = os.Remove(path) }()
+
+	err = c.ExportBlockDevice(image.ID, "ciao-image", path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error exporting block device: %v", err)
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Error opening exported image: %v", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, fmt.Errorf("Error getting exported image size: %v", err)
+	}
+
+	return f, fi.Size(), nil
+}
+
+// UpdateImage changes the visibility of an image. The visibility of an
+// image may only be changed by the tenant which owns it or by admin.
+func (c *controller) UpdateImage(tenantID, imageID string, visibility types.Visibility) error {
+	glog.Infof("Updating image %v visibility to %v", imageID, visibility)
+
+	image, err := c.ds.GetImage(imageID)
+	if err != nil {
+		return err
+	}
+
+	if tenantID != "admin" && image.TenantID != tenantID {
+		return api.ErrImageNotPermitted
+	}
+
+	err = c.ds.UpdateImageVisibility(imageID, visibility)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("Image %v visibility updated", imageID)
+	return nil
+}
+
+// PatchImage applies a json merge patch to an image. Tenants may only
+// patch their own images. Only the name of an image may be changed.
+func (c *controller) PatchImage(tenantID, imageID string, patch []byte) error {
+	image, err := c.ds.GetImage(imageID)
+	if err != nil {
+		return err
+	}
+
+	if tenantID != "admin" && image.TenantID != tenantID {
+		return api.ErrImageNotPermitted
+	}
+
+	var req struct {
+		Name *string `json:"name"`
+	}
+
+	err = json.Unmarshal(patch, &req)
+	if err != nil {
+		return types.ErrBadRequest
+	}
+
+	if req.Name != nil && !imageNameRegexp.MatchString(*req.Name) {
+		return types.ErrBadName
+	}
+
+	return c.ds.JSONPatchImage(imageID, patch)
+}
+
+// imageUpload tracks the progress of an image upload.
+// imageUploadDataTimeout is how long an asynchronous upload waits for its
+// data to start arriving before the image is killed.
+var imageUploadDataTimeout = 10 * time.Minute
+
+type imageUpload struct {
+	ID       string
+	received uint64
+	ctx      context.Context
+	cancel   context.CancelFunc
+	started  bool // the data of an asynchronous upload is being received
+}
+
+func (u *imageUpload) Write(p []byte) (int, error) {
+	atomic.AddUint64(&u.received, uint64(len(p)))
+	return len(p), nil
+}
+
+func (c *controller) addUpload(imageID string, cancel context.CancelFunc) (*imageUpload, error) {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	if _, ok := c.uploads[imageID]; ok {
+		return nil, api.ErrImageSaving
+	}
+
+	if c.uploads == nil {
+		c.uploads = make(map[string]*imageUpload)
+	}
+
+	u := &imageUpload{
+		ID:     uuid.Generate().String(),
+		cancel: cancel,
+	}
+	c.uploads[imageID] = u
+
+	return u, nil
+}
+
+// removeUpload stops tracking the upload u of the image, unless it has
+// already been replaced by another upload.
+func (c *controller) removeUpload(imageID string, u *imageUpload) {
+	c.uploadsLock.Lock()
+	if c.uploads[imageID] == u {
+		delete(c.uploads, imageID)
+	}
+	c.uploadsLock.Unlock()
+}
+
+// receiveUpload returns the asynchronous upload uploadID of the image,
+// which starts receiving its data. The data of an upload is only received
+// once.
+func (c *controller) receiveUpload(imageID, uploadID string) (*imageUpload, error) {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	u, ok := c.uploads[imageID]
+	if !ok || u.ID != uploadID || u.ctx == nil {
+		return nil, api.ErrNoImageUpload
+	}
+
+	if u.started {
+		return nil, api.ErrImageSaving
+	}
+
+	u.started = true
+	return u, nil
+}
+
+// expireUpload kills the image if the data of its asynchronous upload u
+// has not started arriving.
+func (c *controller) expireUpload(image types.Image, u *imageUpload) {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	if c.uploads[image.ID] != u || u.started {
+		return
+	}
+
+	glog.Errorf("No data received for upload %v of image %v", u.ID, image.ID)
+
+	u.cancel()
+	image.State = types.Killed
+	_ = c.ds.UpdateImage(image)
+	delete(c.uploads, image.ID)
+}
+
+// completeUpload stores the image once its data has been imported, unless
+// the upload u has been cancelled in the meantime.
+func (c *controller) completeUpload(ctx context.Context, image types.Image, u *imageUpload) error {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	if c.uploads[image.ID] != u {
+		return context.Canceled
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := c.ds.UpdateImage(image)
+	if err != nil {
+		return err
+	}
+
+	delete(c.uploads, image.ID)
+	return nil
+}
+
+// uploadProgress returns the number of bytes received so far by an
+// asynchronous upload of the image.
+func (c *controller) uploadProgress(imageID string) (uint64, bool) {
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	u, ok := c.uploads[imageID]
+	if !ok {
+		return 0, false
+	}
+
+	return atomic.LoadUint64(&u.received), true
+}
+
+// failUpload marks the image as killed following an upload error, unless
+// the upload u has been cancelled which has already killed the image.
+func (c *controller) failUpload(image types.Image, u *imageUpload, err error) {
+	glog.Errorf("Error uploading image %v: %v", image.ID, err)
+
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	if c.uploads[image.ID] != u {
+		return
+	}
+
+	image.State = types.Killed
+	_ = c.ds.UpdateImage(image)
+	delete(c.uploads, image.ID)
+}
+
+// CancelImage cancels the upload of an image, which is killed. An image
+// left saving or uploading by a previous instance of the controller is
+// killed too.
+func (c *controller) CancelImage(tenantID, imageID string) error {
+	image, err := c.ds.GetImage(imageID)
+	if err != nil {
+		return err
+	}
+
+	if tenantID != "admin" && image.TenantID != tenantID {
+		return api.ErrNoImage
+	}
+
+	c.uploadsLock.Lock()
+	defer c.uploadsLock.Unlock()
+
+	// the upload may have completed since the image was retrieved.
+	image, err = c.ds.GetImage(imageID)
+	if err != nil {
+		return err
+	}
+
+	if image.State != types.Saving && image.State != types.Uploading {
+		return types.ErrNotCancellable
+	}
+
+	glog.Infof("Cancelling upload of image %v", imageID)
+
+	if u, ok := c.uploads[imageID]; ok {
+		u.cancel()
+		delete(c.uploads, imageID)
+	}
+
+	image.State = types.Killed
+	return c.ds.UpdateImage(image)
+}
+
+// StartImageUpload starts an asynchronous upload of the image and returns
+// its ID. The image is in the uploading state until the data, sent with
+// UploadImageData, has been imported when it becomes active, or killed if
+// the upload fails or is cancelled with CancelImage. The image is killed
+// too if the data does not start arriving within imageUploadDataTimeout.
+func (c *controller) StartImageUpload(tenantID, imageID string) (string, error) {
+	glog.Infof("Starting asynchronous upload of image: %v", imageID)
+
+	image, err := c.ds.GetImage(imageID)
+	if err != nil {
+		return "", err
+	}
+
+	if tenantID != "admin" && image.TenantID != tenantID {
+		return "", api.ErrNoImage
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	upload, err := c.addUpload(imageID, cancel)
+	if err != nil {
+		cancel()
+		return "", err
+	}
+	upload.ctx = ctx
+
+	image.State = types.Uploading
+	image.Size = 0
+	err = c.ds.UpdateImage(image)
+	if err != nil {
+		c.removeUpload(imageID, upload)
+		cancel()
+		return "", err
+	}
+
+	time.AfterFunc(imageUploadDataTimeout, func() {
+		c.expireUpload(image, upload)
+	})
+
+	return upload.ID, nil
+}
+
+// UploadImageData receives the data of the asynchronous upload uploadID
+// and returns once it has been received, the data being imported in the
+// background. The data is verified against checksum, if given, before
+// returning.
+func (c *controller) UploadImageData(ctx context.Context, tenantID, imageID, uploadID string, body io.Reader, checksum string) error {
+	glog.Infof("Receiving data of image %v upload %v", imageID, uploadID)
+
+	image, err := c.ds.GetImage(imageID)
+	if err != nil {
+		return err
+	}
+
+	if tenantID != "admin" && image.TenantID != tenantID {
+		return api.ErrNoImage
+	}
+
+	upload, err := c.receiveUpload(imageID, uploadID)
+	if err != nil {
+		return err
+	}
+
+	path, sum, err := spoolImage(contextReader{upload.ctx, contextReader{ctx, body}}, upload, checksum)
+	if err != nil {
+		c.failUpload(image, upload, err)
+		upload.cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == api.ErrImageChecksum {
+			return err
+		}
+		return api.ErrImageSaving
+	}
+
+	go func() {
+		defer upload.cancel()
+		defer func() { _ = os.Remove(path) }()
+
+		err := c.importImage(imageID, path)
+		if err != nil {
+			c.failUpload(image, upload, err)
+			return
+		}
+
+		imageSize, err := c.GetBlockDeviceSize(imageID)
+		if err != nil {
+			c.failUpload(image, upload, fmt.Errorf("Error getting block device size: %v", err))
+			return
+		}
+
+		image.Size = imageSize
+		image.Checksum = sum
+		image.State = types.Active
+		err = c.completeUpload(upload.ctx, image, upload)
+		if err != nil {
+			c.failUpload(image, upload, err)
+			return
+		}
+
+		glog.Infof("Image %v uploaded", imageID)
+	}()
+
+	return nil
+}
+
 // DeleteImage will delete a raw image and its metadata
 func (c *controller) DeleteImage(tenantID, imageID string) error {
 	glog.Infof("Deleting image: %v", imageID)
@@ -219,6 +717,12 @@ func (c *controller) GetImage(tenantID, imageID string) (types.Image, error) {
 		return types.Image{}, api.ErrNoImage
 	}
 
+	if image.State == types.Uploading {
+		if received, ok := c.uploadProgress(image.ID); ok {
+			image.Size = received
+		}
+	}
+
 	glog.Infof("Image %v found", imageID)
 	return image, nil
 }
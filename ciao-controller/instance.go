@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -58,7 +59,7 @@ func isCNCIWorkload(workload *types.Workload) bool {
 }
 
 func newInstance(ctl *controller, tenantID string, workload *types.Workload,
-	name string, subnet string, IPAddr net.IP) (*instance, error) {
+	name string, subnet string, IPAddr net.IP, mac string) (*instance, error) {
 	id := uuid.Generate()
 
 	if name != "" {
@@ -72,7 +73,7 @@ func newInstance(ctl *controller, tenantID string, workload *types.Workload,
 		}
 	}
 
-	config, err := newConfig(ctl, workload, id.String(), tenantID, name, IPAddr)
+	config, err := newConfig(ctl, workload, id.String(), tenantID, name, IPAddr, mac)
 	if err != nil {
 		return nil, err
 	}
@@ -123,7 +124,7 @@ func (i *instance) Add() error {
 			return fmt.Errorf("Invalid block device mapping.  %s already in use", volume.ID)
 		}
 
-		_, err = ds.CreateStorageAttachment(i.Instance.ID, volume)
+		_, err = ds.CreateStorageAttachment(i.Instance.ID, volume, "")
 		if err != nil {
 			return errors.Wrap(err, "Error creating storage attachment")
 		}
@@ -220,7 +221,7 @@ func getStorage(c *controller, s types.StorageResource, tenant string, instanceI
 		return payloads.StorageResource{}, errors.New("Unsupported workload storage variant in getStorage()")
 	}
 
-	volume, err := c.CreateVolume(tenant, req)
+	volume, err := c.createVolume(context.Background(), tenant, req)
 	if err != nil {
 		return payloads.StorageResource{}, errors.Wrap(err, "Error creating volume")
 	}
@@ -265,7 +266,7 @@ func networkConfig(ctl *controller, tenant *types.Tenant, networking *payloads.N
 }
 
 func newConfig(ctl *controller, wl *types.Workload, instanceID string, tenantID string,
-	name string, IPaddr net.IP) (config, error) {
+	name string, IPaddr net.IP, mac string) (config, error) {
 	var metaData userData
 	var config config
 	var networking payloads.NetworkResources
@@ -287,6 +288,12 @@ func newConfig(ctl *controller, wl *types.Workload, instanceID string, tenantID
 		return config, err
 	}
 
+	// the MAC address requested for the instance replaces the one
+	// derived from its IP address.
+	if mac != "" {
+		networking.VnicMAC = mac
+	}
+
 	metaData.Hostname = instanceID
 	if name != "" {
 		metaData.Hostname = name
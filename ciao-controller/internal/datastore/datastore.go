@@ -94,6 +94,7 @@ type persistentStore interface {
 
 	// interfaces related to workloads
 	addWorkload(wl types.Workload) error
+	updateWorkload(wl types.Workload) error
 	deleteWorkload(ID string) error
 	getWorkloads() ([]types.Workload, error)
 
@@ -198,6 +199,8 @@ type Datastore struct {
 	workloadsLock   *sync.RWMutex
 	workloads       map[string]types.Workload
 	publicWorkloads []string
+
+	events eventBroker
 }
 
 func (ds *Datastore) initExternalIPs() {
@@ -261,11 +264,11 @@ func (ds *Datastore) initWorkloads() error {
 	for _, wl := range workloads {
 		ds.workloads[wl.ID] = wl
 
+		// as in AddWorkload, a public workload is only listed as public
+		// even if it has an owner.
 		if wl.Visibility == types.Public {
 			ds.publicWorkloads = append(ds.publicWorkloads, wl.ID)
-		}
-
-		if wl.TenantID != "" {
+		} else if wl.TenantID != "" {
 			_, ok := ds.tenants[wl.TenantID]
 			if !ok {
 				return errors.Wrapf(err, "Database inconsistent: tenant in workload not in database: %s", wl.TenantID)
@@ -417,7 +420,12 @@ func (ds *Datastore) AddTenant(id string, config types.TenantConfig) (*types.Ten
 		return nil, errors.New("Duplicate Tenant ID")
 	}
 
-	err := ds.db.addTenant(id, config)
+	err := ds.checkTenantSubnet(id, config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ds.db.addTenant(id, config)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error adding tenant (%v) to database", id)
 	}
@@ -432,6 +440,71 @@ func (ds *Datastore) AddTenant(id string, config types.TenantConfig) (*types.Ten
 	return &t.Tenant, nil
 }
 
+// checkTenantSubnet verifies that the explicit subnet of a tenant, if any,
+// does not overlap the explicit subnet of another tenant. Tenants whose
+// subnets are allocated from the tenant network have separate networks and
+// are not checked. The tenants lock must be held.
+func (ds *Datastore) checkTenantSubnet(id string, config types.TenantConfig) error {
+	if config.Subnet == "" {
+		return nil
+	}
+
+	subnet, err := config.ValidateSubnet()
+	if err != nil {
+		return err
+	}
+
+	for _, t := range ds.tenants {
+		if t.ID == id || t.Subnet == "" {
+			continue
+		}
+
+		_, other, err := net.ParseCIDR(t.Subnet)
+		if err != nil {
+			continue
+		}
+
+		if subnet.Contains(other.IP) || other.Contains(subnet.IP) {
+			return &types.TenantSubnetConflictError{
+				Subnet:   config.Subnet,
+				Conflict: t.Subnet,
+				TenantID: t.ID,
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetTenantDeleteTime records when a tenant was soft deleted. A zero time
+// restores the tenant.
+func (ds *Datastore) SetTenantDeleteTime(ID string, t time.Time) error {
+	ds.tenantsLock.Lock()
+	defer ds.tenantsLock.Unlock()
+
+	tenant, ok := ds.tenants[ID]
+	if !ok {
+		return ErrNoTenant
+	}
+
+	oldTime := tenant.DeleteTime
+	tenant.DeleteTime = t
+
+	err := ds.db.updateTenant(&tenant.Tenant)
+	if err != nil {
+		tenant.DeleteTime = oldTime
+		return errors.Wrapf(err, "error updating tenant (%v)", ID)
+	}
+
+	return nil
+}
+
+// patchSets reports whether a json merge patch sets field to a value.
+func patchSets(fields map[string]json.RawMessage, field string) bool {
+	v, ok := fields[field]
+	return ok && string(v) != "null"
+}
+
 // DeleteTenant removes a tenant from the datastore.
 // It is the responsibility of the caller to ensure all tenant artifacts
 // are removed first.
@@ -502,11 +575,44 @@ func (ds *Datastore) JSONPatchTenant(ID string, patch []byte) error {
 		return errors.Wrap(err, "error updating tenant")
 	}
 
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(patch, &fields)
+	if err != nil {
+		return errors.Wrap(err, "error updating tenant")
+	}
+
+	// setting the subnet bits returns the tenant to subnets allocated
+	// from the tenant network, setting the subnet pins it.
+	if patchSets(fields, "subnet") {
+		if patchSets(fields, "subnet_bits") {
+			return types.ErrSubnetAndBits
+		}
+
+		subnet, err := config.ValidateSubnet()
+		if err != nil {
+			return err
+		}
+
+		config.Subnet = subnet.String()
+		config.SubnetBits, _ = subnet.Mask.Size()
+	} else if patchSets(fields, "subnet_bits") {
+		config.Subnet = ""
+	}
+
+	if err := config.ValidateSubnetBits(); err != nil {
+		return err
+	}
+
+	if err := ds.checkTenantSubnet(ID, config); err != nil {
+		return err
+	}
+
 	// SubnetBits must not modified if there are active instances.
 	// for now, the cncis must also be removed. In the future we might
 	// be able to just update the cnci with the new subnet info.
 	if len(tenant.instances) > 0 {
-		if oldconfig.SubnetBits != config.SubnetBits {
+		if oldconfig.SubnetBits != config.SubnetBits ||
+			oldconfig.Subnet != config.Subnet {
 			return errors.New("Unable to update with active instances")
 		}
 	}
@@ -543,6 +649,117 @@ func (ds *Datastore) AddWorkload(w types.Workload) error {
 	return nil
 }
 
+// immutableWorkload returns the encoding of the fields of a workload which
+// may not be patched.
+func immutableWorkload(wl types.Workload) ([]byte, error) {
+	wl.Description = ""
+	wl.Visibility = ""
+	wl.Requirements = payloads.WorkloadRequirements{}
+
+	return json.Marshal(wl)
+}
+
+// JSONPatchWorkload will update a workload with changes from a json merge
+// patch. Only the description, visibility and requirements of the workload
+// may be changed.
+func (ds *Datastore) JSONPatchWorkload(ID string, patch []byte) error {
+	var wl types.Workload
+
+	ds.workloadsLock.Lock()
+	defer ds.workloadsLock.Unlock()
+
+	old, ok := ds.workloads[ID]
+	if !ok {
+		return types.ErrWorkloadNotFound
+	}
+
+	orig, err := json.Marshal(old)
+	if err != nil {
+		return errors.Wrap(err, "error updating workload")
+	}
+
+	new, err := jsonpatch.MergePatch(orig, patch)
+	if err != nil {
+		return errors.Wrap(err, "error updating workload")
+	}
+
+	err = json.Unmarshal(new, &wl)
+	if err != nil {
+		return errors.Wrap(err, "error updating workload")
+	}
+	wl.TenantID = old.TenantID
+
+	a, err := immutableWorkload(old)
+	if err != nil {
+		return errors.Wrap(err, "error updating workload")
+	}
+
+	b, err := immutableWorkload(wl)
+	if err != nil {
+		return errors.Wrap(err, "error updating workload")
+	}
+
+	if string(a) != string(b) {
+		return types.ErrWorkloadImmutable
+	}
+
+	if wl.Visibility != old.Visibility {
+		switch wl.Visibility {
+		case types.Public:
+		case types.Private:
+			if wl.TenantID == "" {
+				return types.ErrBadRequest
+			}
+		default:
+			return types.ErrBadRequest
+		}
+	}
+
+	err = ds.db.updateWorkload(wl)
+	if err != nil {
+		return errors.Wrapf(err, "error updating workload (%v) in database", ID)
+	}
+
+	ds.workloads[ID] = wl
+
+	if (wl.Visibility == types.Public) == (old.Visibility == types.Public) {
+		return nil
+	}
+
+	ds.tenantsLock.Lock()
+	defer ds.tenantsLock.Unlock()
+
+	tenant, ok := ds.tenants[wl.TenantID]
+
+	if wl.Visibility == types.Public {
+		ds.publicWorkloads = append(ds.publicWorkloads, ID)
+		if ok {
+			for i, id := range tenant.workloads {
+				if id == ID {
+					tenant.workloads = append(tenant.workloads[:i], tenant.workloads[i+1:]...)
+					break
+				}
+			}
+		}
+		return nil
+	}
+
+	for i, id := range ds.publicWorkloads {
+		if id == ID {
+			ds.publicWorkloads = append(ds.publicWorkloads[:i], ds.publicWorkloads[i+1:]...)
+			break
+		}
+	}
+
+	if !ok {
+		return ErrNoTenant
+	}
+
+	tenant.workloads = append(tenant.workloads, ID)
+
+	return nil
+}
+
 // DeleteWorkload will delete an unused workload from the datastore.
 // workload ID out of the datastore.
 func (ds *Datastore) DeleteWorkload(workloadID string) error {
@@ -623,6 +840,24 @@ func (ds *Datastore) GetWorkloads(tenantID string) ([]types.Workload, error) {
 	return ds.getWorkloads(tenantID, true)
 }
 
+// GetAllWorkloads retrieves the public workloads and the private workloads
+// of every tenant, ordered by ID.
+func (ds *Datastore) GetAllWorkloads() ([]types.Workload, error) {
+	ds.workloadsLock.RLock()
+	defer ds.workloadsLock.RUnlock()
+
+	workloads := make([]types.Workload, 0, len(ds.workloads))
+	for _, wl := range ds.workloads {
+		workloads = append(workloads, wl)
+	}
+
+	sort.Slice(workloads, func(i, j int) bool {
+		return workloads[i].ID < workloads[j].ID
+	})
+
+	return workloads, nil
+}
+
 // GetTenantWorkloads retrieves a list of private workloads.
 func (ds *Datastore) GetTenantWorkloads(tenantID string) ([]types.Workload, error) {
 	return ds.getWorkloads(tenantID, false)
@@ -775,6 +1010,10 @@ func (ds *Datastore) AllocateTenantIPPool(tenantID string, num int) ([]net.IP, e
 
 	// hardcode start address and max address for tenant network.
 	cidr := fmt.Sprintf("%s/%d", "172.16.0.0", tenant.SubnetBits)
+	if tenant.Subnet != "" {
+		cidr = tenant.Subnet
+	}
+
 	IP, ipNet, err := net.ParseCIDR(cidr)
 	if err != nil {
 		return nil, err
@@ -789,6 +1028,11 @@ func (ds *Datastore) AllocateTenantIPPool(tenantID string, num int) ([]net.IP, e
 	maxHosts := (1 << hostBits)
 	mask := binary.BigEndian.Uint32(ipNet.Mask)
 
+	// a tenant with an explicit subnet only has addresses in that subnet.
+	if tenant.Subnet != "" {
+		end = start + uint32(maxHosts)
+	}
+
 	var hostCount int
 
 	ds.tenantsLock.Lock()
@@ -1013,6 +1257,14 @@ func (ds *Datastore) AddInstance(instance *types.Instance) error {
 
 	ds.instancesLock.Unlock()
 
+	if !instance.CNCI {
+		ds.publishEvent(instance.TenantID, types.ResourceEvent{
+			Type:  types.InstanceEvent,
+			ID:    instance.ID,
+			State: instance.State,
+		})
+	}
+
 	ds.tenantsLock.Lock()
 	tenant := ds.tenants[instance.TenantID]
 	if tenant != nil {
@@ -1078,8 +1330,17 @@ func (ds *Datastore) AttachVolumeFailure(instanceID string, volumeID string, rea
 		return errors.Wrapf(err, "error getting block device for volume (%v)", volumeID)
 	}
 
+	// a volume shared read-only remains in use by its other instances
 	oldState := data.State
 	data.State = types.Available
+	attachments, _ := ds.GetVolumeAttachments(volumeID)
+	for _, a := range attachments {
+		if a.InstanceID != instanceID {
+			data.State = types.InUse
+			break
+		}
+	}
+
 	err = ds.UpdateBlockDevice(data)
 	if err != nil {
 		data.State = oldState
@@ -1175,6 +1436,14 @@ func (ds *Datastore) DeleteInstance(instanceID string) error {
 		return errors.Wrapf(err, "error deleting instance")
 	}
 
+	if !i.CNCI {
+		ds.publishEvent(tenantID, types.ResourceEvent{
+			Type:  types.InstanceEvent,
+			ID:    instanceID,
+			State: types.DeletedState,
+		})
+	}
+
 	msg := fmt.Sprintf("Deleted Instance %s", instanceID)
 	e := types.LogEntry{
 		TenantID:  tenantID,
@@ -1210,6 +1479,20 @@ func (ds *Datastore) updateInstanceStatus(status, instanceID string) error {
 	return nil
 }
 
+// publishInstanceState reports the state of a tenant instance to the
+// subscribers of its tenant.
+func (ds *Datastore) publishInstanceState(i *types.Instance) {
+	if i.CNCI {
+		return
+	}
+
+	ds.publishEvent(i.TenantID, types.ResourceEvent{
+		Type:  types.InstanceEvent,
+		ID:    i.ID,
+		State: i.State,
+	})
+}
+
 // InstanceRestarting resets a restarting instance's state to pending.
 func (ds *Datastore) InstanceRestarting(instanceID string) error {
 	err := ds.updateInstanceStatus(payloads.Pending, instanceID)
@@ -1222,6 +1505,8 @@ func (ds *Datastore) InstanceRestarting(instanceID string) error {
 	i.State = payloads.Pending
 	ds.instancesLock.Unlock()
 
+	ds.publishInstanceState(i)
+
 	return nil
 }
 
@@ -1239,6 +1524,8 @@ func (ds *Datastore) InstanceStopped(instanceID string) error {
 	i.State = payloads.Exited
 	ds.instancesLock.Unlock()
 
+	ds.publishInstanceState(i)
+
 	// we may not have received any node stats for this instance
 	if oldNodeID != "" {
 		ds.nodesLock.Lock()
@@ -1543,7 +1830,10 @@ func (ds *Datastore) addInstanceStats(stats []payloads.InstanceStat, nodeID stri
 		ds.instancesLock.Lock()
 		instance, ok := ds.instances[stat.InstanceUUID]
 		if ok {
-			instance.State = stat.State
+			if instance.State != stat.State {
+				instance.State = stat.State
+				ds.publishInstanceState(instance)
+			}
 			instance.NodeID = nodeID
 			instance.SSHIP = stat.SSHIP
 			instance.SSHPort = stat.SSHPort
@@ -1716,6 +2006,13 @@ func (ds *Datastore) AddBlockDevice(device types.Volume) error {
 	devices := ds.tenants[device.TenantID].devices
 	devices[device.ID] = device
 	ds.tenantsLock.Unlock()
+
+	ds.publishEvent(device.TenantID, types.ResourceEvent{
+		Type:  types.VolumeEvent,
+		ID:    device.ID,
+		State: string(device.State),
+	})
+
 	return nil
 }
 
@@ -1745,6 +2042,12 @@ func (ds *Datastore) DeleteBlockDevice(ID string) error {
 	ds.tenantsLock.Unlock()
 	ds.bdLock.Unlock()
 
+	ds.publishEvent(dev.TenantID, types.ResourceEvent{
+		Type:  types.VolumeEvent,
+		ID:    ID,
+		State: types.DeletedState,
+	})
+
 	return nil
 }
 
@@ -1797,9 +2100,59 @@ func (ds *Datastore) UpdateBlockDevice(data types.Volume) error {
 	return errors.Wrapf(ds.AddBlockDevice(data), "error updating block device (%v)", data.ID)
 }
 
+func immutableVolume(v types.Volume) ([]byte, error) {
+	v.Name = ""
+	v.Description = ""
+
+	return json.Marshal(v)
+}
+
+// JSONPatchBlockDevice will update a block device with changes from a json
+// merge patch. Only the name and description of the volume may be changed.
+func (ds *Datastore) JSONPatchBlockDevice(ID string, patch []byte) error {
+	var v types.Volume
+
+	old, err := ds.GetBlockDevice(ID)
+	if err != nil {
+		return err
+	}
+
+	orig, err := json.Marshal(old)
+	if err != nil {
+		return errors.Wrap(err, "error updating block device")
+	}
+
+	new, err := jsonpatch.MergePatch(orig, patch)
+	if err != nil {
+		return errors.Wrap(err, "error updating block device")
+	}
+
+	err = json.Unmarshal(new, &v)
+	if err != nil {
+		return errors.Wrap(err, "error updating block device")
+	}
+	v.Tag = old.Tag
+
+	a, err := immutableVolume(old)
+	if err != nil {
+		return errors.Wrap(err, "error updating block device")
+	}
+
+	b, err := immutableVolume(v)
+	if err != nil {
+		return errors.Wrap(err, "error updating block device")
+	}
+
+	if string(a) != string(b) {
+		return types.ErrVolumeImmutable
+	}
+
+	return ds.UpdateBlockDevice(v)
+}
+
 // CreateStorageAttachment will associate an instance with a block device in
-// the datastore
-func (ds *Datastore) CreateStorageAttachment(instanceID string, volume payloads.StorageResource) (types.StorageAttachment, error) {
+// the datastore, recording the mountpoint requested, if any.
+func (ds *Datastore) CreateStorageAttachment(instanceID string, volume payloads.StorageResource, mountpoint string) (types.StorageAttachment, error) {
 	link := attachment{
 		instanceID: instanceID,
 		volumeID:   volume.ID,
@@ -1811,6 +2164,8 @@ func (ds *Datastore) CreateStorageAttachment(instanceID string, volume payloads.
 		BlockID:    volume.ID,
 		Ephemeral:  volume.Ephemeral,
 		Boot:       volume.Bootable,
+		Mountpoint: mountpoint,
+		ReadOnly:   volume.ReadOnly,
 	}
 
 	err := ds.db.addStorageAttachment(a)
@@ -2394,30 +2749,7 @@ func (ds *Datastore) MapExternalIP(poolID string, instanceID string) (types.Mapp
 		for IP := initIP; ipNet.Contains(IP); incrementIP(IP) {
 			_, ok := ds.mappedIPs[IP.String()]
 			if !ok {
-				m.ID = uuid.Generate().String()
-				m.ExternalIP = IP.String()
-				m.InternalIP = instance.IPAddress
-				m.InstanceID = instanceID
-				m.TenantID = instance.TenantID
-				m.PoolID = pool.ID
-				m.PoolName = pool.Name
-
-				pool.Free--
-
-				err = ds.db.addMappedIP(m)
-				if err != nil {
-					return types.MappedIP{}, errors.Wrap(err, "error adding IP mapping to database")
-				}
-				ds.mappedIPs[IP.String()] = m
-
-				err = ds.db.updatePool(pool)
-				if err != nil {
-					return types.MappedIP{}, errors.Wrap(err, "error updating pool in database")
-				}
-
-				ds.pools[poolID] = pool
-
-				return m, nil
+				return ds.mapIP(pool, instance, IP.String())
 			}
 		}
 	}
@@ -2426,36 +2758,100 @@ func (ds *Datastore) MapExternalIP(poolID string, instanceID string) (types.Mapp
 	for _, IP := range pool.IPs {
 		_, ok := ds.mappedIPs[IP.Address]
 		if !ok {
-			m.ID = uuid.Generate().String()
-			m.ExternalIP = IP.Address
-			m.InternalIP = instance.IPAddress
-			m.InstanceID = instanceID
-			m.TenantID = instance.TenantID
-			m.PoolID = pool.ID
-			m.PoolName = pool.Name
+			return ds.mapIP(pool, instance, IP.Address)
+		}
+	}
 
-			pool.Free--
+	// if you got here you are out of luck. But you never should.
+	glog.Warningf("Pool reports %d free addresses but none found", pool.Free)
+	return m, types.ErrPoolEmpty
+}
 
-			err = ds.db.addMappedIP(m)
-			if err != nil {
-				return types.MappedIP{}, errors.Wrap(err, "error adding IP mapping to database")
-			}
-			ds.mappedIPs[IP.Address] = m
+// MapExternalIPAddress will allocate the given address from a pool to
+// an instance. types.ErrAddressNotFound is returned if the address does not
+// belong to the pool and types.ErrAddressInUse if it is already mapped.
+func (ds *Datastore) MapExternalIPAddress(poolID string, instanceID string, address string) (types.MappedIP, error) {
+	IP := net.ParseIP(address)
+	if IP == nil {
+		return types.MappedIP{}, types.ErrInvalidIP
+	}
 
-			err = ds.db.updatePool(pool)
-			if err != nil {
-				return types.MappedIP{}, errors.Wrap(err, "error updating pool in database")
-			}
+	instance, err := ds.GetInstance(instanceID)
+	if err != nil {
+		return types.MappedIP{}, errors.Wrapf(err, "error getting instance (%v)", instanceID)
+	}
+
+	ds.poolsLock.Lock()
+	defer ds.poolsLock.Unlock()
 
-			ds.pools[poolID] = pool
+	pool, ok := ds.pools[poolID]
+	if !ok {
+		return types.MappedIP{}, types.ErrPoolNotFound
+	}
 
-			return m, nil
+	if !poolContains(pool, IP) {
+		return types.MappedIP{}, types.ErrAddressNotFound
+	}
+
+	if _, ok := ds.mappedIPs[IP.String()]; ok {
+		return types.MappedIP{}, types.ErrAddressInUse
+	}
+
+	return ds.mapIP(pool, instance, IP.String())
+}
+
+// poolContains returns true if IP is one of the addresses of pool which
+// may be mapped. The network address of each subnet is reserved.
+func poolContains(pool types.Pool, IP net.IP) bool {
+	for _, sub := range pool.Subnets {
+		_, ipNet, err := net.ParseCIDR(sub.CIDR)
+		if err != nil {
+			continue
+		}
+
+		if ipNet.Contains(IP) && !IP.Equal(ipNet.IP) {
+			return true
 		}
 	}
 
-	// if you got here you are out of luck. But you never should.
-	glog.Warningf("Pool reports %d free addresses but none found", pool.Free)
-	return m, types.ErrPoolEmpty
+	for _, addr := range pool.IPs {
+		if IP.Equal(net.ParseIP(addr.Address)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mapIP records the mapping of address from pool to instance.
+// lock for the pools must be held by the caller.
+func (ds *Datastore) mapIP(pool types.Pool, instance *types.Instance, address string) (types.MappedIP, error) {
+	m := types.MappedIP{
+		ID:         uuid.Generate().String(),
+		ExternalIP: address,
+		InternalIP: instance.IPAddress,
+		InstanceID: instance.ID,
+		TenantID:   instance.TenantID,
+		PoolID:     pool.ID,
+		PoolName:   pool.Name,
+	}
+
+	pool.Free--
+
+	err := ds.db.addMappedIP(m)
+	if err != nil {
+		return types.MappedIP{}, errors.Wrap(err, "error adding IP mapping to database")
+	}
+	ds.mappedIPs[address] = m
+
+	err = ds.db.updatePool(pool)
+	if err != nil {
+		return types.MappedIP{}, errors.Wrap(err, "error updating pool in database")
+	}
+
+	ds.pools[pool.ID] = pool
+
+	return m, nil
 }
 
 // UnMapExternalIP will stop associating a given address with an instance.
@@ -2615,9 +3011,59 @@ func (ds *Datastore) AddImage(i types.Image) error {
 		ds.internalImages = append(ds.internalImages, i.ID)
 	}
 
+	ds.publishImageState(i.TenantID, i.ID, string(i.State))
+
 	return nil
 }
 
+func immutableImage(i types.Image) ([]byte, error) {
+	i.Name = ""
+
+	return json.Marshal(i)
+}
+
+// JSONPatchImage will update an image with changes from a json merge patch.
+// Only the name of the image may be changed.
+func (ds *Datastore) JSONPatchImage(ID string, patch []byte) error {
+	var i types.Image
+
+	old, err := ds.GetImage(ID)
+	if err != nil {
+		return err
+	}
+
+	orig, err := json.Marshal(old)
+	if err != nil {
+		return errors.Wrap(err, "error updating image")
+	}
+
+	new, err := jsonpatch.MergePatch(orig, patch)
+	if err != nil {
+		return errors.Wrap(err, "error updating image")
+	}
+
+	err = json.Unmarshal(new, &i)
+	if err != nil {
+		return errors.Wrap(err, "error updating image")
+	}
+
+	a, err := immutableImage(old)
+	if err != nil {
+		return errors.Wrap(err, "error updating image")
+	}
+
+	b, err := immutableImage(i)
+	if err != nil {
+		return errors.Wrap(err, "error updating image")
+	}
+
+	if string(a) != string(b) {
+		return types.ErrImageImmutable
+	}
+
+	return ds.UpdateImage(i)
+}
+
 // UpdateImage updates the image metadate in the datastore and database
 func (ds *Datastore) UpdateImage(i types.Image) error {
 	ds.imageLock.Lock()
@@ -2648,9 +3094,77 @@ func (ds *Datastore) UpdateImage(i types.Image) error {
 
 	ds.images[i.ID] = i
 
+	if oldImage.State != i.State {
+		ds.publishImageState(i.TenantID, i.ID, string(i.State))
+	}
+
 	return nil
 }
 
+// publishImageState reports the state of an image to the subscribers of
+// the tenant owning it. Images not owned by a tenant are not reported.
+func (ds *Datastore) publishImageState(tenantID string, ID string, state string) {
+	if tenantID == "" {
+		return
+	}
+
+	ds.publishEvent(tenantID, types.ResourceEvent{
+		Type:  types.ImageEvent,
+		ID:    ID,
+		State: state,
+	})
+}
+
+// UpdateImageVisibility changes the visibility of an image in the
+// datastore and database
+func (ds *Datastore) UpdateImageVisibility(ID string, visibility types.Visibility) error {
+	ds.imageLock.Lock()
+	defer ds.imageLock.Unlock()
+
+	image, ok := ds.images[ID]
+	if !ok {
+		return api.ErrNoImage
+	}
+
+	if image.Visibility == visibility {
+		return nil
+	}
+
+	old := image.Visibility
+	image.Visibility = visibility
+
+	if err := ds.db.updateImage(image); err != nil {
+		return errors.Wrap(err, "Error updating image in database")
+	}
+
+	switch old {
+	case types.Public:
+		ds.publicImages = removeImageID(ds.publicImages, ID)
+	case types.Internal:
+		ds.internalImages = removeImageID(ds.internalImages, ID)
+	}
+
+	switch visibility {
+	case types.Public:
+		ds.publicImages = append(ds.publicImages, ID)
+	case types.Internal:
+		ds.internalImages = append(ds.internalImages, ID)
+	}
+
+	ds.images[ID] = image
+
+	return nil
+}
+
+func removeImageID(IDs []string, ID string) []string {
+	for i, id := range IDs {
+		if id == ID {
+			return append(IDs[:i], IDs[i+1:]...)
+		}
+	}
+	return IDs
+}
+
 // GetImage retrieves an image by ID
 func (ds *Datastore) GetImage(ID string) (types.Image, error) {
 	ds.imageLock.RLock()
@@ -2783,5 +3297,7 @@ func (ds *Datastore) DeleteImage(ID string) error {
 
 	delete(ds.images, ID)
 
+	ds.publishImageState(image.TenantID, ID, types.DeletedState)
+
 	return nil
 }
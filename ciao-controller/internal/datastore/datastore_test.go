@@ -1033,6 +1033,130 @@ func TestUpdateTenant(t *testing.T) {
 	}
 }
 
+func TestSetTenantDeleteTime(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deleteTime := time.Now()
+	err = ds.SetTenantDeleteTime(tenant.ID, deleteTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbTenant, err := ds.db.getTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !dbTenant.DeleteTime.Equal(deleteTime) {
+		t.Fatalf("expected delete time %v got %v", deleteTime, dbTenant.DeleteTime)
+	}
+
+	err = ds.SetTenantDeleteTime(tenant.ID, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbTenant, err = ds.db.getTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !dbTenant.DeleteTime.IsZero() {
+		t.Fatalf("expected tenant to be restored, got delete time %v", dbTenant.DeleteTime)
+	}
+
+	err = ds.SetTenantDeleteTime(uuid.Generate().String(), deleteTime)
+	if err != ErrNoTenant {
+		t.Fatalf("expected %v got %v", ErrNoTenant, err)
+	}
+}
+
+func TestTenantSubnet(t *testing.T) {
+	config := types.TenantConfig{
+		SubnetBits: 30,
+		Subnet:     "10.65.0.0/30",
+	}
+
+	tenant, err := ds.AddTenant(uuid.Generate().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only a single host address is available in a /30
+	ip, err := ds.AllocateTenantIP(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.String() != "10.65.0.2" {
+		t.Fatalf("expected 10.65.0.2 got %s", ip)
+	}
+
+	_, err = ds.AllocateTenantIP(tenant.ID)
+	if err == nil {
+		t.Fatal("expected address allocation outside of subnet to fail")
+	}
+
+	dbTenant, err := ds.db.getTenant(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dbTenant.Subnet != config.Subnet {
+		t.Fatalf("expected subnet %s got %s", config.Subnet, dbTenant.Subnet)
+	}
+
+	config.SubnetBits = 24
+	config.Subnet = "10.65.0.0/24"
+	_, err = ds.AddTenant(uuid.Generate().String(), config)
+	if _, ok := err.(*types.TenantSubnetConflictError); !ok {
+		t.Fatalf("expected TenantSubnetConflictError got %v", err)
+	}
+
+	other, err := ds.AddTenant(uuid.Generate().String(), types.TenantConfig{SubnetBits: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		patch  string
+		err    error
+		subnet string
+		bits   int
+	}{
+		{`{"subnet":"10.65.0.0/29"}`, &types.TenantSubnetConflictError{}, "", 24},
+		{`{"subnet":"10.66.0.0/20","subnet_bits":20}`, types.ErrSubnetAndBits, "", 24},
+		{`{"subnet":"10.66.0.1/20"}`, types.ErrBadSubnet, "", 24},
+		{`{"subnet":"10.66.0.0/20"}`, nil, "10.66.0.0/20", 20},
+		{`{"name":"pinned"}`, nil, "10.66.0.0/20", 20},
+		{`{"subnet_bits":22}`, nil, "", 22},
+	}
+
+	for _, test := range tests {
+		err = ds.JSONPatchTenant(other.ID, []byte(test.patch))
+		if _, ok := test.err.(*types.TenantSubnetConflictError); ok {
+			if _, ok := err.(*types.TenantSubnetConflictError); !ok {
+				t.Fatalf("%s: expected TenantSubnetConflictError got %v", test.patch, err)
+			}
+		} else if err != test.err {
+			t.Fatalf("%s: expected %v got %v", test.patch, test.err, err)
+		}
+
+		updated, err := ds.GetTenant(other.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if updated.Subnet != test.subnet || updated.SubnetBits != test.bits {
+			t.Fatalf("%s: expected subnet %q/%d got %q/%d", test.patch,
+				test.subnet, test.bits, updated.Subnet, updated.SubnetBits)
+		}
+	}
+}
+
 func TestDeleteTenant(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
@@ -1538,7 +1662,7 @@ func TestCreateStorageAttachment(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(instance.ID, volume, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1596,7 +1720,7 @@ func TestUpdateStorageAttachmentDeleted(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(instance.ID, volume, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1645,7 +1769,7 @@ func TestGetStorageAttachment(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(instance.ID, volume, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1743,7 +1867,7 @@ func TestDeleteStorageAttachment(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(instance.ID, volume, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1809,7 +1933,7 @@ func TestDeleteStorageAttachmentError(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(instance.ID, volume, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1880,7 +2004,7 @@ func TestGetVolumeAttachments(t *testing.T) {
 		Ephemeral: false,
 		Bootable:  false,
 	}
-	_, err = ds.CreateStorageAttachment(instance.ID, volume)
+	_, err = ds.CreateStorageAttachment(instance.ID, volume, "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -2476,6 +2600,105 @@ func TestGetMappedIPs(t *testing.T) {
 	}
 }
 
+func TestJSONPatchWorkload(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetTenantWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := wls[0]
+
+	a, err := json.Marshal(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wl := old
+	wl.Description = "Patched workload"
+	wl.Requirements.VCPUs = 4
+
+	b, err := json.Marshal(wl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merge, err := jsonpatch.CreateMergePatch(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.JSONPatchWorkload(wl.ID, merge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testWorkload, err := ds.GetWorkload(wl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if testWorkload.Description != "Patched workload" || testWorkload.Requirements.VCPUs != 4 {
+		t.Fatal("Workload update not successful")
+	}
+
+	for _, patch := range []string{
+		`{"id":"ba58f471-0735-4773-9550-188e2d012941"}`,
+		`{"fw_type":"legacy"}`,
+		`{"vm_type":"docker"}`,
+	} {
+		err = ds.JSONPatchWorkload(wl.ID, []byte(patch))
+		if err != types.ErrWorkloadImmutable {
+			t.Errorf("%s: expected %v, got %v", patch, types.ErrWorkloadImmutable, err)
+		}
+	}
+}
+
+func TestGetAllWorkloads(t *testing.T) {
+	tenant1, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant2, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := make(map[string]bool)
+	for _, tenantID := range []string{tenant1.ID, tenant2.ID} {
+		wls, err := ds.GetWorkloads(tenantID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, wl := range wls {
+			expected[wl.ID] = true
+		}
+	}
+
+	wls, err := ds.GetAllWorkloads()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, wl := range wls {
+		delete(expected, wl.ID)
+
+		if i > 0 && wls[i-1].ID >= wl.ID {
+			t.Errorf("workloads not ordered by ID: %s before %s", wls[i-1].ID, wl.ID)
+		}
+	}
+
+	if len(expected) != 0 {
+		t.Errorf("workloads missing: %v", expected)
+	}
+}
+
 func TestDeleteWorkload(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
@@ -2591,6 +2814,74 @@ func TestAddRemoveImage(t *testing.T) {
 	}
 }
 
+func TestUpdateImageVisibility(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := types.Image{
+		ID:         uuid.Generate().String(),
+		Name:       "test-image-visibility",
+		Visibility: types.Private,
+		TenantID:   tenant.ID,
+	}
+
+	err = ds.AddImage(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.UpdateImageVisibility(i.ID, types.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := ds.GetImage(i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Visibility != types.Public {
+		t.Fatal("Image visibility not updated")
+	}
+
+	images, err := ds.GetImages(other.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ID != i.ID {
+		t.Fatal("Public image not visible to other tenants")
+	}
+
+	err = ds.UpdateImageVisibility(i.ID, types.Private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images, err = ds.GetImages(other.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 {
+		t.Fatal("Private image visible to other tenants")
+	}
+
+	err = ds.UpdateImageVisibility(uuid.Generate().String(), types.Public)
+	if err != api.ErrNoImage {
+		t.Fatal("Expected error on update of unknown image")
+	}
+
+	err = ds.DeleteImage(i.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestAddRemovePublicImage(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
@@ -2837,3 +3128,93 @@ func TestMain(m *testing.M) {
 
 	os.Exit(code)
 }
+
+func TestResourceEvents(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wls, err := ds.GetTenantWorkloads(tenant.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events1, cancel1, err := ds.SubscribeEvents(tenant.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events2, cancel2, err := ds.SubscribeEvents(tenant.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ds.SubscribeEvents(tenant.ID, 2)
+	if err != types.ErrTooManyStreams {
+		t.Fatalf("Expected %v, got %v", types.ErrTooManyStreams, err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ds.DeleteInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	volume := types.Volume{
+		BlockDevice: storage.BlockDevice{ID: uuid.Generate().String()},
+		State:       types.Available,
+		TenantID:    tenant.ID,
+		CreateTime:  time.Now(),
+	}
+
+	err = ds.AddBlockDevice(volume)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []types.ResourceEvent{
+		{Type: types.InstanceEvent, ID: instance.ID, State: payloads.Pending},
+		{Type: types.InstanceEvent, ID: instance.ID, State: types.DeletedState},
+		{Type: types.VolumeEvent, ID: volume.ID, State: string(types.Available)},
+	}
+
+	for _, events := range []<-chan types.ResourceEvent{events1, events2} {
+		for _, e := range expected {
+			select {
+			case got := <-events:
+				if got != e {
+					t.Fatalf("Expected event %v, got %v", e, got)
+				}
+			default:
+				t.Fatalf("Expected event %v", e)
+			}
+		}
+	}
+
+	cancel1()
+	cancel1()
+
+	if _, ok := <-events1; ok {
+		t.Fatal("Expected events to be closed")
+	}
+
+	_, cancel3, err := ds.SubscribeEvents(tenant.ID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel2()
+	cancel3()
+
+	ds.events.Lock()
+	_, ok := ds.events.subscribers[tenant.ID]
+	ds.events.Unlock()
+	if ok {
+		t.Fatal("Expected no subscribers to remain")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"sync"
+
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/golang/glog"
+)
+
+// eventQueueLen is the number of events queued for a subscriber. Events
+// are dropped for subscribers which fall further behind.
+const eventQueueLen = 64
+
+// eventBroker delivers the resource events of a tenant to its subscribers.
+type eventBroker struct {
+	sync.Mutex
+	subscribers map[string]map[chan types.ResourceEvent]struct{}
+}
+
+// SubscribeEvents returns a channel on which the resource events of tenant
+// are delivered, and a function to cancel the subscription. At most max
+// subscriptions may be active for a tenant at once.
+func (ds *Datastore) SubscribeEvents(tenant string, max int) (<-chan types.ResourceEvent, func(), error) {
+	b := &ds.events
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.subscribers == nil {
+		b.subscribers = make(map[string]map[chan types.ResourceEvent]struct{})
+	}
+
+	subs := b.subscribers[tenant]
+	if len(subs) >= max {
+		return nil, nil, types.ErrTooManyStreams
+	}
+
+	if subs == nil {
+		subs = make(map[chan types.ResourceEvent]struct{})
+		b.subscribers[tenant] = subs
+	}
+
+	ch := make(chan types.ResourceEvent, eventQueueLen)
+	subs[ch] = struct{}{}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.Lock()
+			defer b.Unlock()
+
+			delete(subs, ch)
+			if len(subs) == 0 {
+				delete(b.subscribers, tenant)
+			}
+			close(ch)
+		})
+	}
+
+	return ch, cancel, nil
+}
+
+// publishEvent delivers an event to the subscribers of tenant without
+// blocking.
+func (ds *Datastore) publishEvent(tenant string, e types.ResourceEvent) {
+	b := &ds.events
+
+	b.Lock()
+	defer b.Unlock()
+
+	for ch := range b.subscribers[tenant] {
+		select {
+		case ch <- e:
+		default:
+			glog.Warningf("Dropping %s event for %s, subscriber of tenant %s too slow", e.Type, e.ID, tenant)
+		}
+	}
+}
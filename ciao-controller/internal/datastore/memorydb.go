@@ -85,6 +85,7 @@ func (db *MemoryDB) addTenant(id string, config types.TenantConfig) error {
 			TenantConfig: types.TenantConfig{
 				Name:       config.Name,
 				SubnetBits: config.SubnetBits,
+				Subnet:     config.Subnet,
 			},
 		},
 		network:   make(map[uint32]map[uint32]bool),
@@ -227,6 +228,10 @@ func (db *MemoryDB) addWorkload(wl types.Workload) error {
 	return nil
 }
 
+func (db *MemoryDB) updateWorkload(wl types.Workload) error {
+	return nil
+}
+
 func (db *MemoryDB) deleteWorkload(ID string) error {
 	return nil
 }
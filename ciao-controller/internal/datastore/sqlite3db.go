@@ -164,11 +164,25 @@ func (d attachments) Init() error {
 		block_id string,
 		ephemeral int,
 		boot int,
+		mountpoint string default '',
+		read_only int default 0,
 		foreign key(instance_id) references instances(id),
 		foreign key(block_id) references block_data(id)
 		);`
 
-	return d.ds.exec(d.db, cmd)
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// tables created before mountpoints or read-only attachments were
+	// recorded lack the columns
+	err = d.ds.addColumn(d.db, "attachments", "mountpoint string default ''")
+	if err != nil {
+		return err
+	}
+
+	return d.ds.addColumn(d.db, "attachments", "read_only int default 0")
 }
 
 // workload storage resources
@@ -206,10 +220,24 @@ func (d tenantData) Init() error {
 		id varchar(32) primary key,
 		name text,
 		subnet_bits int,
-		permissions text
+		permissions text,
+		subnet text default '',
+		delete_time DATETIME
 		);`
 
-	return d.ds.exec(d.db, cmd)
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// tables created before tenant subnets could be set or tenants soft
+	// deleted lack the columns
+	err = d.ds.addColumn(d.db, "tenants", "subnet text default ''")
+	if err != nil {
+		return err
+	}
+
+	return d.ds.addColumn(d.db, "tenants", "delete_time DATETIME")
 }
 
 // workload template data
@@ -406,10 +434,17 @@ func (d imageData) Init() error {
 			name string,
 			createtime DATETIME,
 			size int,
-			visibility string
+			visibility string,
+			checksum string default ''
 		);`
 
-	return d.ds.exec(d.db, cmd)
+	err := d.ds.exec(d.db, cmd)
+	if err != nil {
+		return err
+	}
+
+	// tables created before checksums were recorded lack the column
+	return d.ds.addColumn(d.db, "images", "checksum string default ''")
 }
 
 func (ds *sqliteDB) exec(db *sql.DB, cmd string) error {
@@ -420,6 +455,39 @@ func (ds *sqliteDB) exec(db *sql.DB, cmd string) error {
 	return err
 }
 
+// addColumn adds a column, given by its definition, to table unless the
+// table already has it.
+func (ds *sqliteDB) addColumn(db *sql.DB, table string, column string) error {
+	name := strings.Fields(column)[0]
+
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var colName, colType string
+		var dflt sql.NullString
+
+		err = rows.Scan(&cid, &colName, &colType, &notNull, &dflt, &pk)
+		if err != nil {
+			return err
+		}
+
+		if colName == name {
+			return nil
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	return ds.exec(db, "ALTER TABLE "+table+" ADD COLUMN "+column)
+}
+
 // This function is deprecated and will be removed soon. It should not be used
 // for newly written or updated code.
 func (ds *sqliteDB) create(tableName string, record ...interface{}) error {
@@ -672,7 +740,9 @@ func (ds *sqliteDB) addTenant(ID string, config types.TenantConfig) error {
 		return errors.Wrap(err, "Error marshalling permissions")
 	}
 
-	err = ds.create("tenants", ID, config.Name, config.SubnetBits, string(perms))
+	db := ds.getTableDB("tenants")
+
+	_, err = db.Exec("INSERT INTO tenants (id, name, subnet_bits, permissions, subnet) VALUES (?, ?, ?, ?, ?)", ID, config.Name, config.SubnetBits, string(perms), config.Subnet)
 
 	return err
 }
@@ -681,7 +751,9 @@ func (ds *sqliteDB) getTenant(ID string) (*tenant, error) {
 	query := `SELECT	tenants.id,
 				tenants.name,
 				tenants.subnet_bits,
-				tenants.permissions
+				tenants.permissions,
+				tenants.subnet,
+				tenants.delete_time
 		  FROM tenants
 		  WHERE tenants.id = ?`
 
@@ -692,7 +764,8 @@ func (ds *sqliteDB) getTenant(ID string) (*tenant, error) {
 	t := &tenant{}
 
 	var perms []byte
-	err := row.Scan(&t.ID, &t.Name, &t.SubnetBits, &perms)
+	var deleteTime *time.Time
+	err := row.Scan(&t.ID, &t.Name, &t.SubnetBits, &perms, &t.Subnet, &deleteTime)
 	if err != nil {
 		glog.Warning("unable to retrieve tenant from tenants")
 
@@ -704,6 +777,10 @@ func (ds *sqliteDB) getTenant(ID string) (*tenant, error) {
 		return nil, err
 	}
 
+	if deleteTime != nil {
+		t.DeleteTime = *deleteTime
+	}
+
 	if err := json.Unmarshal(perms, &t.Permissions); err != nil {
 		return nil, errors.Wrap(err, "Error unmarshalling permissions")
 	}
@@ -840,6 +917,22 @@ func (ds *sqliteDB) addWorkload(w types.Workload) error {
 	return err
 }
 
+func (ds *sqliteDB) updateWorkload(w types.Workload) error {
+	db := ds.getTableDB("workload_template")
+
+	ds.dbLock.Lock()
+	defer ds.dbLock.Unlock()
+
+	requirements, err := json.Marshal(w.Requirements)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE workload_template SET description = ?, visibility = ?, requirements = ? WHERE id = ?", w.Description, w.Visibility, string(requirements), w.ID)
+
+	return err
+}
+
 func (ds *sqliteDB) deleteWorkload(ID string) error {
 	db := ds.getTableDB("workload_template")
 
@@ -883,7 +976,9 @@ func (ds *sqliteDB) getTenants() ([]*tenant, error) {
 	query := `SELECT	tenants.id,
 				tenants.name,
 				tenants.subnet_bits,
-				tenants.permissions
+				tenants.permissions,
+				tenants.subnet,
+				tenants.delete_time
 		  FROM tenants `
 
 	rows, err := db.Query(query)
@@ -896,13 +991,18 @@ func (ds *sqliteDB) getTenants() ([]*tenant, error) {
 		var id sql.NullString
 		var name sql.NullString
 		var perms []byte
+		var deleteTime *time.Time
 
 		t := new(tenant)
-		err = rows.Scan(&id, &name, &t.SubnetBits, &perms)
+		err = rows.Scan(&id, &name, &t.SubnetBits, &perms, &t.Subnet, &deleteTime)
 		if err != nil {
 			return nil, err
 		}
 
+		if deleteTime != nil {
+			t.DeleteTime = *deleteTime
+		}
+
 		if id.Valid {
 			t.ID = id.String
 		}
@@ -1044,7 +1144,12 @@ func (ds *sqliteDB) updateTenant(tenant *types.Tenant) error {
 		return errors.Wrap(err, "Error marshalling permissions")
 	}
 
-	_, err = db.Exec("UPDATE tenants SET name = ?, subnet_bits = ?, permissions = ? WHERE id = ?", tenant.Name, tenant.SubnetBits, string(perms), tenant.ID)
+	var deleteTime interface{}
+	if !tenant.DeleteTime.IsZero() {
+		deleteTime = tenant.DeleteTime
+	}
+
+	_, err = db.Exec("UPDATE tenants SET name = ?, subnet_bits = ?, permissions = ?, subnet = ?, delete_time = ? WHERE id = ?", tenant.Name, tenant.SubnetBits, string(perms), tenant.Subnet, deleteTime, tenant.ID)
 
 	return err
 }
@@ -1701,7 +1806,7 @@ func (ds *sqliteDB) addStorageAttachment(a types.StorageAttachment) error {
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec("INSERT INTO attachments (id, instance_id, block_id, ephemeral, boot) VALUES (?, ?, ?, ?, ?)", a.ID, a.InstanceID, a.BlockID, a.Ephemeral, a.Boot)
+	_, err := db.Exec("INSERT INTO attachments (id, instance_id, block_id, ephemeral, boot, mountpoint, read_only) VALUES (?, ?, ?, ?, ?, ?, ?)", a.ID, a.InstanceID, a.BlockID, a.Ephemeral, a.Boot, a.Mountpoint, a.ReadOnly)
 
 	return err
 }
@@ -1715,7 +1820,9 @@ func (ds *sqliteDB) getAllStorageAttachments() (map[string]types.StorageAttachme
 				attachments.instance_id,
 				attachments.block_id,
 				attachments.ephemeral,
-				attachments.boot
+				attachments.boot,
+				attachments.mountpoint,
+				attachments.read_only
 		  FROM	attachments `
 
 	rows, err := db.Query(query)
@@ -1727,7 +1834,7 @@ func (ds *sqliteDB) getAllStorageAttachments() (map[string]types.StorageAttachme
 	for rows.Next() {
 		var a types.StorageAttachment
 
-		err = rows.Scan(&a.ID, &a.InstanceID, &a.BlockID, &a.Ephemeral, &a.Boot)
+		err = rows.Scan(&a.ID, &a.InstanceID, &a.BlockID, &a.Ephemeral, &a.Boot, &a.Mountpoint, &a.ReadOnly)
 		if err != nil {
 			continue
 		}
@@ -2170,7 +2277,7 @@ func (ds *sqliteDB) getQuotas(tenantID string) ([]types.QuotaDetails, error) {
 func (ds *sqliteDB) getImages() ([]types.Image, error) {
 	images := []types.Image{}
 
-	query := `SELECT id, state, tenant_id, name, createtime, size, visibility FROM images`
+	query := `SELECT id, state, tenant_id, name, createtime, size, visibility, checksum FROM images`
 
 	db := ds.getTableDB("images")
 	ds.dbLock.Lock()
@@ -2186,7 +2293,7 @@ func (ds *sqliteDB) getImages() ([]types.Image, error) {
 		i := types.Image{}
 		var state, visibility string
 
-		err = rows.Scan(&i.ID, &state, &i.TenantID, &i.Name, &i.CreateTime, &i.Size, &visibility)
+		err = rows.Scan(&i.ID, &state, &i.TenantID, &i.Name, &i.CreateTime, &i.Size, &visibility, &i.Checksum)
 		if err != nil {
 			return []types.Image{}, errors.Wrap(err, "error reading image row from database")
 		}
@@ -2201,13 +2308,13 @@ func (ds *sqliteDB) getImages() ([]types.Image, error) {
 }
 
 func (ds *sqliteDB) updateImage(i types.Image) error {
-	query := `REPLACE INTO images (id, state, tenant_id, name, createtime, size, visibility) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	query := `REPLACE INTO images (id, state, tenant_id, name, createtime, size, visibility, checksum) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
 
 	db := ds.getTableDB("images")
 	ds.dbLock.Lock()
 	defer ds.dbLock.Unlock()
 
-	_, err := db.Exec(query, i.ID, i.State, i.TenantID, i.Name, i.CreateTime, i.Size, i.Visibility)
+	_, err := db.Exec(query, i.ID, i.State, i.TenantID, i.Name, i.CreateTime, i.Size, i.Visibility, i.Checksum)
 
 	return errors.Wrap(err, "Error updatiing image into database")
 }
@@ -233,6 +233,7 @@ func TestSQLiteDBGetAllStorageAttachments(t *testing.T) {
 		InstanceID: uuid.Generate().String(),
 		BlockID:    uuid.Generate().String(),
 		Ephemeral:  false,
+		Mountpoint: "/dev/vdc",
 	}
 
 	err = db.addStorageAttachment(a)
@@ -1345,6 +1346,7 @@ func TestSQLiteDBAddRemoveImages(t *testing.T) {
 		Name:       "test-image",
 		Size:       1234567,
 		Visibility: types.Public,
+		Checksum:   "2dfe3ca5b6e1c4b2ab2b4a1e8f3d2c1b0a9e8f7d6c5b4a3928170615f4e3d2c1",
 	}
 
 	err = db.updateImage(i)
@@ -1475,3 +1477,41 @@ func TestSQLiteDBUpdateImage(t *testing.T) {
 		t.Fatalf("Returned image not as expected %v vs %v", images[0], i)
 	}
 }
+
+func TestSQLiteDBAddColumn(t *testing.T) {
+	ps, err := getPersistentStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ps.disconnect()
+
+	ds := ps.(*sqliteDB)
+	db := ds.getTableDB("attachments")
+
+	err = ds.exec(db, "CREATE TABLE legacy (id string primary key)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("INSERT INTO legacy (id) VALUES (?)", "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = ds.addColumn(db, "legacy", "mountpoint string default ''")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mountpoint string
+	err = db.QueryRow("SELECT mountpoint FROM legacy WHERE id = ?", "old").Scan(&mountpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mountpoint != "" {
+		t.Fatalf("expected empty mountpoint got %q", mountpoint)
+	}
+}
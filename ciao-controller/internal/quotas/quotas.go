@@ -15,6 +15,9 @@
 package quotas
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
 )
@@ -50,6 +53,13 @@ type consumeOp struct {
 	ch        chan Result
 }
 
+type checkOp struct {
+	tenantID  string
+	count     int
+	resources []payloads.RequestedResource
+	ch        chan Result
+}
+
 type releaseOp struct {
 	tenantID  string
 	resources []payloads.RequestedResource
@@ -165,6 +175,26 @@ func checkLimit(tenantDetails map[string]*tenantData, op *consumeOp) Result {
 	return res
 }
 
+func checkQuota(tenantDetails map[string]*tenantData, op *checkOp) Result {
+	td := getTenantData(tenantDetails, op.tenantID)
+	var exceeded []string
+
+	for _, r := range op.resources {
+		q, ok := td.quotas[r.Type]
+
+		if ok && q.limit > -1 && q.consumed+r.Value*op.count > q.limit {
+			exceeded = append(exceeded, resourceToQuotaName(r.Type))
+		}
+	}
+
+	res := &result{resources: op.resources}
+	res.allowed = len(exceeded) == 0
+	if !res.allowed {
+		res.reason = fmt.Sprintf("Over quota: %s", strings.Join(exceeded, ", "))
+	}
+	return res
+}
+
 func release(tenantDetails map[string]*tenantData, op *releaseOp) {
 	td := getTenantData(tenantDetails, op.tenantID)
 
@@ -201,6 +231,18 @@ func quotaNameToResource(name string) payloads.Resource {
 	return ""
 }
 
+// ValidName returns true if name is the name of a tenant quota or limit.
+func ValidName(name string) bool {
+	switch name {
+	case "tenant-vcpu-per-instance-limit",
+		"tenant-mem-per-instance-limit",
+		"tenant-volume-size-limit":
+		return true
+	}
+
+	return quotaNameToResource(name) != ""
+}
+
 func resourceToQuotaName(r payloads.Resource) string {
 	switch r {
 	case payloads.VCPUs:
@@ -308,6 +350,17 @@ func (qs *Quotas) Init() {
 				op.ch <- res
 				close(op.ch)
 
+			case *checkOp:
+				res := checkQuota(tenantDetails, op)
+				if !res.Allowed() {
+					op.ch <- res
+					close(op.ch)
+					continue
+				}
+				res = checkLimit(tenantDetails, &consumeOp{op.tenantID, op.resources, nil})
+				op.ch <- res
+				close(op.ch)
+
 			case *releaseOp:
 				release(tenantDetails, op)
 
@@ -359,6 +412,17 @@ func (qs *Quotas) Consume(tenantID string, resources ...payloads.RequestedResour
 	return ch
 }
 
+// Check indicates whether count successive calls to Consume() with the
+// supplied resources would be allowed, without updating the quota records.
+// It checks the same quotas and limits as Consume().
+func (qs *Quotas) Check(tenantID string, count int, resources ...payloads.RequestedResource) chan Result {
+	ch := make(chan Result, 1)
+	data := &checkOp{tenantID, count, copyResources(resources), ch}
+	qs.ch <- data
+
+	return ch
+}
+
 // Release will update the quota records for a tenant to indicate that it is no
 // longer using the supplied resources.
 func (qs *Quotas) Release(tenantID string, resources ...payloads.RequestedResource) {
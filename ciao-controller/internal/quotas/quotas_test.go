@@ -61,6 +61,47 @@ func TestConsumeAndRelease(t *testing.T) {
 	qs.Shutdown()
 }
 
+func TestCheck(t *testing.T) {
+	qs := &Quotas{}
+	qs.Init()
+
+	quotas := []types.QuotaDetails{
+		{Name: "tenant-vcpu-quota", Value: 10},
+		{Name: "tenant-vcpu-per-instance-limit", Value: 4},
+	}
+
+	qs.Update("test-tenant-1", quotas)
+
+	res := <-qs.Check("test-tenant-1", 2, payloads.RequestedResource{Type: payloads.VCPUs, Value: 4})
+	if !res.Allowed() {
+		t.Fatalf("Expected to be allowed: %s", res.Reason())
+	}
+
+	res = <-qs.Check("test-tenant-1", 3, payloads.RequestedResource{Type: payloads.VCPUs, Value: 4})
+	if res.Allowed() {
+		t.Fatal("Expected to be denied")
+	}
+	if res.Reason() != "Over quota: tenant-vcpu-quota" {
+		t.Fatalf("Unexpected reason: %s", res.Reason())
+	}
+
+	res = <-qs.Check("test-tenant-1", 1, payloads.RequestedResource{Type: payloads.VCPUs, Value: 5})
+	if res.Allowed() {
+		t.Fatal("Expected to be denied by the per instance limit")
+	}
+
+	// Checking must not consume anything
+	res = <-qs.Consume("test-tenant-1", payloads.RequestedResource{Type: payloads.VCPUs, Value: 4})
+	if !res.Allowed() {
+		t.Fatal("Expected to be allowed")
+	}
+
+	testHasQuota(t, qs.DumpQuotas("test-tenant-1"),
+		types.QuotaDetails{Name: "tenant-vcpu-quota", Value: 10, Usage: 4})
+
+	qs.Shutdown()
+}
+
 func testHasQuota(t *testing.T, qds []types.QuotaDetails, qd types.QuotaDetails) {
 	for i := range qds {
 		if reflect.DeepEqual(qd, qds[i]) {
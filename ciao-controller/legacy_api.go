@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/service"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
@@ -39,39 +40,21 @@ func (h legacyAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if h.Privileged {
 		privileged := service.GetPrivilege(r.Context())
 		if !privileged {
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			api.WriteError(w, http.StatusUnauthorized, api.ErrNotPrivileged)
 			return
 		}
 	}
 
 	resp, err := h.Handler(h.controller, w, r)
 	if err != nil {
-		data := HTTPErrorData{
-			Code:    resp.status,
-			Name:    http.StatusText(resp.status),
-			Message: err.Error(),
-		}
-
-		code := HTTPReturnErrorCode{
-			Error: data,
-		}
-
 		glog.Warningf("Returning error response to request: %s: %v", r.URL.String(), err)
-
-		b, err := json.Marshal(code)
-		if err != nil {
-			http.Error(w, http.StatusText(resp.status), resp.status)
-			return
-		}
-
-		http.Error(w, string(b), resp.status)
+		api.WriteError(w, resp.status, err)
 		return
 	}
 
 	b, err := json.Marshal(resp.response)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError),
-			http.StatusInternalServerError)
+		api.WriteError(w, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -28,6 +28,7 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
@@ -55,6 +56,17 @@ type controller struct {
 	tenantReadinessLock sync.Mutex
 	qs                  *quotas.Quotas
 	httpServers         []*http.Server
+	uploads             map[string]*imageUpload
+	uploadsLock         sync.Mutex
+	volumeCreations     map[string]context.CancelFunc
+	volumeCreationsLock sync.Mutex
+	evacuations         map[string]*evacuation
+	evacuationsLock     sync.Mutex
+	attachLock          sync.Mutex
+	macAddressLock      sync.Mutex
+	tenantRetention     time.Duration
+	tenantPurges        map[string]*time.Timer
+	tenantPurgesLock    sync.Mutex
 }
 
 type cnciNetFlag string
@@ -89,6 +101,24 @@ var clientCertCAPath = "/etc/pki/ciao/auth-CA.pem"
 
 var cephID = flag.String("ceph_id", "", "ceph client id")
 
+var apiRateLimit = flag.Float64("api_rate_limit", 0, "API requests per second allowed per tenant, 0 for unlimited")
+var apiRateBurst = flag.Int("api_rate_burst", api.DefaultRateBurst, "API requests allowed in a burst per tenant")
+
+var apiCORSOrigins = flag.String("api_cors_origins", "", "Comma separated list of origins allowed to make cross-origin API requests")
+var apiCORSCredentials = flag.Bool("api_cors_credentials", false, "Allow cross-origin API requests to include credentials")
+
+var apiIdempotencyTTL = flag.Duration("api_idempotency_ttl", api.DefaultIdempotencyTTL, "How long responses to create requests carrying an Idempotency-Key are kept, negative to disable")
+
+var apiMaxBodySize = flag.Int64("api_max_body_size", api.DefaultMaxBodySize, "Largest API request body accepted in bytes, negative for unlimited")
+var apiMaxImageSize = flag.Int64("api_max_image_size", 0, "Largest image upload accepted in bytes, zero for unlimited")
+var apiRequestTimeout = flag.Duration("api_request_timeout", api.DefaultRequestTimeout, "Time allowed to serve an API request, negative for unlimited")
+var apiImageUploadTimeout = flag.Duration("api_image_upload_timeout", 0, "Time allowed to upload an image, zero for unlimited")
+var apiAccessLog = flag.String("api_access_log", "", "File to which a JSON line is appended for every API request, empty to disable")
+
+var tenantRetention = flag.Duration("tenant_retention", 0, "How long a deleted tenant may be restored before its resources are removed, zero to remove them immediately")
+
+var instanceSSHPort = flag.Int("instance_ssh_port", 22, "Port at which instances are reached by ssh through their external IP")
+
 var adminSSHKey = ""
 
 // this default allows us to have up to 32K hosts within the upper part
@@ -160,6 +190,7 @@ func main() {
 	ctl.tenantReadiness = make(map[string]*tenantConfirmMemo)
 	ctl.ds = new(datastore.Datastore)
 	ctl.qs = new(quotas.Quotas)
+	ctl.tenantRetention = *tenantRetention
 
 	dsConfig := datastore.Config{
 		PersistentURI:     "file:" + *persistentDatastoreLocation,
@@ -242,6 +273,12 @@ func main() {
 		return
 	}
 
+	err = initializeTenantPurges(ctl)
+	if err != nil {
+		glog.Fatal("Unable to schedule the removal of deleted tenants: ", err)
+		return
+	}
+
 	host, err := getNameFromCert(httpsCAcert, httpsKey)
 	if err != nil {
 		glog.Warningf("Unable to get name from certificate: %s", err)
@@ -14,23 +14,129 @@
 
 package main
 
-import "github.com/golang/glog"
+import (
+	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/golang/glog"
+)
 
-func (c *controller) EvacuateNode(nodeID string) error {
-	// should I bother to see if nodeID is valid?
-	go func() {
-		if err := c.client.EvacuateNode(nodeID); err != nil {
-			glog.Warningf("Error evacuating node")
+// evacuation records the instances running on a node when its evacuation
+// was requested.
+type evacuation struct {
+	instances []string
+}
+
+// nodeInMaintenance returns true if the last status reported by nodeID is
+// MAINTENANCE. Launchers report this status once they have been evacuated,
+// so it survives a restart of the controller.
+func (c *controller) nodeInMaintenance(nodeID string) bool {
+	for _, node := range c.ds.GetNodeLastStats().Nodes {
+		if node.ID == nodeID {
+			return node.Status == string(types.NodeStatusMaintenance)
 		}
-	}()
+	}
+
+	return false
+}
+
+func (c *controller) EvacuateNode(nodeID string) error {
+	if _, err := c.ds.GetNode(nodeID); err != nil {
+		return types.ErrNodeNotFound
+	}
+
+	instances, err := c.ds.GetAllInstancesByNode(nodeID)
+	if err != nil {
+		return err
+	}
+
+	e := &evacuation{}
+	for _, instance := range instances {
+		e.instances = append(e.instances, instance.ID)
+	}
+
+	if err := c.client.EvacuateNode(nodeID); err != nil {
+		glog.Warningf("Error evacuating node %s: %v", nodeID, err)
+		return err
+	}
+
+	c.evacuationsLock.Lock()
+	if c.evacuations == nil {
+		c.evacuations = make(map[string]*evacuation)
+	}
+	c.evacuations[nodeID] = e
+	c.evacuationsLock.Unlock()
+
 	return nil
 }
 
 func (c *controller) RestoreNode(nodeID string) error {
-	go func() {
-		if err := c.client.RestoreNode(nodeID); err != nil {
-			glog.Warning("Error restoring node")
-		}
-	}()
+	if _, err := c.ds.GetNode(nodeID); err != nil {
+		return types.ErrNodeNotFound
+	}
+
+	c.evacuationsLock.Lock()
+	_, ok := c.evacuations[nodeID]
+	c.evacuationsLock.Unlock()
+
+	if !ok && !c.nodeInMaintenance(nodeID) {
+		return types.ErrNodeNotEvacuated
+	}
+
+	if err := c.client.RestoreNode(nodeID); err != nil {
+		glog.Warningf("Error restoring node %s: %v", nodeID, err)
+		return err
+	}
+
+	c.evacuationsLock.Lock()
+	delete(c.evacuations, nodeID)
+	c.evacuationsLock.Unlock()
+
 	return nil
 }
+
+// NodeEvacuation reports how many of the instances running on a node when
+// its evacuation was requested have since left the node. The instances of
+// a node evacuated before the controller was restarted are not known, so
+// only those still on the node are reported.
+func (c *controller) NodeEvacuation(nodeID string) (types.NodeAction, error) {
+	if _, err := c.ds.GetNode(nodeID); err != nil {
+		return types.NodeAction{}, types.ErrNodeNotFound
+	}
+
+	c.evacuationsLock.Lock()
+	e, ok := c.evacuations[nodeID]
+	c.evacuationsLock.Unlock()
+
+	if !ok {
+		if !c.nodeInMaintenance(nodeID) {
+			return types.NodeAction{}, types.ErrNodeNotEvacuated
+		}
+
+		instances, err := c.ds.GetAllInstancesByNode(nodeID)
+		if err != nil {
+			return types.NodeAction{}, err
+		}
+
+		return types.NodeAction{
+			NodeID:             nodeID,
+			Action:             "evacuate",
+			TotalInstances:     len(instances),
+			RemainingInstances: len(instances),
+		}, nil
+	}
+
+	action := types.NodeAction{
+		NodeID:         nodeID,
+		Action:         "evacuate",
+		TotalInstances: len(e.instances),
+	}
+
+	for _, ID := range e.instances {
+		instance, err := c.ds.GetInstance(ID)
+		if err != nil || instance.NodeID != nodeID {
+			action.MigratedInstances++
+		}
+	}
+	action.RemainingInstances = action.TotalInstances - action.MigratedInstances
+
+	return action, nil
+}
@@ -15,6 +15,8 @@
 package main
 
 import (
+	"fmt"
+
 	"github.com/ciao-project/ciao/ciao-controller/internal/datastore"
 	"github.com/ciao-project/ciao/ciao-controller/internal/quotas"
 	"github.com/ciao-project/ciao/ciao-controller/types"
@@ -31,6 +33,31 @@ func (c *controller) UpdateQuotas(tenantID string, qds []types.QuotaDetails) err
 	return nil
 }
 
+// validateQuotas checks that the quotas are known and that their values are
+// either positive or unlimited.
+func validateQuotas(qds []types.QuotaDetails) error {
+	var reasons []string
+	seen := make(map[string]bool)
+
+	for _, qd := range qds {
+		switch {
+		case !quotas.ValidName(qd.Name):
+			reasons = append(reasons, fmt.Sprintf("%s: unknown quota", qd.Name))
+		case seen[qd.Name]:
+			reasons = append(reasons, fmt.Sprintf("%s: set more than once", qd.Name))
+		case qd.Value < -1:
+			reasons = append(reasons, fmt.Sprintf("%s: invalid value %d", qd.Name, qd.Value))
+		}
+		seen[qd.Name] = true
+	}
+
+	if len(reasons) > 0 {
+		return &types.InvalidQuotasError{Reasons: reasons}
+	}
+
+	return nil
+}
+
 func (c *controller) ListQuotas(tenantID string) []types.QuotaDetails {
 	return c.qs.DumpQuotas(tenantID)
 }
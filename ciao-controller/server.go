@@ -21,10 +21,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/clogger/gloginterface"
 	"github.com/ciao-project/ciao/service"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
@@ -38,7 +41,7 @@ type clientCertAuthHandler struct {
 
 func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(r.TLS.VerifiedChains) != 1 {
-		http.Error(w, "Unexpected number of certificate chains presented", http.StatusUnauthorized)
+		api.WriteError(w, http.StatusUnauthorized, errors.New("Unexpected number of certificate chains presented"))
 		return
 	}
 
@@ -51,7 +54,7 @@ func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		privileged = true
 	}
 
-	r = r.WithContext(service.SetPrivilege(r.Context(), true))
+	r = r.WithContext(service.SetPrivilege(r.Context(), privileged))
 
 	vars := mux.Vars(r)
 	tenantFromVars := vars["tenant"]
@@ -64,7 +67,7 @@ func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 			}
 		}
 		if !tenantMatched {
-			http.Error(w, "Access to tenant not permitted with certificate", http.StatusUnauthorized)
+			api.WriteError(w, http.StatusUnauthorized, errors.New("Access to tenant not permitted with certificate"))
 			return
 		}
 	}
@@ -73,7 +76,8 @@ func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	if tenantFromVars != "" {
 		err := h.Controller.confirmTenant(tenantFromVars)
 		if err != nil {
-			http.Error(w, "Error confirming tenant", http.StatusInternalServerError)
+			api.WriteError(w, http.StatusInternalServerError, errors.New("Error confirming tenant"))
+			return
 		}
 	}
 
@@ -81,11 +85,40 @@ func (h *clientCertAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 }
 
 func (c *controller) createCiaoRoutes(r *mux.Router) error {
-	config := api.Config{URL: c.apiURL, CiaoService: c}
+	config := api.Config{
+		URL:                  c.apiURL,
+		CiaoService:          c,
+		RateLimit:            *apiRateLimit,
+		RateBurst:            *apiRateBurst,
+		UnlimitedPrivileged:  true,
+		CORSAllowCredentials: *apiCORSCredentials,
+		IdempotencyTTL:       *apiIdempotencyTTL,
+		MaxBodySize:          *apiMaxBodySize,
+		MaxImageSize:         *apiMaxImageSize,
+		RequestTimeout:       *apiRequestTimeout,
+		ImageUploadTimeout:   *apiImageUploadTimeout,
+		Logger:               gloginterface.CiaoGlogLogger{},
+	}
+
+	if *apiCORSOrigins != "" {
+		config.CORSOrigins = strings.Split(*apiCORSOrigins, ",")
+	}
+
+	if *apiAccessLog != "" {
+		f, err := os.OpenFile(*apiAccessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return errors.Wrap(err, "Error opening API access log")
+		}
+		config.AccessLog = f
+	}
 
 	r = api.Routes(config, r)
 
 	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetName() == api.PreflightRoute {
+			return nil
+		}
+
 		h := &clientCertAuthHandler{
 			Next:       route.GetHandler(),
 			Controller: c,
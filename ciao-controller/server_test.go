@@ -0,0 +1,83 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/testutil"
+	"github.com/gorilla/mux"
+)
+
+// Tests that the API rate limit applies to the tenant certificates and not
+// to the admin ones
+//
+// Test is expected to pass with the requests made with the tenant
+// certificate throttled once the burst is exhausted and those made with
+// the admin certificate not throttled
+func TestRateLimitCertificates(t *testing.T) {
+	savedLimit, savedBurst := *apiRateLimit, *apiRateBurst
+	*apiRateLimit, *apiRateBurst = 0.01, 2
+	defer func() {
+		*apiRateLimit, *apiRateBurst = savedLimit, savedBurst
+	}()
+
+	r := mux.NewRouter()
+	if err := ctl.createCiaoRoutes(r); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(organization string) int {
+		req, err := http.NewRequest("GET", "/"+testutil.ComputeUser+"/volumes", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", fmt.Sprintf("application/%s", api.VolumesV1))
+
+		cert := &x509.Certificate{
+			Subject: pkix.Name{Organization: []string{organization}},
+		}
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := send(testutil.ComputeUser); code != http.StatusOK {
+			t.Fatalf("request %d: got %v, expected %v", i, code, http.StatusOK)
+		}
+	}
+
+	if code := send(testutil.ComputeUser); code != http.StatusTooManyRequests {
+		t.Fatalf("got %v, expected %v", code, http.StatusTooManyRequests)
+	}
+
+	for i := 0; i < 5; i++ {
+		if code := send("admin"); code != http.StatusOK {
+			t.Fatalf("admin request %d: got %v, expected %v", i, code, http.StatusOK)
+		}
+	}
+}
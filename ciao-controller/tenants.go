@@ -17,6 +17,7 @@ package main
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/uuid"
@@ -24,7 +25,9 @@ import (
 	"github.com/pkg/errors"
 )
 
-func (c *controller) ListTenants() ([]types.TenantSummary, error) {
+// ListTenants returns the tenants of the cluster. Soft deleted tenants are
+// only included if includeDeleted is set.
+func (c *controller) ListTenants(includeDeleted bool) ([]types.TenantSummary, error) {
 	var summary []types.TenantSummary
 
 	tenants, err := c.ds.GetAllTenants()
@@ -37,11 +40,19 @@ func (c *controller) ListTenants() ([]types.TenantSummary, error) {
 			continue
 		}
 
+		if !t.DeleteTime.IsZero() && !includeDeleted {
+			continue
+		}
+
 		ts := types.TenantSummary{
 			ID:   t.ID,
 			Name: t.Name,
 		}
 
+		if !t.DeleteTime.IsZero() {
+			ts.State = types.TenantDeleting
+		}
+
 		ref := fmt.Sprintf("%s/tenants/%s", c.apiURL, t.ID)
 		link := types.Link{
 			Rel:  "self",
@@ -71,20 +82,41 @@ func (c *controller) PatchTenant(tenantID string, patch []byte) error {
 	return c.ds.JSONPatchTenant(tenantID, patch)
 }
 
-func (c *controller) CreateTenant(tenantID string, config types.TenantConfig) (types.TenantSummary, error) {
+// CreateTenant creates a tenant and sets its initial quotas, if any. The
+// tenant is not created if the quotas cannot be set.
+func (c *controller) CreateTenant(tenantID string, config types.TenantConfig, qds []types.QuotaDetails) (types.TenantSummary, error) {
 	// tenant ID must be a UUID4
 	tuuid, err := uuid.Parse(tenantID)
 	if err != nil {
 		return types.TenantSummary{}, err
 	}
 
-	// SubnetBits must be between 12 and 30
+	// an explicit subnet determines the subnet bits
+	if config.Subnet != "" {
+		if config.SubnetBits != 0 {
+			return types.TenantSummary{}, types.ErrSubnetAndBits
+		}
+
+		subnet, err := config.ValidateSubnet()
+		if err != nil {
+			return types.TenantSummary{}, err
+		}
+
+		config.Subnet = subnet.String()
+		config.SubnetBits, _ = subnet.Mask.Size()
+	}
+
+	// SubnetBits defaults to 24 when not specified
 	if config.SubnetBits == 0 {
 		config.SubnetBits = 24
-	} else {
-		if config.SubnetBits < 12 || config.SubnetBits > 30 {
-			return types.TenantSummary{}, errors.New("subnet bits must be between 12 and 30")
-		}
+	}
+
+	if err := config.ValidateSubnetBits(); err != nil {
+		return types.TenantSummary{}, err
+	}
+
+	if err := validateQuotas(qds); err != nil {
+		return types.TenantSummary{}, err
 	}
 
 	tenant, err := c.ds.AddTenant(tuuid.String(), config)
@@ -97,6 +129,16 @@ func (c *controller) CreateTenant(tenantID string, config types.TenantConfig) (t
 		return types.TenantSummary{}, err
 	}
 
+	if len(qds) > 0 {
+		err = c.UpdateQuotas(tenant.ID, qds)
+		if err != nil {
+			if derr := c.purgeTenant(tenant.ID); derr != nil {
+				glog.Warningf("Unable to remove tenant %s: %v", tenant.ID, derr)
+			}
+			return types.TenantSummary{}, err
+		}
+	}
+
 	ts := types.TenantSummary{
 		ID:   tenant.ID,
 		Name: tenant.Name,
@@ -185,12 +227,129 @@ func (c *controller) deleteInstances(tenantID string) error {
 	return nil
 }
 
-// DeleteTenant will remove any object associated with this tenant.
+// DeleteTenant deletes a tenant. When a retention period is configured the
+// tenant is only marked as deleting, its resources are removed when the
+// period expires or when the tenant is deleted again.
+func (c *controller) DeleteTenant(tenantID string) error {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if tenant == nil || c.tenantRetention <= 0 || !tenant.DeleteTime.IsZero() {
+		return c.purgeTenant(tenantID)
+	}
+
+	err = c.ds.SetTenantDeleteTime(tenantID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	c.schedulePurge(tenantID, c.tenantRetention)
+
+	return nil
+}
+
+// checkTenantActive returns types.ErrTenantDeleting if tenantID has been
+// soft deleted. Resources may not be created for such a tenant as they
+// would be removed when the tenant is purged.
+func (c *controller) checkTenantActive(tenantID string) error {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if tenant != nil && !tenant.DeleteTime.IsZero() {
+		return types.ErrTenantDeleting
+	}
+
+	return nil
+}
+
+// RestoreTenant cancels the deletion of a soft deleted tenant.
+func (c *controller) RestoreTenant(tenantID string) error {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	if tenant == nil {
+		return types.ErrTenantNotFound
+	}
+
+	if tenant.DeleteTime.IsZero() {
+		return types.ErrTenantNotDeleting
+	}
+
+	c.cancelPurge(tenantID)
+
+	return c.ds.SetTenantDeleteTime(tenantID, time.Time{})
+}
+
+// schedulePurge removes the resources of a soft deleted tenant after d,
+// unless the tenant has been restored in the meantime.
+func (c *controller) schedulePurge(tenantID string, d time.Duration) {
+	c.tenantPurgesLock.Lock()
+	defer c.tenantPurgesLock.Unlock()
+
+	if c.tenantPurges == nil {
+		c.tenantPurges = make(map[string]*time.Timer)
+	}
+
+	if timer := c.tenantPurges[tenantID]; timer != nil {
+		timer.Stop()
+	}
+
+	c.tenantPurges[tenantID] = time.AfterFunc(d, func() {
+		tenant, err := c.ds.GetTenant(tenantID)
+		if err != nil || tenant == nil || tenant.DeleteTime.IsZero() {
+			return
+		}
+
+		err = c.purgeTenant(tenantID)
+		if err != nil {
+			glog.Warningf("Unable to remove deleted tenant %s: %v", tenantID, err)
+		}
+	})
+}
+
+func (c *controller) cancelPurge(tenantID string) {
+	c.tenantPurgesLock.Lock()
+	defer c.tenantPurgesLock.Unlock()
+
+	if timer := c.tenantPurges[tenantID]; timer != nil {
+		timer.Stop()
+		delete(c.tenantPurges, tenantID)
+	}
+}
+
+// initializeTenantPurges schedules the removal of the tenants which were
+// soft deleted before the controller was restarted.
+func initializeTenantPurges(c *controller) error {
+	ts, err := c.ds.GetAllTenants()
+	if err != nil {
+		return errors.Wrap(err, "error getting tenants")
+	}
+
+	for _, t := range ts {
+		if t.DeleteTime.IsZero() {
+			continue
+		}
+
+		c.schedulePurge(t.ID, time.Until(t.DeleteTime.Add(c.tenantRetention)))
+	}
+
+	return nil
+}
+
+// purgeTenant will remove any object associated with this tenant.
 // at this point we can assume the admin has already
 // revoked the tenant's certificate. So no more
 // activity can happen for this tenant while this
 // command is going.
-func (c *controller) DeleteTenant(tenantID string) error {
+func (c *controller) purgeTenant(tenantID string) error {
+	c.cancelPurge(tenantID)
+
 	err := c.deleteInstances(tenantID)
 	if err != nil {
 		return err
@@ -248,3 +407,132 @@ func (c *controller) DeleteTenant(tenantID string) error {
 	// quotas get deleted from database as side effect to deleting tenant
 	return c.ds.DeleteTenant(tenantID)
 }
+
+// ProbeTenantNetwork checks that the tunnels between all the CNCIs
+// of a tenant are passing traffic.
+func (c *controller) ProbeTenantNetwork(tenantID string) (types.CNCIProbeResponse, error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.CNCIProbeResponse{}, err
+	}
+
+	if tenant == nil {
+		return types.CNCIProbeResponse{}, types.ErrTenantNotFound
+	}
+
+	return tenant.CNCIctrl.Probe()
+}
+
+// ShowTenantCNCI returns the CNCIs serving a tenant along with the external
+// IPs mapped to the instances of their subnets.
+func (c *controller) ShowTenantCNCI(tenantID string) (types.TenantCNCIResponse, error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return types.TenantCNCIResponse{}, err
+	}
+
+	if tenant == nil {
+		return types.TenantCNCIResponse{}, types.ErrTenantNotFound
+	}
+
+	cncis := c.tenantCNCIs(tenant)
+	if len(cncis) == 0 {
+		return types.TenantCNCIResponse{}, types.ErrNoCNCI
+	}
+
+	return types.TenantCNCIResponse{CNCIs: cncis}, nil
+}
+
+// tenantCNCIs returns the CNCIs of tenant along with the external IPs
+// mapped to the instances on their subnets.
+func (c *controller) tenantCNCIs(tenant *types.Tenant) []types.TenantCNCI {
+	if tenant.CNCIctrl == nil {
+		return nil
+	}
+
+	cncis := tenant.CNCIctrl.List()
+
+	bySubnet := make(map[string]*types.TenantCNCI)
+	for i := range cncis {
+		for _, subnet := range cncis[i].Subnets {
+			bySubnet[subnet] = &cncis[i]
+		}
+	}
+
+	for _, m := range c.ListMappedAddresses(&tenant.ID) {
+		instance, err := c.ds.GetInstance(m.InstanceID)
+		if err != nil {
+			glog.Warningf("Unable to get instance %s mapped to %s: %v", m.InstanceID, m.ExternalIP, err)
+			continue
+		}
+
+		cnci, ok := bySubnet[instance.Subnet]
+		if !ok {
+			continue
+		}
+		cnci.MappedIPs = append(cnci.MappedIPs, m)
+	}
+
+	return cncis
+}
+
+// ListCNCIs summarises the load of the CNCIs of all the tenants, or only
+// those of tenantID if it is not empty. Each CNCI serves a single tenant.
+func (c *controller) ListCNCIs(tenantID string) ([]types.CNCISummary, error) {
+	var tenants []*types.Tenant
+
+	if tenantID != "" {
+		tenant, err := c.ds.GetTenant(tenantID)
+		if err != nil {
+			return nil, err
+		}
+
+		if tenant == nil {
+			return nil, types.ErrTenantNotFound
+		}
+
+		tenants = append(tenants, tenant)
+	} else {
+		var err error
+
+		tenants, err = c.ds.GetAllTenants()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	summaries := []types.CNCISummary{}
+	for _, tenant := range tenants {
+		for _, cnci := range c.tenantCNCIs(tenant) {
+			summaries = append(summaries, types.CNCISummary{
+				ID:        cnci.InstanceID,
+				TenantID:  cnci.TenantID,
+				IPAddress: cnci.IPAddress,
+				Subnets:   len(cnci.Subnets),
+				Tenants:   1,
+				PublicIPs: len(cnci.MappedIPs),
+			})
+		}
+	}
+
+	return summaries, nil
+}
+
+// maxTenantStreams is the number of event streams which may be open for a
+// tenant at once.
+const maxTenantStreams = 8
+
+// SubscribeTenantEvents returns a channel on which the resource events of
+// a tenant are delivered and a function to cancel the subscription.
+func (c *controller) SubscribeTenantEvents(tenantID string) (<-chan types.ResourceEvent, func(), error) {
+	tenant, err := c.ds.GetTenant(tenantID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if tenant == nil {
+		return nil, nil, types.ErrTenantNotFound
+	}
+
+	return c.ds.SubscribeEvents(tenantID, maxTenantStreams)
+}
@@ -19,6 +19,8 @@ package types
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"sync"
@@ -45,7 +47,6 @@ const (
 )
 
 // StorageResource defines a storage resource for a workload.
-// TBD: should the workload support multiple of these?
 type StorageResource struct {
 	// ID indicates a volumeID. If ID is blank, then it needs to be created.
 	ID string `json:"id"`
@@ -58,7 +59,9 @@ type StorageResource struct {
 	//      does it count against quota?
 	Ephemeral bool `json:"ephemeral"`
 
-	// Size is the size of the storage to be created if new.
+	// Size is the size in GiB of the storage to be created if new. It
+	// defaults to the size of the source image or volume and must be
+	// given for empty storage.
 	Size int `json:"size"`
 
 	// ImageType indicates whether we are making a new resource
@@ -78,7 +81,9 @@ type StorageResource struct {
 }
 
 // Workload contains resource and configuration information for a user
-// workload.
+// workload. The volumes in Storage are created or attached when an instance
+// of the workload is launched; a VM workload must boot from exactly one of
+// them.
 type Workload struct {
 	ID           string                        `json:"id"`
 	TenantID     string                        `json:"-"`
@@ -108,6 +113,10 @@ type WorkloadRequest struct {
 	TraceLabel string
 	Name       string
 	Subnet     string
+	Volumes    []string // IDs of existing volumes to attach at boot
+	NodeID     string   // node the instances must be placed on
+	Exclude    []string // nodes the instances must not be placed on
+	MACAddress string   // MAC address of the instance, generated if empty
 }
 
 // Instance contains information about an instance of a workload.
@@ -130,6 +139,24 @@ type Instance struct {
 	StateChange *sync.Cond   `json:"-"`
 }
 
+// Types of the resources reported by ResourceEvent.
+const (
+	InstanceEvent = "instance"
+	VolumeEvent   = "volume"
+	ImageEvent    = "image"
+)
+
+// DeletedState is the state reported by a ResourceEvent for a resource
+// which has been deleted.
+const DeletedState = "deleted"
+
+// ResourceEvent describes a change of state of a tenant resource.
+type ResourceEvent struct {
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	State string `json:"state"`
+}
+
 // SortedInstancesByID implements sort.Interface for Instance by ID string
 type SortedInstancesByID []*Instance
 
@@ -144,26 +171,98 @@ func (s SortedNodesByID) Len() int           { return len(s) }
 func (s SortedNodesByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s SortedNodesByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
 
-// TenantConfig stores the configurable attributes of a tenant.
+// TenantConfig stores the configurable attributes of a tenant. Tenant
+// subnets are either allocated from the tenant network with a prefix length
+// of SubnetBits or pinned to the CIDR in Subnet, in which case SubnetBits
+// holds its prefix length. A request may only set one of the two.
 type TenantConfig struct {
 	Name        string `json:"name"`
 	SubnetBits  int    `json:"subnet_bits"`
+	Subnet      string `json:"subnet,omitempty"`
 	Permissions struct {
 		PrivilegedContainers bool `json:"privileged_containers"`
 	} `json:"permissions"`
 }
 
+const (
+	// MinSubnetBits is the smallest prefix length of a tenant subnet.
+	// Tenant subnets are allocated from 172.16.0.0/12.
+	MinSubnetBits = 12
+
+	// MaxSubnetBits is the largest prefix length of a tenant subnet,
+	// leaving room for two hosts.
+	MaxSubnetBits = 30
+)
+
+// SubnetBitsError is returned when the subnet bits of a tenant are outside
+// of the range supported by the tenant network.
+type SubnetBitsError struct {
+	SubnetBits int
+}
+
+func (e *SubnetBitsError) Error() string {
+	return fmt.Sprintf("Subnet bits %d invalid, must be between %d and %d",
+		e.SubnetBits, MinSubnetBits, MaxSubnetBits)
+}
+
+// ValidateSubnetBits checks that tenant subnets of SubnetBits can be
+// allocated from the tenant network.
+func (config TenantConfig) ValidateSubnetBits() error {
+	if config.SubnetBits < MinSubnetBits || config.SubnetBits > MaxSubnetBits {
+		return &SubnetBitsError{SubnetBits: config.SubnetBits}
+	}
+	return nil
+}
+
+// ValidateSubnet checks that Subnet is an IPv4 network whose prefix length
+// is valid for a tenant subnet and returns it.
+func (config TenantConfig) ValidateSubnet() (*net.IPNet, error) {
+	ip, ipNet, err := net.ParseCIDR(config.Subnet)
+	if err != nil || ip.To4() == nil || !ip.Equal(ipNet.IP) {
+		return nil, ErrBadSubnet
+	}
+
+	ones, _ := ipNet.Mask.Size()
+	if ones < MinSubnetBits || ones > MaxSubnetBits {
+		return nil, &SubnetBitsError{SubnetBits: ones}
+	}
+
+	return ipNet, nil
+}
+
+// TenantSubnetConflictError is returned when the subnet of a tenant overlaps
+// the subnet of another tenant.
+type TenantSubnetConflictError struct {
+	Subnet   string
+	Conflict string
+	TenantID string
+}
+
+func (e *TenantSubnetConflictError) Error() string {
+	return fmt.Sprintf("Subnet %s overlaps subnet %s of tenant %s",
+		e.Subnet, e.Conflict, e.TenantID)
+}
+
 // Tenant contains information about a tenant or project.
 type Tenant struct {
 	TenantConfig
 	ID       string
 	CNCIctrl CNCIController
+
+	// DeleteTime is when the tenant was soft deleted, zero unless the
+	// tenant is deleting.
+	DeleteTime time.Time
 }
 
+// TenantDeleting is the state of a tenant which has been deleted but
+// which may still be restored.
+const TenantDeleting = "deleting"
+
 // TenantSummary is a short form of Tenant
 type TenantSummary struct {
 	ID    string `json:"id"`
 	Name  string `json:"name"`
+	State string `json:"state,omitempty"`
 	Links []Link `json:"links,omitempty"`
 }
 
@@ -173,9 +272,11 @@ type TenantsListResponse struct {
 }
 
 // TenantRequest contains information for creating a new tenant.
+// The Quotas, if any, are set when the tenant is created.
 type TenantRequest struct {
-	ID     string       `json:"id"`
-	Config TenantConfig `json:"config"`
+	ID     string         `json:"id"`
+	Config TenantConfig   `json:"config"`
+	Quotas []QuotaDetails `json:"quotas,omitempty"`
 }
 
 // LogEntry stores information about events.
@@ -210,12 +311,16 @@ type NodeSummary struct {
 }
 
 // TenantCNCI contains information about the CNCI instance for a tenant.
+// IPAddress, the routable IP of the CNCI, is empty until the CNCI has been
+// launched. MappedIPs are the external IPs mapped to the instances of the
+// subnets served by the CNCI.
 type TenantCNCI struct {
-	TenantID   string   `json:"tenant_id"`
-	IPAddress  string   `json:"ip_address"`
-	MACAddress string   `json:"mac_address"`
-	InstanceID string   `json:"instance_id"`
-	Subnets    []string `json:"subnets"`
+	TenantID   string     `json:"tenant_id"`
+	IPAddress  string     `json:"ip_address"`
+	MACAddress string     `json:"mac_address"`
+	InstanceID string     `json:"instance_id"`
+	Subnets    []string   `json:"subnets"`
+	MappedIPs  []MappedIP `json:"mapped_ips"`
 }
 
 // FrameStat contains tracing information per node.
@@ -275,6 +380,10 @@ const (
 	// attached to an instance.
 	InUse BlockState = "in-use"
 
+	// Creating means that the volume is in the process
+	// of being created.
+	Creating BlockState = "creating"
+
 	// Detaching means that the volume is in process
 	// of detaching.
 	Detaching BlockState = "detaching"
@@ -291,6 +400,15 @@ type Volume struct {
 	Name        string     `json:"name"`        // a human readable name for this volume
 	Description string     `json:"description"` // some text to describe this volume.
 	Internal    bool       `json:"internal"`    // whether this storage should be shown to the user
+
+	Attachments []VolumeAttachment `json:"attachments"` // the instances this volume is attached to
+}
+
+// VolumeAttachment describes where a volume is attached.
+type VolumeAttachment struct {
+	InstanceID string `json:"instance_id"`
+	Mountpoint string `json:"mountpoint,omitempty"`
+	ReadOnly   bool   `json:"read_only,omitempty"`
 }
 
 // StorageAttachment represents a link between a block device and
@@ -301,6 +419,8 @@ type StorageAttachment struct {
 	BlockID    string // the ID of the block device
 	Ephemeral  bool   // whether the storage should be deleted on Cleanup
 	Boot       bool   // whether this is a boot device
+	Mountpoint string // the mountpoint requested when attaching
+	ReadOnly   bool   // whether the instance may only read the volume
 }
 
 // CiaoNode contains status and statistic information for an individual
@@ -348,6 +468,17 @@ type CiaoNodeStatus struct {
 	Status NodeStatusType `json:"status"`
 }
 
+// NodeAction reports the progress of the evacuation of a node. Instances
+// which have been moved to another node or deleted since the evacuation
+// started are counted as migrated.
+type NodeAction struct {
+	NodeID             string `json:"node_id"`
+	Action             string `json:"action"`
+	TotalInstances     int    `json:"total_instances"`
+	MigratedInstances  int    `json:"migrated_instances"`
+	RemainingInstances int    `json:"remaining_instances"`
+}
+
 // CiaoNodes represents the unmarshalled version of the contents of a
 // /v2.1/nodes response.  It contains status and statistics information
 // for a set of nodes.
@@ -548,9 +679,15 @@ var (
 	// ErrTenantNotFound is returned when a tenant ID is unknown.
 	ErrTenantNotFound = errors.New("Tenant not found")
 
+	// ErrNoCNCI is returned when a tenant has no CNCI yet.
+	ErrNoCNCI = errors.New("Tenant has no CNCI")
+
 	// ErrInstanceNotFound is returned when an instance is not found.
 	ErrInstanceNotFound = errors.New("Instance not found")
 
+	// ErrNodeNotFound is returned when a node is not found.
+	ErrNodeNotFound = errors.New("Node not found")
+
 	// ErrInstanceNotAssigned is returned when an instance is not assigned to a node.
 	ErrInstanceNotAssigned = errors.New("Cannot perform operation: instance not assigned to Node")
 
@@ -575,6 +712,9 @@ var (
 	// ErrAddressNotFound is returned when an address isn't found.
 	ErrAddressNotFound = errors.New("Address Not Found")
 
+	// ErrAddressInUse is returned when an address is already mapped
+	ErrAddressInUse = errors.New("Address already mapped")
+
 	// ErrInvalidPoolAddress is returned when an address isn't part of a pool
 	ErrInvalidPoolAddress = errors.New("The Address is not found in this pool")
 
@@ -584,21 +724,69 @@ var (
 	// ErrPoolEmpty is returned when a pool has no free IPs
 	ErrPoolEmpty = errors.New("Pool has no Free IPs")
 
+	// ErrMappingSkipped is returned for the mappings of a batch which were
+	// not attempted as the batch was stopped by an earlier failure
+	ErrMappingSkipped = errors.New("Mapping not attempted")
+
 	// ErrDuplicatePoolName is returned when a duplicate pool name is used
 	ErrDuplicatePoolName = errors.New("Pool by that name already exists")
 
-	// ErrInstanceMapped is returned when an instance cannot be deleted
-	// due to having an external IP assigned to it.
-	ErrInstanceMapped = errors.New("Unmap the external IP prior to deletion")
-
 	// ErrWorkloadNotFound is returned when a workload ID cannot be found
 	ErrWorkloadNotFound = errors.New("Workload not found")
 
 	// ErrWorkloadInUse is returned by DeleteWorkload when an instance of a workload is still active.
 	ErrWorkloadInUse = errors.New("Workload definition still in use")
 
+	// ErrTooManyStreams is returned when a tenant has too many event
+	// streams open
+	ErrTooManyStreams = errors.New("Too many event streams")
+
+	// ErrWorkloadImmutable is returned when a patch changes a workload field
+	// other than description, visibility or workload_requirements.
+	ErrWorkloadImmutable = errors.New("Only description, visibility and workload_requirements of a workload may be changed")
+
+	// ErrVolumeImmutable is returned when a patch changes a volume field
+	// other than name or description.
+	ErrVolumeImmutable = errors.New("Only name and description of a volume may be changed")
+
+	// ErrImageImmutable is returned when a patch changes an image field
+	// other than name.
+	ErrImageImmutable = errors.New("Only name of an image may be changed")
+
+	// ErrNotCancellable is returned when cancelling a volume which is not
+	// being created or an image which is not being uploaded.
+	ErrNotCancellable = errors.New("No operation in progress to cancel")
+
+	// ErrTenantNotDeleting is returned when restoring a tenant which has
+	// not been deleted.
+	ErrTenantNotDeleting = errors.New("Tenant is not being deleted")
+
+	// ErrTenantDeleting is returned when creating a resource for a
+	// tenant which is being deleted.
+	ErrTenantDeleting = errors.New("Tenant is being deleted")
+
+	// ErrBadSubnet is returned when the subnet of a tenant is not a
+	// valid IPv4 network.
+	ErrBadSubnet = errors.New("Invalid subnet")
+
+	// ErrSubnetAndBits is returned when a tenant request sets both the
+	// subnet and the subnet bits.
+	ErrSubnetAndBits = errors.New("Only one of subnet and subnet_bits may be set")
+
 	// ErrBadName is returned when a name doesn't match the requirements
 	ErrBadName = errors.New("Requested name doesn't match requirements")
+
+	// ErrNodeNotEvacuated is returned when restoring a node which has not
+	// been evacuated.
+	ErrNodeNotEvacuated = errors.New("Node has not been evacuated")
+
+	// ErrPrivilegedNotPermitted is returned when a tenant which is not
+	// permitted privileged containers launches a privileged workload
+	ErrPrivilegedNotPermitted = errors.New("Permission denied: you do not have permission to create privileged workloads")
+
+	// ErrNoWorkloadResources is returned when launching a VM workload which
+	// does not require any memory or VCPUs
+	ErrNoWorkloadResources = errors.New("VM workloads must require memory and VCPUs")
 )
 
 // Link provides a url and relationship for a resource.
@@ -615,10 +803,41 @@ type APILink struct {
 	MinVersion string `json:"minimum_version"`
 }
 
+// APIVersion lists the supported versions of the media type of a resource.
+type APIVersion struct {
+	Resource   string   `json:"resource"`
+	Versions   []string `json:"versions"`
+	Version    string   `json:"version"`
+	MinVersion string   `json:"minimum_version"`
+}
+
+// APIVersions is the version matrix of all the resources of the API.
+type APIVersions struct {
+	Versions []APIVersion `json:"versions"`
+}
+
+// APIError describes why an API request failed.
+type APIError struct {
+	Code    int      `json:"code"`
+	Name    string   `json:"name"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+// APIErrorResponse is the body returned for every failed API request,
+// following the OpenStack fault format
+// http://developer.openstack.org/api-guide/compute/faults.html
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
 // ExternalSubnet represents a subnet for External IPs.
+// Used and Free count the allocatable addresses of the subnet.
 type ExternalSubnet struct {
 	ID    string `json:"id"`
 	CIDR  string `json:"subnet"`
+	Used  int    `json:"used"`
+	Free  int    `json:"free"`
 	Links []Link `json:"links"`
 }
 
@@ -658,9 +877,11 @@ type PoolSummary struct {
 	Links    []Link `json:"links,omitempty"`
 }
 
-// ListPoolsResponse respresents a summary list of all pools.
+// ListPoolsResponse respresents a summary list of all pools. More is set
+// when the list is a page and further pools follow it.
 type ListPoolsResponse struct {
 	Pools []PoolSummary `json:"pools"`
+	More  bool          `json:"more,omitempty"`
 }
 
 // NewIPAddressRequest is used to add a new external IP to a pool.
@@ -700,6 +921,16 @@ type MappedIPShort struct {
 type MapIPRequest struct {
 	PoolName   *string `json:"pool_name"`
 	InstanceID string  `json:"instance_id"`
+	ExternalIP *string `json:"external_ip,omitempty"`
+}
+
+// MapIPBatchResult is the outcome of one of the mappings of a batch
+// external IP request. Only one of MappedIP or Error is set.
+type MapIPBatchResult struct {
+	InstanceID string    `json:"instance_id"`
+	PoolName   *string   `json:"pool_name"`
+	MappedIP   *MappedIP `json:"mapped_ip,omitempty"`
+	Error      string    `json:"error,omitempty"`
 }
 
 // QuotaDetails holds information for updating and querying quotas
@@ -739,12 +970,31 @@ func (qd *QuotaDetails) MarshalJSON() ([]byte, error) {
 	})
 }
 
-// UnmarshalJSON provides a custom demarshaller for quota API
+// quotaInt decodes a quota value or usage which may either be a string,
+// as in v1 of the API, or a number, as in v2.
+func quotaInt(data json.RawMessage) int {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		if s == "unlimited" {
+			return -1
+		}
+		v, _ := strconv.Atoi(s)
+		return v
+	}
+
+	var v int
+	_ = json.Unmarshal(data, &v)
+	return v
+}
+
+// UnmarshalJSON provides a custom demarshaller for quota API. Both the v1
+// and v2 representations are accepted.
 func (qd *QuotaDetails) UnmarshalJSON(data []byte) error {
 	tmp := struct {
-		Name  string `json:"name"`
-		Value string `json:"value"`
-		Usage string `json:"usage"`
+		Name      string          `json:"name"`
+		Value     json.RawMessage `json:"value"`
+		Usage     json.RawMessage `json:"usage"`
+		Unlimited bool            `json:"unlimited"`
 	}{}
 
 	err := json.Unmarshal(data, &tmp)
@@ -753,20 +1003,71 @@ func (qd *QuotaDetails) UnmarshalJSON(data []byte) error {
 	}
 
 	qd.Name = tmp.Name
-	if tmp.Value == "unlimited" {
+	qd.Value = quotaInt(tmp.Value)
+	if tmp.Unlimited {
 		qd.Value = -1
-	} else {
-		qd.Value, _ = strconv.Atoi(tmp.Value)
 	}
-	qd.Usage, _ = strconv.Atoi(tmp.Usage)
+	qd.Usage = quotaInt(tmp.Usage)
 	return nil
 }
 
+// QuotaDetailsV2 holds the representation of a quota used by v2 of the
+// tenants API. The value is always numeric and unlimited quotas, which
+// have a negative value, are flagged explicitly.
+type QuotaDetailsV2 struct {
+	Name      string `json:"name"`
+	Value     int    `json:"value"`
+	Usage     *int   `json:"usage,omitempty"`
+	Unlimited bool   `json:"unlimited,omitempty"`
+}
+
+// QuotaListResponseV2 holds the layout for returning quotas in v2 of the API
+type QuotaListResponseV2 struct {
+	Quotas []QuotaDetailsV2 `json:"quotas"`
+}
+
+// NewQuotaListResponseV2 converts quotas to their v2 representation. As
+// in v1 no usage is reported for limits.
+func NewQuotaListResponseV2(quotas []QuotaDetails) QuotaListResponseV2 {
+	resp := QuotaListResponseV2{Quotas: []QuotaDetailsV2{}}
+
+	for _, qd := range quotas {
+		q := QuotaDetailsV2{
+			Name:      qd.Name,
+			Value:     qd.Value,
+			Unlimited: qd.Value < 0,
+		}
+
+		if !strings.Contains(qd.Name, "limit") {
+			usage := qd.Usage
+			q.Usage = &usage
+		}
+
+		resp.Quotas = append(resp.Quotas, q)
+	}
+
+	return resp
+}
+
 // QuotaUpdateRequest holds the layout for updating quota API
 type QuotaUpdateRequest struct {
 	Quotas []QuotaDetails `json:"quotas"`
 }
 
+// InvalidQuotasError is returned when quotas cannot be set for a tenant.
+type InvalidQuotasError struct {
+	Reasons []string
+}
+
+func (e *InvalidQuotasError) Error() string {
+	return fmt.Sprintf("%d invalid quota(s)", len(e.Reasons))
+}
+
+// Details returns one error message per invalid quota.
+func (e *InvalidQuotasError) Details() []string {
+	return e.Reasons
+}
+
 // QuotaListResponse holds the layout for returning quotas in the API
 type QuotaListResponse struct {
 	Quotas []QuotaDetails `json:"quotas"`
@@ -784,9 +1085,68 @@ type CNCIController interface {
 	WaitForActive(subnet string) error
 	GetInstanceCNCI(InstanceID string) (*Instance, error)
 	GetSubnetCNCI(subnet string) (*Instance, error)
+	Probe() (CNCIProbeResponse, error)
+	ProbeResult(result payloads.CNCIProbeResultEvent) error
+	List() []TenantCNCI
 	Shutdown()
 }
 
+// TenantResourceSummary is the current footprint of a tenant. VCPUs and
+// MemMB are the resources required by its running instances, VolumeGB is
+// the size of its volumes and Images and ImageBytes only account for the
+// images it owns.
+type TenantResourceSummary struct {
+	TenantID         string `json:"tenant_id"`
+	Instances        int    `json:"instances"`
+	RunningInstances int    `json:"running_instances"`
+	VCPUs            int    `json:"vcpus"`
+	MemMB            int    `json:"mem_mb"`
+	Volumes          int    `json:"volumes"`
+	VolumeGB         int    `json:"volume_gb"`
+	Images           int    `json:"images"`
+	ImageBytes       uint64 `json:"image_bytes"`
+	MappedIPs        int    `json:"mapped_ips"`
+}
+
+// TenantCNCIResponse lists the CNCIs serving a tenant.
+type TenantCNCIResponse struct {
+	CNCIs []TenantCNCI `json:"cncis"`
+}
+
+// CNCISummary describes the load of a CNCI. Tenants is the number of
+// tenants it serves and PublicIPs the number of external IPs mapped to
+// instances on its subnets.
+type CNCISummary struct {
+	ID        string `json:"id"`
+	TenantID  string `json:"tenant_id"`
+	IPAddress string `json:"ip_address"`
+	Subnets   int    `json:"subnets"`
+	Tenants   int    `json:"tenants"`
+	PublicIPs int    `json:"public_ips"`
+}
+
+// CNCIListResponse lists the CNCIs of the cluster.
+type CNCIListResponse struct {
+	CNCIs []CNCISummary `json:"cncis"`
+}
+
+// CNCIProbeFailure describes a CNCI tunnel found not to be passing traffic.
+// To is empty when the probing CNCI did not report any result.
+type CNCIProbeFailure struct {
+	From  string `json:"from"`
+	To    string `json:"to,omitempty"`
+	Error string `json:"error"`
+}
+
+// CNCIProbeResponse contains the result of probing the tunnels between the
+// CNCIs of a tenant. Matrix maps the ID of each probing CNCI to the
+// reachability of the tunnel IP of each of its peers.
+type CNCIProbeResponse struct {
+	Healthy  bool                       `json:"healthy"`
+	Matrix   map[string]map[string]bool `json:"matrix"`
+	Failures []CNCIProbeFailure         `json:"failures,omitempty"`
+}
+
 // ImageState represents the state of the image.
 type ImageState string
 
@@ -797,6 +1157,9 @@ const (
 	// Saving means the image is being saved
 	Saving ImageState = "saving"
 
+	// Uploading means the image data is being received asynchronously.
+	Uploading ImageState = "uploading"
+
 	// Active means that the image is created, uploaded and ready to use.
 	Active ImageState = "active"
 
@@ -827,6 +1190,7 @@ type Image struct {
 	CreateTime time.Time  `json:"create_time"`
 	Size       uint64     `json:"size"`
 	Visibility Visibility `json:"visibility"`
+	Checksum   string     `json:"checksum,omitempty"`
 }
 
 // TransitionInstanceState safely sets thes state on an instance
@@ -15,7 +15,11 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
@@ -25,28 +29,123 @@ import (
 	"github.com/golang/glog"
 )
 
+// imageVolumeSize checks that the image a volume is to be created from is
+// active and returns its ID along with the size of the volume in GiB. The
+// volume is at least as large as the image.
+func (c *controller) imageVolumeSize(tenant string, req api.RequestedVolume) (string, int, error) {
+	image, err := c.GetImage(tenant, req.ImageRef)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if image.State != types.Active {
+		return "", 0, api.ErrImageNotActive
+	}
+
+	imageSize := int((image.Size + (1 << 30) - 1) >> 30)
+	if req.Size == 0 {
+		return image.ID, imageSize, nil
+	}
+
+	if req.Size < imageSize {
+		return "", 0, api.ErrVolumeTooSmall
+	}
+
+	return image.ID, req.Size, nil
+}
+
+// sourceVolumeSize checks that the volume a volume is to be cloned from
+// belongs to the tenant and is not changing state, and returns the size of
+// the clone in GiB. The clone is at least as large as its source.
+func (c *controller) sourceVolumeSize(tenant string, req api.RequestedVolume) (int, error) {
+	source, err := c.ds.GetBlockDevice(req.SourceVolID)
+	if err != nil {
+		return 0, api.ErrVolumeNotFound
+	}
+
+	if source.TenantID != tenant {
+		return 0, api.ErrVolumeOwner
+	}
+
+	if source.State != types.Available && source.State != types.InUse {
+		return 0, api.ErrVolumeNotAvailable
+	}
+
+	if req.Size == 0 {
+		return source.Size, nil
+	}
+
+	if req.Size < source.Size {
+		return 0, api.ErrVolumeTooSmall
+	}
+
+	return req.Size, nil
+}
+
 // CreateVolume will create a new block device and store it in the datastore.
-func (c *controller) CreateVolume(tenant string, req api.RequestedVolume) (types.Volume, error) {
+// A volume created from an image is sized to hold the image, a volume cloned
+// from another volume is at least as large as its source. The volume is
+// deleted rather than stored if ctx is cancelled while it is created.
+func (c *controller) CreateVolume(ctx context.Context, tenant string, req api.RequestedVolume) (types.Volume, error) {
+	err := c.checkTenantActive(tenant)
+	if err != nil {
+		return types.Volume{}, err
+	}
+
+	if req.ImageRef != "" {
+		req.ImageRef, req.Size, err = c.imageVolumeSize(tenant, req)
+	} else if req.SourceVolID != "" {
+		req.Size, err = c.sourceVolumeSize(tenant, req)
+	}
+
+	if err != nil {
+		return types.Volume{}, err
+	}
+
+	return c.createVolume(ctx, tenant, req)
+}
+
+// createVolume creates the volumes of instances, the images of which have
+// been checked when their workload was created.
+func (c *controller) createVolume(ctx context.Context, tenant string, req api.RequestedVolume) (types.Volume, error) {
 	var bd storage.BlockDevice
 
+	resources := []payloads.RequestedResource{
+		{Type: payloads.Volume, Value: 1},
+		{Type: payloads.SharedDiskGiB, Value: req.Size},
+	}
+
+	// reject volumes which would take the tenant over its quotas before
+	// creating them, when their size is known.
+	if !req.Internal && req.Size > 0 {
+		res := <-c.qs.Check(tenant, 1, resources...)
+		if !res.Allowed() {
+			return types.Volume{}, api.ErrQuota
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return types.Volume{}, err
+	}
+
 	var err error
-	// no limits checking for now.
 	if req.ImageRef != "" {
 		// create bootable volume
 		bd, err = c.CreateBlockDeviceFromSnapshot(req.ImageRef, "ciao-image")
 		bd.Bootable = true
 	} else if req.SourceVolID != "" {
-		// copy existing volume
-		bd, err = c.CopyBlockDevice(req.SourceVolID)
+		// copy existing volume, which is bootable if its source is
+		var source types.Volume
+		source, err = c.ds.GetBlockDevice(req.SourceVolID)
+		if err == nil {
+			bd, err = c.CopyBlockDevice(req.SourceVolID)
+			bd.Bootable = source.Bootable
+		}
 	} else {
 		// create empty volume
 		bd, err = c.CreateBlockDevice("", "", req.Size)
 	}
 
-	if err == nil && req.Size > bd.Size {
-		bd.Size, err = c.Resize(bd.ID, req.Size)
-	}
-
 	if err != nil {
 		return types.Volume{}, err
 	}
@@ -59,43 +158,161 @@ func (c *controller) CreateVolume(tenant string, req api.RequestedVolume) (types
 		BlockDevice: bd,
 		CreateTime:  time.Now(),
 		TenantID:    tenant,
-		State:       types.Available,
+		State:       types.Creating,
 		Name:        req.Name,
 		Description: req.Description,
 		Internal:    req.Internal,
+		Attachments: []types.VolumeAttachment{},
 	}
 
-	// It's best to make the quota request here as we don't know the volume
-	// size earlier. If the ceph cluster is full then it might error out
-	// earlier.
-	resources := []payloads.RequestedResource{
-		{Type: payloads.Volume, Value: 1},
-		{Type: payloads.SharedDiskGiB, Value: bd.Size},
+	// the volume is listed as creating until it has been resized and
+	// accounted for, and may be cancelled in the meantime.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	err = c.addVolumeCreation(data, cancel)
+	if err != nil {
+		_ = c.DeleteBlockDevice(bd.ID)
+		return types.Volume{}, err
+	}
+
+	err = c.completeVolume(ctx, &data, req.Size, resources)
+	if err != nil {
+		c.removeVolumeCreation(data.ID)
+		_ = c.DeleteBlockDevice(bd.ID)
+		_ = c.ds.DeleteBlockDevice(bd.ID)
+		return types.Volume{}, err
+	}
+
+	return data, nil
+}
+
+// completeVolume resizes a volume being created to size, consumes its quota
+// and makes it available unless the creation has been cancelled.
+func (c *controller) completeVolume(ctx context.Context, data *types.Volume, size int,
+	resources []payloads.RequestedResource) error {
+	var err error
+	if size > data.Size {
+		data.Size, err = c.Resize(data.ID, size)
+		if err != nil {
+			return err
+		}
 	}
 
+	// The quota is consumed here as the size of the volume may only be
+	// known once it has been created. If the ceph cluster is full then it
+	// might error out earlier.
+	resources[1].Value = data.Size
+
 	if !data.Internal {
-		res := <-c.qs.Consume(tenant, resources...)
+		res := <-c.qs.Consume(data.TenantID, resources...)
 
 		if !res.Allowed() {
-			_ = c.DeleteBlockDevice(bd.ID)
-			c.qs.Release(tenant, res.Resources()...)
-			return types.Volume{}, api.ErrQuota
+			c.qs.Release(data.TenantID, res.Resources()...)
+			return api.ErrQuota
 		}
 	}
 
-	err = c.ds.AddBlockDevice(data)
+	c.volumeCreationsLock.Lock()
+	defer c.volumeCreationsLock.Unlock()
+
+	err = ctx.Err()
+	if err == nil {
+		data.State = types.Available
+		err = c.ds.UpdateBlockDevice(*data)
+	}
+
 	if err != nil {
-		_ = c.DeleteBlockDevice(bd.ID)
 		if !data.Internal {
-			c.qs.Release(tenant, resources...)
+			c.qs.Release(data.TenantID, resources...)
 		}
-		return types.Volume{}, err
+		return err
 	}
 
-	return data, nil
+	delete(c.volumeCreations, data.ID)
+	return nil
+}
+
+// addVolumeCreation stores a volume in the creating state along with the
+// function cancelling its creation.
+func (c *controller) addVolumeCreation(data types.Volume, cancel context.CancelFunc) error {
+	c.volumeCreationsLock.Lock()
+	defer c.volumeCreationsLock.Unlock()
+
+	err := c.ds.AddBlockDevice(data)
+	if err != nil {
+		return err
+	}
+
+	if c.volumeCreations == nil {
+		c.volumeCreations = make(map[string]context.CancelFunc)
+	}
+	c.volumeCreations[data.ID] = cancel
+
+	return nil
+}
+
+func (c *controller) removeVolumeCreation(ID string) {
+	c.volumeCreationsLock.Lock()
+	delete(c.volumeCreations, ID)
+	c.volumeCreationsLock.Unlock()
+}
+
+// CancelVolume cancels the creation of a volume. A volume left in the
+// creating state by a previous instance of the controller is deleted.
+func (c *controller) CancelVolume(tenant string, volume string) error {
+	info, err := c.ds.GetBlockDevice(volume)
+	if err != nil {
+		return err
+	}
+
+	if info.TenantID != tenant {
+		return api.ErrVolumeOwner
+	}
+
+	c.volumeCreationsLock.Lock()
+	defer c.volumeCreationsLock.Unlock()
+
+	// the volume may have completed since it was retrieved.
+	info, err = c.ds.GetBlockDevice(volume)
+	if err != nil {
+		return err
+	}
+
+	if info.State != types.Creating {
+		return types.ErrNotCancellable
+	}
+
+	glog.Infof("Cancelling creation of volume %s", volume)
+
+	if cancel, ok := c.volumeCreations[volume]; ok {
+		// createVolume deletes the volume once it notices.
+		cancel()
+		delete(c.volumeCreations, volume)
+		return nil
+	}
+
+	err = c.DeleteBlockDevice(volume)
+	if err != nil {
+		glog.Warningf("Unable to delete block device %s: %v", volume, err)
+	}
+
+	return c.ds.DeleteBlockDevice(volume)
 }
 
 func (c *controller) DeleteVolume(tenant string, volume string) error {
+	return c.deleteVolume(tenant, volume, false)
+}
+
+// ForceDeleteVolume deletes a volume regardless of its state, removing any
+// attachment it may have. Failures to remove the volume from the storage
+// backend are only logged, so forcing may orphan backend resources if the
+// backend is unreachable.
+func (c *controller) ForceDeleteVolume(tenant string, volume string) error {
+	return c.deleteVolume(tenant, volume, true)
+}
+
+func (c *controller) deleteVolume(tenant string, volume string, force bool) error {
 	// get the block device information
 	info, err := c.ds.GetBlockDevice(volume)
 	if err != nil {
@@ -107,8 +324,25 @@ func (c *controller) DeleteVolume(tenant string, volume string) error {
 		return api.ErrVolumeOwner
 	}
 
-	// check that the block device is available.
-	if info.State != types.Available {
+	if force {
+		if info.State != types.Available {
+			glog.Warningf("Forcing deletion of volume %s in state %s", volume, info.State)
+		}
+
+		// remove any attachments left behind.
+		attachments, err := c.ds.GetVolumeAttachments(volume)
+		if err != nil {
+			return err
+		}
+
+		for _, a := range attachments {
+			err = c.ds.DeleteStorageAttachment(a.ID)
+			if err != nil {
+				return err
+			}
+		}
+	} else if info.State != types.Available {
+		// check that the block device is available.
 		return api.ErrVolumeNotAvailable
 	}
 
@@ -121,7 +355,10 @@ func (c *controller) DeleteVolume(tenant string, volume string) error {
 	// tell the underlying storage media to remove.
 	err = c.DeleteBlockDevice(volume)
 	if err != nil {
-		return err
+		if !force {
+			return err
+		}
+		glog.Warningf("Unable to remove volume %s from storage backend: %v", volume, err)
 	}
 
 	// release quota associated with this volume
@@ -132,35 +369,136 @@ func (c *controller) DeleteVolume(tenant string, volume string) error {
 	return nil
 }
 
-func (c *controller) AttachVolume(tenant string, volume string, instance string, mountpoint string) error {
+// mountpointRegexp matches the device paths a volume may be attached at.
+var mountpointRegexp = regexp.MustCompile("^/dev/(?:[hsv]|xv)d[a-z]{1,2}$")
+
+// normalizeMountpoint returns the device path of a mountpoint, which may be
+// given with or without its /dev/ prefix.
+func normalizeMountpoint(mountpoint string) (string, error) {
+	m := strings.TrimSpace(mountpoint)
+	if !strings.HasPrefix(m, "/") {
+		m = "/dev/" + m
+	}
+
+	m = path.Clean(m)
+	if !mountpointRegexp.MatchString(m) {
+		return "", api.ErrBadMountpoint
+	}
+
+	return m, nil
+}
+
+// selectMountpoint returns the normalized mountpoint requested for a volume
+// attached to an instance with the given attachments. The first free virtio
+// device after the root disk is selected if no mountpoint is requested.
+func selectMountpoint(attachments []types.StorageAttachment, mountpoint string) (string, error) {
+	used := make(map[string]bool)
+	for _, a := range attachments {
+		if m, err := normalizeMountpoint(a.Mountpoint); err == nil {
+			used[m] = true
+		}
+	}
+
+	if mountpoint == "" {
+		for l := 'b'; l <= 'z'; l++ {
+			m := "/dev/vd" + string(l)
+			if !used[m] {
+				return m, nil
+			}
+		}
+		return "", api.ErrMountpointInUse
+	}
+
+	m, err := normalizeMountpoint(mountpoint)
+	if err != nil {
+		return "", err
+	}
+
+	if used[m] {
+		return "", api.ErrMountpointInUse
+	}
+
+	return m, nil
+}
+
+// AttachVolume attaches a volume to an instance at the given mountpoint,
+// or at the first free device if none is given. The mountpoint of the
+// volume is returned.
+func (c *controller) AttachVolume(tenant string, volume string, instance string, mountpoint string, readOnly bool) (string, error) {
 	// get the block device information
 	info, err := c.ds.GetBlockDevice(volume)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	// check that the block device is available.
-	if info.State != types.Available {
-		return api.ErrVolumeNotAvailable
+	// check that the block device is available. A volume which is in use
+	// may still be shared with other instances read-only.
+	if !attachable(info.State, readOnly) {
+		return "", api.ErrVolumeNotAvailable
 	}
 
 	// check that the block device is owned by the tenant.
 	if info.TenantID != tenant {
-		return api.ErrVolumeOwner
+		return "", api.ErrVolumeOwner
 	}
 
 	// check that the instance is owned by the tenant.
 	i, err := c.ds.GetTenantInstance(tenant, instance)
 	if err != nil {
-		return api.ErrInstanceNotFound
+		return "", api.ErrInstanceNotFound
 	}
 
-	// update volume state to attaching
-	info.State = types.Attaching
+	// volumes can only be hot plugged read-write, read-only volumes are
+	// set up when the instance is restarted.
+	if readOnly {
+		i.StateLock.RLock()
+		state := i.State
+		i.StateLock.RUnlock()
 
-	err = c.ds.UpdateBlockDevice(info)
+		if state != payloads.Exited {
+			return "", api.ErrInstanceNotStopped
+		}
+	}
+
+	// the mountpoint must remain free until the attachment is created.
+	c.attachLock.Lock()
+	attachments := c.ds.GetStorageAttachments(i.ID)
+	for _, a := range attachments {
+		if a.BlockID == info.ID {
+			c.attachLock.Unlock()
+			return "", api.ErrVolumeAttached
+		}
+	}
+
+	mountpoint, err = selectMountpoint(attachments, mountpoint)
 	if err != nil {
-		return err
+		c.attachLock.Unlock()
+		return "", err
+	}
+
+	// the volume may have been attached since it was checked.
+	info, err = c.ds.GetBlockDevice(volume)
+	if err != nil {
+		c.attachLock.Unlock()
+		return "", err
+	}
+
+	if !attachable(info.State, readOnly) {
+		c.attachLock.Unlock()
+		return "", api.ErrVolumeNotAvailable
+	}
+
+	oldState := info.State
+
+	// update volume state to attaching
+	if info.State == types.Available {
+		info.State = types.Attaching
+
+		err = c.ds.UpdateBlockDevice(info)
+		if err != nil {
+			c.attachLock.Unlock()
+			return "", err
+		}
 	}
 
 	// create an attachment object
@@ -168,37 +506,125 @@ func (c *controller) AttachVolume(tenant string, volume string, instance string,
 		ID:        info.ID,
 		Ephemeral: false,
 		Bootable:  false,
+		ReadOnly:  readOnly,
 	}
-	_, err = c.ds.CreateStorageAttachment(i.ID, a)
+	sa, err := c.ds.CreateStorageAttachment(i.ID, a, mountpoint)
+	c.attachLock.Unlock()
 	if err != nil {
-		info.State = types.Available
+		info.State = oldState
 		dsErr := c.ds.UpdateBlockDevice(info)
 		if dsErr != nil {
 			glog.Error(dsErr)
 		}
-		return err
+		return "", err
 	}
 
 	// send command to attach volume.
-	err = c.client.attachVolume(volume, instance, i.NodeID)
+	err = c.client.attachVolume(volume, instance, i.NodeID, readOnly)
 	if err != nil {
-		info.State = types.Available
-		dsErr := c.ds.UpdateBlockDevice(info)
+		dsErr := c.ds.DeleteStorageAttachment(sa.ID)
 		if dsErr != nil {
 			glog.Error(dsErr)
 		}
-		return err
+
+		info.State = oldState
+		dsErr = c.ds.UpdateBlockDevice(info)
+		if dsErr != nil {
+			glog.Error(dsErr)
+		}
+		return "", err
 	}
 
-	return nil
+	return mountpoint, nil
+}
+
+// attachable reports whether a volume in the given state may be attached.
+// Only one instance may write to a volume, but any number of instances may
+// share it read-only.
+func attachable(state types.BlockState, readOnly bool) bool {
+	return state == types.Available || (readOnly && state == types.InUse)
+}
+
+// checkBootVolumes verifies that the volumes referenced by the block device
+// mapping of a server create request may be attached to the new instance and
+// returns their IDs. The mountpoints are accepted for compatibility with the
+// attach action, the devices are named by the launcher.
+func (c *controller) checkBootVolumes(tenant string, mappings []api.BlockDeviceMapping, nInstances int) ([]string, error) {
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+
+	// a volume may only be attached to a single instance.
+	if nInstances > 1 {
+		return nil, types.ErrBadRequest
+	}
+
+	var volumes []string
+	seen := make(map[string]bool)
+
+	for _, m := range mappings {
+		if m.VolumeID == "" || seen[m.VolumeID] {
+			return nil, types.ErrBadRequest
+		}
+		seen[m.VolumeID] = true
+
+		info, err := c.ds.GetBlockDevice(m.VolumeID)
+		if err != nil {
+			return nil, api.ErrVolumeNotFound
+		}
+
+		if info.TenantID != tenant {
+			return nil, api.ErrVolumeOwner
+		}
+
+		switch info.State {
+		case types.Available:
+		case types.Attaching, types.InUse:
+			return nil, api.ErrVolumeAttached
+		default:
+			return nil, api.ErrVolumeNotAvailable
+		}
+
+		volumes = append(volumes, info.ID)
+	}
+
+	return volumes, nil
 }
 
-func (c *controller) DetachVolume(tenant string, volume string, attachment string) error {
-	// we don't support detaching by attachment ID yet.
-	if attachment != "" {
-		return errors.New("Detaching by attachment ID not implemented")
+// selectAttachment returns the attachment of a volume matching detach. A
+// volume with a single attachment may be detached without identifying it.
+func selectAttachment(attachments []types.StorageAttachment, detach api.VolumeDetach) (types.StorageAttachment, error) {
+	var matches []types.StorageAttachment
+
+	for _, a := range attachments {
+		if detach.AttachmentID != "" && a.ID != detach.AttachmentID {
+			continue
+		}
+
+		if detach.InstanceID != "" && a.InstanceID != detach.InstanceID {
+			continue
+		}
+
+		if detach.Mountpoint != "" && a.Mountpoint != detach.Mountpoint {
+			continue
+		}
+
+		matches = append(matches, a)
 	}
 
+	switch len(matches) {
+	case 0:
+		return types.StorageAttachment{}, api.ErrVolumeNotAttached
+	case 1:
+		return matches[0], nil
+	default:
+		return types.StorageAttachment{}, api.ErrVolumeAttachmentAmbiguous
+	}
+}
+
+// DetachVolume detaches a volume from the exited instance identified by
+// detach.
+func (c *controller) DetachVolume(tenant string, volume string, detach api.VolumeDetach) error {
 	// get attachment info
 	attachments, err := c.ds.GetVolumeAttachments(volume)
 	if err != nil {
@@ -225,47 +651,46 @@ func (c *controller) DetachVolume(tenant string, volume string, attachment strin
 		return api.ErrVolumeNotAttached
 	}
 
+	a, err := selectAttachment(attachments, detach)
+	if err != nil {
+		return err
+	}
+
 	// we cannot detach a boot device - these aren't
 	// like regular attachments and shouldn't be treated
 	// as such.
-	for _, a := range attachments {
-		if a.Boot == true {
-			return api.ErrVolumeNotAttached
-		}
+	if a.Boot {
+		return api.ErrVolumeNotAttached
 	}
 
-	var retval error
+	// get instance info
+	i, err := c.ds.GetTenantInstance(tenant, a.InstanceID)
+	if err != nil {
+		glog.Error(api.ErrInstanceNotFound)
+		return err
+	}
 
-	// detach everything for this volume
-	for _, a := range attachments {
-		// get instance info
-		i, err := c.ds.GetTenantInstance(tenant, a.InstanceID)
-		if err != nil {
-			glog.Error(api.ErrInstanceNotFound)
-			// keep going
-			retval = err
-			continue
-		}
+	i.StateLock.RLock()
+	state := i.State
+	i.StateLock.RUnlock()
 
-		i.StateLock.RLock()
-		state := i.State
-		i.StateLock.RUnlock()
-
-		if state != payloads.Exited {
-			retval = errors.New("Can only detach from exited instances")
-			continue
-		}
+	if state != payloads.Exited {
+		return errors.New("Can only detach from exited instances")
+	}
 
-		// update volume state to detaching
-		info.State = types.Available
+	err = c.ds.DeleteStorageAttachment(a.ID)
+	if err != nil {
+		return err
+	}
 
-		err = c.ds.UpdateBlockDevice(info)
-		if err != nil {
-			return err
-		}
+	// the volume remains in use while it has other attachments
+	if len(attachments) > 1 {
+		return nil
 	}
 
-	return retval
+	info.State = types.Available
+
+	return c.ds.UpdateBlockDevice(info)
 }
 
 func (c *controller) ListVolumesDetail(tenant string) ([]types.Volume, error) {
@@ -281,7 +706,7 @@ func (c *controller) ListVolumesDetail(tenant string) ([]types.Volume, error) {
 			continue
 		}
 
-		vols = append(vols, vol)
+		vols = append(vols, c.volumeAttachments(vol))
 	}
 
 	return vols, nil
@@ -297,5 +722,41 @@ func (c *controller) ShowVolumeDetails(tenant string, volume string) (types.Volu
 		return types.Volume{}, api.ErrVolumeOwner
 	}
 
-	return vol, nil
+	return c.volumeAttachments(vol), nil
+}
+
+// PatchVolume applies a json merge patch to a volume. Only the name and
+// description of a volume may be changed.
+func (c *controller) PatchVolume(tenant string, volume string, patch []byte) error {
+	vol, err := c.ds.GetBlockDevice(volume)
+	if err != nil {
+		return err
+	}
+
+	if vol.TenantID != tenant {
+		return api.ErrVolumeOwner
+	}
+
+	return c.ds.JSONPatchBlockDevice(volume, patch)
+}
+
+// volumeAttachments fills in the instances a volume is attached to.
+func (c *controller) volumeAttachments(vol types.Volume) types.Volume {
+	vol.Attachments = []types.VolumeAttachment{}
+
+	attachments, err := c.ds.GetVolumeAttachments(vol.ID)
+	if err != nil {
+		glog.Warningf("Unable to get attachments of volume %s: %v", vol.ID, err)
+		return vol
+	}
+
+	for _, a := range attachments {
+		vol.Attachments = append(vol.Attachments, types.VolumeAttachment{
+			InstanceID: a.InstanceID,
+			Mountpoint: a.Mountpoint,
+			ReadOnly:   a.ReadOnly,
+		})
+	}
+
+	return vol
 }
@@ -15,8 +15,11 @@
 package main
 
 import (
+	"encoding/json"
+
 	"github.com/golang/glog"
 
+	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/uuid"
@@ -85,6 +88,17 @@ func (c *controller) validateWorkloadStorage(req *types.Workload) error {
 			return types.ErrBadRequest
 		}
 
+		// a new volume's size defaults to that of its source, an empty
+		// volume has no source to size it from.
+		if req.Storage[i].Size < 0 {
+			return types.ErrBadRequest
+		}
+
+		if req.Storage[i].ID == "" && req.Storage[i].SourceType == types.Empty &&
+			req.Storage[i].Size == 0 {
+			return types.ErrBadRequest
+		}
+
 		if req.Storage[i].ID != "" {
 			// validate that the id is at least valid
 			// uuid4.
@@ -109,8 +123,8 @@ func (c *controller) validateWorkloadStorage(req *types.Workload) error {
 		}
 	}
 
-	// must be at least one bootable volume
-	if req.VMType == payloads.QEMU && bootableCount == 0 {
+	// VMs boot from exactly one volume
+	if req.VMType == payloads.QEMU && bootableCount != 1 {
 		return types.ErrBadRequest
 	}
 
@@ -166,7 +180,12 @@ func (c *controller) CreateWorkload(req types.Workload) (types.Workload, error)
 	// If the any storage sources use a name for an image these will be resolved to
 	// an ID in-place. Hence why this takes a pointer to the workload.
 
-	err := c.validateWorkloadRequest(&req)
+	err := c.checkTenantActive(req.TenantID)
+	if err != nil {
+		return req, err
+	}
+
+	err = c.validateWorkloadRequest(&req)
 	if err != nil {
 		return req, err
 	}
@@ -177,6 +196,93 @@ func (c *controller) CreateWorkload(req types.Workload) (types.Workload, error)
 	return req, err
 }
 
+// CreateWorkloadFromInstance creates a private workload with the
+// configuration of a stopped instance. The boot volume of the instance is
+// captured into an image named after the workload, which replaces the boot
+// storage of the workload the instance was created from.
+func (c *controller) CreateWorkloadFromInstance(tenantID string, instanceID string, name string) (types.Workload, error) {
+	err := c.checkTenantActive(tenantID)
+	if err != nil {
+		return types.Workload{}, err
+	}
+
+	i, err := c.ds.GetTenantInstance(tenantID, instanceID)
+	if err != nil {
+		return types.Workload{}, err
+	}
+
+	i.StateLock.RLock()
+	state := i.State
+	i.StateLock.RUnlock()
+
+	if state != payloads.Exited {
+		return types.Workload{}, api.ErrInstanceNotStopped
+	}
+
+	wl, err := c.ds.GetWorkload(i.WorkloadID)
+	if err != nil {
+		return types.Workload{}, err
+	}
+
+	var boot *types.StorageAttachment
+	attachments := c.ds.GetStorageAttachments(instanceID)
+	for j := range attachments {
+		if attachments[j].Boot {
+			boot = &attachments[j]
+			break
+		}
+	}
+
+	if wl.VMType != payloads.QEMU || boot == nil {
+		return types.Workload{}, api.ErrNoBootVolume
+	}
+
+	vol, err := c.ds.GetBlockDevice(boot.BlockID)
+	if err != nil {
+		return types.Workload{}, err
+	}
+
+	image, err := c.captureImage(tenantID, vol.ID, name)
+	if err != nil {
+		return types.Workload{}, err
+	}
+
+	storage := []types.StorageResource{
+		{
+			Bootable:   true,
+			Ephemeral:  boot.Ephemeral,
+			Size:       vol.Size,
+			SourceType: types.ImageService,
+			Source:     image.ID,
+		},
+	}
+	for _, s := range wl.Storage {
+		if !s.Bootable {
+			storage = append(storage, s)
+		}
+	}
+
+	req := types.Workload{
+		TenantID:     tenantID,
+		Description:  name,
+		FWType:       wl.FWType,
+		VMType:       wl.VMType,
+		Config:       wl.Config,
+		Storage:      storage,
+		Visibility:   types.Private,
+		Requirements: wl.Requirements,
+	}
+
+	newWl, err := c.CreateWorkload(req)
+	if err != nil {
+		_ = c.DeleteImage(tenantID, image.ID)
+		return types.Workload{}, err
+	}
+
+	glog.Infof("Workload %v created from instance %v", newWl.ID, instanceID)
+	return newWl, nil
+}
+
 func (c *controller) DeleteWorkload(tenantID string, workloadID string) error {
 	wl, err := c.ds.GetWorkload(workloadID)
 	if err != nil {
@@ -190,6 +296,36 @@ func (c *controller) DeleteWorkload(tenantID string, workloadID string) error {
 	return types.ErrWorkloadNotFound
 }
 
+// PatchWorkload applies a json merge patch to a workload. Tenants may only
+// patch their own workloads, which must remain private.
+func (c *controller) PatchWorkload(tenantID string, workloadID string, patch []byte) error {
+	wl, err := c.ds.GetWorkload(workloadID)
+	if err != nil {
+		return err
+	}
+
+	if tenantID != "admin" {
+		if tenantID != wl.TenantID {
+			return types.ErrWorkloadNotFound
+		}
+
+		var req struct {
+			Visibility *types.Visibility `json:"visibility"`
+		}
+
+		err = json.Unmarshal(patch, &req)
+		if err != nil {
+			return err
+		}
+
+		if req.Visibility != nil && *req.Visibility != types.Private {
+			return types.ErrBadRequest
+		}
+	}
+
+	return c.ds.JSONPatchWorkload(workloadID, patch)
+}
+
 func (c *controller) ShowWorkload(tenantID string, workloadID string) (types.Workload, error) {
 	wl, err := c.ds.GetWorkload(workloadID)
 	if err != nil {
@@ -203,6 +339,12 @@ func (c *controller) ShowWorkload(tenantID string, workloadID string) (types.Wor
 	return types.Workload{}, types.ErrWorkloadNotFound
 }
 
+// ListWorkloads returns the public workloads and the private workloads of
+// the tenant. Admin is returned the private workloads of all tenants.
 func (c *controller) ListWorkloads(tenantID string) ([]types.Workload, error) {
+	if tenantID == "admin" {
+		return c.ds.GetAllWorkloads()
+	}
+
 	return c.ds.GetWorkloads(tenantID)
 }
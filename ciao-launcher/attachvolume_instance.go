@@ -23,7 +23,7 @@ import (
 )
 
 func processAttachVolume(storageDriver storage.BlockDriver, monitorCh chan interface{}, cfg *vmConfig,
-	instance, instanceDir, volumeUUID string, conn serverConn) *attachVolumeError {
+	instance, instanceDir, volumeUUID string, readOnly bool, conn serverConn) *attachVolumeError {
 
 	if cfg.Container {
 		attachErr := &attachVolumeError{nil, payloads.AttachVolumeNotSupported}
@@ -38,6 +38,15 @@ func processAttachVolume(storageDriver storage.BlockDriver, monitorCh chan inter
 		return attachErr
 	}
 
+	// the device of a running instance is always hot plugged read-write.
+	// Read-only volumes are attached when the instance is next started.
+	if readOnly && monitorCh != nil {
+		attachErr := &attachVolumeError{nil, payloads.AttachVolumeNotSupported}
+		glog.Errorf("Cannot attach volume %s read-only to running instance %s [%s]",
+			volumeUUID, instance, string(attachErr.code))
+		return attachErr
+	}
+
 	if monitorCh != nil {
 		volumeMap, err := storageDriver.GetVolumeMapping()
 		if err != nil {
@@ -84,7 +93,7 @@ func processAttachVolume(storageDriver storage.BlockDriver, monitorCh chan inter
 		}
 	}
 
-	cfg.Volumes = append(cfg.Volumes, volumeConfig{UUID: volumeUUID})
+	cfg.Volumes = append(cfg.Volumes, volumeConfig{UUID: volumeUUID, ReadOnly: readOnly})
 
 	err := cfg.save(instanceDir)
 	if err != nil {
@@ -103,6 +103,10 @@ func (s dockerTestStorage) CopyBlockDevice(volumeUUID string) (storage.BlockDevi
 	return storage.BlockDevice{}, nil
 }
 
+func (s dockerTestStorage) ExportBlockDevice(volumeUUID string, snapshotID string, path string) error {
+	return nil
+}
+
 func (s dockerTestStorage) GetBlockDeviceSize(volumeUUID string) (uint64, error) {
 	return 0, nil
 }
@@ -79,6 +79,7 @@ type insMonitorCmd struct{}
 
 type insAttachVolumeCmd struct {
 	volumeUUID string
+	readOnly   bool
 }
 
 /*
@@ -235,7 +236,7 @@ func (id *instanceData) attachVolumeCommand(cmd *insAttachVolumeCmd) {
 	}
 
 	attachErr := processAttachVolume(id.storageDriver, id.monitorCh, id.cfg, id.instance, id.instanceDir,
-		cmd.volumeUUID, id.ac.conn)
+		cmd.volumeUUID, cmd.readOnly, id.ac.conn)
 	if attachErr != nil {
 		attachErr.send(id.ac.conn, id.instance, cmd.volumeUUID)
 		return
@@ -829,7 +829,7 @@ func TestAttachVolumeToInstance(t *testing.T) {
 	state, ovsCh, cmdCh, doneCh := startVMWithCFG(t, &wg, &cfg, true, false)
 
 	select {
-	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID}:
+	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID, false}:
 	case <-time.After(time.Second):
 		t.Error("Timed out sending attach volume command")
 	}
@@ -864,7 +864,7 @@ func TestAttachExistingVolumeToInstance(t *testing.T) {
 	state, ovsCh, cmdCh, doneCh := startVMWithCFG(t, &wg, &cfg, true, false)
 
 	select {
-	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID}:
+	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID, false}:
 	case <-time.After(time.Second):
 		t.Error("Timed out sending attach volume command")
 	}
@@ -881,7 +881,7 @@ func TestAttachExistingVolumeToInstance(t *testing.T) {
 	select {
 	case <-state.errorCh:
 		t.Error("Initial Volume attach failed")
-	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID}:
+	case cmdCh <- &insAttachVolumeCmd{testutil.VolumeUUID, false}:
 	case <-time.After(time.Second):
 		t.Error("Timed out sending attach volume command")
 	}
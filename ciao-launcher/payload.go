@@ -153,6 +153,7 @@ func parseStartPayload(data []byte) (*vmConfig, *payloadError) {
 			volumes = append(volumes, volumeConfig{
 				UUID:     storage.ID,
 				Bootable: storage.Bootable,
+				ReadOnly: storage.ReadOnly,
 			})
 		} else {
 			/* See github issue #972:
@@ -272,16 +273,21 @@ func extractVolumeInfo(cmd *payloads.VolumeCmd, errString string) (string, strin
 	return instance, volume, nil
 }
 
-func parseAttachVolumePayload(data []byte) (string, string, *payloadError) {
+func parseAttachVolumePayload(data []byte) (string, string, bool, *payloadError) {
 	var clouddata payloads.AttachVolume
 
 	err := yaml.Unmarshal(data, &clouddata)
 	if err != nil {
 		glog.Errorf("YAML error: %v", err)
-		return "", "", &payloadError{err, payloads.AttachVolumeInvalidPayload}
+		return "", "", false, &payloadError{err, payloads.AttachVolumeInvalidPayload}
 	}
 
-	return extractVolumeInfo(&clouddata.Attach, payloads.AttachVolumeInvalidData)
+	instance, volume, payloadErr := extractVolumeInfo(&clouddata.Attach, payloads.AttachVolumeInvalidData)
+	if payloadErr != nil {
+		return "", "", false, payloadErr
+	}
+
+	return instance, volume, clouddata.Attach.ReadOnly, nil
 }
 
 func linesToBytes(doc []string, buf *bytes.Buffer) {
@@ -69,6 +69,7 @@ start:
 				{
 					"69e84267-ed01-4738-b15f-b47de06b62e7",
 					true,
+					false,
 				},
 			},
 		},
@@ -148,26 +149,35 @@ start:
 
 // Verify the parseAttachVolumePayload function.
 //
-// The function is passed one valid payload and two invalid payloads.
+// The function is passed two valid payloads, one of them read-only, and two
+// invalid payloads.
 //
 // No error should be returned for the valid payload and the returned instance
 // and volume UUIDs should match what is in the payload.  Errors should be
 // returned for the invalid payloads.
 func TestParseAttachVolumePayload(t *testing.T) {
-	instance, volume, err := parseAttachVolumePayload([]byte(testutil.AttachVolumeYaml))
+	instance, volume, readOnly, err := parseAttachVolumePayload([]byte(testutil.AttachVolumeYaml))
 	if err != nil {
 		t.Fatalf("parseAttachVolumePayload failed: %v", err)
 	}
 	if instance != testutil.InstanceUUID || volume != testutil.VolumeUUID {
 		t.Fatalf("VolumeUUID or InstanceUUID is invalid")
 	}
+	if readOnly {
+		t.Fatalf("Volume attached read-only")
+	}
+
+	_, _, readOnly, err = parseAttachVolumePayload([]byte(testutil.ReadOnlyAttachVolumeYaml))
+	if err != nil || !readOnly {
+		t.Fatalf("Read-only attachment expected: %v", err)
+	}
 
-	_, _, err = parseAttachVolumePayload([]byte("  -"))
+	_, _, _, err = parseAttachVolumePayload([]byte("  -"))
 	if err == nil || err.code != payloads.AttachVolumeInvalidPayload {
 		t.Fatalf("AttachVolumeInvalidPayload error expected")
 	}
 
-	_, _, err = parseAttachVolumePayload([]byte(testutil.BadAttachVolumeYaml))
+	_, _, _, err = parseAttachVolumePayload([]byte(testutil.BadAttachVolumeYaml))
 	if err == nil || err.code != payloads.AttachVolumeInvalidData {
 		t.Fatalf("AttachVolumeInvalidData error expected")
 	}
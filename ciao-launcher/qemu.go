@@ -345,6 +345,9 @@ func generateQEMULaunchParams(cfg *vmConfig, isoPath, instanceDir string,
 		blockdevID := fmt.Sprintf("drive_%s", v.UUID)
 		volDriveStr := fmt.Sprintf("file=rbd:rbd/%s:id=%s,if=none,id=%s,format=raw",
 			v.UUID, cephID, blockdevID)
+		if v.ReadOnly {
+			volDriveStr += ",readonly=on"
+		}
 		params = append(params, "-drive", volDriveStr)
 		volDeviceStr :=
 			fmt.Sprintf("virtio-blk-pci,scsi=off,bus=pci.0,addr=0x%x,id=device_%s,drive=%s",
@@ -125,7 +125,7 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 		}
 		client.cmdCh <- &cmdWrapper{instance, &insDeleteCmd{stop: stop}}
 	case ssntp.AttachVolume:
-		instance, volume, payloadErr := parseAttachVolumePayload(payload)
+		instance, volume, readOnly, payloadErr := parseAttachVolumePayload(payload)
 		if payloadErr != nil {
 			attachVolumeError := &attachVolumeError{
 				payloadErr.err,
@@ -135,7 +135,7 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 			glog.Errorf("Unable to parse YAML: %s", payloadErr.err)
 			return
 		}
-		client.cmdCh <- &cmdWrapper{instance, &insAttachVolumeCmd{volume}}
+		client.cmdCh <- &cmdWrapper{instance, &insAttachVolumeCmd{volume, readOnly}}
 	case ssntp.EVACUATE:
 		client.cmdCh <- &cmdWrapper{"", &evacuateCmd{}}
 	case ssntp.Restore:
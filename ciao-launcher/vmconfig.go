@@ -27,6 +27,7 @@ import (
 type volumeConfig struct {
 	UUID     string
 	Bootable bool
+	ReadOnly bool
 }
 
 type vmConfig struct {
@@ -512,6 +512,12 @@ func (sched *ssntpSchedulerServer) workloadFits(node *nodeStat, workload *workRe
 			return false
 		}
 
+		for _, excluded := range workload.requirements.ExcludeNodes {
+			if excluded == node.uuid {
+				return false
+			}
+		}
+
 		return true
 	}
 	return false
@@ -550,6 +556,10 @@ func (sched *ssntpSchedulerServer) getCommandConcentratorUUID(command ssntp.Comm
 		var cmd payloads.CommandCNCIRefresh
 		err := yaml.Unmarshal(payload, &cmd)
 		return cmd.Command.CNCIUUID, err
+	case ssntp.ProbeCNCI:
+		var cmd payloads.CommandCNCIProbe
+		err := yaml.Unmarshal(payload, &cmd)
+		return cmd.Probe.CNCIUUID, err
 	}
 }
 
@@ -817,6 +827,8 @@ func (sched *ssntpSchedulerServer) CommandForward(controllerUUID string, command
 		dest, instanceUUID = sched.fwdCmdToComputeNode(command, payload)
 	case ssntp.RefreshCNCI:
 		fallthrough
+	case ssntp.ProbeCNCI:
+		fallthrough
 	case ssntp.AssignPublicIP:
 		fallthrough
 	case ssntp.ReleasePublicIP:
@@ -857,8 +869,14 @@ func (sched *ssntpSchedulerServer) EventForward(uuid string, event ssntp.Event,
 
 func (sched *ssntpSchedulerServer) EventNotify(uuid string, event ssntp.Event, frame *ssntp.Frame) {
 	// Currently all events are handled by EventForward, the SSNTP command forwader,
-	// or directly by role defined forwarding rules.
+	// or directly by role defined forwarding rules. Heartbeats are answered here.
 	glog.V(2).Infof("EVENT %v from %s\n", event, uuid)
+
+	if event == ssntp.Heartbeat {
+		if _, err := sched.ssntp.SendEvent(uuid, ssntp.HeartbeatAck, frame.Payload); err != nil {
+			glog.Warningf("Unable to acknowledge heartbeat from %s: %v", uuid, err)
+		}
+	}
 }
 
 func (sched *ssntpSchedulerServer) ErrorNotify(uuid string, error ssntp.Error, frame *ssntp.Frame) {
@@ -1091,6 +1109,14 @@ func setSSNTPForwardRules(sched *ssntpSchedulerServer) {
 			Operand: ssntp.UnassignPublicIPFailure,
 			Dest:    ssntp.Controller,
 		},
+		{ // all CNCIProbeResult events go to all Controllers
+			Operand: ssntp.CNCIProbeResult,
+			Dest:    ssntp.Controller,
+		},
+		{ // all ConcentratorInstanceReady events go to all Controllers
+			Operand: ssntp.ConcentratorInstanceReady,
+			Dest:    ssntp.Controller,
+		},
 		{ // all START command are processed by the Command forwarder
 			Operand:        ssntp.START,
 			CommandForward: sched,
@@ -1135,6 +1161,10 @@ func setSSNTPForwardRules(sched *ssntpSchedulerServer) {
 			Operand:        ssntp.RefreshCNCI,
 			CommandForward: sched,
 		},
+		{ // all ProbeCNCI commands are processed by the Command forwarder
+			Operand:        ssntp.ProbeCNCI,
+			CommandForward: sched,
+		},
 	}
 }
 
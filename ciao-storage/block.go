@@ -34,6 +34,7 @@ type BlockDriver interface {
 	UnmapVolumeFromNode(volumeUUID string) error
 	GetVolumeMapping() (map[string][]string, error)
 	CopyBlockDevice(string) (BlockDevice, error)
+	ExportBlockDevice(volumeUUID string, snapshotID string, path string) error
 	GetBlockDeviceSize(volumeUUID string) (uint64, error)
 	IsValidSnapshotUUID(string) error
 	Resize(volumeUUID string, sizeGiB int) (int, error)
@@ -144,6 +144,17 @@ func (d CephDriver) CopyBlockDevice(volumeUUID string) (BlockDevice, error) {
 	return BlockDevice{ID: ID, Size: size}, nil
 }
 
+// ExportBlockDevice writes the contents of the snapshot of a volume to the
+// file at path.
+func (d CephDriver) ExportBlockDevice(volumeUUID string, snapshotID string, path string) error {
+	cmd := exec.Command("rbd", "--id", d.ID, "export", volumeUUID+"@"+snapshotID, path)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Error when running: %v: %v: %s", cmd.Args, err, out)
+	}
+	return nil
+}
+
 // DeleteBlockDevice will remove a rbd image from the ceph cluster.
 func (d CephDriver) DeleteBlockDevice(volumeUUID string) error {
 	cmd := exec.Command("rbd", "--id", d.ID, "rm", volumeUUID)
@@ -16,6 +16,7 @@ package storage
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"sync/atomic"
 
@@ -47,6 +48,15 @@ func (d *NoopDriver) CopyBlockDevice(string) (BlockDevice, error) {
 	return BlockDevice{ID: uuid.Generate().String()}, nil
 }
 
+// ExportBlockDevice pretends to export a block device by creating an empty file.
+func (d *NoopDriver) ExportBlockDevice(volumeUUID string, snapshotID string, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 // DeleteBlockDevice pretends to delete a block device.
 func (d *NoopDriver) DeleteBlockDevice(string) error {
 	return nil
@@ -55,6 +55,6 @@ func init() {
 
 	rootCmd.AddCommand(attachCmd)
 
-	attachVolCmd.Flags().StringVar(&volAttachFlags.mode, "mode", "rw", "Access mode")
+	attachVolCmd.Flags().StringVar(&volAttachFlags.mode, "mode", "rw", "Access mode (rw or ro)")
 	attachVolCmd.Flags().StringVar(&volAttachFlags.mountpoint, "mountpoint", "/mnt", "Mount point ")
 }
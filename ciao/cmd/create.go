@@ -48,6 +48,7 @@ var instanceFlags = struct {
 
 var tenantFlags = struct {
 	cidrPrefixSize             int
+	subnet                     string
 	name                       string
 	createPrivilegedContainers bool
 }{}
@@ -175,6 +176,10 @@ var tenantCreateCmd = &cobra.Command{
 			return errors.New("Subnet prefix must be 12-30")
 		}
 
+		if tenantFlags.cidrPrefixSize != 0 && tenantFlags.subnet != "" {
+			return errors.New("Only one of subnet and CIDR prefix size may be set")
+		}
+
 		tuuid, err := uuid.Parse(tenantID)
 		if err != nil {
 			return errors.New("Tenant ID must be a UUID")
@@ -183,6 +188,7 @@ var tenantCreateCmd = &cobra.Command{
 		config := types.TenantConfig{
 			Name:       tenantFlags.name,
 			SubnetBits: tenantFlags.cidrPrefixSize,
+			Subnet:     tenantFlags.subnet,
 		}
 		config.Permissions.PrivilegedContainers = tenantFlags.createPrivilegedContainers
 
@@ -396,4 +402,5 @@ func init() {
 	tenantCreateCmd.Flags().IntVar(&tenantFlags.cidrPrefixSize, "cidr-prefix-size", 0, "Number of bits in network mask (12-30)")
 	tenantCreateCmd.Flags().BoolVar(&tenantFlags.createPrivilegedContainers, "create-privileged-containers", false, "Whether this tenant can create privileged containers")
 	tenantCreateCmd.Flags().StringVar(&tenantFlags.name, "name", "", "Tenant name")
+	tenantCreateCmd.Flags().StringVar(&tenantFlags.subnet, "subnet", "", "Tenant subnet in CIDR notation")
 }
@@ -78,6 +78,10 @@ var tenantUpdateCmd = &cobra.Command{
 			return errors.New("Subnet prefix must be 12-30")
 		}
 
+		if tenantFlags.cidrPrefixSize != 0 && tenantFlags.subnet != "" {
+			return errors.New("Only one of subnet and CIDR prefix size may be set")
+		}
+
 		tuuid, err := uuid.Parse(tenantID)
 		if err != nil {
 			return errors.New("Tenant ID must be a UUID")
@@ -86,6 +90,7 @@ var tenantUpdateCmd = &cobra.Command{
 		config := types.TenantConfig{
 			Name:       tenantFlags.name,
 			SubnetBits: tenantFlags.cidrPrefixSize,
+			Subnet:     tenantFlags.subnet,
 		}
 		config.Permissions.PrivilegedContainers = tenantFlags.createPrivilegedContainers
 
@@ -101,6 +106,7 @@ func init() {
 	tenantUpdateCmd.Flags().IntVar(&tenantFlags.cidrPrefixSize, "cidr-prefix-size", 0, "Number of bits in network mask (12-30)")
 	tenantUpdateCmd.Flags().BoolVar(&tenantFlags.createPrivilegedContainers, "create-privileged-containers", false, "Whether this tenant can create privileged containers")
 	tenantUpdateCmd.Flags().StringVar(&tenantFlags.name, "name", "", "Tenant name")
+	tenantUpdateCmd.Flags().StringVar(&tenantFlags.subnet, "subnet", "", "Tenant subnet in CIDR notation")
 
 	rootCmd.AddCommand(updateCmd)
 }
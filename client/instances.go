@@ -22,6 +22,7 @@ import (
 	"net/http"
 
 	"github.com/ciao-project/ciao/ciao-controller/api"
+	"github.com/ciao-project/ciao/ciao-controller/types"
 	"github.com/pkg/errors"
 )
 
@@ -68,6 +69,22 @@ func (client *Client) StartInstance(instanceID string) error {
 	return client.instanceAction(instanceID, "os-start")
 }
 
+// CreateWorkloadFromInstance creates a workload from the given stopped
+// instance, its boot volume being captured into an image
+func (client *Client) CreateWorkloadFromInstance(instanceID string, name string) (types.Workload, error) {
+	var response types.WorkloadResponse
+
+	url := client.buildCiaoURL("%s/instances/%s/action", client.TenantID, instanceID)
+
+	request := struct {
+		CreateWorkload api.CreateWorkloadAction `json:"create_workload"`
+	}{api.CreateWorkloadAction{Name: name}}
+
+	err := client.postResource(url, api.InstancesV1, &request, &response)
+
+	return response.Workload, err
+}
+
 // ListInstancesByWorkload provides the list of instances for a given tenant and workloadID.
 func (client *Client) ListInstancesByWorkload(tenantID string, workloadID string) (api.Servers, error) {
 	var servers api.Servers
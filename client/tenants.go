@@ -145,6 +145,11 @@ func (client *Client) UpdateTenantConfig(ID string, config types.TenantConfig) e
 		config.Name = oldconfig.Name
 	}
 
+	// an explicit subnet is kept unless the subnet bits are changed
+	if config.Subnet == "" && config.SubnetBits == 0 {
+		config.Subnet = oldconfig.Subnet
+	}
+
 	if config.SubnetBits == 0 {
 		config.SubnetBits = oldconfig.SubnetBits
 	}
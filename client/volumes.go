@@ -19,6 +19,7 @@ package client
 import (
 	"github.com/ciao-project/ciao/ciao-controller/api"
 	"github.com/ciao-project/ciao/ciao-controller/types"
+	"github.com/pkg/errors"
 )
 
 // CreateVolume creates a volume from a request
@@ -64,9 +65,14 @@ func (client *Client) AttachVolume(volumeID string, instanceID, mountPoint strin
 	type AttachRequest struct {
 		MountPoint   string `json:"mountpoint"`
 		Mode         string `json:"mode"`
+		ReadOnly     bool   `json:"read_only,omitempty"`
 		InstanceUUID string `json:"instance_uuid"`
 	}
 
+	if mode != "" && mode != "rw" && mode != "ro" {
+		return errors.Errorf("Invalid access mode %q", mode)
+	}
+
 	// mountpoint or mode isn't required
 	var attachReq = struct {
 		Attach AttachRequest `json:"attach"`
@@ -74,6 +80,7 @@ func (client *Client) AttachVolume(volumeID string, instanceID, mountPoint strin
 		Attach: AttachRequest{
 			MountPoint:   mountPoint,
 			Mode:         mode,
+			ReadOnly:     mode == "ro",
 			InstanceUUID: instanceID,
 		},
 	}
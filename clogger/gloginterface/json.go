@@ -0,0 +1,121 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package gloginterface
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Levels of the log lines written by CiaoJSONLogger.
+const (
+	LevelInfo    = "info"
+	LevelWarning = "warning"
+	LevelError   = "error"
+	LevelFatal   = "fatal"
+)
+
+// jsonMutex serialises the log lines written by all the CiaoJSONLoggers
+// so that they are not interleaved.
+var jsonMutex sync.Mutex
+
+// CiaoJSONLogger is a type that writes each log line as a JSON object for
+// the CiaoLog interface. The verbosity is still controlled by glog's -v
+// flag so that both loggers can be switched between freely.
+type CiaoJSONLogger struct {
+	// Out is where the log lines are written, os.Stderr if nil.
+	Out io.Writer
+
+	// Fields are structured fields added to every log line. They cannot
+	// override the level, timestamp, message and caller of the line, nor
+	// the fields of the line itself.
+	Fields map[string]interface{}
+}
+
+// V returns true if the given argument is less than or equal
+// to glog's verbosity level.
+func (l CiaoJSONLogger) V(level int32) bool {
+	return bool(glog.V(glog.Level(level)))
+}
+
+// Infof writes informational output as JSON.
+func (l CiaoJSONLogger) Infof(format string, v ...interface{}) {
+	l.Output(1, LevelInfo, fmt.Sprintf(format, v...), nil)
+}
+
+// Warningf writes warning output as JSON.
+func (l CiaoJSONLogger) Warningf(format string, v ...interface{}) {
+	l.Output(1, LevelWarning, fmt.Sprintf(format, v...), nil)
+}
+
+// Errorf writes error output as JSON.
+func (l CiaoJSONLogger) Errorf(format string, v ...interface{}) {
+	l.Output(1, LevelError, fmt.Sprintf(format, v...), nil)
+}
+
+// Fatalf writes fatal output as JSON and exits with the status used by glog.
+func (l CiaoJSONLogger) Fatalf(format string, v ...interface{}) {
+	l.Output(1, LevelFatal, fmt.Sprintf(format, v...), nil)
+	os.Exit(255)
+}
+
+// Output writes msg as a JSON object at the given level along with the
+// structured fields of the line. depth is the number of stack frames to
+// skip when identifying the caller, 0 being the caller of Output.
+func (l CiaoJSONLogger) Output(depth int, level, msg string, fields map[string]interface{}) {
+	entry := make(map[string]interface{}, len(l.Fields)+len(fields)+4)
+	for k, v := range l.Fields {
+		entry[k] = v
+	}
+	for k, v := range fields {
+		entry[k] = v
+	}
+
+	entry["level"] = level
+	entry["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["message"] = msg
+	if _, file, line, ok := runtime.Caller(depth + 1); ok {
+		entry["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"level":     LevelError,
+			"timestamp": entry["timestamp"],
+			"message":   fmt.Sprintf("unable to marshal log line %q: %v", msg, err),
+		})
+	}
+	data = append(data, '\n')
+
+	out := l.Out
+	if out == nil {
+		out = os.Stderr
+	}
+
+	jsonMutex.Lock()
+	_, _ = out.Write(data)
+	jsonMutex.Unlock()
+}
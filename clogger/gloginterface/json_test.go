@@ -0,0 +1,85 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package gloginterface
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCiaoJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+
+	l := CiaoJSONLogger{
+		Out: &buf,
+		Fields: map[string]interface{}{
+			"component": "test",
+			"level":     "overridden",
+		},
+	}
+
+	l.Infof("info %d", 1)
+	l.Warningf("warning %d", 2)
+	l.Errorf("error %d", 3)
+
+	expected := []struct {
+		level   string
+		message string
+	}{
+		{LevelInfo, "info 1"},
+		{LevelWarning, "warning 2"},
+		{LevelError, "error 3"},
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines got %d: %s", len(expected), len(lines), buf.String())
+	}
+
+	for i, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid log line %s: %v", line, err)
+		}
+
+		if entry["level"] != expected[i].level || entry["message"] != expected[i].message {
+			t.Errorf("Unexpected log line %s", line)
+		}
+
+		if entry["component"] != "test" {
+			t.Errorf("Field missing from %s", line)
+		}
+
+		if caller, _ := entry["caller"].(string); !strings.HasPrefix(caller, "json_test.go:") {
+			t.Errorf("Unexpected caller in %s", line)
+		}
+
+		ts, _ := entry["timestamp"].(string)
+		if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+			t.Errorf("Invalid timestamp in %s: %v", line, err)
+		}
+	}
+
+	buf.Reset()
+	l.Output(0, LevelInfo, "fields", map[string]interface{}{"component": "line", "id": 1})
+	if !strings.Contains(buf.String(), `"component":"line"`) || !strings.Contains(buf.String(), `"id":1`) {
+		t.Errorf("Line fields missing from %s", buf.String())
+	}
+}
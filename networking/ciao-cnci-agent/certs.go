@@ -0,0 +1,92 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+
+	"github.com/ciao-project/ciao/ssntp"
+	"github.com/pkg/errors"
+)
+
+//readCertFile reads a PEM encoded certificate file. The errors name the
+//file and why it cannot be used.
+func readCertFile(desc, p string) ([]byte, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", desc)
+	}
+	if info.IsDir() {
+		return nil, errors.Errorf("%s %s is a directory", desc, p)
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", desc)
+	}
+
+	if block, _ := pem.Decode(data); block == nil {
+		return nil, errors.Errorf("%s %s does not contain PEM data", desc, p)
+	}
+
+	return data, nil
+}
+
+//loadCertificates checks the CA and client certificates on disk and returns
+//the client certificate. The certificates have to be checked before dialing
+//as the SSNTP library treats unusable certificates as fatal.
+func loadCertificates(caPath, certPath string) (*x509.Certificate, error) {
+	caPEM, err := readCertFile("CA certificate", caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !x509.NewCertPool().AppendCertsFromPEM(caPEM) {
+		return nil, errors.Errorf("CA certificate %s does not contain a valid certificate", caPath)
+	}
+
+	certPEM, err := readCertFile("certificate", certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	//The client certificate file also holds the private key
+	pair, err := tls.X509KeyPair(certPEM, certPEM)
+	if err != nil {
+		return nil, errors.Wrapf(err, "certificate %s", certPath)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	return cert, errors.Wrapf(err, "certificate %s", certPath)
+}
+
+//loadSSNTPConfig builds the SSNTP configuration from the certificates
+//currently on disk
+func loadSSNTPConfig() (*ssntp.Config, *x509.Certificate, error) {
+	cert, err := loadCertificates(serverCertPath, clientCertPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &ssntp.Config{UUID: agentUUID, URI: serverURL, CAcert: serverCertPath, Cert: clientCertPath,
+		Log: ssntp.Log, Rand: cnciRand}
+	return cfg, cert, nil
+}
@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ciao-project/ciao/testutil"
+)
+
+// Tests that reloading the SSNTP configuration picks up a rotated
+// certificate
+//
+// The client certificate is replaced on disk between two loads. An
+// invalid certificate must be rejected so that the current one is kept.
+//
+// Test is expected to pass with the second load returning the new
+// certificate
+func TestLoadSSNTPConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cnci-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	savedServerCertPath, savedClientCertPath := serverCertPath, clientCertPath
+	defer func() {
+		serverCertPath, clientCertPath = savedServerCertPath, savedClientCertPath
+	}()
+
+	serverCertPath = path.Join(dir, "CAcert.pem")
+	clientCertPath = path.Join(dir, "cert.pem")
+
+	writeCert := func(p, cert string) {
+		if err := ioutil.WriteFile(p, []byte(cert), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeCert(serverCertPath, testutil.TestCACert)
+	writeCert(clientCertPath, testutil.TestCertCNCIAgent)
+
+	cfg, first, err := loadSSNTPConfig()
+	if err != nil {
+		t.Fatalf("unable to load certificates %v", err)
+	}
+	if cfg.CAcert != serverCertPath || cfg.Cert != clientCertPath {
+		t.Errorf("unexpected certificate paths %s %s", cfg.CAcert, cfg.Cert)
+	}
+
+	writeCert(clientCertPath, testutil.TestCertNetAgent)
+
+	_, second, err := loadSSNTPConfig()
+	if err != nil {
+		t.Fatalf("unable to reload certificates %v", err)
+	}
+
+	if bytes.Equal(first.Raw, second.Raw) {
+		t.Errorf("reload did not pick up the new certificate")
+	}
+
+	writeCert(clientCertPath, "not a certificate")
+
+	if _, _, err := loadSSNTPConfig(); err == nil {
+		t.Errorf("invalid certificate accepted")
+	}
+}
+
+// Tests that unusable certificates are reported with the offending file
+//
+// Test is expected to pass with each error naming the bad file
+func TestLoadCertificatesErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cnci-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	files := map[string]string{
+		"ca.pem":     testutil.TestCACert,
+		"cert.pem":   testutil.TestCertCNCIAgent,
+		"nopem.pem":  "not a certificate",
+		"nokey.pem":  testutil.TestCACert,
+		"badpem.pem": "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		ca   string
+		cert string
+		bad  string
+	}{
+		{"missing.pem", "cert.pem", "missing.pem"},
+		{"ca.pem", "missing.pem", "missing.pem"},
+		{".", "cert.pem", dir},
+		{"nopem.pem", "cert.pem", "nopem.pem"},
+		{"badpem.pem", "cert.pem", "badpem.pem"},
+		{"ca.pem", "nopem.pem", "nopem.pem"},
+		{"ca.pem", "nokey.pem", "nokey.pem"},
+	}
+
+	for _, test := range tests {
+		_, err := loadCertificates(path.Join(dir, test.ca), path.Join(dir, test.cert))
+		if err == nil {
+			t.Errorf("%s %s: expected error", test.ca, test.cert)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.bad) {
+			t.Errorf("%s %s: error does not name %s: %v", test.ca, test.cert, test.bad, err)
+		}
+	}
+
+	if _, err := loadCertificates(path.Join(dir, "ca.pem"), path.Join(dir, "cert.pem")); err != nil {
+		t.Errorf("valid certificates rejected %v", err)
+	}
+}
@@ -17,26 +17,28 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/x509"
 	"flag"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/ciao-project/ciao/clogger/gloginterface"
-	"github.com/ciao-project/ciao/networking/libsnnet"
 	"github.com/ciao-project/ciao/payloads"
 	"github.com/ciao-project/ciao/ssntp"
+	"github.com/ciao-project/ciao/uuid"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 
 	"github.com/golang/glog"
 )
@@ -46,9 +48,25 @@ var serverCertPath string
 var clientCertPath string
 var computeNet string
 var mgmtNet string
+var computeIface string
+var addrFamily string
 var enableNetwork bool
 var enableNATssh bool
 var agentUUID string
+var gracePeriod time.Duration
+var healthInterval time.Duration
+var metricsAddr string
+var bridgeIngressRate uint64
+var bridgeEgressRate uint64
+var topologyFile string
+var heartbeatInterval time.Duration
+var noConfigDrive bool
+var lockDir string
+var interfacesDir string
+var keepNetwork bool
+var logJSON bool
+var cmdQueueSize int
+var cmdQueueTimeout time.Duration
 
 func init() {
 	flag.StringVar(&serverURL, "server", "", "URL of SSNTP server, Use auto for auto discovery")
@@ -56,23 +74,89 @@ func init() {
 	flag.StringVar(&clientCertPath, "cert", "/var/lib/ciao/cert-client-localhost.pem", "CA certificate")
 	flag.StringVar(&computeNet, "compute-net", "", "Compute Subnet")
 	flag.StringVar(&mgmtNet, "mgmt-net", "", "Management Subnet")
+	flag.StringVar(&computeIface, "compute-iface", "", "Compute interface, e.g. a bond, when multiple interfaces exist")
+	flag.StringVar(&addrFamily, "addr-family", "ipv4", "Address family of the management and compute networks: ipv4, ipv6 or both")
 	flag.BoolVar(&enableNetwork, "network", true, "Enable networking")
 	flag.BoolVar(&enableNATssh, "ssh", true, "Enable NAT and SSH")
 	flag.StringVar(&agentUUID, "uuid", "", "UUID the CNCI Agent should use. Autogenerated otherwise")
+	flag.BoolVar(&noConfigDrive, "no-config-drive", false, "Do not mount the config drive to discover the UUID")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve metrics and debug information on, e.g. :9090. Disabled if empty")
+	flag.DurationVar(&healthInterval, "health-interval", time.Minute, "Interval between tunnel health checks")
+	flag.Uint64Var(&bridgeIngressRate, "bridge-ingress-rate", 0, "Per tenant subnet ingress rate limit in bits/s, 0 is unlimited")
+	flag.Uint64Var(&bridgeEgressRate, "bridge-egress-rate", 0, "Per tenant subnet egress rate limit in bits/s, 0 is unlimited")
+	flag.StringVar(&topologyFile, "topology-file", "", "File the network topology is saved to for faster recovery on restart. Disabled if empty")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", 30*time.Second, "Interval between heartbeats sent to the scheduler, 0 disables them")
+	flag.DurationVar(&gracePeriod, "grace-period", 10*time.Second, "Time to wait for in-flight commands to complete on shutdown")
+	flag.StringVar(&lockDir, "lock-dir", defaultLockDir, "Directory holding the lock preventing several agents from running")
+	flag.StringVar(&interfacesDir, "interfaces-dir", defaultInterfacesDir, "Directory holding the network interfaces state")
+	flag.BoolVar(&logJSON, "log-json", false, "Write the logs to stderr as JSON objects rather than in the glog format")
+	flag.BoolVar(&keepNetwork, "keep-network", false, "Keep the DHCP servers and tenant links running when the agent exits")
+	flag.IntVar(&cmdQueueSize, "cmd-queue-size", 64, "Number of commands from the scheduler which may be queued for processing")
+	flag.DurationVar(&cmdQueueTimeout, "cmd-queue-timeout", 5*time.Second, "Time to wait for room in a full command queue before failing a public IP command or probe")
 }
 
+//The log directory is set with the glog log_dir flag, logDir is
+//used when it is not set
 const (
-	lockDir       = "/tmp/lock/ciao"
-	logDir        = "/var/lib/ciao/logs/cnci-agent"
-	lockFile      = "cnci-agent.lock"
-	interfacesDir = "/var/lib/ciao/network/interfaces"
+	defaultLockDir       = "/tmp/lock/ciao"
+	logDir               = "/var/lib/ciao/logs/cnci-agent"
+	lockFile             = "cnci-agent.lock"
+	defaultInterfacesDir = "/var/lib/ciao/network/interfaces"
 )
 
 var cnciRand io.Reader
 
+var errCmdQueueFull = errors.New("command queue full")
+
+//cmdWrapper wraps a command received from the server together with
+//the labels used to correlate the log lines emitted while processing it
 type cmdWrapper struct {
-	cmd interface{}
+	id     string //request ID, the trace label of the originating frame if any
+	tenant string //tenant the command applies to, if known
+	cmd    interface{}
+}
+
+//frameID returns the ID used to label the processing of a frame.
+//The trace label is used when the sender provided one, otherwise a
+//short random ID is generated.
+func frameID(frame *ssntp.Frame) string {
+	if frame != nil && frame.Trace != nil && len(frame.Trace.Label) > 0 {
+		return string(frame.Trace.Label)
+	}
+	return uuid.Generate().String()[:8]
 }
+
+func (c *cmdWrapper) logPrefix() string {
+	if c.tenant == "" {
+		return fmt.Sprintf("[%s] ", c.id)
+	}
+	return fmt.Sprintf("[%s tenant=%s] ", c.id, c.tenant)
+}
+
+//output logs msg on behalf of the caller of infof or errorf. The
+//request ID and tenant are structured fields of the JSON logs, they
+//prefix the message otherwise.
+func (c *cmdWrapper) output(level string, msg string) {
+	if jsonLogger == nil {
+		logDepth(2, level, c.logPrefix()+msg)
+		return
+	}
+
+	fields := map[string]interface{}{"request_id": c.id}
+	if c.tenant != "" {
+		fields["tenant"] = c.tenant
+	}
+	jsonLogger.Output(2, level, msg, fields)
+}
+
+func (c *cmdWrapper) infof(format string, args ...interface{}) {
+	c.output(gloginterface.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (c *cmdWrapper) errorf(format string, args ...interface{}) {
+	c.output(gloginterface.LevelError, fmt.Sprintf(format, args...))
+}
+
 type statusConnected struct{}
 
 type ssntpConn struct {
@@ -95,37 +179,113 @@ func (s *ssntpConn) setStatus(status bool) {
 
 type agentClient struct {
 	ssntpConn
-	db    *cnciDatabase
-	cmdCh chan *cmdWrapper
+	db        *cnciDatabase
+	cmdCh     chan *cmdWrapper
+	connects  uint32
+	heartbeat *heartbeater //nil if heartbeats are disabled
 }
 
 func (client *agentClient) DisconnectNotify() {
 	client.setStatus(false)
-	glog.Warning("disconnected")
+	logWarningf("disconnected")
 }
 
 func (client *agentClient) ConnectNotify() {
+	if atomic.AddUint32(&client.connects, 1) > 1 {
+		metrics.reconnects.inc()
+	}
 	client.setStatus(true)
-	client.cmdCh <- &cmdWrapper{&statusConnected{}}
-	glog.Info("connected")
+	if client.heartbeat != nil {
+		client.heartbeat.ack()
+	}
+	client.queue(&cmdWrapper{cmd: &statusConnected{}})
+	logInfof("connected")
+}
+
+//queue hands cmd over to the command loop. The SSNTP notifications are
+//delivered from the receive path of the connection, which must never
+//block, so the wait for room in a full command queue happens in the
+//background. Commands which can be failed back to the sender are shed
+//once cmdQueueTimeout expires, the others wait for as long as it takes.
+func (client *agentClient) queue(cmd *cmdWrapper) {
+	select {
+	case client.cmdCh <- cmd:
+		return
+	default:
+	}
+
+	metrics.commandQueueFull.inc()
+
+	if !cmd.sheddable() {
+		go func() {
+			client.cmdCh <- cmd
+		}()
+		return
+	}
+
+	go func() {
+		timer := time.NewTimer(cmdQueueTimeout)
+		defer timer.Stop()
+
+		select {
+		case client.cmdCh <- cmd:
+		case <-timer.C:
+			client.shed(cmd)
+		}
+	}()
+}
+
+//sheddable reports whether cmd may be dropped when the command queue
+//remains full. The controller is told about the public IP commands
+//which are dropped and times out the probes. The registration and the
+//tenant events, which are already saved to the database, may not be
+//dropped or the CNCI would never catch up with the controller.
+func (c *cmdWrapper) sheddable() bool {
+	switch c.cmd.(type) {
+	case *payloads.CommandAssignPublicIP, *payloads.CommandReleasePublicIP,
+		*payloads.CommandCNCIProbe:
+		return true
+	}
+	return false
+}
+
+//shed drops cmd, replying with a failure to the public IP commands so
+//that the controller does not wait for them forever
+func (client *agentClient) shed(cmd *cmdWrapper) {
+	metrics.commandsDropped.inc()
+	cmd.errorf("Command queue full, dropping command")
+
+	var err error
+	switch c := cmd.cmd.(type) {
+	case *payloads.CommandAssignPublicIP:
+		err = sendNetworkError(&client.ssntpConn, ssntp.AssignPublicIPFailure,
+			&publicIPError{cmd: &c.AssignIP, cause: errCmdQueueFull})
+	case *payloads.CommandReleasePublicIP:
+		err = sendNetworkError(&client.ssntpConn, ssntp.UnassignPublicIPFailure,
+			&publicIPError{cmd: &c.ReleaseIP, cause: errCmdQueueFull})
+	}
+
+	if err != nil {
+		cmd.errorf("Unable to send failure : %+v", err)
+	}
 }
 
 func (client *agentClient) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
-	glog.Infof("STATUS %s", status)
+	logInfof("STATUS %s", status)
 }
 
 func (client *agentClient) ErrorNotify(err ssntp.Error, frame *ssntp.Frame) {
-	glog.Infof("ERROR %v", err)
+	logInfof("ERROR %v", err)
 }
 
-func getLock() error {
-	err := os.MkdirAll(lockDir, 0777)
+func getLock(dir string) error {
+	err := createDir(dir, 0777)
 	if err != nil {
-		return errors.Wrapf(err, "unable to create lockdir %s", lockDir)
+		return errors.Wrapf(err, "unable to create lockdir %s", dir)
 	}
 
 	/* We're going to let the OS close and unlock this fd */
-	lockPath := path.Join(lockDir, lockFile)
+	lockPath := path.Join(dir, lockFile)
 	fd, err := syscall.Open(lockPath, syscall.O_CREAT, syscall.S_IWUSR|syscall.S_IRUSR)
 	if err != nil {
 		return errors.Wrapf(err, "unable to open lock file %v", lockPath)
@@ -133,265 +293,405 @@ func getLock() error {
 
 	syscall.CloseOnExec(fd)
 
-	if syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB) != nil {
-		errors.Wrapf(err, "cnci agent is already running. Exiting.")
+	err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		_ = syscall.Close(fd)
+		return errors.Errorf("cnci agent is already running, %v is locked", lockPath)
+	} else if err != nil {
+		_ = syscall.Close(fd)
+		return errors.Wrapf(err, "unable to lock %v", lockPath)
+	}
+
+	return nil
+}
+
+//createDir creates dir unless it exists and checks that the agent
+//may write to it
+func createDir(dir string, perm os.FileMode) error {
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+
+	if err := unix.Access(dir, unix.W_OK); err != nil {
+		return errors.Wrapf(err, "%s is not writable", dir)
 	}
 
 	return nil
 }
 
 /* Must be called after flag.Parse() */
-func initLogger() error {
+func initLogger(defaultDir string) error {
 	logDirFlag := flag.Lookup("log_dir")
 	if logDirFlag == nil {
 		return errors.Errorf("log_dir does not exist")
 	}
 
 	if logDirFlag.Value.String() == "" {
-		err := logDirFlag.Value.Set(logDir)
+		err := logDirFlag.Value.Set(defaultDir)
 		if err != nil {
 			return errors.Wrapf(err, "logger init")
 		}
 	}
 
-	if err := os.MkdirAll(logDirFlag.Value.String(), 0755); err != nil {
-		return errors.Wrapf(err, "unable to create log directory (%s)", logDir)
+	dir := logDirFlag.Value.String()
+	if err := createDir(dir, 0755); err != nil {
+		return errors.Wrapf(err, "unable to create log directory (%s)", dir)
 	}
 
 	return nil
 }
 
-func createMandatoryDirs() error {
-	if err := os.MkdirAll(interfacesDir, 0755); err != nil {
+func createMandatoryDirs(interfacesDir string) error {
+	if err := createDir(interfacesDir, 0755); err != nil {
 		return errors.Wrapf(err, "unable to create interfaces directory (%s)",
 			interfacesDir)
 	}
 	return nil
 }
 
-func processRefreshCNCI(cmd *payloads.CommandCNCIRefresh) {
-	c := &cmd.Command
-	glog.Infof("Processing: CiaoCommandCNCIRefresh %v", c)
+func processRefreshCNCI(cmd *cmdWrapper, refresh *payloads.CommandCNCIRefresh) {
+	c := &refresh.Command
+	cmd.infof("Processing: CiaoCommandCNCIRefresh %v", c)
 
 	// add call to function to refresh cnci.
 	err := refreshCNCI(c)
 	if err != nil {
-		glog.Errorf("Unable to refresh CNCI list: %v", err)
+		metrics.commandErrors.inc()
+		cmd.errorf("Unable to refresh CNCI list: %v", err)
 	}
 }
 
-func processCommand(client *ssntpConn, cmd *cmdWrapper) {
+func processCommand(client *ssntpConn, db *cnciDatabase, cmd *cmdWrapper) {
 
 	switch netCmd := cmd.cmd.(type) {
 
 	case *payloads.EventTenantAdded:
 
+		inflight.start(cmd, "TenantAdded")
 		go func(cmd *cmdWrapper) {
+			defer inflight.done(cmd)
 			c := &netCmd.TenantAdded
-			glog.Infof("Processing: CiaoEventTenantAdded %v", c)
+			cmd.infof("Processing: CiaoEventTenantAdded %v", c)
 			err := addRemoteSubnet(c)
 			if err != nil {
-				glog.Errorf("Error Processing: CiaoEventTenantAdded %+v", err)
+				metrics.commandErrors.inc()
+				cmd.errorf("Error Processing: CiaoEventTenantAdded %+v", err)
+			} else {
+				metrics.subnetsAdded.inc()
 			}
 		}(cmd)
 
 	case *payloads.EventTenantRemoved:
 
+		inflight.start(cmd, "TenantRemoved")
 		go func(cmd *cmdWrapper) {
+			defer inflight.done(cmd)
 			c := &netCmd.TenantRemoved
-			glog.Infof("Processing: CiaoEventTenantRemoved %v", c)
+			cmd.infof("Processing: CiaoEventTenantRemoved %v", c)
 			err := delRemoteSubnet(c)
 
 			if err != nil {
-				glog.Errorf("Error Processing: CiaoEventTenantRemoved %+v", err)
+				metrics.commandErrors.inc()
+				cmd.errorf("Error Processing: CiaoEventTenantRemoved %+v", err)
+			} else {
+				metrics.subnetsRemoved.inc()
 			}
 		}(cmd)
 
 	case *payloads.CommandAssignPublicIP:
 
+		inflight.start(cmd, "AssignPublicIP")
 		go func(cmd *cmdWrapper) {
+			defer inflight.done(cmd)
 			c := &netCmd.AssignIP
-			glog.Infof("Processing: CiaoCommandAssignPublicIP %v", c)
-			err := assignPubIP(c)
+			cmd.infof("Processing: CiaoCommandAssignPublicIP %v", c)
+			dup, err := dbApplyPublicIPCommand(db, netCmd, func() error {
+				return assignPubIP(c)
+			})
+			if dup {
+				cmd.infof("Duplicate CiaoCommandAssignPublicIP %v", c.PublicIP)
+			}
 			if err != nil {
-				glog.Errorf("Error Processing: CiaoCommandAssignPublicIP %+v", err)
-				err = sendNetworkError(client, ssntp.AssignPublicIPFailure, c)
+				if !dup {
+					metrics.commandErrors.inc()
+				}
+				cmd.errorf("Error Processing: CiaoCommandAssignPublicIP %+v", err)
+				err = sendNetworkError(client, ssntp.AssignPublicIPFailure,
+					&publicIPError{cmd: c, cause: err})
 			} else {
+				if !dup {
+					metrics.publicIPAssigned.inc()
+				}
 				err = sendNetworkEvent(client, ssntp.PublicIPAssigned, c)
 			}
 
 			if err != nil {
-				glog.Errorf("Unable to send event : %+v", err)
+				cmd.errorf("Unable to send event : %+v", err)
 			}
 		}(cmd)
 
 	case *payloads.CommandReleasePublicIP:
 
+		inflight.start(cmd, "ReleasePublicIP")
 		go func(cmd *cmdWrapper) {
+			defer inflight.done(cmd)
 			c := &netCmd.ReleaseIP
-			glog.Infof("Processing: CiaoCommandReleasePublicIP %v", c)
-			err := releasePubIP(c)
+			cmd.infof("Processing: CiaoCommandReleasePublicIP %v", c)
+			dup, err := dbApplyPublicIPCommand(db, netCmd, func() error {
+				return releasePubIP(c)
+			})
+			if dup {
+				cmd.infof("Duplicate CiaoCommandReleasePublicIP %v", c.PublicIP)
+			}
 			if err != nil {
-				glog.Errorf("Error Processing: CiaoCommandReleasePublicIP %+v", c)
-				err = sendNetworkError(client, ssntp.UnassignPublicIPFailure, c)
+				if !dup {
+					metrics.commandErrors.inc()
+				}
+				cmd.errorf("Error Processing: CiaoCommandReleasePublicIP %+v", err)
+				err = sendNetworkError(client, ssntp.UnassignPublicIPFailure,
+					&publicIPError{cmd: c, cause: err})
 			} else {
+				if !dup {
+					metrics.publicIPReleased.inc()
+				}
 				err = sendNetworkEvent(client, ssntp.PublicIPUnassigned, c)
 			}
 
 			if err != nil {
-				glog.Errorf("Unable to send event : %+v", err)
+				cmd.errorf("Unable to send event : %+v", err)
 			}
 		}(cmd)
 
 	case *payloads.CommandCNCIRefresh:
 
-		go processRefreshCNCI(netCmd)
+		inflight.start(cmd, "RefreshCNCI")
+		go func(cmd *cmdWrapper) {
+			defer inflight.done(cmd)
+			processRefreshCNCI(cmd, netCmd)
+		}(cmd)
+
+	case *payloads.CommandCNCIProbe:
+
+		inflight.start(cmd, "ProbeCNCI")
+		go func(cmd *cmdWrapper) {
+			defer inflight.done(cmd)
+			c := &netCmd.Probe
+			cmd.infof("Processing: CiaoCommandCNCIProbe %v", c)
+			result := probeCNCI(c)
+			err := sendNetworkEvent(client, ssntp.CNCIProbeResult, result)
+			if err != nil {
+				cmd.errorf("Unable to send event : %+v", err)
+			}
+		}(cmd)
 
 	case *statusConnected:
 		//Block and send this as it does not make sense to send other events
-		//or process commands when we have not yet registered
-		glog.Infof("Processing: status connected")
+		//or process commands when we have not yet registered. The CNCI is
+		//only registered once its network is configured so that traffic is
+		//not routed to a half configured CNCI
+		status := waitNetworkReady()
+		logInfof("Processing: status connected")
 		err := sendNetworkEvent(client, ssntp.ConcentratorInstanceAdded, nil)
 		if err != nil {
-			glog.Errorf("Unable to register : %+v", err)
+			logErrorf("Unable to register : %+v", err)
+			break
+		}
+
+		if status.degraded() {
+			logWarningf("Network degraded, failed subnets %v public IPs %v",
+				status.failedSubnets, status.failedPublicIPs)
+		}
+		err = sendNetworkEvent(client, ssntp.ConcentratorInstanceReady, status)
+		if err != nil {
+			logErrorf("Unable to send ready : %+v", err)
 		}
 
 	default:
-		glog.Errorf("Processing unknown command")
+		cmd.errorf("Processing unknown command")
 
 	}
 }
 
 func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame) {
 	payload := frame.Payload
+	id := frameID(frame)
 
 	switch cmd {
 	case ssntp.AssignPublicIP:
-		glog.Infof("CMD: ssntp.AssignPublicIP %v", len(payload))
-
-		go func(payload []byte) {
-			var assignIP payloads.CommandAssignPublicIP
-			err := yaml.Unmarshal(payload, &assignIP)
-			if err != nil {
-				glog.Warning("Error unmarshalling StartFailure")
-				return
-			}
-			glog.Infof("EVENT: ssntp.AssignPublicIP %v", assignIP)
+		logInfof("[%s] CMD: ssntp.AssignPublicIP %v", id, len(payload))
 
-			err = dbProcessCommand(client.db, &assignIP)
-			if err != nil {
-				glog.Errorf("unable to save state %+v", err)
-			}
+		var assignIP payloads.CommandAssignPublicIP
+		err := yaml.Unmarshal(payload, &assignIP)
+		if err != nil {
+			logWarningf("[%s] Error unmarshalling AssignPublicIP", id)
+			return
+		}
+		w := &cmdWrapper{id: id, tenant: assignIP.AssignIP.TenantUUID, cmd: &assignIP}
+		w.infof("CMD: ssntp.AssignPublicIP %v", assignIP)
 
-			client.cmdCh <- &cmdWrapper{&assignIP}
-		}(payload)
+		client.queue(w)
 
 	case ssntp.ReleasePublicIP:
-		glog.Infof("CMD: ssntp.ReleasePublicIP %v", len(payload))
-
-		go func(payload []byte) {
-			var releaseIP payloads.CommandReleasePublicIP
-			err := yaml.Unmarshal(payload, &releaseIP)
-			if err != nil {
-				glog.Warning("Error unmarshalling StartFailure")
-				return
-			}
-			glog.Infof("EVENT: ssntp.ReleasePublicIP %s", releaseIP)
+		logInfof("[%s] CMD: ssntp.ReleasePublicIP %v", id, len(payload))
 
-			err = dbProcessCommand(client.db, &releaseIP)
-			if err != nil {
-				glog.Errorf("unable to save state %+v", err)
-			}
+		var releaseIP payloads.CommandReleasePublicIP
+		err := yaml.Unmarshal(payload, &releaseIP)
+		if err != nil {
+			logWarningf("[%s] Error unmarshalling ReleasePublicIP", id)
+			return
+		}
+		w := &cmdWrapper{id: id, tenant: releaseIP.ReleaseIP.TenantUUID, cmd: &releaseIP}
+		w.infof("CMD: ssntp.ReleasePublicIP %v", releaseIP)
 
-			client.cmdCh <- &cmdWrapper{&releaseIP}
-		}(payload)
+		client.queue(w)
 
 	case ssntp.RefreshCNCI:
-		glog.Infof("CMD: ssntp.RefreshCNCI %v", len(payload))
+		logInfof("[%s] CMD: ssntp.RefreshCNCI %v", id, len(payload))
 
-		go func(payload []byte) {
-			var refreshCNCI payloads.CommandCNCIRefresh
+		var refreshCNCI payloads.CommandCNCIRefresh
 
-			err := yaml.Unmarshal(payload, &refreshCNCI)
-			if err != nil {
-				glog.Warning("Error unmarshalling CNCI refresh")
-				return
-			}
-			glog.Infof("CMD: ssntp.RefreshCNCI %v", refreshCNCI)
+		err := yaml.Unmarshal(payload, &refreshCNCI)
+		if err != nil {
+			logWarningf("[%s] Error unmarshalling CNCI refresh", id)
+			return
+		}
+		w := &cmdWrapper{id: id, cmd: &refreshCNCI}
+		w.infof("CMD: ssntp.RefreshCNCI %v", refreshCNCI)
+
+		client.queue(w)
 
-			client.cmdCh <- &cmdWrapper{&refreshCNCI}
-		}(payload)
+	case ssntp.ProbeCNCI:
+		logInfof("[%s] CMD: ssntp.ProbeCNCI %v", id, len(payload))
+
+		var probeCNCI payloads.CommandCNCIProbe
+
+		err := yaml.Unmarshal(payload, &probeCNCI)
+		if err != nil {
+			logWarningf("[%s] Error unmarshalling CNCI probe", id)
+			return
+		}
+		w := &cmdWrapper{id: id, cmd: &probeCNCI}
+		w.infof("CMD: ssntp.ProbeCNCI %v", probeCNCI)
+
+		client.queue(w)
 
 	default:
-		glog.Infof("CMD: %s", cmd)
+		logInfof("[%s] CMD: %s", id, cmd)
 	}
 }
 
 func (client *agentClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 	payload := frame.Payload
+	id := frameID(frame)
 
 	switch event {
 	case ssntp.TenantAdded:
-		glog.Infof("EVENT: ssntp.TenantAdded %v", len(payload))
+		logInfof("[%s] EVENT: ssntp.TenantAdded %v", id, len(payload))
 
-		go func(payload []byte) {
-			var tenantAdded payloads.EventTenantAdded
-			err := yaml.Unmarshal(payload, &tenantAdded)
-			if err != nil {
-				glog.Warning("Error unmarshalling StartFailure")
-				return
-			}
-			glog.Infof("EVENT: ssntp.TenantAdded %s", tenantAdded)
+		var tenantAdded payloads.EventTenantAdded
+		err := yaml.Unmarshal(payload, &tenantAdded)
+		if err != nil {
+			logWarningf("[%s] Error unmarshalling TenantAdded", id)
+			return
+		}
+		w := &cmdWrapper{id: id, tenant: tenantAdded.TenantAdded.TenantUUID, cmd: &tenantAdded}
+		w.infof("EVENT: ssntp.TenantAdded %v", tenantAdded)
 
-			err = dbProcessCommand(client.db, &tenantAdded)
-			if err != nil {
-				glog.Errorf("unable to save state %+v", err)
-			}
+		err = dbProcessCommand(client.db, &tenantAdded)
+		if err != nil {
+			w.errorf("unable to save state %+v", err)
+		}
 
-			client.cmdCh <- &cmdWrapper{&tenantAdded}
-		}(payload)
+		client.queue(w)
 
 	case ssntp.TenantRemoved:
-		glog.Infof("EVENT: ssntp.TenantRemoved %v", len(payload))
+		logInfof("[%s] EVENT: ssntp.TenantRemoved %v", id, len(payload))
 
-		go func(payload []byte) {
-			var tenantRemoved payloads.EventTenantRemoved
-			err := yaml.Unmarshal(payload, &tenantRemoved)
-			if err != nil {
-				glog.Warning("Error unmarshalling StartFailure")
-				return
-			}
-			glog.Infof("EVENT: ssntp.TenantRemoved %s", tenantRemoved)
+		var tenantRemoved payloads.EventTenantRemoved
+		err := yaml.Unmarshal(payload, &tenantRemoved)
+		if err != nil {
+			logWarningf("[%s] Error unmarshalling TenantRemoved", id)
+			return
+		}
+		w := &cmdWrapper{id: id, tenant: tenantRemoved.TenantRemoved.TenantUUID, cmd: &tenantRemoved}
+		w.infof("EVENT: ssntp.TenantRemoved %v", tenantRemoved)
 
-			err = dbProcessCommand(client.db, &tenantRemoved)
-			if err != nil {
-				glog.Errorf("unable to save state %+v", err)
-			}
+		err = dbProcessCommand(client.db, &tenantRemoved)
+		if err != nil {
+			w.errorf("unable to save state %+v", err)
+		}
+
+		client.queue(w)
 
-			client.cmdCh <- &cmdWrapper{&tenantRemoved}
-		}(payload)
+	case ssntp.HeartbeatAck:
+		if glog.V(2) {
+			logInfof("[%s] EVENT: ssntp.HeartbeatAck", id)
+		}
+		if client.heartbeat != nil {
+			client.heartbeat.ack()
+		}
 
 	default:
-		glog.Infof("EVENT %s", event)
+		logInfof("[%s] EVENT %s", id, event)
 	}
 }
 
-func connectToServer(db *cnciDatabase, doneCh chan struct{}, statusCh chan struct{}) {
+func connectToServer(db *cnciDatabase, doneCh chan struct{}, reloadCh <-chan struct{}, statusCh chan struct{}) {
 
 	defer func() {
 		statusCh <- struct{}{}
 	}()
 
-	cfg := &ssntp.Config{UUID: agentUUID, URI: serverURL, CAcert: serverCertPath, Cert: clientCertPath,
-		Log: ssntp.Log, Rand: cnciRand}
-	client := &agentClient{db: db, cmdCh: make(chan *cmdWrapper)}
+	cfg, cert, err := loadSSNTPConfig()
+	if err != nil {
+		logErrorf("Unable to load certificates %+v", err)
+		return
+	}
+
+	//The command channel outlives the connections so that the commands
+	//received before a reload are still processed
+	cmdCh := make(chan *cmdWrapper, cmdQueueSize)
+
+	for cfg != nil {
+		logInfof("Connecting with certificate %v serial %v", cert.Subject.CommonName, cert.SerialNumber)
+		cfg, cert = serveConnection(db, cfg, cmdCh, doneCh, reloadCh)
+	}
+}
+
+//serveConnection dials the scheduler and processes its commands until the
+//agent quits or the certificates are reloaded. It returns the configuration
+//to redial with if the certificates have been reloaded, nil otherwise.
+//The network state is left untouched across reloads.
+func serveConnection(db *cnciDatabase, cfg *ssntp.Config, cmdCh chan *cmdWrapper,
+	doneCh chan struct{}, reloadCh <-chan struct{}) (*ssntp.Config, *x509.Certificate) {
+
+	client := &agentClient{db: db, cmdCh: cmdCh}
+
+	connDoneCh := make(chan struct{})
+	defer close(connDoneCh)
+
+	if heartbeatInterval > 0 {
+		client.heartbeat = &heartbeater{
+			interval:  heartbeatInterval,
+			connected: client.isConnected,
+			send: func() error {
+				_, err := client.SendEvent(ssntp.Heartbeat, nil)
+				return err
+			},
+			lost: func() {
+				client.setStatus(false)
+				client.Reconnect()
+			},
+		}
+		go client.heartbeat.run(connDoneCh)
+	}
 
 	dialCh := make(chan error)
 
 	go func() {
 		err := client.Dial(cfg, client)
 		if err != nil {
-			glog.Errorf("Unable to connect to server %v", err)
+			logErrorf("Unable to connect to server %v", err)
 			dialCh <- err
 			return
 		}
@@ -400,16 +700,37 @@ func connectToServer(db *cnciDatabase, doneCh chan struct{}, statusCh chan struc
 	}()
 
 	dialing := true
+	quitting := false
+	var next *ssntp.Config
+	var nextCert *x509.Certificate
 
 DONE:
 	for {
 		select {
 		case err := <-dialCh:
 			dialing = false
-			if err != nil {
+			if err != nil || quitting || next != nil {
 				break DONE
 			}
 		case <-doneCh:
+			quitting = true
+			client.Close()
+			if !dialing {
+				break DONE
+			}
+			//Stop selecting the closed channel until the dial completes
+			doneCh = nil
+		case <-reloadCh:
+			if next != nil {
+				continue
+			}
+			reloaded, reloadedCert, err := loadSSNTPConfig()
+			if err != nil {
+				logErrorf("Unable to reload certificates, keeping the current ones %+v", err)
+				continue
+			}
+			logInfof("Certificates reloaded, reconnecting")
+			next, nextCert = reloaded, reloadedCert
 			client.Close()
 			if !dialing {
 				break DONE
@@ -423,62 +744,53 @@ DONE:
 			select {
 			case <-doneCh:
 				client.Close()
+				quitting = true
 				break DONE
 			default:
 			}
-			glog.Infof("cmd channel: %v", cmd)
-			processCommand(&client.ssntpConn, cmd)
+			logInfof("cmd channel: %v", cmd)
+			processCommand(&client.ssntpConn, client.db, cmd)
 		}
 	}
-}
-
-//Try to discover the scheduler automatically if needed
-func discoverScheduler() error {
 
-	if serverURL != "auto" {
-		return nil
+	if quitting {
+		return nil, nil
 	}
-
-	serverURL = ""
-	return nil
-
+	return next, nextCert
 }
 
-//CloudInitJSON represents the contents of the cloud init file
-type CloudInitJSON struct {
-	UUID     string `json:"uuid"`
-	Hostname string `json:"hostname"`
+//networkStatus is the outcome of the rebuild of the network state
+type networkStatus struct {
+	failedSubnets   []string
+	failedPublicIPs []string
 }
 
-//Try to discover the UUID automatically if needed
-func discoverUUID() (string, error) {
-
-	//TODO: Do this via systemd
-	out, err := exec.Command("mount", "/dev/vdb", "/media").Output()
-	if err != nil {
-		//Ignore this error, we may be already mounted
-		glog.Errorf("Unable to mount /dev/vdb %v %s", err, string(out))
-	}
+func (s *networkStatus) degraded() bool {
+	return len(s.failedSubnets) > 0 || len(s.failedPublicIPs) > 0
+}
 
-	payload, err := ioutil.ReadFile("/media/openstack/latest/meta_data.json")
-	if err != nil {
-		return "", errors.Wrapf(err, "Unable to read /media/openstack/latest/meta_data.json %v")
-	}
+//netReadyCh is closed, and netStatus set, once the network state has
+//been rebuilt. The CNCI does not register with the scheduler before.
+var netReadyCh = make(chan struct{})
+var netStatus networkStatus
 
-	metaData := &CloudInitJSON{}
-	err = json.Unmarshal(payload, metaData)
-	if err != nil {
-		return "", errors.Wrapf(err, "Unable to read UUID from /media/openstack/latest/meta_data.json")
-	}
+func setNetworkReady(status networkStatus) {
+	netStatus = status
+	close(netReadyCh)
+}
 
-	return metaData.UUID, nil
+func waitNetworkReady() *networkStatus {
+	<-netReadyCh
+	return &netStatus
 }
 
-//Rebuild network state from database
-func rebuildNetworkState(db *cnciDatabase) error {
+//Rebuild network state from database. The subnets and public IPs which
+//could not be reprogrammed are reported in the status
+func rebuildNetworkState(db *cnciDatabase) (networkStatus, error) {
 	var lastError error
+	var status networkStatus
 	if db == nil {
-		return nil
+		return status, nil
 	}
 
 	db.SubnetMap.Lock()
@@ -487,67 +799,86 @@ func rebuildNetworkState(db *cnciDatabase) error {
 	defer db.PublicIPMap.Unlock()
 
 	for key, subnet := range db.SubnetMap.m {
-		glog.Infof("Key: %v Subnet: %v", key, subnet)
+		logInfof("Key: %v Subnet: %v", key, subnet)
 		err := addRemoteSubnet(subnet)
 		if err != nil {
 			lastError = err
-			glog.Errorf("rebuildNetworkState: %v", err)
+			status.failedSubnets = append(status.failedSubnets, subnet.TenantSubnet)
+			logErrorf("rebuildNetworkState: %v", err)
 		}
 	}
 
 	for key, publicIP := range db.PublicIPMap.m {
-		glog.Infof("Key: %v PublicIP: %v", key, publicIP)
+		logInfof("Key: %v PublicIP: %v", key, publicIP)
 		err := assignPubIP(publicIP)
 		if err != nil {
 			lastError = err
-			glog.Errorf("rebuildNetworkState: %v", err)
+			status.failedPublicIPs = append(status.failedPublicIPs, publicIP.PublicIP)
+			logErrorf("rebuildNetworkState: %v", err)
 		}
 	}
 
-	return errors.Wrapf(lastError, "rebuild network state")
+	sort.Strings(status.failedSubnets)
+	sort.Strings(status.failedPublicIPs)
+
+	return status, errors.Wrapf(lastError, "rebuild network state")
 }
 
 func main() {
 
-	if getLock() != nil {
+	flag.Parse()
+
+	if err := getLock(lockDir); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
 
-	flag.Parse()
-
-	libsnnet.Logger = gloginterface.CiaoGlogLogger{}
+	initLogFormat(logJSON)
 
-	if err := initLogger(); err != nil {
+	if err := initLogger(logDir); err != nil {
 		log.Fatalf("Unable to initialise logs: %+v", err)
 	}
 
-	glog.Info("Starting CNCI Agent")
+	logInfof("Starting CNCI Agent")
+
+	if cmdQueueSize < 0 {
+		logFatalf("Invalid command queue size %d", cmdQueueSize)
+	}
+
+	//Catch deployment mistakes early, the SSNTP library only reports
+	//unusable certificates when dialing
+	if _, err := loadCertificates(serverCertPath, clientCertPath); err != nil {
+		logFatalf("Invalid SSNTP certificates: %v", err)
+	}
 
-	if err := createMandatoryDirs(); err != nil {
-		glog.Fatalf("Unable to create mandatory dirs: %+v", err)
+	if err := createMandatoryDirs(interfacesDir); err != nil {
+		logFatalf("Unable to create mandatory dirs: %+v", err)
 	}
 
 	if err := discoverScheduler(); err != nil {
-		glog.Fatalf("Unable to auto discover scheduler: %+v", err)
+		logFatalf("Unable to auto discover scheduler: %+v", err)
 	}
-	glog.Errorf("Scheduler address %v", serverURL)
+	logErrorf("Scheduler address %v", serverURL)
 
-	if agentUUID == "" {
-		agentUUID, _ = discoverUUID()
+	if id, err := discoverUUID(agentUUID, !noConfigDrive); err != nil {
+		logErrorf("Unable to discover UUID: %+v", err)
+	} else {
+		agentUUID = id
 	}
-	glog.Errorf("CNCI Agent: UUID : %v", agentUUID)
+	logErrorf("CNCI Agent: UUID : %v", agentUUID)
 
 	doneCh := make(chan struct{})
 	statusCh := make(chan struct{})
 	signalCh := make(chan os.Signal, 1)
 	timeoutCh := make(chan struct{})
 	wdogCh := make(chan struct{})
+	reloadCh := make(chan struct{}, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	//TODO: Wait till the node gets an IP address before we kick this off
 	//TODO: Add a IP address change notifier to handle potential IP address change
 	if err := initNetwork(signalCh); err != nil {
-		glog.Fatalf("Unable to setup network. %+v", err)
+		logFatalf("Unable to setup network. %+v", err)
 	}
 
 	//Recover the state from the database and then
@@ -555,38 +886,57 @@ func main() {
 	//Has to be done prior to accepting commands over the network
 	db, err := dbInit()
 	if err != nil {
-		glog.Fatalf("Unable to setup database. %+v", err)
+		logFatalf("Unable to setup database. %+v", err)
 	}
 
-	if err := rebuildNetworkState(db); err != nil {
-		glog.Errorf("Unable to rebuild network state. %+v", err)
+	status, err := rebuildNetworkState(db)
+	if err != nil {
+		logErrorf("Unable to rebuild network state. %+v", err)
 	}
+	setNetworkReady(status)
 
-	go connectToServer(db, doneCh, statusCh)
+	if metricsAddr != "" {
+		go serveMetrics(metricsAddr, db)
+	}
+
+	go connectToServer(db, doneCh, reloadCh, statusCh)
 
 	//Prime the watchdog
 	go func() {
 		wdogCh <- struct{}{}
 	}()
 
+	healthTicker := time.NewTicker(healthInterval)
+	defer healthTicker.Stop()
+
 DONE:
 	for {
 		select {
-		case <-signalCh:
-			glog.Info("Received terminating signal.  Waiting for server loop to quit")
+		case sig := <-signalCh:
+			if sig == syscall.SIGHUP {
+				logInfof("Received SIGHUP, reloading certificates")
+				select {
+				case reloadCh <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			logInfof("Received terminating signal.  Waiting for server loop to quit")
 			close(doneCh)
 			go func() {
 				time.Sleep(time.Second)
 				timeoutCh <- struct{}{}
 			}()
 		case <-statusCh:
-			glog.Info("Server Loop quit cleanly")
+			logInfof("Server Loop quit cleanly")
 			break DONE
 		case <-timeoutCh:
-			glog.Warning("Server Loop did not exit within 1 second quitting")
+			logWarningf("Server Loop did not exit within 1 second quitting")
 			break DONE
+		case <-healthTicker.C:
+			go checkTunnels()
 		case <-wdogCh:
-			glog.Info("Watchdog kicker")
+			logInfof("Watchdog kicker")
 			go func() {
 				//TODO: Add software watchdog to CNCI VM
 				time.Sleep(5 * time.Second)
@@ -595,6 +945,21 @@ DONE:
 		}
 	}
 
+	//Give the commands being processed a chance to complete so that
+	//we do not leave the network half configured
+	pending := inflight.wait(gracePeriod)
+	for _, cmd := range pending {
+		logWarningf("%s did not complete within %v, its state may be inconsistent", cmd, gracePeriod)
+	}
+
+	//Tearing down the network under the feet of the pending commands
+	//would leave it in an unknown state, leave it to the next agent
+	if len(pending) > 0 {
+		logWarningf("Commands still in flight, network not shut down")
+	} else if err := shutdownNetwork(); err != nil {
+		logErrorf("Unable to shut down network: %v", err)
+	}
+
 	glog.Flush()
-	glog.Info("Exit")
+	logInfof("Exit")
 }
@@ -0,0 +1,317 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+func TestGetLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cnci-agent-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	if err := getLock(dir); err != nil {
+		t.Fatalf("Unable to acquire lock %v", err)
+	}
+
+	err = getLock(dir)
+	if err == nil {
+		t.Fatal("Second agent acquired the lock")
+	}
+
+	if !strings.Contains(err.Error(), "already running") {
+		t.Fatalf("Unexpected error %v", err)
+	}
+}
+
+func TestCreateMandatoryDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cnci-agent-dirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	interfaces := path.Join(dir, "network", "interfaces")
+	if err := createMandatoryDirs(interfaces); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := os.Stat(interfaces); err != nil || !fi.IsDir() {
+		t.Fatalf("%s not created %v", interfaces, err)
+	}
+
+	//A directory cannot be created under a regular file
+	file := path.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, create := range []func(string) error{createMandatoryDirs, getLock, initLogger} {
+		err = create(path.Join(file, "sub"))
+		if err == nil || !strings.Contains(err.Error(), file) {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+}
+
+func TestInitLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cnci-agent-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	logDirFlag := flag.Lookup("log_dir")
+	saved := logDirFlag.Value.String()
+	defer func() { _ = logDirFlag.Value.Set(saved) }()
+
+	if err := logDirFlag.Value.Set(""); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := path.Join(dir, "logs")
+	if err := initLogger(logs); err != nil {
+		t.Fatal(err)
+	}
+
+	if logDirFlag.Value.String() != logs {
+		t.Fatalf("Expected log_dir %s got %s", logs, logDirFlag.Value.String())
+	}
+
+	if _, err := os.Stat(logs); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func floodCommands(t *testing.T, client *agentClient, n int) {
+	payload, err := yaml.Marshal(&payloads.CommandCNCIProbe{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			client.CommandNotify(ssntp.ProbeCNCI, &ssntp.Frame{Payload: payload})
+		}
+		client.EventNotify(ssntp.HeartbeatAck, &ssntp.Frame{})
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(10 * time.Second):
+		t.Fatal("SSNTP notifications blocked by the command queue")
+	}
+}
+
+// Tests that a flood of commands does not block the SSNTP notifications
+//
+// Test is expected to pass with the commands which do not fit in the
+// command queue dropped once the queue timeout expires
+func TestCommandQueueFlood(t *testing.T) {
+	saved := cmdQueueTimeout
+	cmdQueueTimeout = 10 * time.Millisecond
+	defer func() { cmdQueueTimeout = saved }()
+
+	const size = 4
+	const flood = 20
+
+	client := &agentClient{cmdCh: make(chan *cmdWrapper, size)}
+	dropped := atomic.LoadUint64(&metrics.commandsDropped.value)
+
+	floodCommands(t, client, flood)
+
+	waitDropped(t, dropped, flood-size)
+
+	if len(client.cmdCh) != size {
+		t.Errorf("Expected %d queued commands got %d", size, len(client.cmdCh))
+	}
+}
+
+//waitDropped waits for n commands to be dropped in the background
+func waitDropped(t *testing.T, dropped uint64, n int) {
+	timeout := time.After(10 * time.Second)
+	for atomic.LoadUint64(&metrics.commandsDropped.value)-dropped < uint64(n) {
+		select {
+		case <-timeout:
+			t.Fatalf("Expected %d dropped commands got %d", n,
+				atomic.LoadUint64(&metrics.commandsDropped.value)-dropped)
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if d := atomic.LoadUint64(&metrics.commandsDropped.value) - dropped; d != uint64(n) {
+		t.Errorf("Expected %d dropped commands got %d", n, d)
+	}
+}
+
+// Tests that commands wait for room in a full command queue
+//
+// Test is expected to pass with all the commands delivered to a slow
+// command loop and none dropped
+func TestCommandQueueBackpressure(t *testing.T) {
+	saved := cmdQueueTimeout
+	cmdQueueTimeout = 5 * time.Second
+	defer func() { cmdQueueTimeout = saved }()
+
+	const flood = 20
+
+	client := &agentClient{cmdCh: make(chan *cmdWrapper, 2)}
+	dropped := atomic.LoadUint64(&metrics.commandsDropped.value)
+	full := atomic.LoadUint64(&metrics.commandQueueFull.value)
+
+	receivedCh := make(chan int)
+	go func() {
+		received := 0
+		for i := 0; i < flood; i++ {
+			select {
+			case <-client.cmdCh:
+				received++
+				time.Sleep(time.Millisecond)
+			case <-time.After(10 * time.Second):
+			}
+		}
+		receivedCh <- received
+	}()
+
+	floodCommands(t, client, flood)
+
+	if received := <-receivedCh; received != flood {
+		t.Errorf("Expected %d commands got %d", flood, received)
+	}
+
+	if atomic.LoadUint64(&metrics.commandsDropped.value) != dropped {
+		t.Error("Commands dropped despite room in the command queue")
+	}
+
+	if atomic.LoadUint64(&metrics.commandQueueFull.value) == full {
+		t.Error("Command queue never found full")
+	}
+}
+
+// Tests the commands received while the command loop waits for the
+// network to be ready before registering the CNCI
+//
+// Test is expected to pass with the SSNTP notifications not blocked, the
+// public IP commands shed and the registration and tenant events all
+// delivered to the command loop once the network is ready
+func TestCommandQueueNetworkNotReady(t *testing.T) {
+	savedTimeout := cmdQueueTimeout
+	cmdQueueTimeout = 10 * time.Millisecond
+	savedReadyCh := netReadyCh
+	netReadyCh = make(chan struct{})
+	defer func() {
+		cmdQueueTimeout = savedTimeout
+		netReadyCh = savedReadyCh
+	}()
+
+	const tenants = 5
+	const publicIPs = 5
+
+	mem := &memDb{tables: make(map[string]map[string]interface{})}
+	db := &cnciDatabase{DbProvider: mem}
+	db.SubnetMap.m = make(map[string]*payloads.TenantAddedEvent)
+	client := &agentClient{db: db, cmdCh: make(chan *cmdWrapper, 2)}
+	dropped := atomic.LoadUint64(&metrics.commandsDropped.value)
+
+	//The command loop blocks in waitNetworkReady while processing the
+	//registration and then hands over the commands it receives
+	cmdCh := make(chan *cmdWrapper)
+	go func() {
+		cmd := <-client.cmdCh
+		if _, ok := cmd.cmd.(*statusConnected); !ok {
+			t.Errorf("Expected registration got %T", cmd.cmd)
+		}
+		processCommand(&client.ssntpConn, client.db, cmd)
+		for cmd := range client.cmdCh {
+			cmdCh <- cmd
+		}
+	}()
+
+	//Registering fails without a connection, as the test expects
+	client.queue(&cmdWrapper{cmd: &statusConnected{}})
+	for len(client.cmdCh) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		for i := 0; i < tenants; i++ {
+			payload, err := yaml.Marshal(&payloads.EventTenantAdded{
+				TenantAdded: payloads.TenantAddedEvent{
+					TenantUUID:   "tenant",
+					TenantSubnet: fmt.Sprintf("192.168.%d.0/24", i),
+				},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			client.EventNotify(ssntp.TenantAdded, &ssntp.Frame{Payload: payload})
+		}
+
+		payload, err := yaml.Marshal(&payloads.CommandAssignPublicIP{})
+		if err != nil {
+			t.Error(err)
+		}
+		for i := 0; i < publicIPs; i++ {
+			client.CommandNotify(ssntp.AssignPublicIP, &ssntp.Frame{Payload: payload})
+		}
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatal("SSNTP notifications blocked by the command loop")
+	}
+
+	waitDropped(t, dropped, publicIPs)
+
+	if len(db.SubnetMap.m) != tenants {
+		t.Errorf("Expected %d saved subnets got %d", tenants, len(db.SubnetMap.m))
+	}
+
+	close(netReadyCh)
+
+	for i := 0; i < tenants; i++ {
+		select {
+		case cmd := <-cmdCh:
+			if _, ok := cmd.cmd.(*payloads.EventTenantAdded); !ok {
+				t.Errorf("Expected tenant event got %T", cmd.cmd)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Expected %d tenant events got %d", tenants, i)
+		}
+	}
+}
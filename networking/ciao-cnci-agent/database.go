@@ -25,7 +25,14 @@ import (
 	"github.com/pkg/errors"
 )
 
-// cnciDatabase
+// cnciDatabase holds the state of the CNCI persisted across restarts.
+//
+// The maps are only accessed with their lock held, the SubnetMap being
+// locked first when both are needed. The locks are not held while commands
+// are applied, except by rebuildNetworkState which runs before any command
+// is processed. The commands on a public IP are serialized, and saved, by
+// dbApplyPublicIPCommand so that its saved state follows the order in which
+// they are applied.
 type cnciDatabase struct {
 	database.DbProvider //Database used to persist the CNCI state
 	SubnetMap
@@ -86,7 +93,17 @@ func (d *SubnetMap) Add(k string, v interface{}) error {
 //PublicIPMap maintains the list of active Public IP handled by this CNCI
 type PublicIPMap struct {
 	sync.Mutex
-	m map[string]*payloads.PublicIPCommand //index: PublicIP
+	m        map[string]*payloads.PublicIPCommand //index: PublicIP
+	inflight map[string]*publicIPOp               //index: PublicIP
+}
+
+//publicIPOp is a public IP assignment or release being processed
+type publicIPOp struct {
+	assign bool
+	cmd    payloads.PublicIPCommand
+	dups   int //duplicate commands waiting for the result
+	done   chan struct{}
+	err    error
 }
 
 //NewTable creates a new map
@@ -119,6 +136,7 @@ func dbInit() (*cnciDatabase, error) {
 	db.DbProvider = database.NewBoltDBProvider()
 	db.SubnetMap.m = make(map[string]*payloads.TenantAddedEvent)
 	db.PublicIPMap.m = make(map[string]*payloads.PublicIPCommand)
+	db.PublicIPMap.inflight = make(map[string]*publicIPOp)
 
 	if err := db.DbInit(dbCfg.DataDir, dbCfg.DbFile); err != nil {
 		return nil, errors.Wrapf(err, "db init: %v, %v", dbCfg.DataDir, dbCfg.DbFile)
@@ -193,6 +211,10 @@ func dbProcessCommand(db *cnciDatabase, cmd interface{}) error {
 		defer db.PublicIPMap.Unlock()
 
 		key := c.PublicIP
+		if _, ok := db.PublicIPMap.m[key]; !ok {
+			//Already released
+			return nil
+		}
 		delete(db.PublicIPMap.m, key)
 
 		if err := db.DbDelete(tablePublicIPMap, key); err != nil {
@@ -206,3 +228,80 @@ func dbProcessCommand(db *cnciDatabase, cmd interface{}) error {
 
 	return nil
 }
+
+//dbApplyPublicIPCommand saves the public IP assignment or release cmd to
+//the database and applies it with fn while no other command is being
+//applied to the public IP
+func dbApplyPublicIPCommand(db *cnciDatabase, cmd interface{}, fn func() error) (dup bool, err error) {
+	var c *payloads.PublicIPCommand
+	var assign bool
+
+	switch netCmd := cmd.(type) {
+	case *payloads.CommandAssignPublicIP:
+		c = &netCmd.AssignIP
+		assign = true
+	case *payloads.CommandReleasePublicIP:
+		c = &netCmd.ReleaseIP
+	default:
+		return false, errors.Errorf("unknown command: %v", cmd)
+	}
+
+	return dbPublicIPCommand(db, c, assign, func() error {
+		if db != nil {
+			if err := dbProcessCommand(db, cmd); err != nil {
+				logErrorf("Unable to save state of public IP %s %+v", c.PublicIP, err)
+			}
+		}
+		return fn()
+	})
+}
+
+//dbPublicIPCommand runs fn to assign (or release) a public IP unless the same
+//command is already being processed for that public IP. A duplicate command
+//waits for the command in flight and shares its result without running fn.
+//Different commands for the same public IP are serialized.
+func dbPublicIPCommand(db *cnciDatabase, c *payloads.PublicIPCommand,
+	assign bool, fn func() error) (dup bool, err error) {
+
+	if db == nil {
+		return false, fn()
+	}
+
+	key := c.PublicIP
+	op := &publicIPOp{assign: assign, cmd: *c, done: make(chan struct{})}
+
+	for {
+		db.PublicIPMap.Lock()
+		if db.PublicIPMap.inflight == nil {
+			db.PublicIPMap.inflight = make(map[string]*publicIPOp)
+		}
+		cur, ok := db.PublicIPMap.inflight[key]
+		if !ok {
+			db.PublicIPMap.inflight[key] = op
+		} else if cur.assign == assign && cur.cmd == *c {
+			cur.dups++
+		}
+		db.PublicIPMap.Unlock()
+
+		if !ok {
+			break
+		}
+
+		<-cur.done
+		if cur.assign == assign && cur.cmd == *c {
+			return true, cur.err
+		}
+	}
+
+	op.err = fn()
+
+	db.PublicIPMap.Lock()
+	delete(db.PublicIPMap.inflight, key)
+	if op.dups > 0 {
+		logInfof("Public IP %s command shared with %d duplicates", key, op.dups)
+	}
+	db.PublicIPMap.Unlock()
+	close(op.done)
+
+	return false, op.err
+}
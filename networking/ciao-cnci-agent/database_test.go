@@ -0,0 +1,305 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ciao-project/ciao/database"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/pkg/errors"
+)
+
+func newTestPublicIPCommand() *payloads.PublicIPCommand {
+	return &payloads.PublicIPCommand{
+		ConcentratorUUID: "concentrator",
+		TenantUUID:       "tenant",
+		InstanceUUID:     "instance",
+		PublicIP:         "198.51.100.10",
+		PrivateIP:        "192.168.0.2",
+		VnicMAC:          "02:00:00:00:00:01",
+	}
+}
+
+func waitPublicIPDups(t *testing.T, db *cnciDatabase, publicIP string, dups int) {
+	for i := 0; i < 500; i++ {
+		db.PublicIPMap.Lock()
+		op := db.PublicIPMap.inflight[publicIP]
+		n := 0
+		if op != nil {
+			n = op.dups
+		}
+		db.PublicIPMap.Unlock()
+
+		if n >= dups {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("duplicate command not detected for %s", publicIP)
+}
+
+// Tests that the same AssignPublicIP sent twice is only processed once
+//
+// The second command arrives while the first is in flight. It should be
+// recognized as a duplicate and share the result of the first one.
+//
+// Test is expected to pass with a single assignment
+func TestPublicIPDuplicateAssign(t *testing.T) {
+	db := &cnciDatabase{}
+
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	assign := func() error {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	dups := make([]bool, 2)
+	errs := make([]error, 2)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dups[0], errs[0] = dbPublicIPCommand(db, newTestPublicIPCommand(), true, assign)
+	}()
+
+	<-started
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dups[1], errs[1] = dbPublicIPCommand(db, newTestPublicIPCommand(), true, assign)
+	}()
+
+	waitPublicIPDups(t, db, newTestPublicIPCommand().PublicIP, 1)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected a single assignment got %d", n)
+	}
+
+	if dups[0] || !dups[1] {
+		t.Errorf("expected only the second command to be a duplicate %v", dups)
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("command %d failed %v", i, err)
+		}
+	}
+
+	if len(db.PublicIPMap.inflight) != 0 {
+		t.Errorf("commands still in flight %v", db.PublicIPMap.inflight)
+	}
+}
+
+// Tests that a release of a public IP being assigned is not treated as
+// a duplicate
+//
+// Test is expected to pass with the release run after the assignment
+func TestPublicIPAssignRelease(t *testing.T) {
+	db := &cnciDatabase{}
+
+	var order []string
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	done := make(chan bool)
+	go func() {
+		dup, _ := dbPublicIPCommand(db, newTestPublicIPCommand(), true, func() error {
+			close(started)
+			<-release
+			order = append(order, "assign")
+			return nil
+		})
+		done <- dup
+	}()
+
+	<-started
+
+	go func() {
+		dup, _ := dbPublicIPCommand(db, newTestPublicIPCommand(), false, func() error {
+			order = append(order, "release")
+			return nil
+		})
+		done <- dup
+	}()
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if <-done {
+			t.Errorf("unexpected duplicate command")
+		}
+	}
+
+	if len(order) != 2 || order[0] != "assign" || order[1] != "release" {
+		t.Errorf("unexpected command order %v", order)
+	}
+}
+
+// memDb is an in memory database.DbProvider
+type memDb struct {
+	sync.Mutex
+	tables map[string]map[string]interface{}
+}
+
+func (m *memDb) DbInit(dbDir, dbFile string) error           { return nil }
+func (m *memDb) DbClose() error                              { return nil }
+func (m *memDb) DbTablesInit(tables []string) error          { return nil }
+func (m *memDb) DbTableRebuild(table database.DbTable) error { return nil }
+
+func (m *memDb) DbGet(table string, key string, dbTable database.DbTable) (interface{}, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.tables[table][key], nil
+}
+
+func (m *memDb) DbGetAll(table string, dbTable database.DbTable) ([]interface{}, error) {
+	m.Lock()
+	defer m.Unlock()
+	var values []interface{}
+	for _, v := range m.tables[table] {
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (m *memDb) DbAdd(table string, key string, value interface{}) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.tables[table] == nil {
+		m.tables[table] = make(map[string]interface{})
+	}
+	m.tables[table][key] = value
+	return nil
+}
+
+func (m *memDb) DbDelete(table string, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.tables[table][key]; !ok {
+		return errors.Errorf("Key is not found: %v", key)
+	}
+	delete(m.tables[table], key)
+	return nil
+}
+
+// Tests concurrent assignments and releases of the same public IPs
+//
+// The commands are applied concurrently, as they are by processCommand,
+// and are meant to be run with the race detector.
+//
+// Test is expected to pass with the saved state of each public IP
+// matching the last command applied to it
+func TestPublicIPConcurrentAssignRelease(t *testing.T) {
+	mem := &memDb{tables: make(map[string]map[string]interface{})}
+	db := &cnciDatabase{DbProvider: mem}
+	db.PublicIPMap.NewTable()
+
+	publicIPs := []string{"198.51.100.10", "198.51.100.11"}
+
+	var fwLock sync.Mutex
+	assigned := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, ip := range publicIPs {
+			c := newTestPublicIPCommand()
+			c.PublicIP = ip
+
+			var cmd interface{} = &payloads.CommandReleasePublicIP{ReleaseIP: *c}
+			if i%2 == 0 {
+				cmd = &payloads.CommandAssignPublicIP{AssignIP: *c}
+			}
+
+			wg.Add(1)
+			go func(cmd interface{}, ip string) {
+				defer wg.Done()
+				_, assign := cmd.(*payloads.CommandAssignPublicIP)
+				_, err := dbApplyPublicIPCommand(db, cmd, func() error {
+					fwLock.Lock()
+					assigned[ip] = assign
+					fwLock.Unlock()
+					return nil
+				})
+				if err != nil {
+					t.Errorf("command on %s failed %v", ip, err)
+				}
+			}(cmd, ip)
+		}
+	}
+	wg.Wait()
+
+	db.PublicIPMap.Lock()
+	defer db.PublicIPMap.Unlock()
+
+	for _, ip := range publicIPs {
+		_, saved := db.PublicIPMap.m[ip]
+		_, persisted := mem.tables[tablePublicIPMap][ip]
+		if saved != assigned[ip] || persisted != assigned[ip] {
+			t.Errorf("%s: assigned %v but saved %v and persisted %v",
+				ip, assigned[ip], saved, persisted)
+		}
+	}
+
+	if len(db.PublicIPMap.inflight) != 0 {
+		t.Errorf("commands still in flight %v", db.PublicIPMap.inflight)
+	}
+
+	if _, err := dbApplyPublicIPCommand(db, &payloads.CommandCNCIProbe{}, nil); err == nil {
+		t.Errorf("expected an error for an unknown command")
+	}
+}
+
+// Tests that the release of a public IP which is not assigned is saved
+//
+// Test is expected to pass as releases may be repeated, e.g. when the
+// instance is deleted after its public IP was released
+func TestPublicIPReleaseUnassigned(t *testing.T) {
+	mem := &memDb{tables: make(map[string]map[string]interface{})}
+	db := &cnciDatabase{DbProvider: mem}
+	db.PublicIPMap.NewTable()
+
+	cmd := &payloads.CommandReleasePublicIP{ReleaseIP: *newTestPublicIPCommand()}
+	if err := dbProcessCommand(db, cmd); err != nil {
+		t.Fatalf("release of unassigned public IP failed %v", err)
+	}
+
+	assign := &payloads.CommandAssignPublicIP{AssignIP: *newTestPublicIPCommand()}
+	if err := dbProcessCommand(db, assign); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := dbProcessCommand(db, cmd); err != nil {
+			t.Fatalf("release %d failed %v", i, err)
+		}
+	}
+
+	if len(db.PublicIPMap.m) != 0 || len(mem.tables[tablePublicIPMap]) != 0 {
+		t.Errorf("public IP still saved %v", db.PublicIPMap.m)
+	}
+}
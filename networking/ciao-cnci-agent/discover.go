@@ -0,0 +1,152 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/ciao-project/ciao/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	configDriveDev   = "/dev/vdb"
+	configDriveMount = "/media"
+	metaDataFile     = "openstack/latest/meta_data.json"
+	dmiUUIDFile      = "/sys/class/dmi/id/product_uuid"
+)
+
+//readFile and runCommand are used by the UUID discovery methods
+//to access the system. They may be replaced for testing.
+var readFile = ioutil.ReadFile
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+//uuidMethod is a single way of discovering the UUID of the CNCI instance
+type uuidMethod struct {
+	name        string
+	discover    func() (string, error)
+	configDrive bool //the method mounts the config drive
+}
+
+//uuidMethods lists the UUID discovery methods in the order they are tried
+var uuidMethods = []uuidMethod{
+	{name: "config drive", discover: configDriveUUID, configDrive: true},
+	{name: "dmi", discover: dmiUUID},
+}
+
+//Try to discover the scheduler automatically if needed
+func discoverScheduler() error {
+
+	if serverURL != "auto" {
+		return nil
+	}
+
+	serverURL = ""
+	return nil
+
+}
+
+//CloudInitJSON represents the contents of the cloud init file
+type CloudInitJSON struct {
+	UUID     string `json:"uuid"`
+	Hostname string `json:"hostname"`
+}
+
+//configDriveUUID reads the UUID from the meta data present on the
+//config drive. If the config drive is mounted here it is unmounted
+//once the meta data has been read.
+func configDriveUUID() (string, error) {
+	out, err := runCommand("mount", configDriveDev, configDriveMount)
+	if err != nil {
+		//Ignore this error, we may be already mounted
+		logWarningf("Unable to mount %s %v %s", configDriveDev, err, string(out))
+	} else {
+		defer func() {
+			out, err := runCommand("umount", configDriveMount)
+			if err != nil {
+				logWarningf("Unable to unmount %s %v %s", configDriveMount, err, string(out))
+			}
+		}()
+	}
+
+	metaDataPath := path.Join(configDriveMount, metaDataFile)
+	payload, err := readFile(metaDataPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to read %s", metaDataPath)
+	}
+
+	metaData := &CloudInitJSON{}
+	err = json.Unmarshal(payload, metaData)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to parse %s", metaDataPath)
+	}
+
+	if _, err := uuid.Parse(metaData.UUID); err != nil {
+		return "", errors.Wrapf(err, "invalid UUID in %s", metaDataPath)
+	}
+
+	return metaData.UUID, nil
+}
+
+//dmiUUID reads the SMBIOS system UUID exposed by the kernel
+func dmiUUID() (string, error) {
+	payload, err := readFile(dmiUUIDFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to read %s", dmiUUIDFile)
+	}
+
+	id := strings.ToLower(strings.TrimSpace(string(payload)))
+	if _, err := uuid.Parse(id); err != nil {
+		return "", errors.Wrapf(err, "invalid UUID in %s", dmiUUIDFile)
+	}
+
+	return id, nil
+}
+
+//Try to discover the UUID automatically if needed
+//The UUID given, if any, is returned without touching the system.
+//Otherwise each discovery method is tried in order and the first
+//UUID found is returned. The config drive is only mounted if
+//configDrive is set.
+func discoverUUID(given string, configDrive bool) (string, error) {
+	if given != "" {
+		return given, nil
+	}
+
+	var failures []string
+
+	for _, m := range uuidMethods {
+		if m.configDrive && !configDrive {
+			continue
+		}
+
+		id, err := m.discover()
+		if err == nil {
+			logInfof("UUID %s discovered using %s", id, m.name)
+			return id, nil
+		}
+		failures = append(failures, m.name+": "+err.Error())
+	}
+
+	return "", errors.Errorf("unable to discover UUID [%s]", strings.Join(failures, "; "))
+}
@@ -0,0 +1,193 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testUUID = "67d86208-b46c-4465-9018-fe14087d415f"
+
+type fakeSystem struct {
+	files    map[string]string
+	mountErr error
+	mounted  bool
+	commands []string
+}
+
+func (f *fakeSystem) readFile(name string) ([]byte, error) {
+	data, ok := f.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return []byte(data), nil
+}
+
+func (f *fakeSystem) runCommand(name string, args ...string) ([]byte, error) {
+	f.commands = append(f.commands, name)
+
+	switch name {
+	case "mount":
+		if f.mountErr != nil {
+			return nil, f.mountErr
+		}
+		f.mounted = true
+	case "umount":
+		f.mounted = false
+	}
+	return nil, nil
+}
+
+func withFakeSystem(f *fakeSystem, test func()) {
+	savedReadFile := readFile
+	savedRunCommand := runCommand
+	defer func() {
+		readFile = savedReadFile
+		runCommand = savedRunCommand
+	}()
+
+	readFile = f.readFile
+	runCommand = f.runCommand
+	test()
+}
+
+// Tests that the UUID is read from the config drive
+//
+// Test is expected to pass and to leave the config drive unmounted
+func TestDiscoverUUIDConfigDrive(t *testing.T) {
+	f := &fakeSystem{
+		files: map[string]string{
+			"/media/openstack/latest/meta_data.json": `{"uuid":"` + testUUID + `","hostname":"cnci"}`,
+			dmiUUIDFile:                              "00000000-0000-0000-0000-000000000000\n",
+		},
+	}
+
+	withFakeSystem(f, func() {
+		id, err := discoverUUID("", true)
+		if err != nil {
+			t.Fatalf("discoverUUID failed: %v", err)
+		}
+		if id != testUUID {
+			t.Errorf("expected %s got %s", testUUID, id)
+		}
+	})
+
+	if f.mounted {
+		t.Errorf("config drive left mounted")
+	}
+}
+
+// Tests the DMI fallback when the config drive is unavailable
+//
+// Test is expected to pass and return the lower cased DMI UUID
+func TestDiscoverUUIDDMI(t *testing.T) {
+	f := &fakeSystem{
+		files: map[string]string{
+			dmiUUIDFile: strings.ToUpper(testUUID) + "\n",
+		},
+		mountErr: errors.New("no such device"),
+	}
+
+	withFakeSystem(f, func() {
+		id, err := discoverUUID("", true)
+		if err != nil {
+			t.Fatalf("discoverUUID failed: %v", err)
+		}
+		if id != testUUID {
+			t.Errorf("expected %s got %s", testUUID, id)
+		}
+	})
+}
+
+// Tests that the failures of all methods are reported
+//
+// Test is expected to return an error naming each method
+func TestDiscoverUUIDFailure(t *testing.T) {
+	f := &fakeSystem{
+		files: map[string]string{
+			dmiUUIDFile: "not-a-uuid",
+		},
+		mountErr: errors.New("no such device"),
+	}
+
+	withFakeSystem(f, func() {
+		_, err := discoverUUID("", true)
+		if err == nil {
+			t.Fatalf("discoverUUID expected to fail")
+		}
+		for _, m := range uuidMethods {
+			if !strings.Contains(err.Error(), m.name) {
+				t.Errorf("error %v does not mention %s", err, m.name)
+			}
+		}
+	})
+}
+
+// Tests that a given UUID is used as is
+//
+// Test is expected to pass without running any command
+func TestDiscoverUUIDGiven(t *testing.T) {
+	f := &fakeSystem{
+		files: map[string]string{
+			dmiUUIDFile: "00000000-0000-0000-0000-000000000000\n",
+		},
+	}
+
+	withFakeSystem(f, func() {
+		id, err := discoverUUID(testUUID, true)
+		if err != nil {
+			t.Fatalf("discoverUUID failed: %v", err)
+		}
+		if id != testUUID {
+			t.Errorf("expected %s got %s", testUUID, id)
+		}
+	})
+
+	if len(f.commands) != 0 {
+		t.Errorf("unexpected commands %v", f.commands)
+	}
+}
+
+// Tests that the config drive is skipped when disabled
+//
+// Test is expected to pass, return the DMI UUID and never mount the
+// config drive
+func TestDiscoverUUIDNoConfigDrive(t *testing.T) {
+	f := &fakeSystem{
+		files: map[string]string{
+			"/media/openstack/latest/meta_data.json": `{"uuid":"00000000-0000-0000-0000-000000000000","hostname":"cnci"}`,
+			dmiUUIDFile:                              testUUID + "\n",
+		},
+	}
+
+	withFakeSystem(f, func() {
+		id, err := discoverUUID("", false)
+		if err != nil {
+			t.Fatalf("discoverUUID failed: %v", err)
+		}
+		if id != testUUID {
+			t.Errorf("expected %s got %s", testUUID, id)
+		}
+	})
+
+	if len(f.commands) != 0 || f.mounted {
+		t.Errorf("config drive mounted %v", f.commands)
+	}
+}
@@ -0,0 +1,78 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//heartbeatMisses is the number of consecutive heartbeats which may go
+//unacknowledged before the scheduler is considered gone
+const heartbeatMisses = 3
+
+//heartbeater periodically checks the liveness of the scheduler. The
+//connection is declared lost when the scheduler stops acknowledging
+//the heartbeats even though the transport is still up.
+type heartbeater struct {
+	interval  time.Duration
+	pending   uint32 //heartbeats sent and not yet acknowledged
+	connected func() bool
+	send      func() error
+	lost      func()
+}
+
+//ack records the acknowledgement of the heartbeats sent so far
+func (h *heartbeater) ack() {
+	atomic.StoreUint32(&h.pending, 0)
+}
+
+//tick sends the next heartbeat unless too many heartbeats have gone
+//unacknowledged, in which case the connection is declared lost
+func (h *heartbeater) tick() {
+	if !h.connected() {
+		h.ack()
+		return
+	}
+
+	if missed := atomic.LoadUint32(&h.pending); missed >= heartbeatMisses {
+		logWarningf("Scheduler unresponsive, %d heartbeats unacknowledged", missed)
+		h.ack()
+		h.lost()
+		return
+	}
+
+	atomic.AddUint32(&h.pending, 1)
+	if err := h.send(); err != nil {
+		logWarningf("Unable to send heartbeat %v", err)
+	}
+}
+
+//run sends heartbeats until doneCh is closed
+func (h *heartbeater) run(doneCh <-chan struct{}) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-doneCh:
+			return
+		case <-ticker.C:
+			h.tick()
+		}
+	}
+}
@@ -0,0 +1,104 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestHeartbeater(connected *bool, sent *int, lost *int) *heartbeater {
+	return &heartbeater{
+		interval:  time.Millisecond,
+		connected: func() bool { return *connected },
+		send: func() error {
+			*sent++
+			return nil
+		},
+		lost: func() {
+			*lost++
+			*connected = false
+		},
+	}
+}
+
+func TestHeartbeatAcknowledged(t *testing.T) {
+	connected := true
+	var sent, lost int
+	h := newTestHeartbeater(&connected, &sent, &lost)
+
+	for i := 0; i < 2*heartbeatMisses; i++ {
+		h.tick()
+		h.ack()
+	}
+
+	if sent != 2*heartbeatMisses || lost != 0 {
+		t.Fatalf("Expected %d heartbeats and no loss, got %d and %d", 2*heartbeatMisses, sent, lost)
+	}
+}
+
+func TestHeartbeatMissed(t *testing.T) {
+	connected := true
+	var sent, lost int
+	h := newTestHeartbeater(&connected, &sent, &lost)
+
+	for i := 0; i < heartbeatMisses; i++ {
+		h.tick()
+	}
+	if lost != 0 {
+		t.Fatalf("Connection declared lost after %d heartbeats", heartbeatMisses)
+	}
+
+	h.tick()
+	if lost != 1 || connected {
+		t.Fatalf("Connection not declared lost after %d missed heartbeats", heartbeatMisses)
+	}
+
+	//No heartbeats are sent while disconnected
+	h.tick()
+	if sent != heartbeatMisses || lost != 1 {
+		t.Fatalf("Unexpected heartbeat activity while disconnected %d %d", sent, lost)
+	}
+
+	//Heartbeats resume on reconnection
+	connected = true
+	h.tick()
+	if sent != heartbeatMisses+1 {
+		t.Fatalf("Heartbeats not resumed on reconnection")
+	}
+}
+
+func TestHeartbeatStop(t *testing.T) {
+	h := &heartbeater{
+		interval:  time.Millisecond,
+		connected: func() bool { return false },
+	}
+
+	doneCh := make(chan struct{})
+	stoppedCh := make(chan struct{})
+	go func() {
+		h.run(doneCh)
+		close(stoppedCh)
+	}()
+
+	close(doneCh)
+	select {
+	case <-stoppedCh:
+	case <-time.After(time.Second):
+		t.Fatal("Heartbeat goroutine did not stop")
+	}
+}
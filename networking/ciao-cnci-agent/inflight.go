@@ -0,0 +1,84 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//cmdTracker keeps track of the command goroutines that have not
+//yet completed so that shutdown can wait for them to finish
+type cmdTracker struct {
+	wg sync.WaitGroup
+
+	sync.Mutex
+	pending map[*cmdWrapper]string
+}
+
+//inflight tracks the commands being processed by the agent
+var inflight = newCmdTracker()
+
+func newCmdTracker() *cmdTracker {
+	return &cmdTracker{pending: make(map[*cmdWrapper]string)}
+}
+
+//start records that the processing of cmd has started. It must be
+//called before the goroutine processing the command is launched.
+func (t *cmdTracker) start(cmd *cmdWrapper, name string) {
+	t.Lock()
+	t.pending[cmd] = cmd.logPrefix() + name
+	t.Unlock()
+	t.wg.Add(1)
+}
+
+//done records that the processing of cmd has completed
+func (t *cmdTracker) done(cmd *cmdWrapper) {
+	t.Lock()
+	delete(t.pending, cmd)
+	t.Unlock()
+	t.wg.Done()
+}
+
+//wait waits for all the commands to complete for up to timeout.
+//It returns the description of the commands still being processed
+//when the timeout expired.
+func (t *cmdTracker) wait(timeout time.Duration) []string {
+	doneCh := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	var pending []string
+	for _, desc := range t.pending {
+		pending = append(pending, desc)
+	}
+	sort.Strings(pending)
+
+	return pending
+}
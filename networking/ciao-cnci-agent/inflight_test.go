@@ -0,0 +1,69 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests that wait returns once all the commands have completed
+//
+// Test is expected to pass without reporting any pending command
+func TestCmdTrackerDrain(t *testing.T) {
+	tracker := newCmdTracker()
+
+	for i := 0; i < 3; i++ {
+		cmd := &cmdWrapper{id: "drain"}
+		tracker.start(cmd, "AssignPublicIP")
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			tracker.done(cmd)
+		}()
+	}
+
+	pending := tracker.wait(5 * time.Second)
+	if len(pending) != 0 {
+		t.Errorf("unexpected pending commands %v", pending)
+	}
+}
+
+// Tests that commands which do not complete within the grace period
+// are reported
+//
+// Test is expected to pass and to report the stuck command only
+func TestCmdTrackerTimeout(t *testing.T) {
+	tracker := newCmdTracker()
+
+	fast := &cmdWrapper{id: "fast"}
+	tracker.start(fast, "ReleasePublicIP")
+	tracker.done(fast)
+
+	stuck := &cmdWrapper{id: "stuck", tenant: "tenant"}
+	tracker.start(stuck, "TenantAdded")
+	defer tracker.done(stuck)
+
+	pending := tracker.wait(10 * time.Millisecond)
+	if len(pending) != 1 {
+		t.Fatalf("expected 1 pending command got %v", pending)
+	}
+
+	if !strings.Contains(pending[0], "stuck") || !strings.Contains(pending[0], "TenantAdded") {
+		t.Errorf("unexpected pending command description %s", pending[0])
+	}
+}
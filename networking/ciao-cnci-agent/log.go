@@ -0,0 +1,86 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ciao-project/ciao/clogger/gloginterface"
+	"github.com/ciao-project/ciao/networking/libsnnet"
+	"github.com/golang/glog"
+)
+
+//jsonLogger writes the logs of the agent as JSON objects when set.
+//They are written through glog otherwise.
+var jsonLogger *gloginterface.CiaoJSONLogger
+
+//initLogFormat selects the format of the logs of both the agent
+//and libsnnet
+func initLogFormat(json bool) {
+	if !json {
+		jsonLogger = nil
+		libsnnet.Logger = gloginterface.CiaoGlogLogger{}
+		return
+	}
+
+	jsonLogger = &gloginterface.CiaoJSONLogger{
+		Fields: map[string]interface{}{"component": "ciao-cnci-agent"},
+	}
+	libsnnet.Logger = gloginterface.CiaoJSONLogger{
+		Fields: map[string]interface{}{"component": "libsnnet"},
+	}
+}
+
+//logDepth logs msg at the given level, depth being the number of
+//stack frames to skip when identifying the caller
+func logDepth(depth int, level string, msg string) {
+	if jsonLogger != nil {
+		jsonLogger.Output(depth+1, level, msg, nil)
+		return
+	}
+
+	switch level {
+	case gloginterface.LevelWarning:
+		glog.WarningDepth(depth+1, msg)
+	case gloginterface.LevelError:
+		glog.ErrorDepth(depth+1, msg)
+	case gloginterface.LevelFatal:
+		glog.FatalDepth(depth+1, msg)
+	default:
+		glog.InfoDepth(depth+1, msg)
+	}
+}
+
+func logInfof(format string, args ...interface{}) {
+	logDepth(1, gloginterface.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func logWarningf(format string, args ...interface{}) {
+	logDepth(1, gloginterface.LevelWarning, fmt.Sprintf(format, args...))
+}
+
+func logErrorf(format string, args ...interface{}) {
+	logDepth(1, gloginterface.LevelError, fmt.Sprintf(format, args...))
+}
+
+//logFatalf logs the message and exits
+func logFatalf(format string, args ...interface{}) {
+	logDepth(1, gloginterface.LevelFatal, fmt.Sprintf(format, args...))
+	glog.Flush()
+	os.Exit(255)
+}
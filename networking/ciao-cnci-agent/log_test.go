@@ -0,0 +1,83 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ciao-project/ciao/clogger/gloginterface"
+	"github.com/ciao-project/ciao/networking/libsnnet"
+)
+
+// Tests that the agent and libsnnet logs are written as JSON objects
+// when requested
+//
+// Test is expected to pass with the logs of the agent attributed
+// to their call site
+func TestLogJSON(t *testing.T) {
+	savedLogger := libsnnet.Logger
+	defer func() {
+		initLogFormat(false)
+		libsnnet.Logger = savedLogger
+	}()
+
+	initLogFormat(true)
+	if _, ok := libsnnet.Logger.(gloginterface.CiaoJSONLogger); !ok {
+		t.Fatalf("Unexpected libsnnet logger %T", libsnnet.Logger)
+	}
+
+	var buf bytes.Buffer
+	jsonLogger.Out = &buf
+
+	logWarningf("agent %s", "warning")
+	c := &cmdWrapper{id: "abcd", tenant: "tenant"}
+	c.errorf("command %s", "error")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines got %s", buf.String())
+	}
+
+	for i, level := range []string{gloginterface.LevelWarning, gloginterface.LevelError} {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatalf("Invalid log line %s: %v", lines[i], err)
+		}
+
+		if entry["level"] != level || entry["component"] != "ciao-cnci-agent" {
+			t.Errorf("Unexpected log line %s", lines[i])
+		}
+
+		if caller, _ := entry["caller"].(string); !strings.HasPrefix(caller, "log_test.go:") {
+			t.Errorf("Unexpected caller in %s", lines[i])
+		}
+	}
+
+	if !strings.Contains(lines[1], `"request_id":"abcd"`) ||
+		!strings.Contains(lines[1], `"tenant":"tenant"`) ||
+		!strings.Contains(lines[1], `"message":"command error"`) {
+		t.Errorf("Command fields missing from %s", lines[1])
+	}
+
+	initLogFormat(false)
+	if jsonLogger != nil {
+		t.Errorf("JSON logger still set")
+	}
+}
@@ -0,0 +1,215 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//The metrics are exposed using the Prometheus text exposition format
+
+type counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+func (c *counter) inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *counter) write(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	fmt.Fprintf(b, "%s %d\n", c.name, atomic.LoadUint64(&c.value))
+}
+
+type gauge struct {
+	name  string
+	help  string
+	value func() int
+}
+
+func (g *gauge) write(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	fmt.Fprintf(b, "%s %d\n", g.name, g.value())
+}
+
+type histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	buckets []float64 //Upper bounds in seconds, in increasing order
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+
+	h.Lock()
+	defer h.Unlock()
+
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(b *bytes.Buffer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, le := range h.buckets {
+		fmt.Fprintf(b, "%s_bucket{le=\"%g\"} %d\n", h.name, le, h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(b, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(b, "%s_count %d\n", h.name, h.count)
+}
+
+//agentMetrics contains all the metrics exposed by the agent
+type agentMetrics struct {
+	subnetsAdded     counter
+	subnetsRemoved   counter
+	publicIPAssigned counter
+	publicIPReleased counter
+	commandErrors    counter
+	commandQueueFull counter
+	commandsDropped  counter
+	reconnects       counter
+	addSubnetLatency *histogram
+	tunnels          gauge
+}
+
+var metrics = newAgentMetrics()
+
+func newAgentMetrics() *agentMetrics {
+	return &agentMetrics{
+		subnetsAdded: counter{
+			name: "cnci_subnets_added_total",
+			help: "Number of remote subnets added to the CNCI.",
+		},
+		subnetsRemoved: counter{
+			name: "cnci_subnets_removed_total",
+			help: "Number of remote subnets removed from the CNCI.",
+		},
+		publicIPAssigned: counter{
+			name: "cnci_public_ips_assigned_total",
+			help: "Number of public IPs assigned.",
+		},
+		publicIPReleased: counter{
+			name: "cnci_public_ips_released_total",
+			help: "Number of public IPs released.",
+		},
+		commandErrors: counter{
+			name: "cnci_command_errors_total",
+			help: "Number of commands which failed to be processed.",
+		},
+		commandQueueFull: counter{
+			name: "cnci_command_queue_full_total",
+			help: "Number of commands which found the command queue full.",
+		},
+		commandsDropped: counter{
+			name: "cnci_commands_dropped_total",
+			help: "Number of commands dropped because the command queue remained full.",
+		},
+		reconnects: counter{
+			name: "cnci_reconnects_total",
+			help: "Number of times the agent reconnected to the scheduler.",
+		},
+		addSubnetLatency: newHistogram("cnci_add_remote_subnet_duration_seconds",
+			"Time taken to add a remote subnet.",
+			[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}),
+		tunnels: gauge{
+			name:  "cnci_tunnels",
+			help:  "Number of tunnels served by the CNCI.",
+			value: func() int { return 0 },
+		},
+	}
+}
+
+func (m *agentMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b bytes.Buffer
+
+	for _, c := range []*counter{&m.subnetsAdded, &m.subnetsRemoved,
+		&m.publicIPAssigned, &m.publicIPReleased, &m.commandErrors,
+		&m.commandQueueFull, &m.commandsDropped, &m.reconnects} {
+		c.write(&b)
+	}
+	m.tunnels.write(&b)
+	m.addSubnetLatency.write(&b)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write(b.Bytes())
+}
+
+//serveTopology returns the topology of the CNCI for debugging
+func serveTopology(w http.ResponseWriter, r *http.Request) {
+	if gCnci == nil {
+		http.Error(w, "network not initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	b, err := gCnci.DumpTopology()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+//serveMetrics exposes the agent metrics and the CNCI topology on addr. The number of tunnels
+//is obtained from the subnets recorded in the database.
+func serveMetrics(addr string, db *cnciDatabase) {
+	if db != nil {
+		metrics.tunnels.value = func() int {
+			db.SubnetMap.Lock()
+			defer db.SubnetMap.Unlock()
+			return len(db.SubnetMap.m)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/debug/topology", serveTopology)
+
+	logInfof("Serving metrics on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logErrorf("Unable to serve metrics: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tests the metrics exposed by the agent
+//
+// Test is expected to pass and to report the updated counters,
+// gauge and histogram in the Prometheus text format
+func TestMetrics(t *testing.T) {
+	m := newAgentMetrics()
+	m.tunnels.value = func() int { return 3 }
+
+	m.subnetsAdded.inc()
+	m.subnetsAdded.inc()
+	m.publicIPAssigned.inc()
+	m.reconnects.inc()
+	m.addSubnetLatency.observe(200 * time.Millisecond)
+	m.addSubnetLatency.observe(3 * time.Second)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	expected := []string{
+		"# TYPE cnci_subnets_added_total counter\n",
+		"cnci_subnets_added_total 2\n",
+		"cnci_subnets_removed_total 0\n",
+		"cnci_public_ips_assigned_total 1\n",
+		"cnci_reconnects_total 1\n",
+		"# TYPE cnci_tunnels gauge\n",
+		"cnci_tunnels 3\n",
+		"# TYPE cnci_add_remote_subnet_duration_seconds histogram\n",
+		"cnci_add_remote_subnet_duration_seconds_bucket{le=\"0.1\"} 0\n",
+		"cnci_add_remote_subnet_duration_seconds_bucket{le=\"0.25\"} 1\n",
+		"cnci_add_remote_subnet_duration_seconds_bucket{le=\"5\"} 2\n",
+		"cnci_add_remote_subnet_duration_seconds_bucket{le=\"+Inf\"} 2\n",
+		"cnci_add_remote_subnet_duration_seconds_sum 3.2\n",
+		"cnci_add_remote_subnet_duration_seconds_count 2\n",
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("metrics missing %q\n%s", e, body)
+		}
+	}
+}
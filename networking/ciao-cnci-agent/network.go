@@ -21,11 +21,13 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 
 	"github.com/ciao-project/ciao/networking/libsnnet"
@@ -43,8 +45,20 @@ func initNetwork(cancelCh <-chan os.Signal) error {
 	cnci := &libsnnet.Cnci{}
 
 	cnci.NetworkConfig = &libsnnet.NetworkConfig{
-		Mode: libsnnet.GreTunnel,
+		Mode:         libsnnet.GreTunnel,
+		ComputeIface: computeIface,
 	}
+	cnci.BridgeRateLimit = libsnnet.RateLimit{
+		Ingress: bridgeIngressRate,
+		Egress:  bridgeEgressRate,
+	}
+	cnci.TopologyFile = topologyFile
+
+	family, err := parseAddrFamily(addrFamily)
+	if err != nil {
+		return err
+	}
+	cnci.AddrFamily = family
 
 	if computeNet != "" {
 		_, cnet, _ := net.ParseCIDR(computeNet)
@@ -62,14 +76,13 @@ func initNetwork(cancelCh <-chan os.Signal) error {
 		cnci.ManagementNet = []net.IPNet{*mnet}
 	}
 
-	var err error
 	delays := []int64{1, 2, 5, 10, 20, 40, 60}
 	for _, d := range delays {
 		err = cnci.Init()
 		if err == nil {
 			break
 		}
-		glog.Infof("cnci network failed %v retrying in %v", err, d)
+		logInfof("cnci network failed %v retrying in %v", err, d)
 		select {
 		case <-time.After(time.Duration(d) * time.Second):
 		case <-cancelCh:
@@ -85,15 +98,54 @@ func initNetwork(cancelCh <-chan os.Signal) error {
 	if enableNetwork {
 		fw, err := libsnnet.InitFirewall(gCnci.ComputeLink[0].Attrs().Name)
 		if err != nil {
-			glog.Errorf("Firewall initialize failed %v", err) //Explicit ignore
+			logErrorf("Firewall initialize failed %v", err) //Explicit ignore
 		}
 		gFw = fw
 	}
-	glog.Infof("Network Initialized %v", gCnci)
+	logInfof("Network Initialized %v", gCnci)
 
 	return nil
 }
 
+//parseAddrFamily parses the address family used to discover the
+//management and compute interfaces
+func parseAddrFamily(family string) (libsnnet.AddressFamily, error) {
+	switch family {
+	case "", "ipv4":
+		return libsnnet.IPv4, nil
+	case "ipv6":
+		return libsnnet.IPv6, nil
+	case "both":
+		return libsnnet.IPv4AndIPv6, nil
+	}
+	return libsnnet.IPv4, errors.Errorf("invalid address family %s", family)
+}
+
+//checkTunnels logs the tunnels which are not healthy so that
+//connectivity loss can be noticed before tenants report it
+func checkTunnels() {
+	if gCnci == nil {
+		return
+	}
+
+	for _, t := range gCnci.HealthCheck() {
+		if !t.Up {
+			logWarningf("Tunnel for subnet %s to %v unhealthy: %v", t.Subnet.String(), t.CNIP, t.Err)
+		}
+	}
+}
+
+//shutdownNetwork stops the DHCP servers and tears down the tenant links
+//unless the network is to be kept across agent restarts. It must not be
+//called while commands are still being processed.
+func shutdownNetwork() error {
+	if keepNetwork || gCnci == nil {
+		return nil
+	}
+
+	return gCnci.Shutdown()
+}
+
 func unmarshallSubnetParams(cmd *payloads.TenantAddedEvent) (*net.IPNet, int, net.IP, error) {
 	_, snet, err := net.ParseCIDR(cmd.TenantSubnet)
 	if err != nil {
@@ -157,7 +209,7 @@ func natSSHSubnet(action libsnnet.FwAction, subnet net.IPNet, intIf string, extI
 		if err != nil {
 			return errors.Wrapf(err, "ssh fwd %v", action)
 		}
-		glog.Infof("ssh fwd IP[%s] Port[%d] %d %d", ip, extPort, ip[2], ip[3])
+		logInfof("ssh fwd IP[%s] Port[%d] %d %d", ip, extPort, ip[2], ip[3])
 
 		err = gFw.ExtPortAccess(action, "tcp", extIf, extPort, ip, 22)
 		if err != nil {
@@ -177,19 +229,21 @@ func addRemoteSubnet(cmd *payloads.TenantAddedEvent) error {
 	if !enableNetwork {
 		return nil
 	}
+	start := time.Now()
 	bridge, err := gCnci.AddRemoteSubnet(*rs, tk, rip)
+	metrics.addSubnetLatency.observe(time.Since(start))
 	if err != nil {
 		return errors.Wrapf(err, "add remote subnet %s %x %s", rs, tk, rip)
 	}
 
-	glog.Infof("cnci.AddRemoteSubnet success %s %x %s", rs, tk, rip, err)
+	logInfof("cnci.AddRemoteSubnet success %s %x %s", rs, tk, rip, err)
 
 	if enableNATssh && bridge != "" {
 		err = natSSHSubnet(libsnnet.FwEnable, *rs, bridge, gCnci.ComputeLink[0].Attrs().Name)
 		if err != nil {
 			return errors.Wrapf(err, "enable ssh nat %s %x %s", rs, tk, bridge)
 		}
-		glog.Infof("cnci.AddRemoteSubnet ssh nat success %s %x %s", rs, tk, bridge)
+		logInfof("cnci.AddRemoteSubnet ssh nat success %s %x %s", rs, tk, bridge)
 	}
 	return nil
 }
@@ -207,10 +261,10 @@ func delRemoteSubnet(cmd *payloads.TenantAddedEvent) error {
 
 	err = gCnci.DelRemoteSubnet(*rs, tk, rip)
 	if err != nil {
-		glog.Errorf("delete remote subnet %s %x %s %s", rs, tk, rip, err)
+		logErrorf("delete remote subnet %s %x %s %s", rs, tk, rip, err)
 		return err
 	}
-	glog.Infof("cnci.DelRemoteSubnet success %s %x %s", rs, tk, rip, err)
+	logInfof("cnci.DelRemoteSubnet success %s %x %s", rs, tk, rip, err)
 
 	/* We do not delete the bridge till reset.
 	if enableNATssh {
@@ -219,7 +273,7 @@ func delRemoteSubnet(cmd *payloads.TenantAddedEvent) error {
 			return errors.Errorf(err, "disable ssh nat failed %s %x %s", rs, tk, bridge)
 		}
 	}
-	glog.Infof("cnci.DelRemoteSubnet ssh success %s %x %s", rs, tk, bridge)
+	logInfof("cnci.DelRemoteSubnet ssh success %s %x %s", rs, tk, bridge)
 	*/
 
 	return nil
@@ -239,11 +293,28 @@ func cnciAddedMarshal(agentUUID string) ([]byte, error) {
 		return nil, errors.Errorf("invalid physical configuration")
 	}
 
-	glog.Infoln("cnciAdded Event ", cnciAdded)
+	logInfof("cnciAdded Event %v", cnciAdded)
 
 	return yaml.Marshal(&cnciAdded)
 }
 
+func cnciReadyMarshal(agentUUID string, status *networkStatus) ([]byte, error) {
+	var cnciReady payloads.EventConcentratorInstanceReady
+	evt := &cnciReady.CNCIReady
+
+	evt.InstanceUUID = agentUUID
+	if gCnci != nil {
+		evt.TenantUUID = gCnci.Tenant
+	}
+	evt.Degraded = status.degraded()
+	evt.FailedSubnets = status.failedSubnets
+	evt.FailedPublicIPs = status.failedPublicIPs
+
+	logInfof("cnciReady Event %v", cnciReady)
+
+	return yaml.Marshal(&cnciReady)
+}
+
 func publicIPAssignedMarshal(cmd *payloads.PublicIPCommand) ([]byte, error) {
 	var publicIPAssigned payloads.EventPublicIPAssigned
 	evt := &publicIPAssigned.AssignedIP
@@ -253,7 +324,7 @@ func publicIPAssignedMarshal(cmd *payloads.PublicIPCommand) ([]byte, error) {
 	evt.PublicIP = cmd.PublicIP
 	evt.PrivateIP = cmd.PrivateIP
 
-	glog.Infoln("PublicIPAssignedMarshal Event ", publicIPAssigned)
+	logInfof("PublicIPAssignedMarshal Event %v", publicIPAssigned)
 
 	return yaml.Marshal(&publicIPAssigned)
 }
@@ -267,14 +338,22 @@ func publicIPUnassignedMarshal(cmd *payloads.PublicIPCommand) ([]byte, error) {
 	evt.PublicIP = cmd.PublicIP
 	evt.PrivateIP = cmd.PrivateIP
 
-	glog.Infoln("PublicIPUnassignedMarshal Event ", publicIPUnassigned)
+	logInfof("PublicIPUnassignedMarshal Event %v", publicIPUnassigned)
 
 	return yaml.Marshal(&publicIPUnassigned)
 }
 
-func publicIPFailureMarshal(reason payloads.PublicIPFailureReason, cmd *payloads.PublicIPCommand) ([]byte, error) {
+//publicIPError is the error info of a failed public IP command. The cause
+//is reported to the controller along with the SSNTP error.
+type publicIPError struct {
+	cmd   *payloads.PublicIPCommand
+	cause error
+}
+
+func publicIPFailureMarshal(reason payloads.PublicIPFailureReason, info *publicIPError) ([]byte, error) {
 	var failure payloads.ErrorPublicIPFailure
 
+	cmd := info.cmd
 	failure.ConcentratorUUID = cmd.ConcentratorUUID
 	failure.TenantUUID = cmd.TenantUUID
 	failure.InstanceUUID = cmd.InstanceUUID
@@ -282,8 +361,11 @@ func publicIPFailureMarshal(reason payloads.PublicIPFailureReason, cmd *payloads
 	failure.PrivateIP = cmd.PrivateIP
 	failure.VnicMAC = cmd.VnicMAC
 	failure.Reason = reason
+	if info.cause != nil {
+		failure.Detail = info.cause.Error()
+	}
 
-	glog.Infoln("publicIPFailureMarshal error ", failure)
+	logInfof("publicIPFailureMarshal error %v", failure)
 
 	return yaml.Marshal(&failure)
 }
@@ -310,17 +392,17 @@ func sendNetworkError(client *ssntpConn, errorType ssntp.Error, errorInfo interf
 func generateNetErrorPayload(errorType ssntp.Error, errorInfo interface{}) ([]byte, error) {
 	switch errorType {
 	case ssntp.AssignPublicIPFailure:
-		cmd, ok := errorInfo.(*payloads.PublicIPCommand)
+		info, ok := errorInfo.(*publicIPError)
 		if !ok {
 			return nil, errors.Errorf("invalid errorInfo [%T] %v", errorInfo, errorInfo)
 		}
-		return publicIPFailureMarshal(payloads.PublicIPAssignFailure, cmd)
+		return publicIPFailureMarshal(payloads.PublicIPAssignFailure, info)
 	case ssntp.UnassignPublicIPFailure:
-		cmd, ok := errorInfo.(*payloads.PublicIPCommand)
+		info, ok := errorInfo.(*publicIPError)
 		if !ok {
 			return nil, errors.Errorf("invalid errorInfo [%T] %v", errorInfo, errorInfo)
 		}
-		return publicIPFailureMarshal(payloads.PublicIPReleaseFailure, cmd)
+		return publicIPFailureMarshal(payloads.PublicIPReleaseFailure, info)
 	default:
 		return nil, errors.Errorf("unsupported ssntpErrorInfo type: %v", errorType)
 	}
@@ -350,22 +432,36 @@ func generateNetEventPayload(eventType ssntp.Event, eventInfo interface{}, agent
 
 	switch eventType {
 	case ssntp.ConcentratorInstanceAdded:
-		glog.Infof("generating cnciAdded Event Payload %s", agentUUID)
+		logInfof("generating cnciAdded Event Payload %s", agentUUID)
 		return cnciAddedMarshal(agentUUID)
+	case ssntp.ConcentratorInstanceReady:
+		logInfof("generating cnciReady Event Payload %s", agentUUID)
+		status, ok := eventInfo.(*networkStatus)
+		if !ok {
+			return nil, errors.Errorf("invalid eventInfo [%T] %v", eventInfo, eventInfo)
+		}
+		return cnciReadyMarshal(agentUUID, status)
 	case ssntp.PublicIPAssigned:
-		glog.Infof("generating publicIP Assigned Event Payload %v", eventInfo)
+		logInfof("generating publicIP Assigned Event Payload %v", eventInfo)
 		cmd, ok := eventInfo.(*payloads.PublicIPCommand)
 		if !ok {
 			return nil, errors.Errorf("invalid eventInfo [%T] %v", eventInfo, eventInfo)
 		}
 		return publicIPAssignedMarshal(cmd)
 	case ssntp.PublicIPUnassigned:
-		glog.Infof("generating publicIP Unassigned Event Payload %v", eventInfo)
+		logInfof("generating publicIP Unassigned Event Payload %v", eventInfo)
 		cmd, ok := eventInfo.(*payloads.PublicIPCommand)
 		if !ok {
 			return nil, errors.Errorf("invalid eventInfo [%T] %v", eventInfo, eventInfo)
 		}
 		return publicIPUnassignedMarshal(cmd)
+	case ssntp.CNCIProbeResult:
+		logInfof("generating CNCI Probe Result Event Payload %v", eventInfo)
+		result, ok := eventInfo.(*payloads.CNCIProbeResultEvent)
+		if !ok {
+			return nil, errors.Errorf("invalid eventInfo [%T] %v", eventInfo, eventInfo)
+		}
+		return yaml.Marshal(&payloads.EventCNCIProbeResult{Result: *result})
 	default:
 		return nil, errors.Errorf("unsupported ssntpEventInfo type: %v", eventType)
 	}
@@ -410,6 +506,8 @@ func releasePubIP(cmd *payloads.PublicIPCommand) error {
 	return errors.Wrapf(err, "release ip")
 }
 
+//refreshCNCI updates the tunnel to the CNCIs of the tenant. Only the CNCIs
+//serving cmd.Subnet are refreshed if the command is scoped to a subnet.
 func refreshCNCI(cmd *payloads.CNCIRefreshCommand) error {
 	var neighbors []libsnnet.Neighbor
 
@@ -424,5 +522,61 @@ func refreshCNCI(cmd *payloads.CNCIRefreshCommand) error {
 		neighbors = append(neighbors, n)
 	}
 
+	if cmd.Subnet != "" {
+		return gCnci.UpdateSubnetNeighbors(cmd.Subnet, neighbors)
+	}
 	return gCnci.UpdateNeighbors(neighbors)
 }
+
+//probeTimeout is the number of seconds a tunnel endpoint is given to reply
+const probeTimeout = 2
+
+//probeTunnel checks that the tunnel IP of a remote CNCI replies to a ping
+func probeTunnel(tunnelIP string) error {
+	ip := net.ParseIP(tunnelIP)
+	if ip == nil {
+		return errors.Errorf("invalid tunnel IP %v", tunnelIP)
+	}
+
+	out, err := runCommand("ping", "-c", "1", "-W", strconv.Itoa(probeTimeout), ip.String())
+	if err != nil {
+		return errors.Wrapf(err, "ping %s [%s]", ip, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+//probeCNCI probes all the targets in parallel and reports the
+//reachability of each one of them in the order they were requested
+func probeCNCI(cmd *payloads.CNCIProbeCommand) *payloads.CNCIProbeResultEvent {
+	result := &payloads.CNCIProbeResultEvent{
+		ProbeID:  cmd.ProbeID,
+		CNCIUUID: cmd.CNCIUUID,
+		Results:  make([]payloads.CNCIProbeTargetResult, len(cmd.Targets)),
+	}
+
+	var wg sync.WaitGroup
+	for i, t := range cmd.Targets {
+		wg.Add(1)
+		go func(i int, t payloads.CNCIProbeTarget) {
+			defer wg.Done()
+
+			r := payloads.CNCIProbeTargetResult{
+				CNCIUUID: t.CNCIUUID,
+				TunnelIP: t.TunnelIP,
+			}
+
+			err := probeTunnel(t.TunnelIP)
+			if err != nil {
+				r.Error = err.Error()
+			} else {
+				r.Reachable = true
+			}
+
+			result.Results[i] = r
+		}(i, t)
+	}
+	wg.Wait()
+
+	return result
+}
@@ -0,0 +1,210 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ciao-project/ciao/networking/libsnnet"
+	"github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// Tests that each probe target is reported in request order
+//
+// Test is expected to pass with only the reachable target marked
+// as such and an error recorded for the others
+func TestProbeCNCI(t *testing.T) {
+	savedRunCommand := runCommand
+	defer func() { runCommand = savedRunCommand }()
+
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		if args[len(args)-1] == "192.168.0.1" {
+			return nil, nil
+		}
+		return []byte("100% packet loss"), errors.New("exit status 1")
+	}
+
+	cmd := &payloads.CNCIProbeCommand{
+		ProbeID:  "probe",
+		CNCIUUID: testUUID,
+		Targets: []payloads.CNCIProbeTarget{
+			{CNCIUUID: "reachable", TunnelIP: "192.168.0.1"},
+			{CNCIUUID: "unreachable", TunnelIP: "192.168.0.2"},
+			{CNCIUUID: "invalid", TunnelIP: "not-an-ip"},
+		},
+	}
+
+	result := probeCNCI(cmd)
+	if result.ProbeID != cmd.ProbeID || result.CNCIUUID != cmd.CNCIUUID {
+		t.Fatalf("unexpected probe identity %v", result)
+	}
+
+	if len(result.Results) != len(cmd.Targets) {
+		t.Fatalf("expected %d results got %d", len(cmd.Targets), len(result.Results))
+	}
+
+	for i, r := range result.Results {
+		if r.CNCIUUID != cmd.Targets[i].CNCIUUID {
+			t.Errorf("result %d is for %s expected %s", i, r.CNCIUUID, cmd.Targets[i].CNCIUUID)
+		}
+		reachable := i == 0
+		if r.Reachable != reachable {
+			t.Errorf("%s reachable %v expected %v", r.CNCIUUID, r.Reachable, reachable)
+		}
+		if reachable != (r.Error == "") {
+			t.Errorf("%s unexpected error [%s]", r.CNCIUUID, r.Error)
+		}
+	}
+}
+
+// Tests that the cause of a public IP failure is reported
+//
+// Test is expected to pass with the reason and the cause present in the
+// failure payload
+func TestPublicIPFailurePayload(t *testing.T) {
+	cmd := &payloads.PublicIPCommand{
+		ConcentratorUUID: testUUID,
+		TenantUUID:       "tenant",
+		InstanceUUID:     "instance",
+		PublicIP:         "198.51.100.10",
+		PrivateIP:        "192.168.0.2",
+		VnicMAC:          "02:00:00:00:00:01",
+	}
+
+	info := &publicIPError{cmd: cmd, cause: errors.New("assign ip: no such device")}
+	y, err := generateNetErrorPayload(ssntp.AssignPublicIPFailure, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failure payloads.ErrorPublicIPFailure
+	if err := yaml.Unmarshal(y, &failure); err != nil {
+		t.Fatal(err)
+	}
+
+	if failure.Reason != payloads.PublicIPAssignFailure {
+		t.Errorf("unexpected reason %v", failure.Reason)
+	}
+	if failure.Detail != info.cause.Error() {
+		t.Errorf("unexpected detail %q", failure.Detail)
+	}
+	if failure.PublicIP != cmd.PublicIP || failure.TenantUUID != cmd.TenantUUID {
+		t.Errorf("unexpected failure %+v", failure)
+	}
+
+	if _, err := generateNetErrorPayload(ssntp.UnassignPublicIPFailure, cmd); err == nil {
+		t.Errorf("expected error for invalid error info")
+	}
+}
+
+// Tests that the network is left untouched on shutdown when it is
+// to be kept or has not been initialized
+//
+// Test is expected to pass without the uninitialized CNCI being used
+func TestShutdownNetworkSkipped(t *testing.T) {
+	savedCnci := gCnci
+	savedKeep := keepNetwork
+	defer func() {
+		gCnci = savedCnci
+		keepNetwork = savedKeep
+	}()
+
+	gCnci = nil
+	if err := shutdownNetwork(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	gCnci = &libsnnet.Cnci{}
+	keepNetwork = true
+	if err := shutdownNetwork(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+// Tests the parsing of the address family of the physical interfaces
+//
+// Test is expected to pass with ipv4 as the default and an error for
+// unknown families
+func TestParseAddrFamily(t *testing.T) {
+	for _, tt := range []struct {
+		family   string
+		expected libsnnet.AddressFamily
+		valid    bool
+	}{
+		{"", libsnnet.IPv4, true},
+		{"ipv4", libsnnet.IPv4, true},
+		{"ipv6", libsnnet.IPv6, true},
+		{"both", libsnnet.IPv4AndIPv6, true},
+		{"ipv5", libsnnet.IPv4, false},
+	} {
+		family, err := parseAddrFamily(tt.family)
+		if tt.valid != (err == nil) {
+			t.Errorf("%q: unexpected error %v", tt.family, err)
+			continue
+		}
+		if family != tt.expected {
+			t.Errorf("%q: got %v, expected %v", tt.family, family, tt.expected)
+		}
+	}
+}
+
+// Tests the ready event generated once the network has been rebuilt
+//
+// Test is expected to pass with the event marked as degraded only
+// when a subnet or public IP could not be restored
+func TestCNCIReadyPayload(t *testing.T) {
+	savedCnci := gCnci
+	defer func() {
+		gCnci = savedCnci
+	}()
+	gCnci = &libsnnet.Cnci{Tenant: "tenant"}
+
+	for _, status := range []*networkStatus{
+		{},
+		{failedSubnets: []string{"192.168.0.0/24"}},
+		{failedPublicIPs: []string{"198.51.100.10"}},
+	} {
+		y, err := generateNetEventPayload(ssntp.ConcentratorInstanceReady, status, testUUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ready payloads.EventConcentratorInstanceReady
+		if err := yaml.Unmarshal(y, &ready); err != nil {
+			t.Fatal(err)
+		}
+
+		evt := ready.CNCIReady
+		if evt.InstanceUUID != testUUID || evt.TenantUUID != "tenant" {
+			t.Errorf("unexpected identity %+v", evt)
+		}
+		if evt.Degraded != status.degraded() {
+			t.Errorf("expected degraded %v got %+v", status.degraded(), evt)
+		}
+		if len(evt.FailedSubnets) != len(status.failedSubnets) ||
+			len(evt.FailedPublicIPs) != len(status.failedPublicIPs) {
+			t.Errorf("unexpected failures %+v", evt)
+		}
+	}
+
+	if _, err := generateNetEventPayload(ssntp.ConcentratorInstanceReady, nil, testUUID); err == nil {
+		t.Errorf("expected error for invalid event info")
+	}
+}
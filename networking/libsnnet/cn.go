@@ -17,6 +17,7 @@
 package libsnnet
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strings"
@@ -38,6 +39,10 @@ type NetworkConfig struct {
 	ManagementNet []net.IPNet // Enumerates all possible management subnets
 	ComputeNet    []net.IPNet // Enumerates all possible compute subnets
 	Mode          NetworkMode //The data center networking mode
+
+	// ComputeIface optionally names the link, e.g. a bond, the CNCI
+	// uses for compute traffic when multiple physical links exist
+	ComputeIface string
 }
 
 // CnAPICtx contains API level context used to control the behaviour
@@ -316,6 +321,7 @@ const (
 	vnicPrefix     = "vnic_"
 	grePrefix      = "gre_"
 	cnciVnicPrefix = "cncivnic_"
+	aliasSeparator = "##"
 )
 
 func (cn *ComputeNode) genCnciVnicAlias(cfg *VnicConfig) string {
@@ -426,7 +432,7 @@ func (cn *ComputeNode) rebuildVnicMap(links []netlink.Link) error {
 			if strings.HasPrefix(alias, vnicPrefix) {
 				vnic := alias
 				id := strings.TrimPrefix(vnic, vnicPrefix)
-				id = strings.Split(id, "##")[0]
+				id = strings.Split(id, aliasSeparator)[0]
 				bridge := bridgePrefix + id
 				gre := grePrefix + id
 				if _, err := cn.dbUpdate(bridge, vnic, dbInsVnic); err != nil {
@@ -530,7 +536,7 @@ func (cn *ComputeNode) dbUpdate(bridge string, vnic string, op dbOp) (int, error
 }
 
 func (cn *ComputeNode) genLinkName(device interface{}) (string, error) {
-	for i := 0; i < ifaceRetryLimit; {
+	for i := 0; i < ifaceRetryLimit; i++ {
 		name, _ := genIface(device, false)
 		if !cn.nameMap[name] {
 			cn.nameMap[name] = true
@@ -925,6 +931,19 @@ func waitForDeviceReady(devInfo *linkInfo, timeout time.Duration) (devName strin
 	}
 }
 
+//waitForDeviceReadyContext is waitForDeviceReady which also gives up
+//when the context is cancelled
+func waitForDeviceReadyContext(ctx context.Context, devInfo *linkInfo, timeout time.Duration) (devName string, devIndex int, err error) {
+	select {
+	case <-devInfo.ready:
+		return devInfo.name, devInfo.index, nil
+	case <-time.After(timeout):
+		return "", 0, fmt.Errorf("Timeout waiting for device ready [%v] [%v]", devInfo.index, devInfo.name)
+	case <-ctx.Done():
+		return "", 0, fmt.Errorf("Cancelled waiting for device ready [%v] [%v] %v", devInfo.index, devInfo.name, ctx.Err())
+	}
+}
+
 func (cn *ComputeNode) logicallyCreateVnic(vnic *Vnic) (err error) {
 
 	if vnic.LinkName, err = cn.genLinkName(vnic); err != nil {
@@ -17,10 +17,14 @@
 package libsnnet
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -47,6 +51,33 @@ type Cnci struct {
 	//simultaneously certain netlink calls suffer higher latencies
 	APITimeout time.Duration
 
+	//BridgeRateLimit is the rate limit applied to each tenant bridge.
+	//The default of zero leaves the bandwidth unlimited
+	BridgeRateLimit RateLimit
+
+	//BridgePrefix, GrePrefix and AliasSeparator define the aliases of the
+	//bridges and tunnels created by the CNCI. Only the devices whose
+	//aliases carry the prefixes are claimed when the topology is rebuilt,
+	//allowing isolated CNCIs to share a node as long as neither prefix is
+	//a prefix of the other. They default to br_, gre_ and ##
+	BridgePrefix   string
+	GrePrefix      string
+	AliasSeparator string
+
+	//AddrFamily selects the addresses used to discover the management
+	//and compute interfaces. It defaults to IPv4
+	AddrFamily AddressFamily
+
+	//IfaceRetryLimit bounds the number of names generated for a new
+	//bridge or tunnel before giving up on finding one not in use.
+	//It defaults to 10
+	IfaceRetryLimit int
+
+	//TopologyFile is the file to which a snapshot of the topology is saved
+	//on each change. When present it is used by Init to recover the
+	//topology. The topology is not saved if empty
+	TopologyFile string
+
 	// IPAddress of the concentrator that is routable
 	// The UUID to IP mapping in this case has to be
 	// performed using the datacenter DHCP
@@ -65,6 +96,11 @@ type cnciTopology struct {
 	linkMap   map[string]*linkInfo //Alias to Link mapping
 	nameMap   map[string]bool      //Link name
 	bridgeMap map[string]*bridgeInfo
+	keyMap    map[uint32]string //Subnet key to bridge alias of the subnet using it
+	neighbors []Neighbor        //Last set of neighbors successfully configured
+	//Bridge alias to DNS configuration of the subnet. It cannot be
+	//recovered from the links and is retained across rebuilds
+	dns map[string]SubnetDNS
 }
 
 func newCnciTopology() *cnciTopology {
@@ -72,6 +108,8 @@ func newCnciTopology() *cnciTopology {
 		linkMap:   make(map[string]*linkInfo),
 		nameMap:   make(map[string]bool),
 		bridgeMap: make(map[string]*bridgeInfo),
+		keyMap:    make(map[uint32]string),
+		dns:       make(map[string]SubnetDNS),
 	}
 }
 
@@ -79,6 +117,16 @@ func reinitTopology(topology *cnciTopology) {
 	topology.linkMap = make(map[string]*linkInfo)
 	topology.nameMap = make(map[string]bool)
 	topology.bridgeMap = make(map[string]*bridgeInfo)
+	topology.keyMap = make(map[uint32]string)
+}
+
+// TunnelStatus reports the health of the tunnel connecting a subnet
+// bridge on the CNCI to a compute node
+type TunnelStatus struct {
+	Subnet net.IPNet
+	CNIP   net.IP
+	Up     bool
+	Err    error //Reason the tunnel is not up
 }
 
 type bridgeInfo struct {
@@ -86,6 +134,41 @@ type bridgeInfo struct {
 	*Dnsmasq
 }
 
+// TopologyLink describes a link in the CNCI topology
+type TopologyLink struct {
+	Alias string `json:"alias"`
+	Name  string `json:"name"`
+	Index int    `json:"index,omitempty"` //Only known once the link is ready
+	Ready bool   `json:"ready"`
+}
+
+// TopologyBridge describes a tenant subnet bridge in the CNCI topology
+type TopologyBridge struct {
+	ID      string     `json:"id"`
+	Tunnels int        `json:"tunnels"`
+	Subnet  string     `json:"subnet,omitempty"` //Subnet served by the dnsmasq
+	DNS     *SubnetDNS `json:"dns,omitempty"`    //DNS configuration of the subnet
+}
+
+// TopologyDump is the CNCI topology as seen by the CNCI
+type TopologyDump struct {
+	Links     []TopologyLink   `json:"links"`
+	Bridges   []TopologyBridge `json:"bridges"`
+	Neighbors []Neighbor       `json:"neighbors,omitempty"`
+}
+
+// Plan describes the devices AddRemoteSubnet would create for a remote
+// subnet. The link names are only known for the devices which exist as
+// the names of new devices are generated when they are created.
+type Plan struct {
+	BridgeAlias    string `json:"bridge_alias"`
+	BridgeLinkName string `json:"bridge_link_name,omitempty"`
+	BridgeExists   bool   `json:"bridge_exists"`
+	GreAlias       string `json:"gre_alias"`
+	GreLinkName    string `json:"gre_link_name,omitempty"`
+	GreExists      bool   `json:"gre_exists"`
+}
+
 // Neighbor contains information about other CNCIs for this tenant.
 type Neighbor struct {
 	PhysicalIP string
@@ -102,9 +185,9 @@ func enableForwarding() error {
 //if the link has an IP address the falls within one of the configured subnets
 //However if the subnets are not specified just add the links
 //It is the callers responsibility to pick the correct link
-func (cnci *Cnci) addPhyLinkToConfig(link netlink.Link, ipv4Addrs []netlink.Addr) {
+func (cnci *Cnci) addPhyLinkToConfig(link netlink.Link, addrs []netlink.Addr) {
 
-	for _, addr := range ipv4Addrs {
+	for _, addr := range addrs {
 
 		if cnci.ManagementNet == nil {
 			cnci.MgtAddr = append(cnci.MgtAddr, addr)
@@ -132,11 +215,98 @@ func (cnci *Cnci) addPhyLinkToConfig(link netlink.Link, ipv4Addrs []netlink.Addr
 	}
 }
 
+//selectComputeLink uses the link named in the configuration for compute
+//traffic. Tunnels are bound to its first address within the compute
+//network. It is also used for management traffic unless a management
+//network is specified.
+func (cnci *Cnci) selectComputeLink(links []netlink.Link) error {
+	for _, link := range links {
+		if link.Attrs().Name != cnci.ComputeIface {
+			continue
+		}
+
+		addrs, err := cnci.physicalAddrs(link)
+		if err != nil {
+			return fmt.Errorf("unable to get addresses of %s %v", cnci.ComputeIface, err)
+		}
+
+		cnci.ComputeAddr = nil
+		cnci.ComputeLink = nil
+		for _, addr := range addrs {
+			if cnci.ComputeNet != nil && !subnetsContain(cnci.ComputeNet, addr.IPNet.IP) {
+				continue
+			}
+			cnci.ComputeAddr = append(cnci.ComputeAddr, addr)
+			cnci.ComputeLink = append(cnci.ComputeLink, link)
+		}
+
+		if len(cnci.ComputeAddr) == 0 {
+			return fmt.Errorf("no compute address on %s %v", cnci.ComputeIface, cnci.ComputeNet)
+		}
+
+		if cnci.ManagementNet == nil {
+			cnci.MgtAddr = cnci.ComputeAddr
+			cnci.MgtLink = cnci.ComputeLink
+		}
+		return nil
+	}
+
+	return fmt.Errorf("compute interface %s not found", cnci.ComputeIface)
+}
+
+//physicalAddrs returns the addresses of a physical link in the address
+//family of the CNCI, the IPv4 addresses first. IPv6 link local addresses
+//are ignored as they are not routable
+func (cnci *Cnci) physicalAddrs(link netlink.Link) ([]netlink.Addr, error) {
+	var families []int
+
+	switch cnci.AddrFamily {
+	case IPv4:
+		families = []int{netlink.FAMILY_V4}
+	case IPv6:
+		families = []int{netlink.FAMILY_V6}
+	case IPv4AndIPv6:
+		families = []int{netlink.FAMILY_V4, netlink.FAMILY_V6}
+	default:
+		return nil, fmt.Errorf("invalid address family %d", cnci.AddrFamily)
+	}
+
+	var addrs []netlink.Addr
+	for _, family := range families {
+		list, err := netlink.AddrList(link, family)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range list {
+			if addr.IPNet == nil || addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+func subnetsContain(subnets []net.IPNet, ip net.IP) bool {
+	for _, s := range subnets {
+		if s.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 //This will return error if it cannot find valid physical
 //interfaces with IP addresses assigned
 //This may be just a delay in acquiring IP addresses
 func (cnci *Cnci) findPhyNwInterface() error {
 
+	if cnci.AddrFamily < IPv4 || cnci.AddrFamily > IPv4AndIPv6 {
+		return fmt.Errorf("invalid address family %d", cnci.AddrFamily)
+	}
+
 	links, err := netlink.LinkList()
 	if err != nil {
 		return err
@@ -153,7 +323,7 @@ func (cnci *Cnci) findPhyNwInterface() error {
 			continue
 		}
 
-		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		addrs, err := cnci.physicalAddrs(link)
 		if err != nil || len(addrs) == 0 {
 			continue //Ignore links with no IP addresses
 		}
@@ -163,6 +333,13 @@ func (cnci *Cnci) findPhyNwInterface() error {
 
 	}
 
+	//An explicitly selected compute link overrides the auto configuration
+	if cnci.ComputeIface != "" {
+		if err := cnci.selectComputeLink(links); err != nil {
+			return err
+		}
+	}
+
 	if len(cnci.MgtAddr) == 0 {
 		return fmt.Errorf("unable to associate with management network %v", cnci.ManagementNet)
 	}
@@ -171,8 +348,9 @@ func (cnci *Cnci) findPhyNwInterface() error {
 	}
 
 	//Allow auto configuration only in the case where there is a single physical
-	//interface with an IP address
-	if (cnci.ManagementNet == nil || cnci.ComputeNet == nil) && phyInterfaces > 1 {
+	//interface with an IP address or the compute interface has been selected
+	if cnci.ComputeIface == "" &&
+		(cnci.ManagementNet == nil || cnci.ComputeNet == nil) && phyInterfaces > 1 {
 		return fmt.Errorf("unable to autoconfigure network")
 	}
 
@@ -182,6 +360,8 @@ func (cnci *Cnci) findPhyNwInterface() error {
 // Init sets the CNCI configuration
 // Discovers the physical interfaces and classifies them as management or compute
 // Performs any node specific networking setup.
+// The topology is recovered from the TopologyFile if present and rebuilt
+// from the link aliases otherwise.
 func (cnci *Cnci) Init() error {
 
 	cnci.APITimeout = time.Second * 6
@@ -196,8 +376,9 @@ func (cnci *Cnci) Init() error {
 	}
 
 	cnci.topology = newCnciTopology()
-	if err = cnci.RebuildTopology(); err != nil {
-		return err
+	if err = cnci.recoverTopology(); err != nil {
+		//Carry on with the part of the topology which was recovered
+		glog.Warningf("Unable to fully rebuild topology %v", err)
 	}
 
 	if err = enableForwarding(); err != nil {
@@ -227,7 +408,12 @@ func (cnci *Cnci) rebuildLinkAndNameMap(links []netlink.Link) {
 	}
 }
 
-func (cnci *Cnci) rebuildBridgeMap(links []netlink.Link) error {
+//rebuildBridgeMap makes best effort progress, a bridge which cannot be
+//recovered does not prevent the recovery of the others. The errors
+//encountered are returned.
+func (cnci *Cnci) rebuildBridgeMap(links []netlink.Link, restartDnsmasq bool) []error {
+	var errs []error
+
 	for _, link := range links {
 		if link.Type() != "bridge" {
 			continue
@@ -235,70 +421,105 @@ func (cnci *Cnci) rebuildBridgeMap(links []netlink.Link) error {
 
 		bridgeID := link.Attrs().Alias
 
-		if !strings.HasPrefix(bridgeID, bridgePrefix) {
+		if !strings.HasPrefix(bridgeID, cnci.bridgePrefix()) {
 			continue
 		}
 
-		br, err := NewBridge(bridgeID)
-		if err != nil {
-			return (err)
+		if err := cnci.rebuildBridge(bridgeID, restartDnsmasq); err != nil {
+			glog.Warningf("Unable to rebuild bridge %s %v", bridgeID, err)
+			errs = append(errs, fmt.Errorf("bridge %s: %v", bridgeID, err))
 		}
+	}
+	return errs
+}
 
-		if err = br.GetDevice(); err != nil {
-			return (err)
-		}
+func (cnci *Cnci) rebuildBridge(bridgeID string, restartDnsmasq bool) error {
+	br, err := NewBridge(bridgeID)
+	if err != nil {
+		return (err)
+	}
 
-		subnet, err := stringToSubnet(strings.TrimPrefix(bridgeID, bridgePrefix))
-		if err != nil {
-			return (err)
-		}
+	if err = br.GetDevice(); err != nil {
+		return (err)
+	}
 
-		dns, err := startDnsmasq(br, cnci.Tenant, *subnet)
-		if err != nil {
-			return (err)
-		}
+	if err = br.setRateLimit(cnci.BridgeRateLimit); err != nil {
+		return (err)
+	}
 
-		cnci.topology.bridgeMap[bridgeID] = &bridgeInfo{
-			Dnsmasq: dns,
-		}
+	subnet, err := stringToSubnet(strings.TrimPrefix(bridgeID, cnci.bridgePrefix()))
+	if err != nil {
+		return (err)
+	}
+
+	var dns *Dnsmasq
+	if restartDnsmasq {
+		dns, err = restartBridgeDnsmasq(br, cnci.Tenant, *subnet, cnci.topology.dns[bridgeID])
+	} else {
+		dns, err = startDnsmasq(br, cnci.Tenant, *subnet, cnci.topology.dns[bridgeID])
+	}
+	if err != nil {
+		return (err)
+	}
+
+	cnci.topology.bridgeMap[bridgeID] = &bridgeInfo{
+		Dnsmasq: dns,
 	}
 	return nil
 }
 
-func (cnci *Cnci) verifyTopology(links []netlink.Link) error {
+//verifyTopology ensures that all tunnels have their associated bridges
+//and accounts for the tunnels of each bridge. All the tunnels are
+//checked and the errors encountered are returned.
+func (cnci *Cnci) verifyTopology(links []netlink.Link) []error {
+	var errs []error
+
 	for _, link := range links {
 		if link.Type() != "gretap" {
 			continue
 		}
 
 		gre := link.Attrs().Alias
-		if !strings.HasPrefix(gre, grePrefix) {
+		if !strings.HasPrefix(gre, cnci.grePrefix()) {
 			continue
 		}
 
-		subnetID := strings.TrimPrefix(strings.Split(gre, "##")[0], grePrefix)
-		bridgeID := bridgePrefix + subnetID
+		subnetID := strings.TrimPrefix(strings.Split(gre, cnci.aliasSeparator())[0], cnci.grePrefix())
+		bridgeID := cnci.bridgePrefix() + subnetID
 
 		if _, ok := cnci.topology.linkMap[bridgeID]; !ok {
-			return fmt.Errorf("missing bridge for gre tunnel %s", gre)
+			glog.Warningf("Missing bridge for gre tunnel %s", gre)
+			errs = append(errs, fmt.Errorf("missing bridge for gre tunnel %s", gre))
+			continue
 		}
 
 		brInfo, ok := cnci.topology.bridgeMap[bridgeID]
 		if !ok {
-			return fmt.Errorf("missing bridge map for gre tunnel %s", gre)
+			glog.Warningf("Missing bridge map for gre tunnel %s", gre)
+			errs = append(errs, fmt.Errorf("missing bridge map for gre tunnel %s", gre))
+			continue
 		}
 		brInfo.tunnels++
+
+		if gretap, ok := link.(*netlink.Gretap); ok {
+			cnci.topology.keyMap[gretap.IKey] = bridgeID
+		}
 	}
-	return nil
+	return errs
 }
 
 //RebuildTopology CNCI network database using the information contained
 //in the aliases. It can be called if the agent using the library
 //crashes and loses network topology information.
 //It can also be called, to rebuild the network topology on demand.
-//TODO: Restarting the DNS Masq here - Define a re-attach method
-//TODO: Log failures when making best effort progress
-func (cnci *Cnci) RebuildTopology() error {
+//The dnsmasq instances already serving the bridges are re-attached to,
+//preserving their DHCP leases. If restartDnsmasq is set they are
+//restarted instead.
+//The bridge rate limit is reapplied to all the bridges.
+//The rebuild makes best effort progress. Bridges and tunnels which cannot
+//be recovered are skipped, the rest of the topology is still rebuilt and
+//an error combining all the failures is returned.
+func (cnci *Cnci) RebuildTopology(restartDnsmasq bool) error {
 
 	if cnci.NetworkConfig == nil || cnci.topology == nil {
 		return fmt.Errorf("cnci not initialized")
@@ -311,6 +532,7 @@ func (cnci *Cnci) RebuildTopology() error {
 
 	cnci.topology.Lock()
 	defer cnci.topology.Unlock()
+	defer cnci.saveTopology()
 	reinitTopology(cnci.topology)
 
 	//Update the link and name map
@@ -318,14 +540,26 @@ func (cnci *Cnci) RebuildTopology() error {
 	cnci.rebuildLinkAndNameMap(links)
 
 	//Create the bridge map
-	err = cnci.rebuildBridgeMap(links)
-	if err != nil {
-		return err
-	}
+	errs := cnci.rebuildBridgeMap(links, restartDnsmasq)
 
 	//Ensure that all tunnels have the associated bridges
-	err = cnci.verifyTopology(links)
-	return err
+	errs = append(errs, cnci.verifyTopology(links)...)
+
+	return combineErrors("topology rebuild incomplete", errs)
+}
+
+//combineErrors returns a single error describing all the errors in errs
+//or nil if errs is empty
+func combineErrors(msg string, errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	allErrors := make([]string, len(errs))
+	for i, e := range errs {
+		allErrors[i] = e.Error()
+	}
+	return fmt.Errorf("%s: [%s]", msg, strings.Join(allErrors, "; "))
 }
 
 func subnetToString(subnet net.IPNet) string {
@@ -338,16 +572,86 @@ func stringToSubnet(subnet string) (*net.IPNet, error) {
 	return ipNet, err
 }
 
-func genBridgeAlias(subnet net.IPNet) string {
-	return fmt.Sprintf("%s%s", bridgePrefix, subnetToString(subnet))
+func (cnci *Cnci) bridgePrefix() string {
+	if cnci.BridgePrefix == "" {
+		return bridgePrefix
+	}
+	return cnci.BridgePrefix
+}
+
+func (cnci *Cnci) grePrefix() string {
+	if cnci.GrePrefix == "" {
+		return grePrefix
+	}
+	return cnci.GrePrefix
+}
+
+func (cnci *Cnci) ifaceRetryLimit() int {
+	if cnci.IfaceRetryLimit <= 0 {
+		return ifaceRetryLimit
+	}
+	return cnci.IfaceRetryLimit
+}
+
+func (cnci *Cnci) aliasSeparator() string {
+	if cnci.AliasSeparator == "" {
+		return aliasSeparator
+	}
+	return cnci.AliasSeparator
+}
+
+//aliasToSubnet returns the subnet served by the bridge with the alias
+func (cnci *Cnci) aliasToSubnet(bridgeID string) string {
+	subnet, err := stringToSubnet(strings.TrimPrefix(bridgeID, cnci.bridgePrefix()))
+	if err != nil {
+		return bridgeID
+	}
+	return subnet.String()
+}
+
+//releaseSubnetKey frees the subnet key once the last tunnel of the
+//bridge is gone. The topology lock must be held by the caller.
+func (cnci *Cnci) releaseSubnetKey(key uint32, bridgeID string, brInfo *bridgeInfo) {
+	if brInfo.tunnels > 0 {
+		return
+	}
+	if cnci.topology.keyMap[key] == bridgeID {
+		delete(cnci.topology.keyMap, key)
+	}
+}
+
+func (cnci *Cnci) genBridgeAlias(subnet net.IPNet) string {
+	return fmt.Sprintf("%s%s", cnci.bridgePrefix(), subnetToString(subnet))
+}
+
+func (cnci *Cnci) genGreAlias(subnet net.IPNet, cnIP net.IP) string {
+	return fmt.Sprintf("%s%s%s%s", cnci.grePrefix(), subnetToString(subnet),
+		cnci.aliasSeparator(), cnIP.String())
 }
 
-func genGreAlias(subnet net.IPNet, cnIP net.IP) string {
-	return fmt.Sprintf("%s%s##%s", grePrefix, subnetToString(subnet), cnIP.String())
+func (cnci *Cnci) parseGreAlias(alias string) (*net.IPNet, net.IP, error) {
+	parts := strings.Split(strings.TrimPrefix(alias, cnci.grePrefix()), cnci.aliasSeparator())
+	if !strings.HasPrefix(alias, cnci.grePrefix()) || len(parts) != 2 {
+		return nil, nil, fmt.Errorf("invalid gre alias %s", alias)
+	}
+
+	subnet, err := stringToSubnet(parts[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid subnet in gre alias %s %v", alias, err)
+	}
+
+	cnIP := net.ParseIP(parts[1])
+	if cnIP == nil {
+		return nil, nil, fmt.Errorf("invalid CN IP in gre alias %s", alias)
+	}
+
+	return subnet, cnIP, nil
 }
 
-func genLinkName(device interface{}, nameMap map[string]bool) (string, error) {
-	for i := 0; i < ifaceRetryLimit; {
+//genLinkName generates a link name for device not already in nameMap,
+//giving up after limit attempts
+func genLinkName(device interface{}, nameMap map[string]bool, limit int) (string, error) {
+	for i := 0; i < limit; i++ {
 		name, _ := genIface(device, false)
 		if !nameMap[name] {
 			nameMap[name] = true
@@ -357,22 +661,41 @@ func genLinkName(device interface{}, nameMap map[string]bool) (string, error) {
 	return "", fmt.Errorf("Unable to generate unique device name")
 }
 
-func startDnsmasq(bridge *Bridge, tenant string, subnet net.IPNet) (*Dnsmasq, error) {
+//startDnsmasq re-attaches to the dnsmasq already serving the bridge if
+//any, preserving its DHCP leases. The dnsmasq is only restarted if it is
+//no longer running.
+func startDnsmasq(bridge *Bridge, tenant string, subnet net.IPNet, cfg SubnetDNS) (*Dnsmasq, error) {
 	dns, err := newDnsmasq(bridge.GlobalID, tenant, subnet, 0, bridge)
 	if err != nil {
 		return nil, fmt.Errorf("NewDnsmasq failed %v", err)
 	}
+	dns.setDNS(cfg)
 
-	if _, err = dns.attach(); err != nil {
-		err = dns.restart()
-		if err != nil {
+	if _, err = dns.reattach(); err != nil {
+		glog.Infof("Restarting dnsmasq for %s %v", bridge.GlobalID, err)
+		if err = dns.restart(); err != nil {
 			return nil, fmt.Errorf("dns.start failed %v", err)
 		}
 	}
 	return dns, nil
 }
 
-func createCnciBridge(bridge *Bridge, brInfo *bridgeInfo, tenant string, subnet net.IPNet) (err error) {
+//restartBridgeDnsmasq unconditionally restarts the dnsmasq serving the
+//bridge. All the active DHCP leases are lost.
+func restartBridgeDnsmasq(bridge *Bridge, tenant string, subnet net.IPNet, cfg SubnetDNS) (*Dnsmasq, error) {
+	dns, err := newDnsmasq(bridge.GlobalID, tenant, subnet, 0, bridge)
+	if err != nil {
+		return nil, fmt.Errorf("NewDnsmasq failed %v", err)
+	}
+	dns.setDNS(cfg)
+
+	if err = dns.restart(); err != nil {
+		return nil, fmt.Errorf("dns.restart failed %v", err)
+	}
+	return dns, nil
+}
+
+func createCnciBridge(bridge *Bridge, brInfo *bridgeInfo, tenant string, subnet net.IPNet, limit RateLimit) (err error) {
 	if bridge == nil || brInfo == nil {
 		return fmt.Errorf("nil pointer encountered bridge[%v] brInfo[%v]", bridge, brInfo)
 	}
@@ -382,7 +705,12 @@ func createCnciBridge(bridge *Bridge, brInfo *bridgeInfo, tenant string, subnet
 	if err = bridge.Enable(); err != nil {
 		return err
 	}
-	brInfo.Dnsmasq, err = startDnsmasq(bridge, tenant, subnet)
+	if limit != (RateLimit{}) {
+		if err = bridge.setRateLimit(limit); err != nil {
+			return err
+		}
+	}
+	brInfo.Dnsmasq, err = startDnsmasq(bridge, tenant, subnet, SubnetDNS{})
 	return err
 }
 
@@ -396,12 +724,34 @@ func createCnciTunnel(gre *GreTapEP) (err error) {
 	return nil
 }
 
+//MaxSubnetPrefixLen is the longest prefix length of a tenant subnet
+//supported by the CNCI. A tenant subnet needs at least MinSubnetHosts
+//usable addresses, one for the gateway on the CNCI bridge and at least
+//one leased to the instances by dnsmasq.
+const (
+	MaxSubnetPrefixLen = 30
+	MinSubnetHosts     = 2
+)
+
+//subnetHosts returns the number of usable host addresses of an IPv4
+//subnet, i.e. excluding its network and broadcast addresses
+func subnetHosts(subnet net.IPNet) int {
+	ones, bits := subnet.Mask.Size()
+	if bits != 32 || bits-ones < 2 {
+		return 0
+	}
+	return 1<<uint(bits-ones) - 2
+}
+
 func checkInputParams(subnet net.IPNet, subnetKey int, cnIP net.IP) error {
 	switch {
 	case subnet.IP == nil:
 		return fmt.Errorf("Invalid input parameters - Subnet IP")
 	case subnet.Mask == nil:
 		return fmt.Errorf("Invalid input parameters - Subnet Mask")
+	case subnetHosts(subnet) < MinSubnetHosts:
+		return fmt.Errorf("Invalid input parameters - Subnet %s too small, the longest prefix supported is /%d",
+			subnet.String(), MaxSubnetPrefixLen)
 	case subnetKey == 0:
 		return fmt.Errorf("Invalid input parameters - Subnet Key")
 	case cnIP == nil:
@@ -410,6 +760,24 @@ func checkInputParams(subnet net.IPNet, subnetKey int, cnIP net.IP) error {
 	return nil
 }
 
+//lookupSubnet checks whether the bridge and tunnel of a remote subnet are
+//present in the topology and that the subnet key is not used by another
+//subnet. The topology lock must be held by the caller.
+func (cnci *Cnci) lookupSubnet(bridgeID string, greID string, key uint32) (brExists bool,
+	greExists bool, bLink *linkInfo, gLink *linkInfo, err error) {
+
+	//A subnet key demultiplexes the traffic of a single subnet
+	if owner, ok := cnci.topology.keyMap[key]; ok && owner != bridgeID {
+		err = fmt.Errorf("Subnet key %d already in use by subnet %s",
+			key, cnci.aliasToSubnet(owner))
+		return
+	}
+
+	bLink, brExists = cnci.topology.linkMap[bridgeID]
+	gLink, greExists = cnci.topology.linkMap[greID]
+	return
+}
+
 //This function inserts the remote subnet in the topology
 //If the function returns error the bridgeName can be ignored
 //If the function does not return error and has a valid bridge name
@@ -420,8 +788,12 @@ func (cnci *Cnci) addSubnetToTopology(bridge *Bridge, gre *GreTapEP, brInfo **br
 
 	// CS Start
 	cnci.topology.Lock()
-	bLink, brExists = cnci.topology.linkMap[bridge.GlobalID]
-	gLink, greExists = cnci.topology.linkMap[gre.GlobalID]
+
+	brExists, greExists, bLink, gLink, err = cnci.lookupSubnet(bridge.GlobalID, gre.GlobalID, gre.Key)
+	if err != nil {
+		cnci.topology.Unlock()
+		return
+	}
 
 	if brExists && greExists {
 		cnci.topology.Unlock()
@@ -429,7 +801,7 @@ func (cnci *Cnci) addSubnetToTopology(bridge *Bridge, gre *GreTapEP, brInfo **br
 	}
 
 	if !brExists {
-		bridge.LinkName, err = genLinkName(bridge, cnci.topology.nameMap)
+		bridge.LinkName, err = genLinkName(bridge, cnci.topology.nameMap, cnci.ifaceRetryLimit())
 		if err != nil {
 			cnci.topology.Unlock()
 			return
@@ -453,7 +825,7 @@ func (cnci *Cnci) addSubnetToTopology(bridge *Bridge, gre *GreTapEP, brInfo **br
 	}
 
 	if !greExists {
-		gre.LinkName, err = genLinkName(gre, cnci.topology.nameMap)
+		gre.LinkName, err = genLinkName(gre, cnci.topology.nameMap, cnci.ifaceRetryLimit())
 		if err != nil {
 			cnci.topology.Unlock()
 			return
@@ -465,6 +837,7 @@ func (cnci *Cnci) addSubnetToTopology(bridge *Bridge, gre *GreTapEP, brInfo **br
 		}
 		cnci.topology.linkMap[gre.GlobalID] = gLink
 		(*brInfo).tunnels++
+		cnci.topology.keyMap[gre.Key] = bridge.GlobalID
 	}
 	cnci.topology.Unlock()
 	//End CS
@@ -516,14 +889,14 @@ func (cnci *Cnci) confirmTunnel(n Neighbor) (*GreTunEP, error) {
 			// we should remove this addr.
 			// we can do this because there should
 			// be only one.
-			err = netlink.AddrDel(tun.Link, &a)
+			err = retryNetlink("AddrDel", func() error { return nlOps.addrDel(tun.Link, &a) })
 			if err != nil {
 				return nil, err
 			}
 		}
 	}
 	if !added {
-		err = netlink.AddrAdd(tun.Link, addr)
+		err = retryNetlink("AddrAdd", func() error { return nlOps.addrAdd(tun.Link, addr) })
 		if err != nil {
 			return nil, err
 		}
@@ -539,15 +912,46 @@ func neighborEqual(a netlink.Neigh, b netlink.Neigh) (equal bool) {
 	return false
 }
 
-// make sure that the neighbor entries are correct, as well as the
-// route entry for the neighbor.
-func (cnci *Cnci) confirmNeighbors(tun *GreTunEP, n Neighbor, neighs []netlink.Neigh) (netlink.Neigh, error) {
-	neigh := netlink.Neigh{
+//neighborEntry returns the neighbor entry of n on the tunnel
+func neighborEntry(tun *GreTunEP, n Neighbor) netlink.Neigh {
+	return netlink.Neigh{
 		IP:        net.ParseIP(n.TunnelIP),
 		LLIPAddr:  net.ParseIP(n.PhysicalIP),
 		LinkIndex: tun.Link.Index,
 		State:     netlink.NUD_PERMANENT,
 	}
+}
+
+//neighborRoutes returns the routes through the tunnel to the neighbor
+//itself and to the subnet it serves
+func neighborRoutes(tun *GreTunEP, n Neighbor) ([]netlink.Route, error) {
+	dst := net.IPNet{
+		IP:   net.ParseIP(n.TunnelIP),
+		Mask: net.CIDRMask(32, 32),
+	}
+
+	_, IPnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	return []netlink.Route{
+		{
+			LinkIndex: tun.Link.Index,
+			Dst:       &dst,
+		},
+		{
+			LinkIndex: tun.Link.Index,
+			Dst:       IPnet,
+			Gw:        net.ParseIP(n.TunnelIP),
+		},
+	}, nil
+}
+
+// make sure that the neighbor entries are correct, as well as the
+// route entry for the neighbor.
+func (cnci *Cnci) confirmNeighbors(tun *GreTunEP, n Neighbor, neighs []netlink.Neigh) (netlink.Neigh, error) {
+	neigh := neighborEntry(tun, n)
 
 	var exists bool
 	// see if this already exists
@@ -559,42 +963,120 @@ func (cnci *Cnci) confirmNeighbors(tun *GreTunEP, n Neighbor, neighs []netlink.N
 	}
 
 	if !exists {
-		err := netlink.NeighAdd(&neigh)
+		err := retryNetlink("NeighAdd", func() error { return nlOps.neighAdd(&neigh) })
 		if err != nil {
 			return neigh, err
 		}
 
-		dst := net.IPNet{
-			IP:   net.ParseIP(n.TunnelIP),
-			Mask: net.CIDRMask(32, 32),
-		}
-
-		route := netlink.Route{
-			LinkIndex: tun.Link.Index,
-			Dst:       &dst,
-		}
-		err = netlink.RouteAdd(&route)
+		routes, err := neighborRoutes(tun, n)
 		if err != nil {
 			return neigh, err
 		}
 
-		_, IPnet, err := net.ParseCIDR(n.Subnet)
-		if err != nil {
-			return neigh, err
+		for i := range routes {
+			route := &routes[i]
+			err = retryNetlink("RouteAdd", func() error { return nlOps.routeAdd(route) })
+			if err != nil {
+				return neigh, err
+			}
+		}
+	}
+	return neigh, nil
+}
+
+//missingNetlinkEntry reports whether err indicates that the entry being
+//deleted does not exist
+func missingNetlinkEntry(err error) bool {
+	return err == syscall.ENOENT || err == syscall.ESRCH
+}
+
+//removeDepartedNeighbors tears down the neighbor entries and routes of
+//the neighbors which were configured by the previous update but are
+//absent from neighbors. Only the neighbors serving the subnet are
+//considered unless subnet is empty. The entry of the local CNCI is never
+//removed. Entries already gone are ignored, removal continues on failure
+//and the errors encountered are returned.
+func (cnci *Cnci) removeDepartedNeighbors(tun *GreTunEP, subnet string, neighbors []Neighbor, localIP string) error {
+	current := make(map[string]bool)
+	for _, n := range neighbors {
+		current[n.PhysicalIP] = true
+	}
+
+	cnci.topology.Lock()
+	previous := cnci.topology.neighbors
+	cnci.topology.Unlock()
+
+	var errs []error
+	for _, n := range previous {
+		if n.PhysicalIP == localIP || current[n.PhysicalIP] {
+			continue
+		}
+		if subnet != "" && n.Subnet != subnet {
+			continue
 		}
 
-		route = netlink.Route{
-			LinkIndex: tun.Link.Index,
-			Dst:       IPnet,
-			Gw:        net.ParseIP(n.TunnelIP),
+		errs = append(errs, removeNeighbor(tun, n)...)
+	}
+
+	return combineErrors("departed neighbor cleanup incomplete", errs)
+}
+
+//removeChangedNeighbors tears down the neighbor entries and routes of
+//the neighbors configured by the previous update whose subnet, tunnel IP
+//or tunnel key differ in neighbors, so that they are reprogrammed from
+//scratch. The netlink neighbor entry alone does not reflect the subnet
+//and key, a changed neighbor would otherwise keep its stale routes. The
+//local CNCI is handled by the tunnel and is never removed.
+func (cnci *Cnci) removeChangedNeighbors(tun *GreTunEP, neighbors []Neighbor, localIP string) error {
+	current := make(map[string]Neighbor)
+	for _, n := range neighbors {
+		current[n.PhysicalIP] = n
+	}
+
+	cnci.topology.Lock()
+	previous := cnci.topology.neighbors
+	cnci.topology.Unlock()
+
+	var errs []error
+	for _, n := range previous {
+		updated, ok := current[n.PhysicalIP]
+		if !ok || n.PhysicalIP == localIP || updated == n {
+			continue
 		}
 
-		err = netlink.RouteAdd(&route)
-		if err != nil {
-			return neigh, err
+		glog.Infof("Neighbor %s changed from %v to %v", n.PhysicalIP, n, updated)
+		errs = append(errs, removeNeighbor(tun, n)...)
+	}
+
+	return combineErrors("changed neighbor cleanup incomplete", errs)
+}
+
+//removeNeighbor deletes the neighbor entry and routes of n, ignoring
+//the entries already gone. Removal continues on failure and the errors
+//encountered are returned.
+func removeNeighbor(tun *GreTunEP, n Neighbor) []error {
+	var errs []error
+
+	neigh := neighborEntry(tun, n)
+	err := retryNetlink("NeighDel", func() error { return nlOps.neighDel(&neigh) })
+	if err != nil && !missingNetlinkEntry(err) {
+		errs = append(errs, fmt.Errorf("neighbor %s: %v", n.PhysicalIP, err))
+	}
+
+	routes, err := neighborRoutes(tun, n)
+	if err != nil {
+		return append(errs, fmt.Errorf("neighbor %s: %v", n.PhysicalIP, err))
+	}
+
+	for i := range routes {
+		route := &routes[i]
+		err = retryNetlink("RouteDel", func() error { return nlOps.routeDel(route) })
+		if err != nil && !missingNetlinkEntry(err) {
+			errs = append(errs, fmt.Errorf("neighbor %s route %v: %v", n.PhysicalIP, route.Dst, err))
 		}
 	}
-	return neigh, nil
+
+	return errs
 }
 
 func (cnci *Cnci) confirmRoutes(tun *GreTunEP, updated []netlink.Neigh, old []netlink.Neigh) error {
@@ -613,7 +1095,7 @@ func (cnci *Cnci) confirmRoutes(tun *GreTunEP, updated []netlink.Neigh, old []ne
 		}
 
 		if !found {
-			err := netlink.NeighDel(&n)
+			err := retryNetlink("NeighDel", func() error { return nlOps.neighDel(&n) })
 			if err != nil {
 				glog.Warningf("Unable to delete stale neighbor: (%v)\n", err)
 				// keep going.
@@ -622,7 +1104,7 @@ func (cnci *Cnci) confirmRoutes(tun *GreTunEP, updated []netlink.Neigh, old []ne
 			// remove routes.
 			for _, r := range routes {
 				if r.Dst.IP.Equal(n.IP) || r.Gw.Equal(n.IP) {
-					err = netlink.RouteDel(&r)
+					err = retryNetlink("RouteDel", func() error { return nlOps.routeDel(&r) })
 					if err != nil {
 						glog.Warningf("Unable to delete stale route (%v)\n", err)
 						// keep going.
@@ -634,15 +1116,49 @@ func (cnci *Cnci) confirmRoutes(tun *GreTunEP, updated []netlink.Neigh, old []ne
 	return nil
 }
 
+// localComputeIP returns the address of the CNCI on the compute network
+func (cnci *Cnci) localComputeIP() (string, error) {
+	if len(cnci.ComputeAddr) == 0 || cnci.ComputeAddr[0].IPNet == nil {
+		return "", fmt.Errorf("CNCI %s has no compute address", cnci.ID)
+	}
+
+	return cnci.ComputeAddr[0].IPNet.IP.String(), nil
+}
+
+// neighborIPs returns the physical IPs of neighbors for logging
+func neighborIPs(neighbors []Neighbor) []string {
+	ips := make([]string, 0, len(neighbors))
+	for _, n := range neighbors {
+		ips = append(ips, n.PhysicalIP)
+	}
+	return ips
+}
+
 // UpdateNeighbors will create a point to multipoint gre tunnel between
 // all the CNCIs for this tenant.
+// The neighbor entries and routes of CNCIs which have left the tenant
+// since the previous update are torn down. The local tunnel end point is
+// kept.
+// An empty list carries no information, as the local CNCI is always part
+// of the tenant, and is ignored. A list holding only the local CNCI means
+// that it is the last CNCI of the tenant, only the neighbors configured by
+// previous updates are then torn down.
 func (cnci *Cnci) UpdateNeighbors(neighbors []Neighbor) error {
 	var tun *GreTunEP
-	var err error
+
+	if len(neighbors) == 0 {
+		glog.Warningf("Ignoring empty neighbor list")
+		return nil
+	}
+
+	localIP, err := cnci.localComputeIP()
+	if err != nil {
+		return err
+	}
 
 	// this must be done first
 	for _, n := range neighbors {
-		if n.PhysicalIP == cnci.ComputeAddr[0].IPNet.IP.String() {
+		if n.PhysicalIP == localIP {
 			tun, err = cnci.confirmTunnel(n)
 			if err != nil {
 				return err
@@ -650,46 +1166,457 @@ func (cnci *Cnci) UpdateNeighbors(neighbors []Neighbor) error {
 			break
 		}
 	}
+	if tun == nil {
+		ips := neighborIPs(neighbors)
+		glog.Warningf("Local CNCI %s missing from neighbors %v", localIP, ips)
+		return fmt.Errorf("local CNCI %s missing from neighbors %v", localIP, ips)
+	}
 
-	neighs, err := netlink.NeighList(tun.Link.Index, netlink.FAMILY_V4)
-	if err != nil {
+	return cnci.updateNeighbors(tun, neighbors, localIP)
+}
+
+//updateNeighbors programs neighbors on the tunnel of the local CNCI. The
+//tunnel entries which do not belong to any of the neighbors are swept
+//only if there is at least one remote neighbor.
+func (cnci *Cnci) updateNeighbors(tun *GreTunEP, neighbors []Neighbor, localIP string) error {
+	// must be done before listing the entries so that the changed
+	// neighbors are added back.
+	if err := cnci.removeChangedNeighbors(tun, neighbors, localIP); err != nil {
 		return err
 	}
 
-	var updated []netlink.Neigh
+	remote := 0
 	for _, n := range neighbors {
-		if n.PhysicalIP == cnci.ComputeAddr[0].IPNet.IP.String() {
-			continue
+		if n.PhysicalIP != localIP {
+			remote++
 		}
+	}
 
-		neigh, err := cnci.confirmNeighbors(tun, n, neighs)
+	if remote > 0 {
+		neighs, err := netlink.NeighList(tun.Link.Index, netlink.FAMILY_V4)
 		if err != nil {
 			return err
 		}
 
-		updated = append(updated, neigh)
+		var updated []netlink.Neigh
+		for _, n := range neighbors {
+			if n.PhysicalIP == localIP {
+				continue
+			}
+
+			neigh, err := cnci.confirmNeighbors(tun, n, neighs)
+			if err != nil {
+				return err
+			}
+
+			updated = append(updated, neigh)
+		}
+
+		// clean up any routes neighbors that need removing.
+		err = cnci.confirmRoutes(tun, updated, neighs)
+		if err != nil {
+			return err
+		}
+	} else {
+		glog.Infof("Local CNCI %s is the only CNCI of the tenant", localIP)
+	}
+
+	// tear down whatever is left of the CNCIs which have left the tenant.
+	if err := cnci.removeDepartedNeighbors(tun, "", neighbors, localIP); err != nil {
+		glog.Warningf("Unable to remove departed neighbors: (%v)", err)
+	}
+
+	cnci.topology.Lock()
+	cnci.topology.neighbors = neighbors
+	cnci.saveTopology()
+	cnci.topology.Unlock()
+
+	return nil
+}
+
+// UpdateSubnetNeighbors updates the tunnel to the CNCIs serving a single
+// subnet of the tenant. The neighbors are the CNCIs now serving the subnet.
+// The other neighbors configured by previous updates are left untouched.
+// The local CNCI does not need to be part of the neighbors.
+func (cnci *Cnci) UpdateSubnetNeighbors(subnet string, neighbors []Neighbor) error {
+	localIP, err := cnci.localComputeIP()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range neighbors {
+		if n.Subnet != subnet && n.PhysicalIP != localIP {
+			return fmt.Errorf("neighbor %s not in subnet %s", n.PhysicalIP, subnet)
+		}
+	}
+
+	cnci.topology.Lock()
+	merged := mergeNeighbors(cnci.topology.neighbors, subnet, neighbors, localIP)
+	cnci.topology.Unlock()
+
+	var tun *GreTunEP
+	for _, n := range merged {
+		if n.PhysicalIP == localIP {
+			tun, err = cnci.confirmTunnel(n)
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if tun == nil {
+		ips := neighborIPs(merged)
+		glog.Warningf("Local CNCI %s missing from neighbors %v", localIP, ips)
+		return fmt.Errorf("local CNCI %s unknown", localIP)
+	}
+
+	if err := cnci.removeChangedNeighbors(tun, neighbors, localIP); err != nil {
+		return err
+	}
+
+	neighs, err := netlink.NeighList(tun.Link.Index, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range neighbors {
+		if n.PhysicalIP == localIP {
+			continue
+		}
+
+		if _, err := cnci.confirmNeighbors(tun, n, neighs); err != nil {
+			return err
+		}
+	}
+
+	if err := cnci.removeDepartedNeighbors(tun, subnet, neighbors, localIP); err != nil {
+		glog.Warningf("Unable to remove departed neighbors: (%v)", err)
+	}
+
+	cnci.topology.Lock()
+	cnci.topology.neighbors = merged
+	cnci.saveTopology()
+	cnci.topology.Unlock()
+
+	return nil
+}
+
+//mergeNeighbors replaces the neighbors serving the subnet with neighbors.
+//The local CNCI is kept unless neighbors hold a new entry for it, as are
+//the neighbors of other subnets unless they have moved to the subnet.
+func mergeNeighbors(previous []Neighbor, subnet string, neighbors []Neighbor, localIP string) []Neighbor {
+	updated := make(map[string]bool)
+	for _, n := range neighbors {
+		updated[n.PhysicalIP] = true
+	}
+
+	var merged []Neighbor
+	for _, n := range previous {
+		if updated[n.PhysicalIP] {
+			continue
+		}
+		if n.PhysicalIP == localIP || n.Subnet != subnet {
+			merged = append(merged, n)
+		}
+	}
+
+	return append(merged, neighbors...)
+}
+
+func hasRoute(routes []netlink.Route, dst *net.IPNet, gw net.IP) bool {
+	for _, r := range routes {
+		if r.Dst == nil || r.Dst.String() != dst.String() {
+			continue
+		}
+		if gw == nil || r.Gw.Equal(gw) {
+			return true
+		}
+	}
+	return false
+}
+
+// make sure that the cnci tunnel is still up and that the neighbor and
+// route entries created by confirmNeighbors are still present
+func (cnci *Cnci) checkNeighbors(neighbors []Neighbor) error {
+	localIP, err := cnci.localComputeIP()
+	if err != nil {
+		return err
+	}
+
+	var local *Neighbor
+	for i := range neighbors {
+		if neighbors[i].PhysicalIP == localIP {
+			local = &neighbors[i]
+			break
+		}
+	}
+
+	if local == nil {
+		//The CNCI tunnel has not been setup
+		return nil
+	}
+
+	tun, err := newGreTunEP("cncitun", net.ParseIP(local.PhysicalIP), local.TunnelID)
+	if err != nil {
+		return err
+	}
+
+	if err = tun.getDevice(); err != nil {
+		return err
+	}
+
+	if tun.Link.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("cnci tunnel %s is down", tun.GlobalID)
+	}
+
+	neighs, err := netlink.NeighList(tun.Link.Index, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+
+	routes, err := netlink.RouteList(tun.Link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range neighbors {
+		if n.PhysicalIP == localIP {
+			continue
+		}
+
+		expected := netlink.Neigh{
+			IP:       net.ParseIP(n.TunnelIP),
+			LLIPAddr: net.ParseIP(n.PhysicalIP),
+		}
+
+		var found bool
+		for _, neighbor := range neighs {
+			found = neighborEqual(neighbor, expected)
+			if found {
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("missing neighbor %s for %s", n.TunnelIP, n.PhysicalIP)
+		}
+
+		host := &net.IPNet{
+			IP:   expected.IP,
+			Mask: net.CIDRMask(32, 32),
+		}
+		if !hasRoute(routes, host, nil) {
+			return fmt.Errorf("missing route to neighbor %s", n.TunnelIP)
+		}
+
+		_, IPnet, err := net.ParseCIDR(n.Subnet)
+		if err != nil {
+			return err
+		}
+		if !hasRoute(routes, IPnet, expected.IP) {
+			return fmt.Errorf("missing route to %s via %s", n.Subnet, n.TunnelIP)
+		}
+	}
+
+	return nil
+}
+
+//CheckTunnel verifies that the tunnel connecting the subnet bridge to the
+//compute node cnIP exists, is administratively up and attached to its bridge.
+//If neighbors have been configured it also verifies that the cnci tunnel is
+//up and that the neighbor and route entries are still present.
+//It returns false along with the reason if the tunnel is not healthy
+func (cnci *Cnci) CheckTunnel(subnet net.IPNet, cnIP net.IP) (bool, error) {
+
+	if cnci.NetworkConfig == nil || cnci.topology == nil {
+		return false, fmt.Errorf("cnci not initialized")
+	}
+
+	greID := cnci.genGreAlias(subnet, cnIP)
+	bridgeID := cnci.genBridgeAlias(subnet)
+
+	cnci.topology.Lock()
+	gLink, greExists := cnci.topology.linkMap[greID]
+	bLink, brExists := cnci.topology.linkMap[bridgeID]
+	neighbors := cnci.topology.neighbors
+	cnci.topology.Unlock()
+
+	if !greExists {
+		return false, fmt.Errorf("tunnel %s does not exist", greID)
+	}
+	if !brExists {
+		return false, fmt.Errorf("bridge %s does not exist", bridgeID)
+	}
+
+	_, gIndex, err := waitForDeviceReady(gLink, cnci.APITimeout)
+	if err != nil {
+		return false, err
+	}
+	_, bIndex, err := waitForDeviceReady(bLink, cnci.APITimeout)
+	if err != nil {
+		return false, err
+	}
+
+	link, err := netlink.LinkByIndex(gIndex)
+	if err != nil {
+		return false, fmt.Errorf("tunnel %s device missing %v", greID, err)
+	}
+
+	attrs := link.Attrs()
+	switch {
+	case link.Type() != "gretap":
+		return false, fmt.Errorf("tunnel %s incorrect interface type %s", greID, link.Type())
+	case attrs.Flags&net.FlagUp == 0:
+		return false, fmt.Errorf("tunnel %s is down", greID)
+	case attrs.MasterIndex != bIndex:
+		return false, fmt.Errorf("tunnel %s not attached to bridge %s", greID, bridgeID)
+	}
+
+	if err := cnci.checkNeighbors(neighbors); err != nil {
+		return false, err
 	}
 
-	// clean up any routes neighbors that need removing.
-	return cnci.confirmRoutes(tun, updated, neighs)
+	return true, nil
+}
+
+//HealthCheck checks all the tunnels present in the topology and
+//returns their status
+func (cnci *Cnci) HealthCheck() []TunnelStatus {
+	if cnci.NetworkConfig == nil || cnci.topology == nil {
+		return nil
+	}
+
+	var aliases []string
+
+	cnci.topology.Lock()
+	for alias := range cnci.topology.linkMap {
+		if strings.HasPrefix(alias, cnci.grePrefix()) {
+			aliases = append(aliases, alias)
+		}
+	}
+	cnci.topology.Unlock()
+
+	sort.Strings(aliases)
+
+	status := make([]TunnelStatus, 0, len(aliases))
+	for _, alias := range aliases {
+		subnet, cnIP, err := cnci.parseGreAlias(alias)
+		if err != nil {
+			status = append(status, TunnelStatus{Err: err})
+			continue
+		}
+
+		up, err := cnci.CheckTunnel(*subnet, cnIP)
+		status = append(status, TunnelStatus{
+			Subnet: *subnet,
+			CNIP:   cnIP,
+			Up:     up,
+			Err:    err,
+		})
+	}
+
+	return status
+}
+
+//rollbackRemoteSubnet undoes the changes made by a failed AddRemoteSubnet
+//call. Only the bridge and tunnel added to the topology by that call are
+//removed. The bridge is kept if other tunnels have been attached to it
+//in the meantime.
+func (cnci *Cnci) rollbackRemoteSubnet(bridge *Bridge, brInfo *bridgeInfo, brCreated bool,
+	gre *GreTapEP, greCreated bool) {
+
+	cnci.topology.Lock()
+	defer cnci.topology.Unlock()
+	defer cnci.saveTopology()
+
+	if greCreated {
+		if gre.Link != nil && gre.Link.Index != 0 {
+			if err := gre.destroy(); err != nil {
+				glog.Warningf("Rollback unable to destroy tunnel %s %v", gre.GlobalID, err)
+			}
+		}
+		delete(cnci.topology.linkMap, gre.GlobalID)
+		delete(cnci.topology.nameMap, gre.LinkName)
+		brInfo.tunnels--
+		cnci.releaseSubnetKey(gre.Key, bridge.GlobalID, brInfo)
+	}
+
+	if !brCreated || brInfo.tunnels > 0 {
+		return
+	}
+
+	if brInfo.Dnsmasq != nil {
+		if err := brInfo.Dnsmasq.stop(); err != nil {
+			glog.Warningf("Rollback unable to stop dnsmasq %s %v", bridge.GlobalID, err)
+		}
+	}
+	if bridge.Link != nil && bridge.Link.Index != 0 {
+		if err := bridge.Destroy(); err != nil {
+			glog.Warningf("Rollback unable to destroy bridge %s %v", bridge.GlobalID, err)
+		}
+	}
+	delete(cnci.topology.linkMap, bridge.GlobalID)
+	delete(cnci.topology.bridgeMap, bridge.GlobalID)
+	delete(cnci.topology.nameMap, bridge.LinkName)
+}
+
+//PlanRemoteSubnet returns the devices AddRemoteSubnet would create for
+//a remote subnet without creating them. It neither changes the topology
+//nor touches the links and can be called on a live CNCI
+func (cnci *Cnci) PlanRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP) (Plan, error) {
+	if cnci.topology == nil {
+		return Plan{}, fmt.Errorf("cnci not initialized")
+	}
+
+	if err := checkInputParams(subnet, subnetKey, cnIP); err != nil {
+		return Plan{}, err
+	}
+
+	plan := Plan{
+		BridgeAlias: cnci.genBridgeAlias(subnet),
+		GreAlias:    cnci.genGreAlias(subnet, cnIP),
+	}
+
+	cnci.topology.Lock()
+	defer cnci.topology.Unlock()
+
+	brExists, greExists, bLink, gLink, err := cnci.lookupSubnet(plan.BridgeAlias, plan.GreAlias, uint32(subnetKey))
+	if err != nil {
+		return Plan{}, err
+	}
+
+	plan.BridgeExists = brExists
+	if brExists {
+		plan.BridgeLinkName = bLink.name
+	}
+
+	plan.GreExists = greExists
+	if greExists {
+		plan.GreLinkName = gLink.name
+	}
+
+	return plan, nil
 }
 
 //AddRemoteSubnet attaches a remote subnet to a local bridge on the CNCI
 //If the bridge and DHCP server does not exist it will be created.
 //If the tunnel exists and the bridge does not exist the bridge is created
 //The bridge name interface name is returned if the bridge is newly created
-func (cnci *Cnci) AddRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP) (string, error) {
+//On failure the bridge, DHCP server and tunnel created by the call are
+//removed so that the call can be safely retried
+//Subnets with a prefix longer than MaxSubnetPrefixLen are rejected as they
+//do not leave any address to lease to the instances
+func (cnci *Cnci) AddRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP) (brName string, err error) {
 
 	if err := checkInputParams(subnet, subnetKey, cnIP); err != nil {
 		return "", err
 	}
 
-	bridge, err := NewBridge(genBridgeAlias(subnet))
+	bridge, err := NewBridge(cnci.genBridgeAlias(subnet))
 	if err != nil {
 		return "", err
 	}
 
-	gre, err := newGreTapEP(genGreAlias(subnet, cnIP), cnci.ComputeAddr[0].IPNet.IP, cnIP, uint32(subnetKey))
+	gre, err := newGreTapEP(cnci.genGreAlias(subnet, cnIP), cnci.ComputeAddr[0].IPNet.IP, cnIP, uint32(subnetKey))
 	if err != nil {
 		return "", err
 	}
@@ -705,14 +1632,23 @@ func (cnci *Cnci) AddRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP)
 		return bLink.name, nil
 	}
 
+	//Do not leave any partially created devices behind
+	defer func() {
+		if err != nil {
+			cnci.rollbackRemoteSubnet(bridge, brInfo, !brExists, gre, !greExists)
+		}
+	}()
+
 	//Now create them. This is time consuming
 	if !brExists {
-		err = createCnciBridge(bridge, brInfo, cnci.Tenant, subnet)
+		err = createCnciBridge(bridge, brInfo, cnci.Tenant, subnet, cnci.BridgeRateLimit)
 		bLink.index = bridge.Link.Index
 		close(bLink.ready)
 		if err != nil {
 			//Do not leave the GRE hanging
-			close(gLink.ready)
+			if !greExists {
+				close(gLink.ready)
+			}
 			return "", err
 		}
 	}
@@ -736,6 +1672,11 @@ func (cnci *Cnci) AddRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP)
 	}
 
 	err = gre.attach(bridge)
+	if err == nil {
+		cnci.topology.Lock()
+		cnci.saveTopology()
+		cnci.topology.Unlock()
+	}
 	if brExists {
 		return "", err
 	}
@@ -747,14 +1688,26 @@ func (cnci *Cnci) AddRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP)
 //The bridge and DHCP server is kept around as they impose minimal overhead
 //and helps in the case where instances keep getting added and deleted constantly
 func (cnci *Cnci) DelRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP) error {
+	return cnci.delRemoteSubnet(subnet, subnetKey, cnIP, false)
+}
+
+//DelRemoteSubnetGC detaches a remote subnet from the local bridge
+//Once the last tunnel of the bridge has been removed the bridge and its DHCP
+//server are also torn down. This prevents long running CNCIs from
+//accumulating idle bridges. A bridge which still has tunnels is kept.
+func (cnci *Cnci) DelRemoteSubnetGC(subnet net.IPNet, subnetKey int, cnIP net.IP) error {
+	return cnci.delRemoteSubnet(subnet, subnetKey, cnIP, true)
+}
+
+func (cnci *Cnci) delRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP, removeBridge bool) error {
 
 	if err := checkInputParams(subnet, subnetKey, cnIP); err != nil {
 		return err
 	}
 
-	bridgeID := genBridgeAlias(subnet)
+	bridgeID := cnci.genBridgeAlias(subnet)
 
-	gre, err := newGreTapEP(genGreAlias(subnet, cnIP),
+	gre, err := newGreTapEP(cnci.genGreAlias(subnet, cnIP),
 		cnci.ComputeAddr[0].IPNet.IP,
 		cnIP, uint32(subnetKey))
 
@@ -765,6 +1718,7 @@ func (cnci *Cnci) DelRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP)
 	// CS Start
 	cnci.topology.Lock()
 	defer cnci.topology.Unlock()
+	defer cnci.saveTopology()
 
 	gLink, present := cnci.topology.linkMap[gre.GlobalID]
 
@@ -774,11 +1728,13 @@ func (cnci *Cnci) DelRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP)
 		return nil
 	}
 
-	if brInfo, present := cnci.topology.bridgeMap[bridgeID]; !present {
+	brInfo, brPresent := cnci.topology.bridgeMap[bridgeID]
+	if !brPresent {
 		//TODO: Log this and continue
 		fmt.Println("internal error bridge does not exist ", bridgeID)
 	} else {
 		brInfo.tunnels--
+		cnci.releaseSubnetKey(gre.Key, bridgeID, brInfo)
 	}
 
 	gre.LinkName, gre.Link.Index, err = waitForDeviceReady(gLink, cnci.APITimeout)
@@ -788,48 +1744,231 @@ func (cnci *Cnci) DelRemoteSubnet(subnet net.IPNet, subnetKey int, cnIP net.IP)
 
 	delete(cnci.topology.nameMap, gre.GlobalID)
 	delete(cnci.topology.linkMap, gre.GlobalID)
-	err = gre.destroy()
+	if err = gre.destroy(); err != nil {
+		return err
+	}
 
-	return err
+	if !removeBridge || !brPresent || brInfo.tunnels > 0 {
+		return nil
+	}
+
+	return cnci.removeBridge(bridgeID, brInfo)
+}
+
+//removeBridge stops the DHCP server of an idle bridge, destroys the bridge
+//and removes it from the topology. The topology lock must be held by the
+//caller.
+func (cnci *Cnci) removeBridge(bridgeID string, brInfo *bridgeInfo) error {
+	if brInfo.tunnels > 0 {
+		return fmt.Errorf("bridge %s still has %d tunnels", bridgeID, brInfo.tunnels)
+	}
+
+	bLink, present := cnci.topology.linkMap[bridgeID]
+	if !present {
+		delete(cnci.topology.bridgeMap, bridgeID)
+		return nil
+	}
+
+	bridge, err := NewBridge(bridgeID)
+	if err != nil {
+		return err
+	}
+
+	bridge.LinkName, bridge.Link.Index, err = waitForDeviceReady(bLink, cnci.APITimeout)
+	if err != nil {
+		return fmt.Errorf("DelRemoteSubnet %s %v", bridgeID, err)
+	}
+
+	if brInfo.Dnsmasq != nil {
+		if err := brInfo.Dnsmasq.stop(); err != nil {
+			return err
+		}
+	}
+
+	if err := bridge.Destroy(); err != nil {
+		return err
+	}
+
+	delete(cnci.topology.linkMap, bridgeID)
+	delete(cnci.topology.bridgeMap, bridgeID)
+	delete(cnci.topology.nameMap, bridge.LinkName)
+	delete(cnci.topology.dns, bridgeID)
+	return nil
+}
+
+//ConfigureSubnetDNS sets the DNS configuration pushed to the instances of
+//the subnet by its dnsmasq. As dnsmasq only reads its configuration on
+//startup it is restarted to apply the change. The configuration is
+//re-applied whenever the topology is rebuilt.
+func (cnci *Cnci) ConfigureSubnetDNS(subnet net.IPNet, cfg SubnetDNS) error {
+	if cnci.NetworkConfig == nil || cnci.topology == nil {
+		return fmt.Errorf("cnci not initialized")
+	}
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	bridgeID := cnci.genBridgeAlias(subnet)
+
+	cnci.topology.Lock()
+	defer cnci.topology.Unlock()
+	defer cnci.saveTopology()
+
+	bLink, brExists := cnci.topology.linkMap[bridgeID]
+	brInfo, present := cnci.topology.bridgeMap[bridgeID]
+	if !brExists || !present {
+		return fmt.Errorf("subnet %s does not exist", subnet.String())
+	}
+
+	if _, _, err := waitForDeviceReady(bLink, cnci.APITimeout); err != nil {
+		return fmt.Errorf("ConfigureSubnetDNS %s %v", bridgeID, err)
+	}
+	if brInfo.Dnsmasq == nil {
+		return fmt.Errorf("subnet %s has no dnsmasq", subnet.String())
+	}
+
+	brInfo.Dnsmasq.setDNS(cfg)
+	if err := brInfo.Dnsmasq.restart(); err != nil {
+		return err
+	}
+
+	cnci.topology.dns[bridgeID] = cfg
+	return nil
+}
+
+func linkReady(linfo *linkInfo) bool {
+	select {
+	case <-linfo.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+//DumpTopology returns the JSON encoding of the topology of the CNCI.
+//It can be called concurrently with the other APIs. The details of links
+//and bridges which are still being created are not reported as they are
+//only stable once the link is ready.
+func (cnci *Cnci) DumpTopology() ([]byte, error) {
+	if cnci.topology == nil {
+		return nil, fmt.Errorf("cnci not initialized")
+	}
+
+	cnci.topology.Lock()
+	dump := cnci.topologyDump()
+	cnci.topology.Unlock()
+
+	return json.MarshalIndent(dump, "", "\t")
+}
+
+//topologyDump returns the topology sorted by alias. The topology lock must
+//be held by the caller.
+func (cnci *Cnci) topologyDump() TopologyDump {
+	dump := TopologyDump{
+		Links:   []TopologyLink{},
+		Bridges: []TopologyBridge{},
+	}
+
+	for alias, linfo := range cnci.topology.linkMap {
+		link := TopologyLink{
+			Alias: alias,
+			Name:  linfo.name,
+			Ready: linkReady(linfo),
+		}
+		if link.Ready {
+			link.Index = linfo.index
+		}
+		dump.Links = append(dump.Links, link)
+	}
+
+	for id, brInfo := range cnci.topology.bridgeMap {
+		bridge := TopologyBridge{
+			ID:      id,
+			Tunnels: brInfo.tunnels,
+		}
+		//The dnsmasq is set up by the creator of the bridge before the
+		//bridge is marked ready
+		if linfo, ok := cnci.topology.linkMap[id]; ok && linkReady(linfo) && brInfo.Dnsmasq != nil {
+			bridge.Subnet = brInfo.Dnsmasq.TenantNet.String()
+		}
+		if cfg, ok := cnci.topology.dns[id]; ok {
+			bridge.DNS = &cfg
+		}
+		dump.Bridges = append(dump.Bridges, bridge)
+	}
+
+	dump.Neighbors = append(dump.Neighbors, cnci.topology.neighbors...)
+
+	sort.Slice(dump.Links, func(i, j int) bool { return dump.Links[i].Alias < dump.Links[j].Alias })
+	sort.Slice(dump.Bridges, func(i, j int) bool { return dump.Bridges[i].ID < dump.Bridges[j].ID })
+
+	return dump
 }
 
 //Shutdown stops all DHCP Servers. Tears down all links and tunnels
 //It will continue even on encountering an error and perform as much
 //cleanup as possible
 func (cnci *Cnci) Shutdown() error {
-	var lasterr error
+	return cnci.ShutdownContext(context.Background())
+}
+
+//ShutdownContext stops all DHCP Servers. Tears down all links and tunnels
+//It will continue even on encountering an error and perform as much
+//cleanup as possible until the context is cancelled. On cancellation the
+//remaining cleanup is abandoned and the entries which have not been torn
+//down are retained in the topology
+func (cnci *Cnci) ShutdownContext(ctx context.Context) error {
+	var errs []error
 
 	cnci.topology.Lock()
 	defer cnci.topology.Unlock()
+	defer cnci.saveTopology()
+
+	aborted := func() bool {
+		if ctx.Err() == nil {
+			return false
+		}
+		errs = append(errs, fmt.Errorf("shutdown aborted with %d bridges and %d links remaining %v",
+			len(cnci.topology.bridgeMap), len(cnci.topology.linkMap), ctx.Err()))
+		return true
+	}
 
 	for id, b := range cnci.topology.bridgeMap {
+		if aborted() {
+			return combineErrors("shutdown incomplete", errs)
+		}
 		if b.Dnsmasq != nil {
 			if err := b.Dnsmasq.stop(); err != nil {
-				lasterr = err
+				errs = append(errs, err)
 				continue
 			}
 		} else {
-			lasterr = fmt.Errorf("invalid dnsmasq %v", b)
+			errs = append(errs, fmt.Errorf("invalid dnsmasq %v", b))
 			continue
 		}
 		delete(cnci.topology.bridgeMap, id)
+		delete(cnci.topology.dns, id)
 	}
 
 	for alias, linfo := range cnci.topology.linkMap {
+		if aborted() {
+			return combineErrors("shutdown incomplete", errs)
+		}
 		if linfo != nil {
 			//HACKING: Better to create the right type
 			vnic, err := NewVnic(alias)
 			if err != nil {
-				lasterr = err
+				errs = append(errs, err)
 				continue
 			}
-			vnic.LinkName, vnic.Link.Attrs().Index, err = waitForDeviceReady(linfo, cnci.APITimeout)
+			vnic.LinkName, vnic.Link.Attrs().Index, err = waitForDeviceReadyContext(ctx, linfo, cnci.APITimeout)
 			if err != nil {
-				lasterr = err
+				errs = append(errs, err)
 				continue
 			}
 			if err := vnic.Destroy(); err != nil {
-				lasterr = err
+				errs = append(errs, err)
 				continue
 			}
 			delete(cnci.topology.linkMap, alias)
@@ -837,5 +1976,5 @@ func (cnci *Cnci) Shutdown() error {
 		}
 	}
 
-	return lasterr
+	return combineErrors("shutdown incomplete", errs)
 }
@@ -17,12 +17,21 @@
 package libsnnet
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
 )
 
 func cnciTestInit() (*Cnci, error) {
@@ -47,7 +56,7 @@ func cnciTestInit() (*Cnci, error) {
 	if err := cnci.Init(); err != nil {
 		return nil, err
 	}
-	if err := cnci.RebuildTopology(); err != nil {
+	if err := cnci.RebuildTopology(false); err != nil {
 		return nil, err
 	}
 
@@ -85,11 +94,14 @@ func TestCNCI_Init(t *testing.T) {
 
 	assert.Nil(cnci.DelRemoteSubnet(*tnet, 1234, net.ParseIP("192.168.0.102")))
 
-	err = cnci.RebuildTopology()
+	err = cnci.RebuildTopology(false)
 	require.Nil(t, err)
 
 	//Duplicate
-	assert.Nil(cnci.RebuildTopology())
+	assert.Nil(cnci.RebuildTopology(false))
+
+	//Forced restart of dnsmasq
+	assert.Nil(cnci.RebuildTopology(true))
 
 	_, err = cnci.AddRemoteSubnet(*tnet, 1234, net.ParseIP("192.168.0.105"))
 	assert.Nil(err)
@@ -107,6 +119,991 @@ func TestCNCI_Init(t *testing.T) {
 	assert.Nil(cnci.Shutdown())
 }
 
+//Tests the removal of idle bridges
+//
+//Tests that DelRemoteSubnetGC keeps the bridge while it still has
+//tunnels and tears down the bridge and its dnsmasq once the last
+//tunnel has been removed
+//
+//Test should pass ok
+func TestCNCI_DelRemoteSubnetGC(t *testing.T) {
+	assert := assert.New(t)
+	cnci, err := cnciTestInit()
+	require.Nil(t, err)
+	defer func() { _ = cnci.Shutdown() }()
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/24")
+	cnIP1 := net.ParseIP("192.168.0.102")
+	cnIP2 := net.ParseIP("192.168.0.103")
+	bridgeID := cnci.genBridgeAlias(*tnet)
+
+	_, err = cnci.AddRemoteSubnet(*tnet, 1234, cnIP1)
+	require.Nil(t, err)
+	_, err = cnci.AddRemoteSubnet(*tnet, 1234, cnIP2)
+	require.Nil(t, err)
+
+	//The bridge still has a tunnel
+	assert.Nil(cnci.DelRemoteSubnetGC(*tnet, 1234, cnIP1))
+	_, err = netlink.LinkByAlias(bridgeID)
+	assert.Nil(err)
+	assert.Contains(cnci.topology.bridgeMap, bridgeID)
+
+	//Last tunnel
+	assert.Nil(cnci.DelRemoteSubnetGC(*tnet, 1234, cnIP2))
+	_, err = netlink.LinkByAlias(bridgeID)
+	assert.NotNil(err)
+	assert.NotContains(cnci.topology.bridgeMap, bridgeID)
+	assert.NotContains(cnci.topology.linkMap, bridgeID)
+	assert.NotContains(cnci.topology.keyMap, uint32(1234))
+
+	//Duplicate
+	assert.Nil(cnci.DelRemoteSubnetGC(*tnet, 1234, cnIP2))
+
+	//The subnet can be added again
+	_, err = cnci.AddRemoteSubnet(*tnet, 1234, cnIP1)
+	assert.Nil(err)
+}
+
+//Tests the retry of transient netlink failures
+//
+//Tests that the neighbor configuration survives netlink calls which
+//fail with a transient error before succeeding and that permanent
+//errors are reported without retrying
+//
+//Test should pass ok
+func TestCNCI_NetlinkRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	savedOps, savedBackoff := nlOps, netlinkBackoff
+	defer func() { nlOps, netlinkBackoff = savedOps, savedBackoff }()
+	netlinkBackoff = time.Millisecond
+
+	var neighCalls, routeCalls int
+	neighErrs := []error{syscall.EBUSY, syscall.EAGAIN}
+	nlOps.neighAdd = func(*netlink.Neigh) error {
+		neighCalls++
+		if len(neighErrs) == 0 {
+			return nil
+		}
+		err := neighErrs[0]
+		neighErrs = neighErrs[1:]
+		return err
+	}
+	nlOps.routeAdd = func(*netlink.Route) error {
+		routeCalls++
+		return nil
+	}
+
+	cnci := &Cnci{NetworkConfig: &NetworkConfig{Mode: GreTunnel}}
+	tun, err := newGreTunEP("cncitun", net.ParseIP("192.168.0.1"), 1234)
+	require.Nil(t, err)
+	tun.Link.Index = 100
+
+	n := Neighbor{
+		PhysicalIP: "192.168.0.2",
+		Subnet:     "172.16.1.0/24",
+		TunnelIP:   "10.0.0.2",
+	}
+
+	_, err = cnci.confirmNeighbors(tun, n, nil)
+	assert.Nil(err)
+	assert.Equal(3, neighCalls)
+	assert.Equal(2, routeCalls)
+
+	//Permanent errors are not retried
+	neighCalls = 0
+	neighErrs = []error{syscall.EEXIST}
+	_, err = cnci.confirmNeighbors(tun, n, nil)
+	assert.Equal(syscall.EEXIST, err)
+	assert.Equal(1, neighCalls)
+
+	//Transient errors are retried a bounded number of times
+	neighCalls = 0
+	neighErrs = []error{syscall.EBUSY, syscall.EBUSY, syscall.EBUSY, syscall.EBUSY, syscall.EBUSY}
+	_, err = cnci.confirmNeighbors(tun, n, nil)
+	assert.Equal(syscall.EBUSY, err)
+	assert.Equal(netlinkAttempts, neighCalls)
+}
+
+//Tests the clean up of departed neighbors
+//
+//Tests that the neighbor entry and routes of a neighbor configured by
+//a prior update are removed once it disappears from the neighbors and
+//that the entries of the local CNCI are never removed
+//
+//Test should pass ok
+func TestCNCI_RemoveDepartedNeighbors(t *testing.T) {
+	assert := assert.New(t)
+
+	savedOps := nlOps
+	defer func() { nlOps = savedOps }()
+
+	var neighDels []string
+	var routeDels []string
+	nlOps.neighDel = func(n *netlink.Neigh) error {
+		neighDels = append(neighDels, n.LLIPAddr.String())
+		return nil
+	}
+	nlOps.routeDel = func(r *netlink.Route) error {
+		routeDels = append(routeDels, r.Dst.String())
+		//Already removed along with the stale neighbor entry
+		if r.Gw != nil {
+			return syscall.ESRCH
+		}
+		return nil
+	}
+
+	local := Neighbor{PhysicalIP: "192.168.0.1", Subnet: "172.16.0.0/24", TunnelIP: "10.0.0.1"}
+	n1 := Neighbor{PhysicalIP: "192.168.0.2", Subnet: "172.16.1.0/24", TunnelIP: "10.0.0.2"}
+	n2 := Neighbor{PhysicalIP: "192.168.0.3", Subnet: "172.16.2.0/24", TunnelIP: "10.0.0.3"}
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+	cnci.topology.neighbors = []Neighbor{local, n1, n2}
+
+	tun, err := newGreTunEP("cncitun", net.ParseIP(local.PhysicalIP), 1234)
+	require.Nil(t, err)
+	tun.Link.Index = 100
+
+	assert.Nil(cnci.removeDepartedNeighbors(tun, "", []Neighbor{local, n1}, local.PhysicalIP))
+	assert.Equal([]string{n2.PhysicalIP}, neighDels)
+	assert.Equal([]string{"10.0.0.3/32", n2.Subnet}, routeDels)
+
+	//Nothing has departed
+	neighDels, routeDels = nil, nil
+	assert.Nil(cnci.removeDepartedNeighbors(tun, "", []Neighbor{local, n1, n2}, local.PhysicalIP))
+	assert.Nil(neighDels)
+	assert.Nil(routeDels)
+
+	//The local CNCI is never removed
+	neighDels, routeDels = nil, nil
+	assert.Nil(cnci.removeDepartedNeighbors(tun, "", nil, local.PhysicalIP))
+	assert.Equal([]string{n1.PhysicalIP, n2.PhysicalIP}, neighDels)
+
+	//Failures are reported
+	nlOps.neighDel = func(n *netlink.Neigh) error { return syscall.EPERM }
+	err = cnci.removeDepartedNeighbors(tun, "", []Neighbor{local}, local.PhysicalIP)
+	require.NotNil(t, err)
+	assert.Contains(err.Error(), n1.PhysicalIP)
+}
+
+//Tests the update of the neighbors serving a single subnet
+//
+//Tests that only the neighbors of the subnet are replaced and
+//torn down, the other neighbors and the local CNCI are kept
+//
+//Test should pass ok
+func TestCNCI_SubnetNeighbors(t *testing.T) {
+	assert := assert.New(t)
+
+	savedOps := nlOps
+	defer func() { nlOps = savedOps }()
+
+	var neighDels []string
+	nlOps.neighDel = func(n *netlink.Neigh) error {
+		neighDels = append(neighDels, n.LLIPAddr.String())
+		return nil
+	}
+	nlOps.routeDel = func(r *netlink.Route) error { return nil }
+
+	local := Neighbor{PhysicalIP: "192.168.0.1", Subnet: "172.16.0.0/24", TunnelIP: "10.0.0.1"}
+	n1 := Neighbor{PhysicalIP: "192.168.0.2", Subnet: "172.16.1.0/24", TunnelIP: "10.0.0.2"}
+	n2 := Neighbor{PhysicalIP: "192.168.0.3", Subnet: "172.16.2.0/24", TunnelIP: "10.0.0.3"}
+	n3 := Neighbor{PhysicalIP: "192.168.0.4", Subnet: "172.16.2.0/24", TunnelIP: "10.0.0.4"}
+	previous := []Neighbor{local, n1, n2}
+
+	merged := mergeNeighbors(previous, n2.Subnet, []Neighbor{n3}, local.PhysicalIP)
+	assert.Equal([]Neighbor{local, n1, n3}, merged)
+
+	merged = mergeNeighbors(previous, n2.Subnet, nil, local.PhysicalIP)
+	assert.Equal([]Neighbor{local, n1}, merged)
+
+	moved := local
+	moved.TunnelIP = "10.0.0.10"
+	merged = mergeNeighbors(previous, n1.Subnet, []Neighbor{moved, n1}, local.PhysicalIP)
+	assert.Equal([]Neighbor{n2, moved, n1}, merged)
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+	cnci.topology.neighbors = previous
+
+	tun, err := newGreTunEP("cncitun", net.ParseIP(local.PhysicalIP), 1234)
+	require.Nil(t, err)
+	tun.Link.Index = 100
+
+	//Only the departed neighbors of the subnet are removed
+	assert.Nil(cnci.removeDepartedNeighbors(tun, n2.Subnet, []Neighbor{n3}, local.PhysicalIP))
+	assert.Equal([]string{n2.PhysicalIP}, neighDels)
+}
+
+//Tests the reprogramming of changed neighbors
+//
+//Tests that a neighbor whose subnet or tunnel key changes while its
+//end points stay the same has its entries torn down so that they are
+//reprogrammed, while unchanged neighbors and the local CNCI are kept
+//
+//Test should pass ok
+func TestCNCI_ChangedNeighbors(t *testing.T) {
+	assert := assert.New(t)
+
+	savedOps := nlOps
+	defer func() { nlOps = savedOps }()
+
+	var neighDels []string
+	var routeDels []string
+	nlOps.neighDel = func(n *netlink.Neigh) error {
+		neighDels = append(neighDels, n.LLIPAddr.String())
+		return nil
+	}
+	nlOps.routeDel = func(r *netlink.Route) error {
+		routeDels = append(routeDels, r.Dst.String())
+		return nil
+	}
+
+	local := Neighbor{PhysicalIP: "192.168.0.1", Subnet: "172.16.0.0/24", TunnelIP: "10.0.0.1"}
+	n1 := Neighbor{PhysicalIP: "192.168.0.2", Subnet: "172.16.1.0/24", TunnelIP: "10.0.0.2"}
+	n2 := Neighbor{PhysicalIP: "192.168.0.3", Subnet: "172.16.2.0/24", TunnelIP: "10.0.0.3"}
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+	cnci.topology.neighbors = []Neighbor{local, n1, n2}
+
+	tun, err := newGreTunEP("cncitun", net.ParseIP(local.PhysicalIP), 1234)
+	require.Nil(t, err)
+	tun.Link.Index = 100
+
+	//Only the subnet of the neighbor changes
+	moved := n1
+	moved.Subnet = "172.16.3.0/24"
+	assert.Nil(cnci.removeChangedNeighbors(tun, []Neighbor{local, moved, n2}, local.PhysicalIP))
+	assert.Equal([]string{n1.PhysicalIP}, neighDels)
+	assert.Equal([]string{"10.0.0.2/32", n1.Subnet}, routeDels)
+
+	//Only the tunnel key of the neighbor changes
+	neighDels, routeDels = nil, nil
+	rekeyed := n2
+	rekeyed.TunnelID = 5678
+	assert.Nil(cnci.removeChangedNeighbors(tun, []Neighbor{local, n1, rekeyed}, local.PhysicalIP))
+	assert.Equal([]string{n2.PhysicalIP}, neighDels)
+	assert.Equal([]string{"10.0.0.3/32", n2.Subnet}, routeDels)
+
+	//Unchanged, departed and local neighbors are left alone
+	neighDels, routeDels = nil, nil
+	relocated := local
+	relocated.TunnelIP = "10.0.0.10"
+	assert.Nil(cnci.removeChangedNeighbors(tun, []Neighbor{relocated, n1}, local.PhysicalIP))
+	assert.Nil(neighDels)
+	assert.Nil(routeDels)
+
+	//A neighbor moving to another subnet replaces its previous entry
+	merged := mergeNeighbors(cnci.topology.neighbors, moved.Subnet, []Neighbor{moved}, local.PhysicalIP)
+	assert.Equal([]Neighbor{local, n2, moved}, merged)
+
+	//Failures are reported
+	nlOps.neighDel = func(n *netlink.Neigh) error { return syscall.EPERM }
+	err = cnci.removeChangedNeighbors(tun, []Neighbor{local, moved}, local.PhysicalIP)
+	require.NotNil(t, err)
+	assert.Contains(err.Error(), n1.PhysicalIP)
+}
+
+//Tests the neighbor updates without a local neighbor
+//
+//Tests that updating the neighbors of a CNCI which has no compute address,
+//or with neighbors which do not include the local CNCI, fails instead of
+//dereferencing the missing tunnel
+//
+//Test should pass ok
+func TestCNCI_UpdateNeighborsNoLocal(t *testing.T) {
+	assert := assert.New(t)
+
+	neighbors := []Neighbor{
+		{PhysicalIP: "192.168.0.2", Subnet: "172.16.1.0/24", TunnelIP: "10.0.0.2"},
+		{PhysicalIP: "192.168.0.3", Subnet: "172.16.2.0/24", TunnelIP: "10.0.0.3"},
+	}
+
+	cnci := &Cnci{
+		ID:            "TestCNUUID",
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+
+	assert.NotNil(cnci.UpdateNeighbors(neighbors))
+	assert.NotNil(cnci.UpdateSubnetNeighbors("172.16.1.0/24", neighbors[:1]))
+	assert.NotNil(cnci.checkNeighbors(neighbors))
+
+	addr, err := netlink.ParseAddr("192.168.0.1/24")
+	require.Nil(t, err)
+	cnci.ComputeAddr = []netlink.Addr{*addr}
+
+	err = cnci.UpdateNeighbors(neighbors)
+	require.NotNil(t, err)
+	assert.Contains(err.Error(), "192.168.0.1")
+	assert.Contains(err.Error(), "192.168.0.3")
+
+	assert.NotNil(cnci.UpdateSubnetNeighbors("172.16.1.0/24", neighbors[:1]))
+	assert.Nil(cnci.checkNeighbors(neighbors))
+}
+
+//Tests the neighbor updates with an empty or local only list
+//
+//Tests that an empty neighbor list is ignored, and that a list holding
+//only the local CNCI tears down the neighbors configured by the previous
+//update while keeping the local CNCI
+//
+//Test should pass ok
+func TestCNCI_UpdateNeighborsLocalOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	savedOps := nlOps
+	defer func() { nlOps = savedOps }()
+
+	var neighDels []string
+	nlOps.neighDel = func(n *netlink.Neigh) error {
+		neighDels = append(neighDels, n.LLIPAddr.String())
+		return nil
+	}
+	nlOps.routeDel = func(r *netlink.Route) error { return nil }
+
+	local := Neighbor{PhysicalIP: "192.168.0.1", Subnet: "172.16.0.0/24", TunnelIP: "10.0.0.1"}
+	n1 := Neighbor{PhysicalIP: "192.168.0.2", Subnet: "172.16.1.0/24", TunnelIP: "10.0.0.2"}
+	n2 := Neighbor{PhysicalIP: "192.168.0.3", Subnet: "172.16.2.0/24", TunnelIP: "10.0.0.3"}
+
+	addr, err := netlink.ParseAddr(local.PhysicalIP + "/24")
+	require.Nil(t, err)
+
+	cnci := &Cnci{
+		ID:            "TestCNUUID",
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		ComputeAddr:   []netlink.Addr{*addr},
+		topology:      newCnciTopology(),
+	}
+	cnci.topology.neighbors = []Neighbor{local, n1, n2}
+
+	//An empty list is a no-op
+	assert.Nil(cnci.UpdateNeighbors(nil))
+	assert.Nil(cnci.UpdateNeighbors([]Neighbor{}))
+	assert.Nil(neighDels)
+	assert.Equal([]Neighbor{local, n1, n2}, cnci.topology.neighbors)
+
+	tun, err := newGreTunEP("cncitun", net.ParseIP(local.PhysicalIP), 1234)
+	require.Nil(t, err)
+	tun.Link.Index = 100
+
+	//Only the neighbors known to have left are removed
+	assert.Nil(cnci.updateNeighbors(tun, []Neighbor{local}, local.PhysicalIP))
+	assert.Equal([]string{n1.PhysicalIP, n2.PhysicalIP}, neighDels)
+	assert.Equal([]Neighbor{local}, cnci.topology.neighbors)
+
+	//Nothing is left to remove
+	neighDels = nil
+	assert.Nil(cnci.updateNeighbors(tun, []Neighbor{local}, local.PhysicalIP))
+	assert.Nil(neighDels)
+	assert.Equal([]Neighbor{local}, cnci.topology.neighbors)
+}
+
+//Tests the CNCI tunnel health check
+//
+//Tests that a tunnel added through AddRemoteSubnet is reported
+//as up, that a tunnel which is brought down is reported as such
+//and that unknown tunnels are reported as missing
+//
+//Test should pass ok
+func TestCNCI_CheckTunnel(t *testing.T) {
+	assert := assert.New(t)
+	cnci, err := cnciTestInit()
+	require.Nil(t, err)
+	defer func() { _ = cnci.Shutdown() }()
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/24")
+	cnIP := net.ParseIP("192.168.0.102")
+
+	_, err = cnci.AddRemoteSubnet(*tnet, 1234, cnIP)
+	require.Nil(t, err)
+
+	up, err := cnci.CheckTunnel(*tnet, cnIP)
+	assert.Nil(err)
+	assert.True(up)
+
+	status := cnci.HealthCheck()
+	require.Equal(t, 1, len(status))
+	assert.True(status[0].Up)
+	assert.Equal(tnet.String(), status[0].Subnet.String())
+	assert.True(cnIP.Equal(status[0].CNIP))
+
+	//Bring the tunnel down behind the back of the CNCI
+	gre, err := newGreTapEP(cnci.genGreAlias(*tnet, cnIP), cnci.ComputeAddr[0].IPNet.IP, cnIP, 1234)
+	require.Nil(t, err)
+	require.Nil(t, gre.getDevice())
+	require.Nil(t, gre.disable())
+
+	up, err = cnci.CheckTunnel(*tnet, cnIP)
+	assert.NotNil(err)
+	assert.False(up)
+
+	//Unknown tunnel
+	up, err = cnci.CheckTunnel(*tnet, net.ParseIP("192.168.0.103"))
+	assert.NotNil(err)
+	assert.False(up)
+
+	assert.Nil(cnci.DelRemoteSubnet(*tnet, 1234, cnIP))
+	assert.Equal(0, len(cnci.HealthCheck()))
+}
+
+//Tests the rollback of a failed remote subnet addition
+//
+//Tests that the topology entries added by a failed AddRemoteSubnet
+//are removed and that a bridge shared with another tunnel is kept
+//
+//Test should pass ok
+func TestCNCI_RollbackRemoteSubnet(t *testing.T) {
+	assert := assert.New(t)
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/24")
+	local := net.ParseIP("192.168.0.1")
+
+	addToTopology := func(cnIP net.IP) (*Bridge, *GreTapEP, *bridgeInfo, bool, bool) {
+		bridge, err := NewBridge(cnci.genBridgeAlias(*tnet))
+		require.Nil(t, err)
+		gre, err := newGreTapEP(cnci.genGreAlias(*tnet, cnIP), local, cnIP, 1234)
+		require.Nil(t, err)
+
+		var brInfo *bridgeInfo
+		brExists, greExists, _, _, err := cnci.addSubnetToTopology(bridge, gre, &brInfo)
+		require.Nil(t, err)
+		return bridge, gre, brInfo, brExists, greExists
+	}
+
+	//A failed addition leaves nothing behind
+	bridge, gre, brInfo, brExists, greExists := addToTopology(net.ParseIP("192.168.0.102"))
+	assert.False(brExists)
+	assert.False(greExists)
+
+	cnci.rollbackRemoteSubnet(bridge, brInfo, !brExists, gre, !greExists)
+	assert.Equal(0, len(cnci.topology.linkMap))
+	assert.Equal(0, len(cnci.topology.nameMap))
+	assert.Equal(0, len(cnci.topology.bridgeMap))
+
+	//A bridge used by another tunnel is kept
+	bridge, gre, brInfo, brExists, greExists = addToTopology(net.ParseIP("192.168.0.102"))
+	require.False(t, brExists)
+	require.False(t, greExists)
+
+	bridge2, gre2, brInfo2, brExists2, greExists2 := addToTopology(net.ParseIP("192.168.0.103"))
+	require.True(t, brExists2)
+	require.False(t, greExists2)
+
+	cnci.rollbackRemoteSubnet(bridge2, brInfo2, !brExists2, gre2, !greExists2)
+	assert.Equal(1, brInfo.tunnels)
+	assert.Equal(2, len(cnci.topology.linkMap))
+	assert.Equal(1, len(cnci.topology.bridgeMap))
+
+	_, present := cnci.topology.linkMap[gre2.GlobalID]
+	assert.False(present)
+
+	cnci.rollbackRemoteSubnet(bridge, brInfo, !brExists, gre, !greExists)
+	assert.Equal(0, len(cnci.topology.linkMap))
+	assert.Equal(0, len(cnci.topology.bridgeMap))
+}
+
+//Tests that a subnet key cannot be bound to two subnets
+//
+//Tests that adding a second subnet with the key of an existing subnet
+//fails and names the conflicting subnet, and that the key can be reused
+//once the tunnels of the first subnet are gone
+//
+//Test should pass ok
+func TestCNCI_SubnetKeyCollision(t *testing.T) {
+	assert := assert.New(t)
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+
+	local := net.ParseIP("192.168.0.1")
+	cnIP := net.ParseIP("192.168.0.102")
+
+	addToTopology := func(subnet string, key uint32) (*Bridge, *GreTapEP, *bridgeInfo, bool, bool, error) {
+		_, tnet, _ := net.ParseCIDR(subnet)
+		bridge, err := NewBridge(cnci.genBridgeAlias(*tnet))
+		require.Nil(t, err)
+		gre, err := newGreTapEP(cnci.genGreAlias(*tnet, cnIP), local, cnIP, key)
+		require.Nil(t, err)
+
+		var brInfo *bridgeInfo
+		brExists, greExists, _, _, err := cnci.addSubnetToTopology(bridge, gre, &brInfo)
+		return bridge, gre, brInfo, brExists, greExists, err
+	}
+
+	bridge, gre, brInfo, brExists, greExists, err := addToTopology("192.168.10.0/24", 1234)
+	require.Nil(t, err)
+
+	//The same subnet may use its key again
+	_, _, _, _, _, err = addToTopology("192.168.10.0/24", 1234)
+	assert.Nil(err)
+
+	_, _, _, _, _, err = addToTopology("192.168.20.0/24", 1234)
+	require.NotNil(t, err)
+	assert.Contains(err.Error(), "192.168.10.0/24")
+	assert.Equal(1, len(cnci.topology.bridgeMap))
+
+	//Once released the key may be bound to another subnet
+	cnci.rollbackRemoteSubnet(bridge, brInfo, !brExists, gre, !greExists)
+	_, _, _, _, _, err = addToTopology("192.168.20.0/24", 1234)
+	assert.Nil(err)
+}
+
+//Tests the topology snapshot
+//
+//Tests that the ready part of the topology is saved to the topology
+//file and can be read back and that snapshots of another version
+//are rejected
+//
+//Test should pass ok
+func TestCNCI_TopologySnapshot(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "cnci-topology")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		TopologyFile:  filepath.Join(dir, "topology.json"),
+		topology:      newCnciTopology(),
+	}
+
+	_, tnet, _ := net.ParseCIDR("192.168.10.0/24")
+	cnIP := net.ParseIP("192.168.0.102")
+	bridgeID := cnci.genBridgeAlias(*tnet)
+	greID := cnci.genGreAlias(*tnet, cnIP)
+
+	ready := func(name string, index int) *linkInfo {
+		linfo := &linkInfo{name: name, index: index, ready: make(chan struct{})}
+		close(linfo.ready)
+		return linfo
+	}
+
+	cnci.topology.Lock()
+	cnci.topology.linkMap[bridgeID] = ready("br_1", 10)
+	cnci.topology.linkMap[greID] = ready("gre_1", 11)
+	cnci.topology.linkMap["pending"] = &linkInfo{name: "gre_2", ready: make(chan struct{})}
+	cnci.topology.bridgeMap[bridgeID] = &bridgeInfo{
+		tunnels: 1,
+		Dnsmasq: &Dnsmasq{TenantNet: *tnet},
+	}
+	cnci.topology.keyMap[1234] = bridgeID
+	cnci.topology.dns[bridgeID] = SubnetDNS{Servers: []string{"8.8.8.8"}}
+	cnci.topology.neighbors = []Neighbor{{PhysicalIP: "192.168.0.1", Subnet: "172.16.0.0/24"}}
+	cnci.saveTopology()
+	cnci.topology.Unlock()
+
+	snap, err := readTopologySnapshot(cnci.TopologyFile)
+	require.Nil(t, err)
+
+	assert.Equal(topologyVersion, snap.Version)
+	assert.Equal([]TopologyLink{
+		{Alias: bridgeID, Name: "br_1", Index: 10, Ready: true},
+		{Alias: greID, Name: "gre_1", Index: 11, Ready: true},
+	}, snap.Links)
+	assert.Equal([]TopologyBridge{
+		{
+			ID:      bridgeID,
+			Tunnels: 1,
+			Subnet:  "192.168.10.0/24",
+			DNS:     &SubnetDNS{Servers: []string{"8.8.8.8"}},
+		},
+	}, snap.Bridges)
+	assert.Equal(map[uint32]string{1234: bridgeID}, snap.Keys)
+	assert.Equal(cnci.topology.neighbors, snap.Neighbors)
+
+	snap.Version = topologyVersion + 1
+	require.Nil(t, writeTopologySnapshot(cnci.TopologyFile, snap))
+	_, err = readTopologySnapshot(cnci.TopologyFile)
+	assert.NotNil(err)
+}
+
+//Tests the best effort rebuild of the CNCI topology
+//
+//Tests that a bridge with a corrupt alias does not prevent the
+//rebuild of the other bridges and their tunnels and that the
+//failure is reported
+//
+//Test should pass ok
+func TestCNCI_RebuildTopologyPartial(t *testing.T) {
+	assert := assert.New(t)
+	cnci, err := cnciTestInit()
+	require.Nil(t, err)
+	defer func() { _ = cnci.Shutdown() }()
+
+	_, tnet1, _ := net.ParseCIDR("192.168.0.0/24")
+	_, tnet2, _ := net.ParseCIDR("192.168.1.0/24")
+	cnIP := net.ParseIP("192.168.0.102")
+
+	_, err = cnci.AddRemoteSubnet(*tnet1, 1234, cnIP)
+	require.Nil(t, err)
+	_, err = cnci.AddRemoteSubnet(*tnet2, 1235, cnIP)
+	require.Nil(t, err)
+
+	corrupt, err := NewBridge(bridgePrefix + "corrupt")
+	require.Nil(t, err)
+	require.Nil(t, corrupt.Create())
+	defer func() { _ = corrupt.Destroy() }()
+
+	err = cnci.RebuildTopology(false)
+	require.NotNil(t, err)
+	assert.Contains(err.Error(), corrupt.GlobalID)
+
+	_, present := cnci.topology.bridgeMap[corrupt.GlobalID]
+	assert.False(present)
+
+	for _, tnet := range []*net.IPNet{tnet1, tnet2} {
+		brInfo, present := cnci.topology.bridgeMap[cnci.genBridgeAlias(*tnet)]
+		if assert.True(present) {
+			assert.Equal(1, brInfo.tunnels)
+		}
+	}
+
+	assert.Nil(cnci.DelRemoteSubnet(*tnet1, 1234, cnIP))
+	assert.Nil(cnci.DelRemoteSubnet(*tnet2, 1235, cnIP))
+}
+
+//Tests the verification of the CNCI tunnels
+//
+//Tests that all the tunnels are accounted for even when
+//some of them have no associated bridge
+//
+//Test should pass ok
+func TestCNCI_VerifyTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/24")
+	_, orphan, _ := net.ParseCIDR("192.168.1.0/24")
+
+	bridgeID := cnci.genBridgeAlias(*tnet)
+	cnci.topology.linkMap[bridgeID] = &linkInfo{}
+	cnci.topology.bridgeMap[bridgeID] = &bridgeInfo{}
+
+	gretap := func(alias string) netlink.Link {
+		return &netlink.Gretap{LinkAttrs: netlink.LinkAttrs{Alias: alias}}
+	}
+
+	links := []netlink.Link{
+		gretap(cnci.genGreAlias(*tnet, net.ParseIP("192.168.0.102"))),
+		gretap(cnci.genGreAlias(*orphan, net.ParseIP("192.168.0.102"))),
+		gretap(cnci.genGreAlias(*tnet, net.ParseIP("192.168.0.103"))),
+	}
+
+	errs := cnci.verifyTopology(links)
+	assert.Equal(1, len(errs))
+	assert.Equal(2, cnci.topology.bridgeMap[bridgeID].tunnels)
+}
+
+//Tests the per instance device aliases
+//
+//Tests that a CNCI configured with its own prefixes and separator
+//generates and parses its own aliases and only claims the tunnels
+//carrying its prefix when verifying the topology
+//
+//Test should pass ok
+func TestCNCI_AliasPrefixes(t *testing.T) {
+	assert := assert.New(t)
+
+	cnci := &Cnci{
+		NetworkConfig:  &NetworkConfig{Mode: GreTunnel},
+		BridgePrefix:   "tbr_",
+		GrePrefix:      "tgre_",
+		AliasSeparator: "%%",
+		topology:       newCnciTopology(),
+	}
+	other := &Cnci{NetworkConfig: &NetworkConfig{Mode: GreTunnel}}
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/24")
+	cnIP := net.ParseIP("192.168.0.102")
+
+	bridgeID := cnci.genBridgeAlias(*tnet)
+	greID := cnci.genGreAlias(*tnet, cnIP)
+	assert.Equal("tbr_192.168.0.0+24", bridgeID)
+	assert.Equal("tgre_192.168.0.0+24%%192.168.0.102", greID)
+	assert.Equal("br_192.168.0.0+24", other.genBridgeAlias(*tnet))
+
+	subnet, ip, err := cnci.parseGreAlias(greID)
+	require.Nil(t, err)
+	assert.Equal(tnet.String(), subnet.String())
+	assert.True(cnIP.Equal(ip))
+
+	_, _, err = cnci.parseGreAlias(other.genGreAlias(*tnet, cnIP))
+	assert.NotNil(err)
+
+	cnci.topology.linkMap[bridgeID] = &linkInfo{}
+	cnci.topology.bridgeMap[bridgeID] = &bridgeInfo{}
+
+	gretap := func(alias string) netlink.Link {
+		return &netlink.Gretap{LinkAttrs: netlink.LinkAttrs{Alias: alias}}
+	}
+
+	links := []netlink.Link{
+		gretap(greID),
+		gretap(other.genGreAlias(*tnet, cnIP)),
+	}
+
+	assert.Nil(cnci.verifyTopology(links))
+	assert.Equal(1, cnci.topology.bridgeMap[bridgeID].tunnels)
+}
+
+//Tests isolated CNCIs sharing a namespace
+//
+//Tests that two CNCIs using distinct prefixes can serve the same
+//subnet on the same node and that each only claims its own devices
+//when rebuilding its topology
+//
+//Test should pass ok
+func TestCNCI_SharedNamespace(t *testing.T) {
+	assert := assert.New(t)
+	cnci1, err := cnciTestInit()
+	require.Nil(t, err)
+	defer func() { _ = cnci1.Shutdown() }()
+
+	cnci2 := &Cnci{
+		ID:             "TestCNUUID2",
+		NetworkConfig:  cnci1.NetworkConfig,
+		BridgePrefix:   "tbr_",
+		GrePrefix:      "tgre_",
+		AliasSeparator: "%%",
+	}
+	require.Nil(t, cnci2.Init())
+	defer func() { _ = cnci2.Shutdown() }()
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/24")
+	cnIP := net.ParseIP("192.168.0.102")
+
+	_, err = cnci1.AddRemoteSubnet(*tnet, 1234, cnIP)
+	require.Nil(t, err)
+	_, err = cnci2.AddRemoteSubnet(*tnet, 1235, cnIP)
+	require.Nil(t, err)
+
+	for _, cnci := range []*Cnci{cnci1, cnci2} {
+		assert.Nil(cnci.RebuildTopology(false))
+
+		bridgeID := cnci.genBridgeAlias(*tnet)
+		assert.Equal(1, len(cnci.topology.bridgeMap))
+		require.Contains(t, cnci.topology.bridgeMap, bridgeID)
+		assert.Equal(1, cnci.topology.bridgeMap[bridgeID].tunnels)
+
+		status := cnci.HealthCheck()
+		require.Equal(t, 1, len(status))
+		assert.True(status[0].Up)
+	}
+
+	assert.Nil(cnci2.DelRemoteSubnet(*tnet, 1235, cnIP))
+	assert.Nil(cnci1.RebuildTopology(false))
+	assert.Equal(1, len(cnci1.HealthCheck()))
+}
+
+//Tests the validation of the subnet DNS configuration
+//
+//Tests that malformed DNS configurations and unknown subnets are
+//rejected without altering the topology
+//
+//Test should pass ok
+func TestCNCI_ConfigureSubnetDNS(t *testing.T) {
+	assert := assert.New(t)
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/24")
+
+	err := cnci.ConfigureSubnetDNS(*tnet, SubnetDNS{Servers: []string{"8.8.8.256"}})
+	require.NotNil(t, err)
+	assert.Contains(err.Error(), "8.8.8.256")
+
+	err = cnci.ConfigureSubnetDNS(*tnet, SubnetDNS{Servers: []string{"8.8.8.8"}})
+	require.NotNil(t, err)
+	assert.Contains(err.Error(), tnet.String())
+
+	assert.Equal(0, len(cnci.topology.dns))
+}
+
+//Tests the subnet capacity check
+//
+//Tests that subnets too small to lease an address to an instance are
+//rejected before any device is created and that the smallest supported
+//subnet is accepted
+//
+//Test should pass ok
+func TestCNCI_SubnetCapacity(t *testing.T) {
+	assert := assert.New(t)
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+
+	cnIP := net.ParseIP("192.168.0.101")
+
+	for _, s := range []string{"192.168.0.0/31", "192.168.0.0/32"} {
+		_, tnet, _ := net.ParseCIDR(s)
+
+		_, err := cnci.AddRemoteSubnet(*tnet, 1234, cnIP)
+		require.NotNil(t, err)
+		assert.Contains(err.Error(), s)
+		assert.Equal(0, len(cnci.topology.linkMap))
+	}
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/30")
+	assert.Equal(MinSubnetHosts, subnetHosts(*tnet))
+	assert.Nil(checkInputParams(*tnet, 1234, cnIP))
+}
+
+//Tests the explicit selection of the compute interface
+//
+//Tests that the named link is used for both compute and management
+//traffic when no management network is specified, and that unknown
+//links are reported
+//
+//Test should pass ok
+func TestCNCI_SelectComputeLink(t *testing.T) {
+	assert := assert.New(t)
+
+	link := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "go_testcomp"}}
+	require.Nil(t, netlink.LinkAdd(link))
+	defer func() { _ = netlink.LinkDel(link) }()
+
+	addr, err := netlink.ParseAddr("198.51.100.2/24")
+	require.Nil(t, err)
+	require.Nil(t, netlink.AddrAdd(link, addr))
+
+	links, err := netlink.LinkList()
+	require.Nil(t, err)
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{
+			Mode:         GreTunnel,
+			ComputeIface: "go_testcomp",
+		},
+	}
+
+	require.Nil(t, cnci.selectComputeLink(links))
+	require.Equal(t, 1, len(cnci.ComputeAddr))
+	assert.True(addr.IP.Equal(cnci.ComputeAddr[0].IP))
+	assert.Equal("go_testcomp", cnci.ComputeLink[0].Attrs().Name)
+	assert.Equal(cnci.ComputeAddr, cnci.MgtAddr)
+
+	//Address outside of the compute network
+	_, cnet, _ := net.ParseCIDR("203.0.113.0/24")
+	cnci.ComputeNet = []net.IPNet{*cnet}
+	assert.NotNil(cnci.selectComputeLink(links))
+
+	cnci.ComputeNet = nil
+	cnci.ComputeIface = "go_testmissing"
+	assert.NotNil(cnci.selectComputeLink(links))
+}
+
+//Tests the bounded shutdown of the CNCI
+//
+//Tests that the shutdown gives up waiting for a device which never
+//becomes ready once the context expires and that the devices not
+//torn down are retained in the topology
+//
+//Test should pass ok
+func TestCNCI_ShutdownContext(t *testing.T) {
+	assert := assert.New(t)
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		APITimeout:    time.Minute,
+		topology:      newCnciTopology(),
+	}
+
+	cnci.topology.linkMap["gre_stuck1"] = &linkInfo{ready: make(chan struct{})}
+	cnci.topology.linkMap["gre_stuck2"] = &linkInfo{ready: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := cnci.ShutdownContext(ctx)
+	assert.NotNil(err)
+	assert.True(time.Since(start) < cnci.APITimeout)
+	assert.Equal(2, len(cnci.topology.linkMap))
+
+	//A cancelled context does not attempt any cleanup
+	err = cnci.ShutdownContext(ctx)
+	assert.NotNil(err)
+	assert.Equal(2, len(cnci.topology.linkMap))
+}
+
+//Tests the dump of the CNCI topology
+//
+//Tests that ready and not ready links and bridges are reported
+//and that the dump can be taken while the topology is updated
+//
+//Test should pass ok
+func TestCNCI_DumpTopology(t *testing.T) {
+	assert := assert.New(t)
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{Mode: GreTunnel},
+		topology:      newCnciTopology(),
+	}
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/24")
+	bridgeID := cnci.genBridgeAlias(*tnet)
+	greID := cnci.genGreAlias(*tnet, net.ParseIP("192.168.0.102"))
+
+	ready := make(chan struct{})
+	close(ready)
+	cnci.topology.linkMap[bridgeID] = &linkInfo{name: "br1", index: 10, ready: ready}
+	cnci.topology.linkMap[greID] = &linkInfo{name: "gre1", ready: make(chan struct{})}
+	cnci.topology.bridgeMap[bridgeID] = &bridgeInfo{
+		tunnels: 1,
+		Dnsmasq: &Dnsmasq{TenantNet: *tnet},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cnci.topology.Lock()
+			cnci.topology.nameMap[fmt.Sprintf("link%d", i)] = true
+			cnci.topology.Unlock()
+		}
+	}()
+
+	b, err := cnci.DumpTopology()
+	require.Nil(t, err)
+	<-done
+
+	var dump TopologyDump
+	require.Nil(t, json.Unmarshal(b, &dump))
+
+	require.Equal(t, 2, len(dump.Links))
+	assert.Equal(TopologyLink{Alias: bridgeID, Name: "br1", Index: 10, Ready: true}, dump.Links[0])
+	assert.Equal(TopologyLink{Alias: greID, Name: "gre1"}, dump.Links[1])
+
+	require.Equal(t, 1, len(dump.Bridges))
+	assert.Equal(TopologyBridge{ID: bridgeID, Tunnels: 1, Subnet: tnet.String()}, dump.Bridges[0])
+}
+
 //Whitebox test case of CNCI API primitives
 //
 //This tests ensure that the lower level primitive
@@ -175,3 +1172,135 @@ func TestCNCI_Internal(t *testing.T) {
 	assert.Nil(gre.attach(bridge))
 	assert.Nil(gre.enable())
 }
+
+//constSource is a rand.Source which always generates the same number
+type constSource int64
+
+func (s constSource) Int63() int64 { return int64(s) }
+func (s constSource) Seed(int64)   {}
+
+//Tests that generating a link name gives up once all the names
+//generated are in use
+//
+//The test is expected to pass
+func TestCNCI_GenLinkNameExhausted(t *testing.T) {
+	assert := assert.New(t)
+
+	saved := ifaceRsrc
+	ifaceRsrc = rand.New(constSource(0x2a))
+	defer func() { ifaceRsrc = saved }()
+
+	bridge, err := NewBridge("br_exhausted")
+	assert.Nil(err)
+
+	name, err := genIface(bridge, false)
+	assert.Nil(err)
+	nameMap := map[string]bool{name: true}
+
+	cnci := &Cnci{IfaceRetryLimit: 3}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := genLinkName(bridge, nameMap, cnci.ifaceRetryLimit())
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		assert.NotNil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("genLinkName did not give up on exhaustion")
+	}
+
+	delete(nameMap, name)
+	name2, err := genLinkName(bridge, nameMap, cnci.ifaceRetryLimit())
+	assert.Nil(err)
+	assert.Equal(name, name2)
+	assert.Equal(ifaceRetryLimit, (&Cnci{}).ifaceRetryLimit())
+}
+
+//Tests that the IPv6 addresses of a physical link are matched against
+//the IPv6 management and compute subnets
+//
+//The test is expected to pass
+func TestCNCI_AddPhyLinkToConfigIPv6(t *testing.T) {
+	assert := assert.New(t)
+
+	_, mgt, _ := net.ParseCIDR("fd00:1::/64")
+	_, comp, _ := net.ParseCIDR("fd00:2::/64")
+	_, v4, _ := net.ParseCIDR("192.168.1.0/24")
+
+	cnci := &Cnci{
+		NetworkConfig: &NetworkConfig{
+			ManagementNet: []net.IPNet{*mgt, *v4},
+			ComputeNet:    []net.IPNet{*comp},
+		},
+		AddrFamily: IPv6,
+	}
+
+	link := &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}
+	var addrs []netlink.Addr
+	for _, a := range []string{"fd00:1::10/64", "fd00:2::10/64", "fd00:3::10/64", "192.168.1.10/24"} {
+		addr, err := netlink.ParseAddr(a)
+		require.Nil(t, err)
+		addrs = append(addrs, *addr)
+	}
+
+	cnci.addPhyLinkToConfig(link, addrs)
+
+	if assert.Len(cnci.MgtAddr, 2) {
+		assert.Equal("fd00:1::10", cnci.MgtAddr[0].IP.String())
+		assert.Equal("192.168.1.10", cnci.MgtAddr[1].IP.String())
+	}
+	if assert.Len(cnci.ComputeAddr, 1) {
+		assert.Equal("fd00:2::10", cnci.ComputeAddr[0].IP.String())
+	}
+
+	cnci.AddrFamily = IPv4AndIPv6 + 1
+	assert.NotNil(cnci.findPhyNwInterface())
+}
+
+//Tests that planning a remote subnet reports the devices present in the
+//topology without changing it
+//
+//The test is expected to pass
+func TestCNCI_PlanRemoteSubnet(t *testing.T) {
+	assert := assert.New(t)
+
+	_, tnet, _ := net.ParseCIDR("192.168.0.0/24")
+	cnIP := net.ParseIP("192.168.0.102")
+
+	cnci := &Cnci{NetworkConfig: &NetworkConfig{}}
+	_, err := cnci.PlanRemoteSubnet(*tnet, 1234, cnIP)
+	assert.NotNil(err)
+
+	cnci.topology = newCnciTopology()
+
+	plan, err := cnci.PlanRemoteSubnet(*tnet, 1234, cnIP)
+	require.Nil(t, err)
+	assert.Equal(Plan{
+		BridgeAlias: cnci.genBridgeAlias(*tnet),
+		GreAlias:    cnci.genGreAlias(*tnet, cnIP),
+	}, plan)
+	assert.Empty(cnci.topology.linkMap)
+	assert.Empty(cnci.topology.nameMap)
+
+	cnci.topology.linkMap[plan.BridgeAlias] = &linkInfo{name: "sbr_1"}
+	cnci.topology.keyMap[1234] = plan.BridgeAlias
+
+	plan, err = cnci.PlanRemoteSubnet(*tnet, 1234, cnIP)
+	require.Nil(t, err)
+	assert.True(plan.BridgeExists)
+	assert.Equal("sbr_1", plan.BridgeLinkName)
+	assert.False(plan.GreExists)
+	assert.Empty(plan.GreLinkName)
+	assert.Len(cnci.topology.linkMap, 1)
+
+	//The subnet key is used by another subnet
+	_, onet, _ := net.ParseCIDR("192.168.1.0/24")
+	_, err = cnci.PlanRemoteSubnet(*onet, 1234, cnIP)
+	assert.NotNil(err)
+
+	_, err = cnci.PlanRemoteSubnet(*tnet, 0, cnIP)
+	assert.NotNil(err)
+}
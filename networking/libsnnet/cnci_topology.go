@@ -0,0 +1,275 @@
+//
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package libsnnet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+)
+
+//topologyVersion is the version of the on disk topology snapshot format.
+//Snapshots with a different version are ignored.
+const topologyVersion = 1
+
+//topologySnapshot is the on disk representation of the CNCI topology.
+//Only the links which are ready are recorded.
+type topologySnapshot struct {
+	Version int `json:"version"`
+	TopologyDump
+	Keys      map[uint32]string `json:"keys,omitempty"` //Subnet key to bridge alias
+	RateLimit RateLimit         `json:"rate_limit"`     //Rate limit applied to the bridges
+}
+
+//snapshot returns the ready part of the topology. The topology lock must
+//be held by the caller.
+func (cnci *Cnci) snapshot() *topologySnapshot {
+	dump := cnci.topologyDump()
+
+	snap := &topologySnapshot{
+		Version: topologyVersion,
+		TopologyDump: TopologyDump{
+			Links:     []TopologyLink{},
+			Bridges:   []TopologyBridge{},
+			Neighbors: dump.Neighbors,
+		},
+		Keys:      make(map[uint32]string),
+		RateLimit: cnci.BridgeRateLimit,
+	}
+
+	for _, l := range dump.Links {
+		if l.Ready {
+			snap.Links = append(snap.Links, l)
+		}
+	}
+
+	//The subnet is only reported once the bridge is ready
+	for _, b := range dump.Bridges {
+		if b.Subnet != "" {
+			snap.Bridges = append(snap.Bridges, b)
+		}
+	}
+
+	for key, bridgeID := range cnci.topology.keyMap {
+		snap.Keys[key] = bridgeID
+	}
+
+	return snap
+}
+
+//saveTopology writes a snapshot of the topology to the TopologyFile if
+//one has been configured. A failure to save the snapshot is not fatal, the
+//topology can still be rebuilt from the aliases. The topology lock must be
+//held by the caller.
+func (cnci *Cnci) saveTopology() {
+	if cnci.TopologyFile == "" || cnci.topology == nil {
+		return
+	}
+
+	if err := writeTopologySnapshot(cnci.TopologyFile, cnci.snapshot()); err != nil {
+		glog.Warningf("Unable to save topology %v", err)
+	}
+}
+
+//writeTopologySnapshot replaces the snapshot atomically so that a crash
+//never leaves a partially written snapshot behind
+func writeTopologySnapshot(path string, snap *topologySnapshot) error {
+	data, err := json.MarshalIndent(snap, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func readTopologySnapshot(path string) (*topologySnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snap topologySnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("invalid topology snapshot %s %v", path, err)
+	}
+
+	if snap.Version != topologyVersion {
+		return nil, fmt.Errorf("unsupported topology snapshot version %d", snap.Version)
+	}
+
+	return &snap, nil
+}
+
+//recoverTopology restores the topology from the TopologyFile if present,
+//falling back to rebuilding it from the aliases otherwise
+func (cnci *Cnci) recoverTopology() error {
+	if cnci.TopologyFile == "" {
+		return cnci.RebuildTopology(false)
+	}
+
+	snap, err := readTopologySnapshot(cnci.TopologyFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Ignoring topology snapshot %v", err)
+		}
+		return cnci.RebuildTopology(false)
+	}
+
+	return cnci.restoreTopology(snap)
+}
+
+//restoreTopology restores the topology from a snapshot. The links present
+//on the node remain authoritative, the snapshot is cross-checked against
+//them and only the discrepancies are fixed. Bridges recorded in the snapshot
+//re-attach to their dnsmasq, the rate limit is only reapplied if it has
+//changed. Bridges missing from the snapshot are rebuilt from their alias.
+//The neighbors, which cannot be recovered from the links, are restored from
+//the snapshot.
+func (cnci *Cnci) restoreTopology(snap *topologySnapshot) error {
+	if cnci.NetworkConfig == nil || cnci.topology == nil {
+		return fmt.Errorf("cnci not initialized")
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+
+	cnci.topology.Lock()
+	defer cnci.topology.Unlock()
+	defer cnci.saveTopology()
+	reinitTopology(cnci.topology)
+
+	cnci.rebuildLinkAndNameMap(links)
+
+	known := make(map[string]TopologyBridge)
+	for _, b := range snap.Bridges {
+		known[b.ID] = b
+		if b.DNS != nil {
+			cnci.topology.dns[b.ID] = *b.DNS
+		}
+	}
+
+	var errs []error
+	for _, link := range links {
+		bridgeID := link.Attrs().Alias
+		if link.Type() != "bridge" || !strings.HasPrefix(bridgeID, cnci.bridgePrefix()) {
+			continue
+		}
+
+		b, ok := known[bridgeID]
+		delete(known, bridgeID)
+
+		if ok && b.Subnet == cnci.aliasToSubnet(bridgeID) && snap.RateLimit == cnci.BridgeRateLimit {
+			err = cnci.attachBridge(link, b.Subnet)
+		} else {
+			glog.Infof("Rebuilding bridge %s not matching snapshot", bridgeID)
+			err = cnci.rebuildBridge(bridgeID, false)
+		}
+		if err != nil {
+			glog.Warningf("Unable to restore bridge %s %v", bridgeID, err)
+			errs = append(errs, fmt.Errorf("bridge %s: %v", bridgeID, err))
+		}
+	}
+
+	for bridgeID := range known {
+		glog.Warningf("Dropping bridge %s no longer present", bridgeID)
+		delete(cnci.topology.dns, bridgeID)
+	}
+
+	errs = append(errs, cnci.verifyTopology(links)...)
+	cnci.checkSnapshot(snap)
+
+	cnci.topology.neighbors = append([]Neighbor(nil), snap.Neighbors...)
+
+	return combineErrors("topology restore incomplete", errs)
+}
+
+//attachBridge adds an existing bridge to the bridge map re-attaching to
+//the dnsmasq serving it
+func (cnci *Cnci) attachBridge(link netlink.Link, subnet string) error {
+	brl, ok := link.(*netlink.Bridge)
+	if !ok {
+		return fmt.Errorf("incorrect interface type %v", link.Type())
+	}
+
+	tnet, err := stringToSubnet(subnet)
+	if err != nil {
+		return err
+	}
+
+	br, err := NewBridge(brl.Alias)
+	if err != nil {
+		return err
+	}
+	br.Link = brl
+	br.LinkName = brl.Name
+
+	dns, err := startDnsmasq(br, cnci.Tenant, *tnet, cnci.topology.dns[br.GlobalID])
+	if err != nil {
+		return err
+	}
+
+	cnci.topology.bridgeMap[br.GlobalID] = &bridgeInfo{
+		Dnsmasq: dns,
+	}
+	return nil
+}
+
+//checkSnapshot logs the differences between the snapshot and the restored
+//topology. The topology lock must be held by the caller.
+func (cnci *Cnci) checkSnapshot(snap *topologySnapshot) {
+	for _, l := range snap.Links {
+		linfo, ok := cnci.topology.linkMap[l.Alias]
+		if !ok {
+			glog.Warningf("Link %s no longer present", l.Alias)
+			continue
+		}
+		if linfo.name != l.Name || linfo.index != l.Index {
+			glog.Infof("Link %s changed from %s(%d) to %s(%d)",
+				l.Alias, l.Name, l.Index, linfo.name, linfo.index)
+		}
+	}
+
+	for _, b := range snap.Bridges {
+		brInfo, ok := cnci.topology.bridgeMap[b.ID]
+		if ok && brInfo.tunnels != b.Tunnels {
+			glog.Infof("Bridge %s has %d tunnels, snapshot recorded %d",
+				b.ID, brInfo.tunnels, b.Tunnels)
+		}
+	}
+
+	for key, bridgeID := range snap.Keys {
+		if owner := cnci.topology.keyMap[key]; owner != bridgeID {
+			glog.Infof("Subnet key %d now bound to %q, snapshot recorded %q",
+				key, owner, bridgeID)
+		}
+	}
+}
@@ -24,9 +24,12 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
+
+	"github.com/golang/glog"
 )
 
 //Various configuration options
@@ -42,19 +45,60 @@ const (
 
 //TODO: Set these up above to correct defaults
 
+// SubnetDNS is the DNS configuration pushed to the instances of a tenant
+// subnet by its dnsmasq
+type SubnetDNS struct {
+	Servers      []string `json:"servers,omitempty"`       // Upstream DNS servers
+	SearchDomain string   `json:"search_domain,omitempty"` // Domain searched by the instances
+	DHCPOptions  []string `json:"dhcp_options,omitempty"`  // dnsmasq dhcp-option values, e.g. 42,192.168.0.1
+}
+
+var domainRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*$`)
+
+// validate checks that the configuration can be safely written to the
+// dnsmasq configuration file
+func (c SubnetDNS) validate() error {
+	for _, s := range c.Servers {
+		if net.ParseIP(s) == nil {
+			return fmt.Errorf("invalid DNS server %q", s)
+		}
+	}
+
+	if c.SearchDomain != "" && !domainRegexp.MatchString(c.SearchDomain) {
+		return fmt.Errorf("invalid search domain %q", c.SearchDomain)
+	}
+
+	for _, o := range c.DHCPOptions {
+		if !strings.Contains(o, ",") || strings.ContainsAny(o, "\n\r\x00") {
+			return fmt.Errorf("invalid DHCP option %q", o)
+		}
+	}
+	return nil
+}
+
+// setDNS updates the DNS configuration of the dnsmasq. It only takes effect
+// once the dnsmasq is restarted
+func (d *Dnsmasq) setDNS(c SubnetDNS) {
+	d.DNSServers = c.Servers
+	d.DomainName = c.SearchDomain
+	d.DHCPOptions = c.DHCPOptions
+}
+
 // Dnsmasq contains all the information required to spawn
 // a dnsmasq process on behalf of a tenant on a concentrator
 type Dnsmasq struct {
 	SubnetID    string                // UUID of the Tenant Subnet to which the  dnsmasq supports
 	CNCIId      string                // UUID of the CNCI instance
 	TenantID    string                // UUID of the Tenant to which the CNCI belongs to
-	TenantNet   net.IPNet             // The tenant subnet served by this dnsmasq, has to be /29 or larger
+	TenantNet   net.IPNet             // The tenant subnet served by this dnsmasq, has to be /30 or larger
 	ReservedIPs int                   // Reserve IP at the start of subnet
 	ConcIP      net.IP                // IP Address of the CNCI
 	IPMap       map[string]*DhcpEntry // Static mac to IP map, key is macaddress
 	Dev         *Bridge               // The bridge on which dnsmasq will attach
 	MTU         int                   // MTU that takes into account the tunnel overhead
 	DomainName  string                // Domain Name to be assigned to the subnet
+	DNSServers  []string              // Upstream DNS servers, the resolvers of the node are used if empty
+	DHCPOptions []string              // Additional DHCP options pushed to the instances
 
 	// Private fields
 	dhcpSize  int
@@ -138,6 +182,34 @@ func (d *Dnsmasq) attach() (int, error) {
 	if err = syscall.Kill(pid, syscall.Signal(0)); err != nil {
 		return -1, fmt.Errorf("Process does not exist or unable to attach %v", err)
 	}
+
+	//The pid file may be stale and the pid reused by an unrelated process
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return -1, fmt.Errorf("Unable to read command line of %d %v", pid, err)
+	}
+	if !strings.Contains(string(cmdline), d.confFile) {
+		return -1, fmt.Errorf("Process %d is not serving %s", pid, d.confFile)
+	}
+	return pid, nil
+}
+
+// reattach connects to the dnsmasq already serving d without restarting
+// it, so that the DHCP leases it has handed out are preserved. The pid
+// file must refer to a live process running with the configuration file
+// of d. An error is returned only if no such process exists, i.e. when the
+// dnsmasq genuinely needs to be restarted.
+// Returns pid of the running process on success
+func (d *Dnsmasq) reattach() (int, error) {
+	pid, err := d.attach()
+	if err != nil {
+		return -1, err
+	}
+
+	if d.configChanged() {
+		glog.Warningf("dnsmasq %d is not running with the current configuration of %s, it is applied on the next restart",
+			pid, d.SubnetID)
+	}
 	return pid, nil
 }
 
@@ -334,15 +406,15 @@ func (d *Dnsmasq) createHostsFile() error {
 	return file.Sync()
 }
 
-func (d *Dnsmasq) createConfigFile() error {
+func (d *Dnsmasq) configFileContent() (string, error) {
 	params := make([]string, 20)
 
 	if d.Dev == nil {
-		return fmt.Errorf("bridge nil")
+		return "", fmt.Errorf("bridge nil")
 	}
 
 	if d.Dev.LinkName == "" {
-		return fmt.Errorf("bridge uninitialized")
+		return "", fmt.Errorf("bridge uninitialized")
 	}
 
 	params = append(params, fmt.Sprintf("pid-file=%s\n", d.pidFile))
@@ -351,7 +423,14 @@ func (d *Dnsmasq) createConfigFile() error {
 	//params = append(params, "strict-order\n")
 	//params = append(params, "expand-hosts\n")
 	if d.DomainName != "" {
-		params = append(params, "domain=%s\n", d.DomainName)
+		params = append(params, fmt.Sprintf("domain=%s\n", d.DomainName))
+		params = append(params, fmt.Sprintf("dhcp-option=option:domain-search,%s\n", d.DomainName))
+	}
+	if len(d.DNSServers) > 0 {
+		params = append(params, "no-resolv\n")
+		for _, s := range d.DNSServers {
+			params = append(params, fmt.Sprintf("server=%s\n", s))
+		}
 	}
 	params = append(params, "domain-needed\n")
 	params = append(params, "bogus-priv\n")
@@ -364,23 +443,48 @@ func (d *Dnsmasq) createConfigFile() error {
 	params = append(params, fmt.Sprintf("dhcp-range=%s,static\n", d.subnet.String()))
 	params = append(params, fmt.Sprintf("dhcp-lease-max=%d\n", d.dhcpSize))
 	params = append(params, fmt.Sprintf("dhcp-option-force=26,%d\n", d.MTU))
+	for _, o := range d.DHCPOptions {
+		params = append(params, fmt.Sprintf("dhcp-option=%s\n", o))
+	}
 	//params = append(params, "log-dhcp\n")
 
+	return strings.Join(params, ""), nil
+}
+
+func (d *Dnsmasq) createConfigFile() error {
+	content, err := d.configFileContent()
+	if err != nil {
+		return err
+	}
+
 	file, err := os.Create(d.confFile)
 	if err != nil {
 		return fmt.Errorf("Unable to create file %v %v", d.confFile, err)
 	}
 	defer func() { _ = file.Close() }()
 
-	for _, s := range params {
-		if _, err := file.WriteString(s); err != nil {
-			return err
-		}
+	if _, err := file.WriteString(content); err != nil {
+		return err
 	}
 
 	return file.Sync()
 }
 
+// configChanged reports whether the configuration file of a running dnsmasq
+// differs from its current configuration
+func (d *Dnsmasq) configChanged() bool {
+	content, err := d.configFileContent()
+	if err != nil {
+		return true
+	}
+
+	current, err := ioutil.ReadFile(d.confFile)
+	if err != nil {
+		return true
+	}
+	return string(current) != content
+}
+
 func (d *Dnsmasq) launch() error {
 	prog := "dnsmasq"
 	args := fmt.Sprintf("--conf-file=%s", d.confFile)
@@ -19,10 +19,14 @@ package libsnnet
 import (
 	"io/ioutil"
 	"net"
+	"os"
+	"os/exec"
 	"strconv"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 //Test normal operation DCHP/DNS server setup for a CNCI
@@ -150,3 +154,110 @@ func TestDnsmasq_Negative(t *testing.T) {
 		assert.Nil(d.stop())
 	}
 }
+
+//Test the DNS configuration of a tenant subnet
+//
+//This test checks that malformed DNS configurations are rejected
+//and that the upstream servers, search domain and additional DHCP
+//options are written to the dnsmasq configuration
+//
+//Test is expected to pass
+func TestDnsmasq_SubnetDNS(t *testing.T) {
+	assert := assert.New(t)
+
+	invalid := []SubnetDNS{
+		{Servers: []string{"8.8.8"}},
+		{Servers: []string{"8.8.8.8", "dns.example.com"}},
+		{SearchDomain: "example.com\nserver=1.1.1.1"},
+		{SearchDomain: "-example.com"},
+		{DHCPOptions: []string{"42"}},
+		{DHCPOptions: []string{"42,192.168.0.1\nserver=1.1.1.1"}},
+	}
+	for _, c := range invalid {
+		assert.NotNil(c.validate(), "%v", c)
+	}
+
+	cfg := SubnetDNS{
+		Servers:      []string{"8.8.8.8", "2001:4860:4860::8888"},
+		SearchDomain: "tenant.example.com",
+		DHCPOptions:  []string{"42,192.168.1.1"},
+	}
+	assert.Nil(cfg.validate())
+
+	bridge, _ := NewBridge("dns_testbr")
+	bridge.LinkName = "dns_testbr"
+
+	d := &Dnsmasq{
+		Dev:      bridge,
+		subnet:   net.ParseIP("192.168.1.0"),
+		gateway:  net.IPNet{IP: net.ParseIP("192.168.1.1")},
+		dhcpSize: 253,
+	}
+
+	content, err := d.configFileContent()
+	assert.Nil(err)
+	assert.NotContains(content, "server=")
+	assert.NotContains(content, "domain=")
+
+	d.setDNS(cfg)
+	content, err = d.configFileContent()
+	assert.Nil(err)
+	assert.Contains(content, "no-resolv\n")
+	assert.Contains(content, "server=8.8.8.8\n")
+	assert.Contains(content, "server=2001:4860:4860::8888\n")
+	assert.Contains(content, "domain=tenant.example.com\n")
+	assert.Contains(content, "dhcp-option=option:domain-search,tenant.example.com\n")
+	assert.Contains(content, "dhcp-option=42,192.168.1.1\n")
+}
+
+//Test the re-attach to a running dnsmasq
+//
+//This test simulates a dnsmasq already serving a subnet and checks that
+//startDnsmasq re-attaches to it without restarting it, even when its
+//configuration differs. It also checks that a process which is no longer
+//running cannot be re-attached to
+//
+//Test is expected to pass
+func TestDnsmasq_Reattach(t *testing.T) {
+	assert := assert.New(t)
+
+	subnet := net.IPNet{
+		IP:   net.IPv4(192, 168, 1, 0),
+		Mask: net.IPv4Mask(255, 255, 255, 0),
+	}
+
+	bridge, _ := NewBridge("dns_reattachbr")
+
+	d, err := newDnsmasq(bridge.GlobalID, "tenantuuid", subnet, 0, bridge)
+	require.Nil(t, err)
+
+	//The configuration file appears on the command line of the process
+	cmd := exec.Command("sh", "-c", "sleep 60", d.confFile)
+	require.Nil(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	pid := cmd.Process.Pid
+	require.Nil(t, ioutil.WriteFile(d.pidFile, []byte(strconv.Itoa(pid)+"\n"), 0644))
+	defer func() { _ = os.Remove(d.pidFile) }()
+
+	dns, err := startDnsmasq(bridge, "tenantuuid", subnet, SubnetDNS{Servers: []string{"8.8.8.8"}})
+	require.Nil(t, err)
+
+	attached, err := dns.reattach()
+	assert.Nil(err)
+	assert.Equal(pid, attached)
+	assert.Nil(syscall.Kill(pid, syscall.Signal(0)))
+
+	pidbytes, err := ioutil.ReadFile(d.pidFile)
+	assert.Nil(err)
+	assert.Equal(strconv.Itoa(pid)+"\n", string(pidbytes))
+
+	_ = cmd.Process.Kill()
+	_ = cmd.Wait()
+
+	_, err = d.reattach()
+	assert.NotNil(err)
+}
@@ -100,6 +100,19 @@ const (
 	GreTunnel
 )
 
+// AddressFamily selects the IP addresses used to discover the physical
+// interfaces of the management and compute networks
+type AddressFamily int
+
+const (
+	// IPv4 selects the IPv4 addresses only
+	IPv4 AddressFamily = iota
+	// IPv6 selects the IPv6 addresses only
+	IPv6
+	// IPv4AndIPv6 selects both, the IPv4 addresses being preferred
+	IPv4AndIPv6
+)
+
 // VnicRole specifies the role of the VNIC
 type VnicRole int
 
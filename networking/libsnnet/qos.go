@@ -0,0 +1,134 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package libsnnet
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	qosMinBurst = 32 * 1024 //bytes
+	qosLatency  = 50 * time.Millisecond
+)
+
+//RateLimit specifies the bandwidth available to a tenant subnet in bits
+//per second. Zero means unlimited.
+type RateLimit struct {
+	//Ingress limits the traffic sent by the tenant subnet to the CNCI
+	Ingress uint64
+	//Egress limits the traffic sent by the CNCI to the tenant subnet
+	Egress uint64
+}
+
+//qosBurst returns the burst size in bytes used for a rate in bytes
+//per second
+func qosBurst(rate uint64) uint32 {
+	burst := rate / 100
+	if burst < qosMinBurst {
+		burst = qosMinBurst
+	}
+	return uint32(burst)
+}
+
+//tbfQdisc returns the token bucket filter limiting the egress of
+//the link to rate bits per second
+func tbfQdisc(linkIndex int, rate uint64) *netlink.Tbf {
+	bytesRate := rate / 8
+	burst := qosBurst(bytesRate)
+
+	return &netlink.Tbf{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(1, 0),
+			Parent:    netlink.HANDLE_ROOT,
+		},
+		Rate:   bytesRate,
+		Buffer: uint32(netlink.Xmittime(bytesRate, burst)),
+		Limit:  uint32(uint64(burst) + bytesRate*uint64(qosLatency)/uint64(time.Second)),
+	}
+}
+
+func ingressQdisc(linkIndex int) *netlink.Ingress {
+	return &netlink.Ingress{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: linkIndex,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_INGRESS,
+		},
+	}
+}
+
+func (b *Bridge) setEgressLimit(rate uint64) error {
+	tbf := tbfQdisc(b.Link.Attrs().Index, rate)
+
+	if rate == 0 {
+		//Ignore errors, there may be no limit set
+		_ = netlink.QdiscDel(tbf)
+		return nil
+	}
+
+	if err := netlink.QdiscReplace(tbf); err != nil {
+		return netError(b, "set egress limit %v %v", rate, err)
+	}
+	return nil
+}
+
+//setIngressLimit polices the traffic received by the bridge. The netlink
+//library does not support police actions, hence tc is used for the filter.
+func (b *Bridge) setIngressLimit(rate uint64) error {
+	ingress := ingressQdisc(b.Link.Attrs().Index)
+
+	//Removing the ingress qdisc also removes any existing filter
+	_ = netlink.QdiscDel(ingress)
+
+	if rate == 0 {
+		return nil
+	}
+
+	if err := netlink.QdiscAdd(ingress); err != nil {
+		return netError(b, "set ingress limit %v %v", rate, err)
+	}
+
+	burst := qosBurst(rate / 8)
+	out, err := exec.Command("tc", "filter", "add", "dev", b.LinkName,
+		"parent", "ffff:", "protocol", "all", "prio", "1",
+		"u32", "match", "u32", "0", "0",
+		"police", "rate", fmt.Sprintf("%dbit", rate),
+		"burst", fmt.Sprintf("%db", burst), "drop", "flowid", ":1").CombinedOutput()
+	if err != nil {
+		_ = netlink.QdiscDel(ingress)
+		return netError(b, "set ingress limit %v %v %s", rate, err, string(out))
+	}
+	return nil
+}
+
+//setRateLimit applies the rate limit to the bridge, replacing any limit
+//previously applied. The bridge device must have been obtained.
+func (b *Bridge) setRateLimit(limit RateLimit) error {
+	if b.Link == nil {
+		return netError(b, "set rate limit unknown device")
+	}
+
+	if err := b.setEgressLimit(limit.Egress); err != nil {
+		return err
+	}
+	return b.setIngressLimit(limit.Ingress)
+}
@@ -0,0 +1,85 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package libsnnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+//Tests the token bucket parameters
+//
+//Tests that the rate is converted to bytes per second and that
+//the burst never falls below the minimum burst
+//
+//Test is expected to pass
+func TestQoS_Tbf(t *testing.T) {
+	assert := assert.New(t)
+
+	tbf := tbfQdisc(1, 8*1000*1000)
+	assert.Equal(uint64(1000*1000), tbf.Rate)
+	assert.Equal(uint32(qosMinBurst+50*1000), tbf.Limit)
+
+	assert.Equal(uint32(qosMinBurst), qosBurst(1000))
+	assert.Equal(uint32(1000*1000), qosBurst(100*1000*1000))
+}
+
+//Tests the bridge rate limit
+//
+//Tests that a rate limit can be applied to a bridge, replaced
+//and removed by setting it to zero
+//
+//Test is expected to pass
+func TestQoS_Bridge(t *testing.T) {
+	assert := assert.New(t)
+
+	bridge, err := NewBridge("go_testbr")
+	require.Nil(t, err)
+	require.Nil(t, bridge.Create())
+	defer func() { _ = bridge.Destroy() }()
+
+	qdiscs := func() []netlink.Qdisc {
+		q, err := netlink.QdiscList(bridge.Link)
+		require.Nil(t, err)
+		return q
+	}
+
+	hasQdisc := func(kind string) bool {
+		for _, q := range qdiscs() {
+			if q.Type() == kind {
+				return true
+			}
+		}
+		return false
+	}
+
+	assert.Nil(bridge.setRateLimit(RateLimit{Ingress: 10000000, Egress: 20000000}))
+	assert.True(hasQdisc("tbf"))
+	assert.True(hasQdisc("ingress"))
+
+	//Reapply
+	assert.Nil(bridge.setRateLimit(RateLimit{Ingress: 10000000, Egress: 30000000}))
+	assert.True(hasQdisc("tbf"))
+	assert.True(hasQdisc("ingress"))
+
+	assert.Nil(bridge.setRateLimit(RateLimit{}))
+	assert.False(hasQdisc("tbf"))
+	assert.False(hasQdisc("ingress"))
+}
@@ -31,7 +31,7 @@ func cnciInit(cnci *libsnnet.Cnci) error {
 	if err := cnci.Init(); err != nil {
 		return err
 	}
-	if err := cnci.RebuildTopology(); err != nil {
+	if err := cnci.RebuildTopology(false); err != nil {
 		return err
 	}
 	return nil
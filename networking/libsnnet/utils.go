@@ -23,8 +23,10 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/golang/glog"
 	"github.com/vishvananda/netlink"
 )
 
@@ -44,6 +46,64 @@ var (
 	ifaceRsrc  *rand.Rand
 )
 
+//netlinkAttempts bounds the number of times a mutating netlink call is
+//attempted when it fails with a transient error. The delay between the
+//attempts starts at netlinkBackoff and doubles on each retry
+var (
+	netlinkAttempts = 4
+	netlinkBackoff  = 10 * time.Millisecond
+)
+
+//netlinkOps are the mutating netlink calls which are retried on transient
+//failures. They are replaced by tests to inject failures
+type netlinkOps struct {
+	addrAdd  func(netlink.Link, *netlink.Addr) error
+	addrDel  func(netlink.Link, *netlink.Addr) error
+	neighAdd func(*netlink.Neigh) error
+	neighDel func(*netlink.Neigh) error
+	routeAdd func(*netlink.Route) error
+	routeDel func(*netlink.Route) error
+}
+
+var nlOps = netlinkOps{
+	addrAdd:  netlink.AddrAdd,
+	addrDel:  netlink.AddrDel,
+	neighAdd: netlink.NeighAdd,
+	neighDel: netlink.NeighDel,
+	routeAdd: netlink.RouteAdd,
+	routeDel: netlink.RouteDel,
+}
+
+//retryableNetlinkError reports whether err is a transient netlink failure
+//which is likely to succeed if retried
+func retryableNetlinkError(err error) bool {
+	errno, ok := err.(syscall.Errno)
+	if !ok {
+		return false
+	}
+	switch errno {
+	case syscall.EBUSY, syscall.EAGAIN, syscall.EINTR, syscall.ENOBUFS:
+		return true
+	}
+	return false
+}
+
+//retryNetlink invokes op until it succeeds, fails with an error which is
+//not transient or netlinkAttempts have been made. The last error is
+//returned
+func retryNetlink(name string, op func() error) error {
+	delay := netlinkBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !retryableNetlinkError(err) || attempt >= netlinkAttempts {
+			return err
+		}
+		glog.Warningf("%s failed %v, retrying in %v", name, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 // EqualNetSlice compare 2 network slices
 func EqualNetSlice(slice1, slice2 []string) bool {
 	// if a slice is nil and other isn't then are not equal
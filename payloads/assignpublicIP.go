@@ -66,6 +66,7 @@ const (
 
 // ErrorPublicIPFailure represents the PublicIPFailure SSNTP error payload.
 // It includes information about the IP itself and the actual reason for failure.
+// Detail, when present, describes the underlying cause of the failure.
 type ErrorPublicIPFailure struct {
 	ConcentratorUUID string                `yaml:"concentrator_uuid"`
 	TenantUUID       string                `yaml:"tenant_uuid"`
@@ -74,6 +75,7 @@ type ErrorPublicIPFailure struct {
 	PrivateIP        string                `yaml:"private_ip"`
 	VnicMAC          string                `yaml:"vnic_mac"`
 	Reason           PublicIPFailureReason `yaml:"reason"`
+	Detail           string                `yaml:"detail,omitempty"`
 }
 
 func (r PublicIPFailureReason) String() string {
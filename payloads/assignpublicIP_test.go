@@ -17,6 +17,7 @@
 package payloads_test
 
 import (
+	"strings"
 	"testing"
 
 	. "github.com/ciao-project/ciao/payloads"
@@ -158,3 +159,41 @@ func TestPublicIPFailureString(t *testing.T) {
 		}
 	}
 }
+
+func TestPublicIPFailureDetail(t *testing.T) {
+	failure := ErrorPublicIPFailure{
+		ConcentratorUUID: uuid.Generate().String(),
+		TenantUUID:       uuid.Generate().String(),
+		InstanceUUID:     uuid.Generate().String(),
+		PublicIP:         "10.1.2.3",
+		PrivateIP:        "192.168.1.2",
+		VnicMAC:          "aa:bb:cc:01:02:03",
+		Reason:           PublicIPAssignFailure,
+		Detail:           "assign ip: iptables: No chain/target/match by that name",
+	}
+
+	y, err := yaml.Marshal(&failure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded ErrorPublicIPFailure
+	err = yaml.Unmarshal(y, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded != failure {
+		t.Errorf("PublicIPFailure round trip failed\n[%+v]\n vs\n[%+v]", decoded, failure)
+	}
+
+	failure.Detail = ""
+	y, err = yaml.Marshal(&failure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(y), "detail") {
+		t.Errorf("Empty detail should be omitted\n[%s]", string(y))
+	}
+}
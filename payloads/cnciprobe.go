@@ -0,0 +1,61 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package payloads
+
+// CNCIProbeTarget identifies a remote CNCI tunnel endpoint to probe.
+type CNCIProbeTarget struct {
+	CNCIUUID string `yaml:"cnci_uuid"`
+	TunnelIP string `yaml:"tunnel_ip"`
+}
+
+// CNCIProbeCommand contains the list of tunnel endpoints a CNCI
+// is asked to probe.
+type CNCIProbeCommand struct {
+	ProbeID  string            `yaml:"probe_id"`
+	CNCIUUID string            `yaml:"cnci_uuid"`
+	Targets  []CNCIProbeTarget `yaml:"targets"`
+}
+
+// CommandCNCIProbe represents the unmarshalled version of the contents
+// of an SSNTP ssntp.ProbeCNCI command. This command is sent by the
+// controller to a cnci-agent to check that the tunnels to the other
+// CNCIs of the tenant are passing traffic.
+type CommandCNCIProbe struct {
+	Probe CNCIProbeCommand `yaml:"cnci_probe"`
+}
+
+// CNCIProbeTargetResult contains the reachability of a single
+// probed tunnel endpoint.
+type CNCIProbeTargetResult struct {
+	CNCIUUID  string `yaml:"cnci_uuid"`
+	TunnelIP  string `yaml:"tunnel_ip"`
+	Reachable bool   `yaml:"reachable"`
+	Error     string `yaml:"error,omitempty"`
+}
+
+// CNCIProbeResultEvent contains the results of a tunnel probe
+// performed by a CNCI.
+type CNCIProbeResultEvent struct {
+	ProbeID  string                  `yaml:"probe_id"`
+	CNCIUUID string                  `yaml:"cnci_uuid"`
+	Results  []CNCIProbeTargetResult `yaml:"results"`
+}
+
+// EventCNCIProbeResult represents the unmarshalled version of the contents
+// of an SSNTP ssntp.CNCIProbeResult event. This event is sent by the
+// cnci-agent to the controller in reply to a ssntp.ProbeCNCI command.
+type EventCNCIProbeResult struct {
+	Result CNCIProbeResultEvent `yaml:"cnci_probe_result"`
+}
@@ -0,0 +1,128 @@
+/*
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads_test
+
+import (
+	"testing"
+
+	. "github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+func TestCNCIProbeUnmarshal(t *testing.T) {
+	var probe CommandCNCIProbe
+
+	err := yaml.Unmarshal([]byte(testutil.CNCIProbeYaml), &probe)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if probe.Probe.ProbeID != testutil.CNCIProbeID {
+		t.Errorf("Wrong probe ID field [%s]", probe.Probe.ProbeID)
+	}
+
+	if probe.Probe.CNCIUUID != testutil.CNCIUUID {
+		t.Errorf("Wrong CNCI UUID field [%s]", probe.Probe.CNCIUUID)
+	}
+
+	if len(probe.Probe.Targets) != 1 {
+		t.Fatalf("Incorrect number of targets [%d]", len(probe.Probe.Targets))
+	}
+
+	target := probe.Probe.Targets[0]
+
+	if target.CNCIUUID != testutil.CNCIProbeTargetUUID {
+		t.Errorf("Wrong target CNCI UUID field [%s]", target.CNCIUUID)
+	}
+
+	if target.TunnelIP != "192.168.0.1" {
+		t.Errorf("Wrong target tunnel IP field [%s]", target.TunnelIP)
+	}
+}
+
+func TestCNCIProbeMarshal(t *testing.T) {
+	var probe CommandCNCIProbe
+
+	probe.Probe.ProbeID = testutil.CNCIProbeID
+	probe.Probe.CNCIUUID = testutil.CNCIUUID
+	probe.Probe.Targets = []CNCIProbeTarget{
+		{
+			CNCIUUID: testutil.CNCIProbeTargetUUID,
+			TunnelIP: "192.168.0.1",
+		},
+	}
+
+	y, err := yaml.Marshal(&probe)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.CNCIProbeYaml {
+		t.Errorf("ProbeCNCI marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.CNCIProbeYaml)
+	}
+}
+
+func TestCNCIProbeResultUnmarshal(t *testing.T) {
+	var result EventCNCIProbeResult
+
+	err := yaml.Unmarshal([]byte(testutil.CNCIProbeResultYaml), &result)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if result.Result.ProbeID != testutil.CNCIProbeID {
+		t.Errorf("Wrong probe ID field [%s]", result.Result.ProbeID)
+	}
+
+	if len(result.Result.Results) != 1 {
+		t.Fatalf("Incorrect number of results [%d]", len(result.Result.Results))
+	}
+
+	r := result.Result.Results[0]
+
+	if r.Reachable {
+		t.Errorf("Wrong reachable field [%v]", r.Reachable)
+	}
+
+	if r.Error != "timeout" {
+		t.Errorf("Wrong error field [%s]", r.Error)
+	}
+}
+
+func TestCNCIProbeResultMarshal(t *testing.T) {
+	var result EventCNCIProbeResult
+
+	result.Result.ProbeID = testutil.CNCIProbeID
+	result.Result.CNCIUUID = testutil.CNCIUUID
+	result.Result.Results = []CNCIProbeTargetResult{
+		{
+			CNCIUUID: testutil.CNCIProbeTargetUUID,
+			TunnelIP: "192.168.0.1",
+			Error:    "timeout",
+		},
+	}
+
+	y, err := yaml.Marshal(&result)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.CNCIProbeResultYaml {
+		t.Errorf("CNCIProbeResult marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.CNCIProbeResultYaml)
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2017 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package payloads
+
+// ConcentratorInstanceReadyEvent reports that a CNCI instance has finished
+// reprogramming the subnets and public IPs it was serving before it
+// restarted. A degraded CNCI failed to reprogram some of them.
+type ConcentratorInstanceReadyEvent struct {
+	InstanceUUID    string   `yaml:"instance_uuid"`
+	TenantUUID      string   `yaml:"tenant_uuid"`
+	Degraded        bool     `yaml:"degraded"`
+	FailedSubnets   []string `yaml:"failed_subnets,omitempty"`
+	FailedPublicIPs []string `yaml:"failed_public_ips,omitempty"`
+}
+
+// EventConcentratorInstanceReady represents the unmarshalled version of the
+// contents of an SSNTP ssntp.ConcentratorInstanceReady event. This event is
+// sent by the cnci-agent to the controller once its network is configured.
+type EventConcentratorInstanceReady struct {
+	CNCIReady ConcentratorInstanceReadyEvent `yaml:"concentrator_instance_ready"`
+}
@@ -0,0 +1,73 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads_test
+
+import (
+	"testing"
+
+	. "github.com/ciao-project/ciao/payloads"
+	"github.com/ciao-project/ciao/testutil"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConcentratorReadyUnmarshal(t *testing.T) {
+	var cnciReady EventConcentratorInstanceReady
+
+	err := yaml.Unmarshal([]byte(testutil.CNCIReadyYaml), &cnciReady)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cnciReady.CNCIReady.InstanceUUID != testutil.CNCIUUID {
+		t.Errorf("Wrong instance UUID field [%s]", cnciReady.CNCIReady.InstanceUUID)
+	}
+
+	if cnciReady.CNCIReady.TenantUUID != testutil.TenantUUID {
+		t.Errorf("Wrong tenant UUID field [%s]", cnciReady.CNCIReady.TenantUUID)
+	}
+
+	if !cnciReady.CNCIReady.Degraded {
+		t.Errorf("Wrong degraded field [%v]", cnciReady.CNCIReady.Degraded)
+	}
+
+	if len(cnciReady.CNCIReady.FailedSubnets) != 1 ||
+		cnciReady.CNCIReady.FailedSubnets[0] != "192.168.0.0/24" {
+		t.Errorf("Wrong failed subnets field %v", cnciReady.CNCIReady.FailedSubnets)
+	}
+
+	if len(cnciReady.CNCIReady.FailedPublicIPs) != 0 {
+		t.Errorf("Wrong failed public IPs field %v", cnciReady.CNCIReady.FailedPublicIPs)
+	}
+}
+
+func TestConcentratorReadyMarshal(t *testing.T) {
+	var cnciReady EventConcentratorInstanceReady
+
+	cnciReady.CNCIReady.InstanceUUID = testutil.CNCIUUID
+	cnciReady.CNCIReady.TenantUUID = testutil.TenantUUID
+	cnciReady.CNCIReady.Degraded = true
+	cnciReady.CNCIReady.FailedSubnets = []string{"192.168.0.0/24"}
+
+	y, err := yaml.Marshal(&cnciReady)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.CNCIReadyYaml {
+		t.Errorf("ConcentratorInstanceReady marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.CNCIReadyYaml)
+	}
+}
@@ -24,9 +24,13 @@ type CNCINet struct {
 
 // CNCIRefreshCommand contains information on where to send
 // the updated concentrator instance list.
+// When Subnet is set the refresh is scoped to that subnet, CNCIList
+// then only holds the CNCIs serving it. Otherwise CNCIList holds
+// all the CNCIs of the tenant.
 type CNCIRefreshCommand struct {
 	CNCIUUID string    `yaml:"cnci_uuid"`
 	CNCIList []CNCINet `yaml:"cncis"`
+	Subnet   string    `yaml:"subnet,omitempty"`
 }
 
 // CommandCNCIRefresh represents the unmarshalled version of the
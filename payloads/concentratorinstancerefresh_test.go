@@ -80,3 +80,29 @@ func TestConcentratorRefreshMarshal(t *testing.T) {
 		t.Errorf("ConcentratorInstanceRefresh marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.CNCIRefreshYaml)
 	}
 }
+
+func TestConcentratorSubnetRefresh(t *testing.T) {
+	var cnciRefresh CommandCNCIRefresh
+
+	err := yaml.Unmarshal([]byte(testutil.CNCISubnetRefreshYaml), &cnciRefresh)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cnciRefresh.Command.Subnet != "172.16.0.0/24" {
+		t.Errorf("Wrong subnet scope [%s]", cnciRefresh.Command.Subnet)
+	}
+
+	if len(cnciRefresh.Command.CNCIList) != 1 {
+		t.Errorf("Incorrect length of CNCI list [%d]", len(cnciRefresh.Command.CNCIList))
+	}
+
+	y, err := yaml.Marshal(&cnciRefresh)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != testutil.CNCISubnetRefreshYaml {
+		t.Errorf("ConcentratorInstanceRefresh marshalling failed\n[%s]\n vs\n[%s]", string(y), testutil.CNCISubnetRefreshYaml)
+	}
+}
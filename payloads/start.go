@@ -128,6 +128,10 @@ type StorageResource struct {
 
 	// Size is the requested size for an auto-created storage resource
 	Size int `yaml:"size,omitempty"`
+
+	// ReadOnly indicates that the instance may not write to the storage
+	// resource.
+	ReadOnly bool `yaml:"read_only,omitempty"`
 }
 
 // RequestedResource is used to specify an individual resource contained within
@@ -199,6 +203,11 @@ type WorkloadRequirements struct {
 	// Hostname specifies the node that the instance must be scheduled on
 	Hostname string `yaml:"hostname,omitempty"`
 
+	// ExcludeNodes lists the nodes that the instance must not be scheduled on.
+	// It is set for individual start requests and is not part of a workload
+	// definition.
+	ExcludeNodes []string `yaml:"exclude_nodes,omitempty" json:"-"`
+
 	// NetworkNode specifies that this workload must be scheduled on a network node
 	NetworkNode bool `yaml:"network_node,omitempty"`
 
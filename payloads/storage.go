@@ -30,6 +30,10 @@ type VolumeCmd struct {
 	// running.  This information is needed by the scheduler to route
 	// the command to the correct CN/NN.
 	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// ReadOnly indicates that the volume is to be attached read-only.
+	// Only used when attaching a volume.
+	ReadOnly bool `yaml:"read_only,omitempty"`
 }
 
 // AttachVolume represents the unmarshalled version of the contents of a SSNTP
@@ -44,6 +44,30 @@ func TestAttachVolumeUnmarshal(t *testing.T) {
 	}
 }
 
+func TestAttachVolumeReadOnly(t *testing.T) {
+	var attach AttachVolume
+	err := yaml.Unmarshal([]byte(testutil.AttachVolumeYaml), &attach)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attach.Attach.ReadOnly {
+		t.Error("Volume attached read-only by default")
+	}
+
+	attach.Attach.ReadOnly = true
+
+	y, err := yaml.Marshal(&attach)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != testutil.ReadOnlyAttachVolumeYaml {
+		t.Errorf("AttachVolume marshalling failed\n[%s]\n vs\n[%s]",
+			string(y), testutil.ReadOnlyAttachVolumeYaml)
+	}
+}
+
 func TestAttachVolmeMarshal(t *testing.T) {
 	var attach AttachVolume
 	attach.Attach.InstanceUUID = testutil.InstanceUUID
@@ -378,6 +378,20 @@ func (client *Client) Close() {
 	freeUUID(client.lUUID)
 }
 
+// Reconnect drops the connection to the server. The client then reconnects
+// as it does when the connection is lost. It is used to recover from a server
+// which no longer responds but whose connection has not been torn down.
+func (client *Client) Reconnect() {
+	client.status.Lock()
+	defer client.status.Unlock()
+
+	if client.status.status != ssntpConnected || client.session == nil {
+		return
+	}
+
+	client.session.conn.Close()
+}
+
 func (client *Client) sendCommand(cmd Command, payload []byte, trace *TraceConfig) (int, error) {
 	client.status.Lock()
 	if client.status.status == ssntpClosed {
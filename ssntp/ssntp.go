@@ -42,7 +42,8 @@ type Type uint8
 
 // Command is the SSNTP Command operand.
 // It can be CONNECT, START, STOP, STATS, EVACUATE, DELETE, RESTART,
-// AssignPublicIP, ReleasePublicIP, CONFIGURE, AttachVolume or RefreshCNCI.
+// AssignPublicIP, ReleasePublicIP, CONFIGURE, AttachVolume, RefreshCNCI or
+// ProbeCNCI.
 type Command uint8
 
 // Status is the SSNTP Status operand.
@@ -61,7 +62,8 @@ type Error uint8
 // Event is the SSNTP Event operand.
 // It can be TenantAdded, TenantRemoval, InstanceDeleted, InstanceStopped,
 // ConcentratorInstanceAdded, PublicIPAssigned, PublicIPUnassigned, TraceReport,
-// NodeConnected or NodeDisconnected
+// NodeConnected, NodeDisconnected, CNCIProbeResult, Heartbeat, HeartbeatAck
+// or ConcentratorInstanceReady
 type Event uint8
 
 const (
@@ -233,6 +235,12 @@ const (
 	// tunnel information.
 	// The payload for this command contains the UIID of the CNCI to refresh.
 	RefreshCNCI
+
+	// ProbeCNCI is used to ask a CNCI agent to check the reachability
+	// of the tunnel IPs of the other CNCIs of its tenant.
+	// The payload for this command contains the UUID of the CNCI to probe
+	// and the list of tunnel endpoints it should try to reach.
+	ProbeCNCI
 )
 
 const (
@@ -447,6 +455,29 @@ const (
 	//	|       |       | (0x3) |  (0x2)  |                 | instance information  |
 	//	+---------------------------------------------------------------------------+
 	InstanceStopped
+
+	// CNCIProbeResult is sent by a CNCI agent in reply to a ProbeCNCI command.
+	// The payload contains the reachability of each tunnel endpoint the CNCI
+	// was asked to probe.
+	CNCIProbeResult
+
+	// Heartbeat is periodically sent by clients to the server to check that
+	// the server is still alive. It is not forwarded. The payload, if any, is
+	// opaque to the server.
+	Heartbeat
+
+	// HeartbeatAck is sent by the server in reply to a Heartbeat event. It
+	// carries the payload of the Heartbeat it acknowledges.
+	HeartbeatAck
+
+	// ConcentratorInstanceReady is sent by a CNCI agent after its
+	// ConcentratorInstanceAdded event, once it has reprogrammed the
+	// subnets and public IPs it served before restarting. The payload
+	// reports the subnets and public IPs which could not be reprogrammed,
+	// the CNCI being degraded if there are any.
+	//
+	// The Scheduler must forward this event to all Controllers.
+	ConcentratorInstanceReady
 )
 
 // SSNTP clients and servers can have one or several roles and are expected to declare their
@@ -585,6 +616,8 @@ func (command Command) String() string {
 		return "Restore"
 	case RefreshCNCI:
 		return "Refresh CNCI List"
+	case ProbeCNCI:
+		return "Probe CNCI Tunnels"
 	}
 
 	return ""
@@ -629,6 +662,14 @@ func (status Event) String() string {
 		return "Node Connected"
 	case NodeDisconnected:
 		return "Node Disconnected"
+	case CNCIProbeResult:
+		return "CNCI Probe Result"
+	case Heartbeat:
+		return "Heartbeat"
+	case HeartbeatAck:
+		return "Heartbeat Acknowledgement"
+	case ConcentratorInstanceReady:
+		return "Network Concentrator Instance Ready"
 	}
 
 	return ""
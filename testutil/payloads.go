@@ -47,6 +47,12 @@ const TenantUUID = "2491851d-dce9-48d6-b83a-a717417072ce"
 // CNCIUUID is a test CNCI instance UUID
 const CNCIUUID = "7e84c2d6-5a84-4f9b-98e3-38980f722d1b"
 
+// CNCIProbeID is a test CNCI tunnel probe identifier
+const CNCIProbeID = "9d6bc7a2"
+
+// CNCIProbeTargetUUID is a test UUID for the CNCI targeted by a tunnel probe
+const CNCIProbeTargetUUID = "c5b2f9a2-8f3e-4a52-a6a7-0e3f1e2c4d5b"
+
 // CNCIIP is a test CNCI instance IP address
 const CNCIIP = "10.1.2.3"
 
@@ -249,6 +255,39 @@ var CNCIRefreshYaml = `cnci_refresh:
     tunnel_id: ` + CNCITunnelIDstr + `
 `
 
+// CNCISubnetRefreshYaml is a sample ConcentratorInstanceRefresh ssntp.Event
+// payload scoped to a single subnet for test cases
+var CNCISubnetRefreshYaml = `cnci_refresh:
+  cnci_uuid: ` + CNCIUUID + `
+  cncis:
+  - physical_ip: 10.10.10.1
+    subnet: 172.16.0.0/24
+    tunnel_ip: 192.168.0.0
+    tunnel_id: ` + CNCITunnelIDstr + `
+  subnet: 172.16.0.0/24
+`
+
+// CNCIProbeYaml is a sample ProbeCNCI ssntp.Command payload for test cases
+const CNCIProbeYaml = `cnci_probe:
+  probe_id: ` + CNCIProbeID + `
+  cnci_uuid: ` + CNCIUUID + `
+  targets:
+  - cnci_uuid: ` + CNCIProbeTargetUUID + `
+    tunnel_ip: 192.168.0.1
+`
+
+// CNCIProbeResultYaml is a sample CNCIProbeResult ssntp.Event payload
+// for test cases
+const CNCIProbeResultYaml = `cnci_probe_result:
+  probe_id: ` + CNCIProbeID + `
+  cnci_uuid: ` + CNCIUUID + `
+  results:
+  - cnci_uuid: ` + CNCIProbeTargetUUID + `
+    tunnel_ip: 192.168.0.1
+    reachable: false
+    error: timeout
+`
+
 // CNCIAddedYaml is a sample ConcentratorInstanceAdded ssntp.Event payload for test cases
 const CNCIAddedYaml = `concentrator_instance_added:
   instance_uuid: ` + CNCIUUID + `
@@ -257,6 +296,16 @@ const CNCIAddedYaml = `concentrator_instance_added:
   concentrator_mac: ` + CNCIMAC + `
 `
 
+// CNCIReadyYaml is a sample ConcentratorInstanceReady ssntp.Event payload
+// for test cases
+const CNCIReadyYaml = `concentrator_instance_ready:
+  instance_uuid: ` + CNCIUUID + `
+  tenant_uuid: ` + TenantUUID + `
+  degraded: true
+  failed_subnets:
+  - 192.168.0.0/24
+`
+
 // AssignIPYaml is a sample AssignPublicIP ssntp.Command payload for test cases
 const AssignIPYaml = `assign_public_ip:
   concentrator_uuid: ` + CNCIUUID + `
@@ -542,6 +591,15 @@ const AttachVolumeYaml = `attach_volume:
   workload_agent_uuid: ` + AgentUUID + `
 `
 
+// ReadOnlyAttachVolumeYaml is a sample yaml payload for the ssntp Attach
+// Volume command attaching a volume read-only.
+const ReadOnlyAttachVolumeYaml = `attach_volume:
+  instance_uuid: ` + InstanceUUID + `
+  volume_uuid: ` + VolumeUUID + `
+  workload_agent_uuid: ` + AgentUUID + `
+  read_only: true
+`
+
 // BadAttachVolumeYaml is a corrupt yaml payload for the ssntp Attach Volume command.
 const BadAttachVolumeYaml = `attach_volume:
   volume_uuid: ` + VolumeUUID + `
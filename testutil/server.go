@@ -322,6 +322,18 @@ func getAttachVolumeResult(payload []byte, result *Result) {
 		result.NodeUUID = volCmd.Attach.WorkloadAgentUUID
 		result.InstanceUUID = volCmd.Attach.InstanceUUID
 		result.VolumeUUID = volCmd.Attach.VolumeUUID
+		result.ReadOnly = volCmd.Attach.ReadOnly
+	}
+}
+
+func getReleasePublicIPResult(payload []byte, result *Result) {
+	var releaseCmd payloads.CommandReleasePublicIP
+
+	err := yaml.Unmarshal(payload, &releaseCmd)
+	result.Err = err
+	if err == nil {
+		result.InstanceUUID = releaseCmd.ReleaseIP.InstanceUUID
+		result.TenantUUID = releaseCmd.ReleaseIP.TenantUUID
 	}
 }
 
@@ -398,6 +410,9 @@ func (server *SsntpTestServer) CommandNotify(uuid string, command ssntp.Command,
 	case ssntp.AttachVolume:
 		getAttachVolumeResult(payload, &result)
 
+	case ssntp.ReleasePublicIP:
+		getReleasePublicIPResult(payload, &result)
+
 	default:
 		fmt.Fprintf(os.Stderr, "server unhandled command %s\n", command.String())
 	}
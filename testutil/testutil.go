@@ -26,4 +26,5 @@ type Result struct {
 	TenantUUID   string
 	CNCI         bool
 	VolumeUUID   string
+	ReadOnly     bool
 }